@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/calmestend/ashley-furniture-service/internal/db"
-	"github.com/go-co-op/gocron/v2"
+	"github.com/calmestend/ashley-furniture-service/internal/scheduler"
+	"github.com/calmestend/ashley-furniture-service/internal/service"
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	log.Print("Ashley Furniture Service Starting...")
+	// Windows services start in the system directory, away from .env and ashley.db
+	if err := service.Chdir(); err != nil {
+		log.Fatalf("Error changing to the service directory: %v", err)
+	}
 
 	// Load environment variables from .env
 	err := godotenv.Load()
@@ -20,73 +27,587 @@ func main() {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	// Parse API_LIMIT as int
-	limit, err := strconv.Atoi(os.Getenv("API_LIMIT"))
+	// Run a one-off subcommand (e.g. retransform) when one is given
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
+	log.Print("Ashley Furniture Service Starting...")
+
+	// Stop on SIGINT/SIGTERM or a Windows service stop request, reporting the service's
+	// state to systemd or the service control manager
+	ctx := service.Context("ashley-furniture-service")
+
+	// Parse RESPONSE_PROFILES as name=field,... entries separated by semicolons
+	profiles, err := db.ParseResponseProfiles(os.Getenv("RESPONSE_PROFILES"))
 	if err != nil {
-		log.Fatalf("Invalid API_LIMIT: %v", err)
+		log.Fatalf("Invalid RESPONSE_PROFILES: %v", err)
+	}
+
+	// Parse PRICE_TIERS as name=markup entries separated by semicolons
+	tiers, err := db.ParsePriceTiers(os.Getenv("PRICE_TIERS"))
+	if err != nil {
+		log.Fatalf("Invalid PRICE_TIERS: %v", err)
 	}
 
-	// Initialize both products and prices buckets
-	db.Init()
+	// Parse CHANNELS as name=rule,... entries separated by semicolons
+	channels, err := db.ParseChannels(os.Getenv("CHANNELS"))
+	if err != nil {
+		log.Fatalf("Invalid CHANNELS: %v", err)
+	}
 
-	config := db.APIConfig{
-		BaseURL:       os.Getenv("API_BASE_URL"),
-		Authorization: os.Getenv("API_AUTHORIZATION"),
-		ClientID:      os.Getenv("API_CLIENT_ID"),
-		Customer:      os.Getenv("API_CUSTOMER"),
-		Limit:         limit,
+	// Parse RESPONSE_SCHEMAS as name=field:renamed,... entries separated by semicolons
+	schemas, err := db.ParseResponseSchemas(os.Getenv("RESPONSE_SCHEMAS"))
+	if err != nil {
+		log.Fatalf("Invalid RESPONSE_SCHEMAS: %v", err)
 	}
 
-	// Create a scheduler
-	scheduler, err := gocron.NewScheduler()
+	// Parse API_KEYS as key:role pairs, optionally with a profile, a price tier and a
+	// response schema (key:read:profile, key:write:tier, key:read:en)
+	apiKeys, err := db.ParseAPIKeys(os.Getenv("API_KEYS"), profiles, tiers, schemas)
+	if err != nil {
+		log.Fatalf("Invalid API_KEYS: %v", err)
+	}
+
+	registerExternalSuppliers()
+
+	// Resolve API_FETCHERS against the fetcher registry (empty enables all)
+	fetchers, err := db.EnabledFetchers(os.Getenv("API_FETCHERS"))
+	if err != nil {
+		log.Fatalf("Invalid API_FETCHERS: %v", err)
+	}
+
+	setupSync(fetchers)
+
+	// Log at LOG_LEVEL unless PUT /admin/loglevel persisted another level
+	if err := db.InitLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Fatalf("Error setting log level: %v", err)
+	}
+
+	// Serve catalog reads from a copy of the database published after each completed sync
+	if envBool("SERVING_FILE", false) {
+		if err := db.EnableServingFile(); err != nil {
+			log.Fatalf("Error publishing serving file: %v", err)
+		}
+	}
+
+	config := loadAPIConfig(fetchers)
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if config.Chaos.Enabled() {
+		log.Printf("WARNING: chaos mode is injecting faults into upstream requests (%+v)", config.Chaos)
+	}
+
+	// Log every upstream request with credentials redacted, also toggled by PUT /admin/upstream-logging
+	db.SetUpstreamLogging(envBool("UPSTREAM_LOG", false), 0)
+
+	// Fail fast on bad credentials or an unwritable database unless SELF_CHECK=false
+	if envBool("SELF_CHECK", true) {
+		log.Print("Running startup self-check...")
+		checkCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		err := db.SelfCheck(checkCtx, config, fetchers)
+		cancel()
+		if err != nil {
+			log.Fatalf("Startup self-check failed: %v", err)
+		}
+		log.Print("Self-check passed")
+	}
+
+	setupCache()
+	db.SetAlertWebhook(os.Getenv("ALERT_WEBHOOK_URL"), os.Getenv("ALERT_WEBHOOK_SECRET"))
+
+	// Parse COMPUTED_FIELDS as name=expression entries separated by semicolons
+	computed, err := db.ParseComputedFields(os.Getenv("COMPUTED_FIELDS"))
+	if err != nil {
+		log.Fatalf("Invalid COMPUTED_FIELDS: %v", err)
+	}
+	db.SetComputedFields(computed)
+
+	// Estimate tiempoEntregaDias from the synced inventory when LEAD_TIME_DAYS is set
+	db.SetLeadTime(db.LeadTimeConfig{Handling: envInt("LEAD_TIME_DAYS", -1)})
+
+	setupAvailability()
+	setupLandedCost()
+
+	// Classify products for customs declarations by category; /admin/customs overrides
+	hsCodes, err := db.ParseCategoryCodes(os.Getenv("CUSTOMS_HS_CODES"))
+	if err != nil {
+		log.Fatalf("Invalid CUSTOMS_HS_CODES: %v", err)
+	}
+	taxCategories, err := db.ParseCategoryCodes(os.Getenv("CUSTOMS_TAX_CATEGORIES"))
+	if err != nil {
+		log.Fatalf("Invalid CUSTOMS_TAX_CATEGORIES: %v", err)
+	}
+	customs := db.CustomsConfig{HSCodes: hsCodes, TaxCategories: taxCategories}
+	if err := customs.Validate(); err != nil {
+		log.Fatalf("Invalid customs settings: %v", err)
+	}
+	db.SetCustoms(customs)
+
+	// Every sync (startup, scheduled or manual) runs through the job queue, one at a time
+	jobs, err := db.NewJobQueue(16)
+	if err != nil {
+		log.Fatalf("Error creating job queue: %v", err)
+	}
+	jobs.Start()
+
+	// Syncs run by SYNC_SCHEDULE: every SYNC_INTERVAL (backing off up to SYNC_BACKOFF_MAX
+	// after consecutive failures), at the times of a cron expression in SYNC_TIMEZONE, only
+	// when triggered, or once before exiting. Scheduled syncs and resumes are held back
+	// during the SYNC_BLACKOUT windows.
+	schedule := envString("SYNC_SCHEDULE", scheduler.ScheduleInterval)
+	location, err := time.LoadLocation(envString("SYNC_TIMEZONE", "Local"))
+	if err != nil {
+		log.Fatalf("Invalid SYNC_TIMEZONE: %v", err)
+	}
+	blackout, err := scheduler.ParseBlackout(envString("SYNC_BLACKOUT", ""))
+	if err != nil {
+		log.Fatalf("Invalid SYNC_BLACKOUT: %v", err)
+	}
+	syncSchedule := scheduler.Config{
+		Schedule:    schedule,
+		Interval:    envDuration("SYNC_INTERVAL", 6*time.Hour),
+		Jitter:      envDuration("SYNC_JITTER", 0),
+		MaxInterval: envDuration("SYNC_BACKOFF_MAX", 24*time.Hour),
+		Location:    location,
+		Blackout:    blackout,
+		Done: func(err error) {
+			if err != nil {
+				log.Fatalf("Sync failed, exiting: %v", err)
+			}
+			log.Print("Sync completed, exiting")
+			os.Exit(0)
+		},
+	}
+
+	// A failed sync is resumed from where each fetcher stopped after SYNC_RESUME_COOLDOWN,
+	// rather than waiting for the next scheduled one
+	resume := db.ResumeConfig{
+		Cooldown:    envDuration("SYNC_RESUME_COOLDOWN", 15*time.Minute),
+		MaxAttempts: envInt("SYNC_RESUME_ATTEMPTS", 3),
+		Postpone:    syncSchedule.Postpone,
+	}
+	syncJob := db.ResumableSync(jobs, resume, func(ctx context.Context) error {
+		return db.SyncAll(ctx, config, fetchers)
+	})
+
+	syncScheduler, err := scheduler.New(
+		syncSchedule,
+		func() error {
+			job, err := jobs.Enqueue("sync", db.TriggerSchedule, syncJob)
+			if err != nil {
+				return err
+			}
+			return jobs.Wait(job.ID)
+		},
+	)
 	if err != nil {
 		log.Fatalf("Error creating scheduler: %v", err)
 	}
 
-	// Job to fetch every 15 minutes (change to 6*time.Hour in prod)
-	_, err = scheduler.NewJob(
-		gocron.DurationJob(6*time.Hour),
-		gocron.NewTask(
-			func(config db.APIConfig) {
-				log.Print("Starting product fetch...")
-				if err := db.FetchAllProducts(config); err != nil {
-					log.Printf("Error fetching products: %v", err)
-					return
-				}
-				log.Print("Products fetched successfully!")
-
-				log.Print("Starting price fetch...")
-				if err := db.FetchAllPrices(config); err != nil {
-					log.Printf("Error fetching prices: %v", err)
-					return
-				}
-				log.Print("Prices fetched successfully!")
-			},
-			config,
-		),
+	// Apply the retention policy every RETENTION_INTERVAL through the same job queue
+	retentionJob := db.RetentionJob(db.RetentionConfig{
+		Jobs:         envDuration("RETENTION_JOBS", 90*24*time.Hour),
+		Changes:      envDuration("RETENTION_CHANGES", 30*24*time.Hour),
+		Versions:     envDuration("RETENTION_VERSIONS", 0),
+		RawPages:     envDuration("RETENTION_RAW_PAGES", 0),
+		Quarantine:   envDuration("RETENTION_QUARANTINE", 0),
+		Reservations: envDuration("RETENTION_RESERVATIONS", 7*24*time.Hour),
+		PriceHistory: envDuration("RETENTION_PRICE_HISTORY", 0),
+		Journal:      envDuration("RETENTION_JOURNAL", 30*24*time.Hour),
+	})
+	retentionScheduler, err := scheduler.New(
+		scheduler.Config{Name: "retention", Interval: envDuration("RETENTION_INTERVAL", 24*time.Hour)},
+		func() error {
+			job, err := jobs.Enqueue("retention", db.TriggerSchedule, retentionJob)
+			if err != nil {
+				return err
+			}
+			return jobs.Wait(job.ID)
+		},
 	)
 	if err != nil {
-		log.Fatalf("Error creating cron job: %v", err)
+		log.Fatalf("Error creating retention scheduler: %v", err)
 	}
 
-	// Run an initial fetch
-	go func() {
-		log.Print("Running initial fetch of products and prices...")
-		if err := db.FetchAllProducts(config); err != nil {
-			log.Printf("Error fetching products: %v", err)
-		}
-		if err := db.FetchAllPrices(config); err != nil {
-			log.Printf("Error fetching prices: %v", err)
+	// Queue an initial fetch unless disabled with SYNC_ON_STARTUP=false. The once schedule
+	// runs its own.
+	if envBool("SYNC_ON_STARTUP", true) && !strings.EqualFold(schedule, scheduler.ScheduleOnce) {
+		log.Print("Queueing initial fetch...")
+		if _, err := jobs.Enqueue("sync", db.TriggerStartup, syncJob); err != nil {
+			log.Printf("Error queueing initial fetch: %v", err)
 		}
-	}()
+	}
 
 	// Start the scheduler
 	log.Print("Starting scheduler...")
-	scheduler.Start()
+	syncScheduler.Start()
+	retentionScheduler.Start()
+
+	// Price quotes at cost times QUOTE_MARKUP (or the category's markup), plus QUOTE_TAX_RATE
+	quoteMarkups, err := db.ParseCategoryRates(os.Getenv("QUOTE_MARKUP_BY_CATEGORY"))
+	if err != nil {
+		log.Fatalf("Invalid QUOTE_MARKUP_BY_CATEGORY: %v", err)
+	}
+	quotes := db.QuoteConfig{
+		Markup:         envFloat("QUOTE_MARKUP", 1),
+		CategoryMarkup: quoteMarkups,
+		TaxRate:        envFloat("QUOTE_TAX_RATE", 0.16),
+		Validity:       envDuration("QUOTE_VALIDITY", 15*24*time.Hour),
+	}
+	if err := quotes.Validate(); err != nil {
+		log.Fatalf("Invalid quote settings: %v", err)
+	}
+
+	// Split orders into shipments no heavier or bulkier than the SHIPMENT_VEHICLES
+	vehicles, err := db.ParseShipmentVehicles(envString("SHIPMENT_VEHICLES", db.DefaultShipmentVehicles))
+	if err != nil {
+		log.Fatalf("Invalid SHIPMENT_VEHICLES: %v", err)
+	}
+
+	// Limit every API key, and every client IP without one, to RATE_LIMIT requests per second
+	keyRates, err := db.ParseKeyRates(os.Getenv("RATE_LIMIT_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_KEYS: %v", err)
+	}
+
+	// Stream catalog responses past RESPONSE_BUFFER_MB, or once every response being
+	// built holds RESPONSE_BUFFER_BUDGET_MB
+	bufferLimit := envInt("RESPONSE_BUFFER_MB", db.DefaultResponseBufferLimit>>20)
+	bufferBudget := envInt("RESPONSE_BUFFER_BUDGET_MB", db.DefaultResponseBufferBudget>>20)
+	if bufferLimit < 0 || bufferBudget < 0 {
+		log.Fatalf("Invalid response buffering: RESPONSE_BUFFER_MB and RESPONSE_BUFFER_BUDGET_MB can't be negative")
+	}
+	db.SetResponseBuffering(bufferLimit<<20, bufferBudget<<20)
 
 	// Start HTTP server
 	log.Print("Starting HTTP server...")
-	if err := db.StartServer("8080"); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	serverConfig := db.ServerConfig{
+		Port:             "8080",
+		APIKeys:          apiKeys,
+		Fetchers:         fetchers,
+		Jobs:             jobs,
+		Sync:             syncJob,
+		Retention:        retentionJob,
+		StaleAfter:       envDuration("STALE_AFTER", 0),
+		StaleUnavailable: envBool("STALE_UNAVAILABLE", false),
+		Upstream:         config,
+		Passthrough: db.PassthroughConfig{
+			Rate:     envFloat("UPSTREAM_PASSTHROUGH_RATE", 1),
+			Burst:    envInt("UPSTREAM_PASSTHROUGH_BURST", 5),
+			CacheTTL: envDuration("UPSTREAM_PASSTHROUGH_TTL", time.Minute),
+		},
+		Reservations: db.ReservationConfig{
+			DefaultTTL: envDuration("RESERVATION_TTL", 48*time.Hour),
+			MaxTTL:     envDuration("RESERVATION_MAX_TTL", 30*24*time.Hour),
+		},
+		Quotes:   quotes,
+		Tiers:    tiers,
+		Schemas:  schemas,
+		Channels: channels,
+		Preload: db.PreloadConfig{
+			Enabled: envBool("CATALOG_PRELOAD", false),
+			Refresh: envDuration("CATALOG_PRELOAD_REFRESH", 5*time.Minute),
+		},
+		Vehicles: vehicles,
+		RateLimit: db.RateLimitConfig{
+			Rate:       envFloat("RATE_LIMIT", 0),
+			Burst:      envInt("RATE_LIMIT_BURST", 20),
+			KeyRates:   keyRates,
+			TrustProxy: envBool("RATE_LIMIT_TRUST_PROXY", false),
+		},
+		Debug: db.DebugConfig{
+			Addr: os.Getenv("DEBUG_ADDR"),
+			Auth: envBool("DEBUG_AUTH", true),
+		},
+		Ready: service.Ready,
+	}
+	err = db.StartServer(ctx, serverConfig)
+
+	// Stop the running sync rather than wait for it: every page saved so far is kept
+	log.Print("Ashley Furniture Service stopping...")
+	service.Stopping()
+	jobs.CancelAll()
+	for _, s := range []scheduler.Scheduler{syncScheduler, retentionScheduler} {
+		if shutdownErr := s.Shutdown(); shutdownErr != nil {
+			log.Printf("Error stopping scheduler: %v", shutdownErr)
+		}
+	}
+	service.Stopped(err)
+
+	if err != nil {
+		log.Fatalf("Error running server: %v", err)
+	}
+	log.Print("Ashley Furniture Service stopped")
+}
+
+// registerExternalSuppliers adds the suppliers synced by the programs listed in
+// EXTERNAL_SUPPLIERS, so their fetchers can be enabled like built-in ones
+func registerExternalSuppliers() {
+	external, err := db.ParseExternalSuppliers(os.Getenv("EXTERNAL_SUPPLIERS"))
+	if err != nil {
+		log.Fatalf("Invalid EXTERNAL_SUPPLIERS: %v", err)
+	}
+	for _, supplier := range external {
+		if err := db.RegisterExternalSupplier(supplier); err != nil {
+			log.Fatalf("Invalid EXTERNAL_SUPPLIERS: %v", err)
+		}
+	}
+}
+
+// setupSync applies the settings deciding how synced records are stored and what a
+// completed sync does with them, shared by the service and the commands writing
+// records (once, retransform and seed), then initializes the bucket of every enabled
+// fetcher
+func setupSync(fetchers []db.Syncer) {
+	setupSharding()
+	setupEncryption()
+	setupSKURules()
+	setupSKUPrecedence()
+	setupSimilarity()
+
+	// Recognize unchanged records by the hash CHANGE_DETECTION names
+	if err := db.SetChangeDetection(os.Getenv("CHANGE_DETECTION")); err != nil {
+		log.Fatalf("Invalid CHANGE_DETECTION: %v", err)
+	}
+
+	// Alert when the stock of the SKUs flagged in STOCK_ALERTS drops below their threshold
+	stockAlerts, err := db.ParseStockAlerts(os.Getenv("STOCK_ALERTS"))
+	if err != nil {
+		log.Fatalf("Invalid STOCK_ALERTS: %v", err)
+	}
+	db.SetStockAlerts(stockAlerts)
+
+	db.Init(fetchers)
+}
+
+// setupSKUPrecedence serves SKUs held by several suppliers' catalogs from the first
+// listed in SKU_PRECEDENCE, which syncs record as the winner of each collision
+func setupSKUPrecedence() {
+	db.SetSKUPrecedence(strings.Split(os.Getenv("SKU_PRECEDENCE"), ","))
+}
+
+// setupSharding spreads the records of the SHARDED_BUCKETS over buckets by the first
+// byte of their SKU. Fetchers must be registered first.
+func setupSharding() {
+	if err := db.SetShardedBuckets(strings.Split(os.Getenv("SHARDED_BUCKETS"), ",")); err != nil {
+		log.Fatalf("Invalid SHARDED_BUCKETS: %v", err)
+	}
+}
+
+// setupEncryption enables encryption at rest when ENCRYPTION_KEYS or
+// ENCRYPTION_KEY_COMMAND is set. Must run after the fetchers are registered.
+func setupEncryption() {
+	keysValue := os.Getenv("ENCRYPTION_KEYS")
+	if command := strings.Fields(os.Getenv("ENCRYPTION_KEY_COMMAND")); len(command) > 0 {
+		// Fetch the keys from a KMS, e.g. a script decrypting a data key
+		output, err := exec.Command(command[0], command[1:]...).Output()
+		if err != nil {
+			log.Fatalf("Error running ENCRYPTION_KEY_COMMAND: %v", err)
+		}
+		keysValue = strings.TrimSpace(string(output))
+	}
+
+	keys, err := db.ParseEncryptionKeys(keysValue)
+	if err != nil {
+		log.Fatalf("Invalid encryption keys: %v", err)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	encryption, err := db.NewEncryption(keys, strings.Split(envString("ENCRYPT_BUCKETS", "*"), ","))
+	if err != nil {
+		log.Fatalf("Invalid encryption settings: %v", err)
+	}
+	db.SetEncryption(encryption)
+	log.Print("Encryption at rest enabled")
+}
+
+// setupCache enables the Redis cache when REDIS_URL is set
+func setupCache() {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return
+	}
+
+	cache, err := db.NewRedisCache(url, envString("REDIS_PREFIX", "ashley:"), envDuration("REDIS_TTL", time.Hour))
+	if err != nil {
+		log.Fatalf("Error setting up cache: %v", err)
+	}
+	db.SetCache(cache)
+	log.Print("Redis cache enabled")
+}
+
+// loadAPIConfig builds the upstream API and sync settings from the environment,
+// including the settings of the other suppliers with enabled fetchers
+func loadAPIConfig(fetchers []db.Syncer) db.APIConfig {
+	// Parse API_LIMIT as int
+	limit, err := strconv.Atoi(os.Getenv("API_LIMIT"))
+	if err != nil {
+		log.Fatalf("Invalid API_LIMIT: %v", err)
+	}
+
+	// Parse VALIDATION_BOUNDS as bucket.field=min:max[:reject|flag] entries
+	validation, err := db.ParseBounds(os.Getenv("VALIDATION_BOUNDS"))
+	if err != nil {
+		log.Fatalf("Invalid VALIDATION_BOUNDS: %v", err)
+	}
+
+	// Page size auto-tuning stays within API_LIMIT_MIN..API_LIMIT_MAX, both defaulting to API_LIMIT
+	tuning := db.PageTuning{
+		MinLimit: envInt("API_LIMIT_MIN", limit),
+		MaxLimit: envInt("API_LIMIT_MAX", limit),
+		FastPage: envDuration("API_FAST_PAGE", 5*time.Second),
+	}
+	if tuning.MinLimit < 1 || tuning.MinLimit > limit || tuning.MaxLimit < limit {
+		log.Fatalf("Invalid page size bounds: need 1 <= API_LIMIT_MIN (%d) <= API_LIMIT (%d) <= API_LIMIT_MAX (%d)",
+			tuning.MinLimit, limit, tuning.MaxLimit)
+	}
+
+	// Report the fields Ashley adds to its payloads by UPSTREAM_SCHEMA_DRIFT
+	schemaDrift, err := db.ParseSchemaDrift(os.Getenv("UPSTREAM_SCHEMA_DRIFT"))
+	if err != nil {
+		log.Fatalf("Invalid UPSTREAM_SCHEMA_DRIFT: %v", err)
+	}
+
+	// Responses of the gateway under maintenance defer syncs rather than being retried
+	maintenance, err := db.ParseMaintenance(envString("UPSTREAM_MAINTENANCE_STATUSES", "503"),
+		envString("UPSTREAM_MAINTENANCE_PATTERNS", db.DefaultMaintenancePatterns))
+	if err != nil {
+		log.Fatalf("Invalid UPSTREAM_MAINTENANCE_STATUSES: %v", err)
+	}
+	maintenance.Wait = envDuration("UPSTREAM_MAINTENANCE_WAIT", 30*time.Minute)
+
+	return db.APIConfig{
+		BaseURL:          os.Getenv("API_BASE_URL"),
+		Authorization:    os.Getenv("API_AUTHORIZATION"),
+		ClientID:         os.Getenv("API_CLIENT_ID"),
+		Customer:         os.Getenv("API_CUSTOMER"),
+		UserAgent:        os.Getenv("API_USER_AGENT"),
+		Headers:          loadHeaders("API_HEADERS"),
+		Languages:        envList("API_LANGUAGES", db.DefaultLanguage),
+		Limit:            limit,
+		StoreRawPages:    envBool("STORE_RAW_PAGES", false),
+		StoreRawEntities: envBool("STORE_RAW_ENTITIES", false),
+		Validation:       validation,
+		PageTuning:       tuning,
+		KeepVersions:     envInt("CATALOG_VERSIONS", 10),
+		QuotaReserve:     envFloat("API_QUOTA_RESERVE", 0.1),
+		RequestRate:      envFloat("API_REQUEST_RATE", 0),
+		Parallelism:      envInt("SYNC_PARALLELISM", 1),
+		SkipUnchanged:    envBool("SYNC_SKIP_UNCHANGED", false),
+		SchemaDrift:      schemaDrift,
+		ConditionalPages: envBool("API_CONDITIONAL_PAGES", false),
+		Maintenance:      maintenance,
+		Scope: db.SyncScope{
+			SKUs:       envList("SYNC_SKUS", ""),
+			Series:     envList("SYNC_SERIES", ""),
+			Categories: envList("SYNC_CATEGORIES", ""),
+		},
+		Chaos: db.ChaosConfig{
+			Latency:       envDuration("CHAOS_LATENCY", 0),
+			ErrorRate:     envFloat("CHAOS_ERROR_RATE", 0),
+			MalformedRate: envFloat("CHAOS_MALFORMED_RATE", 0),
+			EmptyRate:     envFloat("CHAOS_EMPTY_RATE", 0),
+		},
+		Suppliers: loadSupplierConfigs(fetchers),
+	}
+}
+
+// setupAvailability counts only the stock of the distribution centers we ship from, in
+// priority order, and combines status, stock and the blacklist into disponibilidad by
+// AVAILABILITY_RULES
+func setupAvailability() {
+	db.SetHomeWarehouses(strings.Split(os.Getenv("HOME_DCS"), ","))
+
+	availabilityRules, err := db.ParseAvailabilityRules(envString("AVAILABILITY_RULES", db.DefaultAvailabilityRules))
+	if err != nil {
+		log.Fatalf("Invalid AVAILABILITY_RULES: %v", err)
+	}
+	db.SetAvailabilityRules(availabilityRules)
+}
+
+// setupLandedCost adds costoImportacion to priced products when LANDED_EXCHANGE_RATE is set
+func setupLandedCost() {
+	dutyRates, err := db.ParseCategoryRates(os.Getenv("LANDED_DUTY_BY_CATEGORY"))
+	if err != nil {
+		log.Fatalf("Invalid LANDED_DUTY_BY_CATEGORY: %v", err)
+	}
+	landed := db.LandedCostConfig{
+		ExchangeRate:  envFloat("LANDED_EXCHANGE_RATE", 0),
+		FreightPerM3:  envFloat("LANDED_FREIGHT_PER_M3", 0),
+		DutyRate:      envFloat("LANDED_DUTY_RATE", 0),
+		CategoryDuty:  dutyRates,
+		IVARate:       envFloat("LANDED_IVA_RATE", 0.16),
+		BrokerageRate: envFloat("LANDED_BROKERAGE_RATE", 0),
+		BrokerageFee:  envFloat("LANDED_BROKERAGE_FEE", 0),
+	}
+	if err := landed.Validate(); err != nil {
+		log.Fatalf("Invalid landed cost settings: %v", err)
+	}
+	db.SetLandedCost(landed)
+}
+
+// setupSimilarity sets which products are suggested for one another after each sync
+func setupSimilarity() {
+	similarity := db.SimilarityConfig{
+		PriceBand:     envFloat("SIMILAR_PRICE_BAND", 0.2),
+		SizeTolerance: envFloat("SIMILAR_SIZE_TOLERANCE", 0.15),
+		Limit:         envInt("SIMILAR_LIMIT", 10),
+	}
+	if err := similarity.Validate(); err != nil {
+		log.Fatalf("Invalid similar product settings: %v", err)
+	}
+	db.SetSimilarity(similarity)
+}
+
+// setupSKURules normalizes SKUs on writes and lookups by SKU_NORMALIZE, resolving the
+// legacy formats of SKU_ALIASES
+func setupSKURules() {
+	rules, err := db.ParseSKUNormalization(envString("SKU_NORMALIZE", "trim,upper"))
+	if err != nil {
+		log.Fatalf("Invalid SKU_NORMALIZE: %v", err)
+	}
+	rules.Aliases, err = db.ParseSKUAliases(os.Getenv("SKU_ALIASES"))
+	if err != nil {
+		log.Fatalf("Invalid SKU_ALIASES: %v", err)
+	}
+	db.SetSKURules(rules)
+}
+
+// loadHeaders parses the extra upstream request headers in the named variable
+func loadHeaders(name string) map[string]string {
+	headers, err := db.ParseHeaders(os.Getenv(name))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return headers
+}
+
+// loadSupplierConfigs reads the settings of every non-Ashley supplier with an enabled
+// fetcher from the variables starting with its prefix, e.g. ACME_BASE_URL
+func loadSupplierConfigs(fetchers []db.Syncer) map[string]db.APIConfig {
+	configs := make(map[string]db.APIConfig)
+	for _, fetcher := range fetchers {
+		supplier := fetcher.Supplier()
+		if _, loaded := configs[supplier]; loaded || supplier == db.AshleySupplier {
+			continue
+		}
+
+		prefix := db.SupplierEnvPrefix(supplier)
+		limit := envInt(prefix+"LIMIT", 100)
+		configs[supplier] = db.APIConfig{
+			BaseURL:       os.Getenv(prefix + "BASE_URL"),
+			Authorization: os.Getenv(prefix + "AUTHORIZATION"),
+			ClientID:      os.Getenv(prefix + "CLIENT_ID"),
+			Customer:      os.Getenv(prefix + "CUSTOMER"),
+			UserAgent:     os.Getenv(prefix + "USER_AGENT"),
+			Headers:       loadHeaders(prefix + "HEADERS"),
+			Limit:         limit,
+			PageTuning:    db.PageTuning{MinLimit: limit, MaxLimit: limit},
+		}
 	}
+	return configs
 }
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/db"
+)
+
+// runCommand executes a one-off subcommand instead of starting the service.
+// Returns false when no command is given.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "retransform":
+		runRetransform(args[1:])
+	case "reencrypt":
+		runReencrypt(args[1:])
+	case "golden":
+		runGolden(args[1:])
+	case "once", "--once", "-once":
+		runOnce(args[1:])
+	case "price-audit":
+		runPriceAudit(args[1:])
+	case "check":
+		runCheck(args[1:])
+	case "dump":
+		runDump(args[1:])
+	case "load":
+		runLoad(args[1:])
+	case "seed":
+		runSeed(args[1:])
+	default:
+		log.Fatalf("Unknown command %q (available: retransform, reencrypt, golden, once, price-audit, check, dump, load, seed)", args[0])
+	}
+
+	return true
+}
+
+// runRetransform re-runs Transform over the stored raw pages and rewrites the buckets
+//
+//	ashley-furniture-service retransform --entity=prices
+func runRetransform(args []string) {
+	flags := flag.NewFlagSet("retransform", flag.ExitOnError)
+	entity := flags.String("entity", "", "comma separated fetchers to retransform (default: all enabled)")
+	flags.Parse(args)
+
+	names := *entity
+	if names == "" {
+		names = os.Getenv("API_FETCHERS")
+	}
+
+	registerExternalSuppliers()
+	fetchers, err := db.EnabledFetchers(names)
+	if err != nil {
+		log.Fatalf("Invalid --entity: %v", err)
+	}
+
+	setupSync(fetchers)
+	config := loadAPIConfig(fetchers)
+	setupCache()
+	for _, fetcher := range fetchers {
+		log.Printf("Retransforming %s from raw pages...", fetcher.Name())
+		count, err := fetcher.Retransform(config)
+		if err != nil {
+			log.Fatalf("Error retransforming %s: %v", fetcher.Name(), err)
+		}
+		log.Printf("Retransformed %d %s", count, fetcher.Name())
+	}
+	recordCommand("retransform", args)
+}
+
+// runCheck validates the database file, prints the report to stdout and exits with
+// status 1 when it found more than orphans
+//
+//	ashley-furniture-service check
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Parse(args)
+
+	registerExternalSuppliers()
+	setupSharding()
+	setupEncryption()
+	setupSKURules()
+
+	report, err := db.Check()
+	if err != nil {
+		log.Fatalf("Error checking database: %v", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatalf("Error printing report: %v", err)
+	}
+
+	total := 0
+	for _, count := range report.Values {
+		total += count
+	}
+	log.Printf("Checked %d values: %d bolt, %d decode, %d key, %d index issues and %d orphans", total,
+		report.Counts[db.CheckBolt], report.Counts[db.CheckDecode], report.Counts[db.CheckKey], report.Counts[db.CheckIndex], report.Counts[db.CheckOrphan])
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// runDump writes the database to a portable archive, gzipped when the file name ends
+// in .gz or .tgz
+//
+//	ashley-furniture-service dump --out=ashley.tar.gz --redact-costs
+func runDump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	out := flags.String("out", "", "archive to write (required)")
+	redactCosts := flags.Bool("redact-costs", false, "remove costs and the buckets holding copies of them")
+	flags.Parse(args)
+	if *out == "" {
+		log.Fatal("dump needs --out")
+	}
+
+	registerExternalSuppliers()
+	setupSharding()
+	setupEncryption()
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Error creating %s: %v", *out, err)
+	}
+	var w io.Writer = file
+	var compressed *gzip.Writer
+	if strings.HasSuffix(*out, ".gz") || strings.HasSuffix(*out, ".tgz") {
+		compressed = gzip.NewWriter(file)
+		w = compressed
+	}
+
+	metadata, err := db.Dump(w, db.DumpOptions{RedactCosts: *redactCosts})
+	if err != nil {
+		file.Close()
+		os.Remove(*out)
+		log.Fatalf("Error dumping database: %v", err)
+	}
+	if compressed != nil {
+		if err := compressed.Close(); err != nil {
+			log.Fatalf("Error writing %s: %v", *out, err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("Error writing %s: %v", *out, err)
+	}
+
+	keys := 0
+	for _, bucket := range metadata.Buckets {
+		keys += bucket.Keys
+	}
+	log.Printf("Dumped %d keys of %d buckets to %s (schema version %d)", keys, len(metadata.Buckets), *out, metadata.SchemaVersion)
+}
+
+// runLoad writes a dump into the database. A database holding records is only
+// replaced with --replace, after being copied aside.
+//
+//	ashley-furniture-service load --in=ashley.tar.gz
+func runLoad(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	in := flags.String("in", "", "archive to read, gzipped or not (required)")
+	replace := flags.Bool("replace", false, "overwrite a database already holding records")
+	flags.Parse(args)
+	if *in == "" {
+		log.Fatal("load needs --in")
+	}
+
+	registerExternalSuppliers()
+	setupSharding()
+	setupEncryption()
+
+	file, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v", *in, err)
+	}
+	defer file.Close()
+	buffered := bufio.NewReader(file)
+	var r io.Reader = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(buffered); err != nil {
+			log.Fatalf("Error reading %s: %v", *in, err)
+		}
+	}
+
+	metadata, err := db.Load(r, db.LoadOptions{Replace: *replace})
+	if err != nil {
+		log.Fatalf("Error loading %s: %v", *in, err)
+	}
+	keys := 0
+	for _, bucket := range metadata.Buckets {
+		keys += bucket.Keys
+	}
+	log.Printf("Loaded %d keys of %d buckets from %s (schema version %d, dumped %s)", keys, len(metadata.Buckets), *in, metadata.SchemaVersion, metadata.CreatedAt.Format(time.RFC3339))
+	if metadata.Redacted {
+		log.Print("The dump was taken with --redact-costs: costs are missing until the next sync")
+	}
+	recordCommand("load", args)
+}
+
+// runSeed fills an empty database with a generated catalog, for development and CI
+// without Ashley credentials
+//
+//	ashley-furniture-service seed --products=2000 --seed=42
+func runSeed(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	products := flags.Int("products", 1000, "products to generate, kits included")
+	seed := flags.Uint64("seed", 1, "seed of the generator; the same seed generates the same catalog")
+	flags.Parse(args)
+
+	validation, err := db.ParseBounds(os.Getenv("VALIDATION_BOUNDS"))
+	if err != nil {
+		log.Fatalf("Invalid VALIDATION_BOUNDS: %v", err)
+	}
+
+	registerExternalSuppliers()
+	fetchers, err := db.EnabledFetchers(os.Getenv("API_FETCHERS"))
+	if err != nil {
+		log.Fatalf("Invalid API_FETCHERS: %v", err)
+	}
+	setupSync(fetchers)
+
+	result, err := db.Seed(db.SeedOptions{Products: *products, Seed: *seed, Validation: validation})
+	if err != nil {
+		log.Fatalf("Error seeding database: %v", err)
+	}
+	log.Printf("Seeded %d products (%d kits) and %d prices, journaled as run %s", result.Products, result.Kits, result.Prices, result.Run)
+	recordCommand("seed", args)
+}
+
+// recordCommand records a command changing stored data in the audit log
+func recordCommand(name string, args []string) {
+	entry := db.AuditEntry{Actor: db.ActorCLI, Action: name, Target: strings.Join(args, " ")}
+	if err := db.RecordAudit(entry); err != nil {
+		log.Printf("Error recording %s in the audit log: %v", name, err)
+	}
+}
+
+// runReencrypt rewrites the stored catalog data with the current encryption settings,
+// sealing plaintext values and re-keying values sealed with an older key
+//
+//	ashley-furniture-service reencrypt
+func runReencrypt(args []string) {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	flags.Parse(args)
+
+	registerExternalSuppliers()
+	setupSharding()
+	setupEncryption()
+
+	rewritten, err := db.Reencrypt()
+	if err != nil {
+		log.Fatalf("Error re-encrypting: %v", err)
+	}
+	if len(rewritten) == 0 {
+		log.Print("All values already stored with the current settings")
+	}
+	for bucket, count := range rewritten {
+		log.Printf("Rewrote %d values of %s", count, bucket)
+	}
+	recordCommand("reencrypt", args)
+}
+
+// onceSummary is printed to stdout by the once command, for the orchestrator running it
+type onceSummary struct {
+	Result     string          `json:"result"` // ok, failed, canceled or deferred
+	Job        string          `json:"job"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Duration   float64         `json:"durationSeconds"`
+	Error      string          `json:"error,omitempty"`
+	RetryAt    *time.Time      `json:"retryAt,omitempty"` // Expected end of the upstream maintenance deferring the sync
+	Fetchers   []db.SyncStatus `json:"fetchers"`
+}
+
+// runOnce runs a single sync of the enabled fetchers (products and prices unless
+// API_FETCHERS says otherwise) without starting the API, prints a JSON summary to
+// stdout and exits with status 1 when the sync failed or was interrupted
+//
+//	ashley-furniture-service --once
+func runOnce(args []string) {
+	flags := flag.NewFlagSet("once", flag.ExitOnError)
+	flags.Parse(args)
+
+	registerExternalSuppliers()
+	fetchers, err := db.EnabledFetchers(os.Getenv("API_FETCHERS"))
+	if err != nil {
+		log.Fatalf("Invalid API_FETCHERS: %v", err)
+	}
+
+	setupSync(fetchers)
+	if envBool("SERVING_FILE", false) {
+		if err := db.EnableServingFile(); err != nil {
+			log.Fatalf("Error publishing serving file: %v", err)
+		}
+	}
+
+	config := loadAPIConfig(fetchers)
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	db.SetUpstreamLogging(envBool("UPSTREAM_LOG", false), 0)
+	setupCache()
+	db.SetAlertWebhook(os.Getenv("ALERT_WEBHOOK_URL"), os.Getenv("ALERT_WEBHOOK_SECRET"))
+
+	// The sync is recorded in the job history like any other
+	jobs, err := db.NewJobQueue(1)
+	if err != nil {
+		log.Fatalf("Error creating job queue: %v", err)
+	}
+	jobs.Start()
+
+	summary := onceSummary{Result: "ok", StartedAt: time.Now()}
+	job, err := jobs.Enqueue("sync", db.TriggerManual, func(ctx context.Context) error {
+		return db.SyncAll(ctx, config, fetchers)
+	})
+	if err != nil {
+		log.Fatalf("Error queueing sync: %v", err)
+	}
+	summary.Job = job.ID
+
+	// An orchestrator stopping the run cancels the sync, which keeps the pages saved so far
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-interrupted
+		log.Printf("Received %v, canceling sync", sig)
+		if _, err := jobs.Cancel(job.ID); err != nil {
+			log.Printf("Error canceling sync: %v", err)
+		}
+	}()
+
+	syncErr := jobs.Wait(job.ID)
+	summary.FinishedAt = time.Now()
+	summary.Duration = summary.FinishedAt.Sub(summary.StartedAt).Seconds()
+	if syncErr != nil {
+		summary.Result = "failed"
+		if errors.Is(syncErr, context.Canceled) {
+			summary.Result = "canceled"
+		} else if until, deferred := db.DeferredUntil(syncErr); deferred {
+			summary.Result = "deferred"
+			summary.RetryAt = &until
+		}
+		summary.Error = syncErr.Error()
+	}
+
+	summary.Fetchers, err = db.GetSyncStatuses(fetchers)
+	if err != nil {
+		log.Printf("Error reading sync status: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(summary); err != nil {
+		log.Printf("Error printing summary: %v", err)
+	}
+
+	if syncErr != nil {
+		os.Exit(1)
+	}
+}
+
+// runPriceAudit recomputes the derived prices (landed cost, price tiers and channels)
+// of the stored catalog and prints the ones that moved beyond --threshold since the
+// baseline was accepted, as JSON. --accept then stores the recomputed prices as the
+// new baseline, once the changes were reviewed.
+//
+//	ashley-furniture-service price-audit --threshold=0.05 [--accept]
+func runPriceAudit(args []string) {
+	flags := flag.NewFlagSet("price-audit", flag.ExitOnError)
+	thresholdFlag := flags.String("threshold", "", "relative change reported, e.g. 0.05 for 5% (default 0.05)")
+	accept := flags.Bool("accept", false, "store the recomputed prices as the baseline of the next audit")
+	flags.Parse(args)
+
+	threshold, err := db.ParsePriceAuditThreshold(*thresholdFlag)
+	if err != nil {
+		log.Fatalf("Invalid --threshold: %v", err)
+	}
+	tiers, err := db.ParsePriceTiers(os.Getenv("PRICE_TIERS"))
+	if err != nil {
+		log.Fatalf("Invalid PRICE_TIERS: %v", err)
+	}
+	channels, err := db.ParseChannels(os.Getenv("CHANNELS"))
+	if err != nil {
+		log.Fatalf("Invalid CHANNELS: %v", err)
+	}
+
+	registerExternalSuppliers()
+	setupSharding()
+	setupEncryption()
+	setupSKURules()
+	setupLandedCost()
+	setupAvailability()
+	setupSKUPrecedence()
+
+	audit, err := db.AuditPrices(tiers, channels, threshold)
+	if err != nil {
+		log.Fatalf("Error auditing prices: %v", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(audit); err != nil {
+		log.Fatalf("Error printing audit: %v", err)
+	}
+	log.Printf("%d prices compared, %d changed more than %g, %d added, %d removed",
+		audit.Compared, len(audit.Changes), threshold, audit.Added, audit.Removed)
+
+	if *accept {
+		count, err := db.AcceptPrices(tiers, channels)
+		if err != nil {
+			log.Fatalf("Error accepting prices: %v", err)
+		}
+		log.Printf("Accepted %d prices as the new baseline", count)
+		recordCommand("price-audit", args)
+	}
+}
+
+// runGolden feeds the recorded upstream pages of every case directory through the
+// transforms and compares the outcome with the case's golden.json. With --update the
+// golden files are rewritten instead, so mapping changes are reviewed as diffs.
+//
+//	ashley-furniture-service golden --dir=testdata/golden [--update]
+//
+// A case directory holds pages named <fetcher>.json or <fetcher>.<n>.json, in the
+// format stored in raw_pages.
+func runGolden(args []string) {
+	flags := flag.NewFlagSet("golden", flag.ExitOnError)
+	dir := flags.String("dir", "testdata/golden", "directory with one subdirectory per case")
+	update := flags.Bool("update", false, "rewrite the golden files with the current output")
+	flags.Parse(args)
+
+	registerExternalSuppliers()
+
+	entries, err := os.ReadDir(*dir)
+	if err != nil {
+		log.Fatalf("Error reading golden cases: %v", err)
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		caseDir := filepath.Join(*dir, entry.Name())
+
+		pages, err := db.LoadGoldenCase(caseDir)
+		if err != nil {
+			log.Fatalf("Error loading %s: %v", caseDir, err)
+		}
+		got, err := db.RenderGolden(pages)
+		if err != nil {
+			log.Fatalf("Error rendering %s: %v", caseDir, err)
+		}
+
+		goldenPath := filepath.Join(caseDir, db.GoldenFile)
+		if *update {
+			if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+				log.Fatalf("Error writing %s: %v", goldenPath, err)
+			}
+			log.Printf("Updated %s", goldenPath)
+			continue
+		}
+
+		want, err := os.ReadFile(goldenPath)
+		if err != nil {
+			log.Fatalf("Error reading %s: %v (run with --update to create it)", goldenPath, err)
+		}
+		if bytes.Equal(got, want) {
+			log.Printf("ok   %s", entry.Name())
+			continue
+		}
+
+		failed++
+		log.Printf("FAIL %s", entry.Name())
+		fmt.Print(db.GoldenDiff(want, got))
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d golden cases differ; review the change and run with --update to accept it", failed)
+	}
+}
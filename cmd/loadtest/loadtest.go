@@ -0,0 +1,158 @@
+// Command loadtest simulates concurrent consumers of the service and reports
+// throughput and latency, so performance regressions are measurable.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080/products -key kiosk-key -c 20 -d 30s
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type result struct {
+	status  int
+	bytes   int64
+	latency time.Duration
+	err     error
+}
+
+// urlList collects a repeatable -url flag
+type urlList []string
+
+func (u *urlList) String() string     { return strings.Join(*u, " ") }
+func (u *urlList) Set(v string) error { *u = append(*u, v); return nil }
+
+func main() {
+	var urls urlList
+	flag.Var(&urls, "url", "URL requested by the consumers, repeat to mix requests (default http://localhost:8080/products)")
+	key := flag.String("key", os.Getenv("LOADTEST_API_KEY"), "API key sent as X-API-Key (default $LOADTEST_API_KEY)")
+	concurrency := flag.Int("c", 10, "concurrent consumers")
+	duration := flag.Duration("d", 30*time.Second, "test duration")
+	gzip := flag.Bool("gzip", true, "send Accept-Encoding: gzip as typical consumers do")
+	timeout := flag.Duration("timeout", 60*time.Second, "per-request timeout")
+	flag.Parse()
+
+	if *concurrency <= 0 {
+		log.Fatal("-c must be positive")
+	}
+	if len(urls) == 0 {
+		urls = urlList{"http://localhost:8080/products"}
+	}
+
+	// A transport per run with enough idle connections for every consumer, so the
+	// test measures the service rather than connection setup
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+			DisableCompression:  true, // Keep responses encoded; we only count bytes
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	results := make(chan result, *concurrency*4)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(consumer int) {
+			defer wg.Done()
+			for n := consumer; ctx.Err() == nil; n++ {
+				r := request(ctx, client, urls[n%len(urls)], *key, *gzip)
+				if ctx.Err() != nil && r.err != nil {
+					return // Cut off by the end of the test
+				}
+				results <- r
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	log.Printf("Running %d consumers for %v against %s", *concurrency, *duration, strings.Join(urls, ", "))
+	startedAt := time.Now()
+	report(results, startedAt)
+}
+
+// request performs one request and drains the body, as a consumer would
+func request(ctx context.Context, client *http.Client, url, key string, gzip bool) result {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return result{err: err}
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	if gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	startedAt := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: err, latency: time.Since(startedAt)}
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	return result{status: resp.StatusCode, bytes: n, latency: time.Since(startedAt), err: err}
+}
+
+// report collects the results until the consumers stop and prints a summary
+func report(results <-chan result, startedAt time.Time) {
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	errs := make(map[string]int)
+	var bytes int64
+
+	for r := range results {
+		if r.err != nil {
+			errs[r.err.Error()]++
+			continue
+		}
+		statuses[r.status]++
+		bytes += r.bytes
+		latencies = append(latencies, r.latency)
+	}
+	elapsed := time.Since(startedAt)
+
+	total := len(latencies)
+	for _, count := range errs {
+		total += count
+	}
+	fmt.Printf("Requests:   %d in %v (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	fmt.Printf("Received:   %.1f MB (%.1f MB/s)\n", float64(bytes)/1e6, float64(bytes)/1e6/elapsed.Seconds())
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("Status %d: %d\n", code, statuses[code])
+	}
+	for message, count := range errs {
+		fmt.Printf("Error:      %d × %s\n", count, message)
+	}
+
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("Latency:    p50 %v  p90 %v  p99 %v  max %v\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1].Round(time.Microsecond))
+}
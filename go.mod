@@ -3,11 +3,19 @@ module github.com/calmestend/ashley-furniture-service
 go 1.24.4
 
 require (
-	github.com/go-co-op/gocron/v2 v2.16.3 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/andybalholm/brotli v1.2.0
+	github.com/go-co-op/gocron/v2 v2.16.3
+	github.com/google/uuid v1.6.0
+	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.7.3
+	go.etcd.io/bbolt v1.4.2
+	golang.org/x/sys v0.29.0
+	golang.org/x/time v0.9.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/jonboulle/clockwork v0.5.0 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
-	go.etcd.io/bbolt v1.4.2 // indirect
-	golang.org/x/sys v0.29.0 // indirect
 )
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Alert is the JSON body posted to the operator webhook
+type Alert struct {
+	Event    string    `json:"event"`
+	Supplier string    `json:"supplier"`
+	Customer string    `json:"customer"`
+	Fetcher  string    `json:"fetcher"`
+	Message  string    `json:"message"`
+	At       time.Time `json:"at"`
+
+	// Set by stock alerts
+	Sku       string `json:"sku,omitempty"`
+	Available *int   `json:"available,omitempty"`
+}
+
+// alertWebhookURL receives operator alerts, empty when alerting is disabled
+var alertWebhookURL string
+
+// alertWebhookSecret signs the alerts posted to the webhook, empty when they go unsigned
+var alertWebhookSecret string
+
+// Headers of the alerts posted to the webhook
+const (
+	webhookIDHeader        = "X-Webhook-Id"        // Random per delivery, for receivers to drop duplicates
+	webhookTimestampHeader = "X-Webhook-Timestamp" // Unix seconds the alert was sent at
+	webhookSignatureHeader = "X-Webhook-Signature" // sha256=<hex HMAC of timestamp.body>
+)
+
+// SetAlertWebhook enables posting operator alerts to url, signed with secret when set
+func SetAlertWebhook(url, secret string) {
+	alertWebhookURL = url
+	alertWebhookSecret = secret
+}
+
+// webhookSignature is the hex HMAC-SHA256, keyed by secret, of the timestamp and body
+// joined by a dot. Signing the timestamp keeps a captured alert from being replayed
+// later with a fresh one.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signWebhook sets the delivery ID and timestamp headers of req, and its signature
+// when a secret is set
+func signWebhook(req *http.Request, body []byte, secret string, now time.Time) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("error generating delivery id: %v", err)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set(webhookIDHeader, hex.EncodeToString(id))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(secret, timestamp, body))
+	}
+	return nil
+}
+
+// alertCredentialsRejected tells the operator a supplier stopped accepting our
+// credentials. It is sent once per outage, not on every failed sync.
+func alertCredentialsRejected(supplier, customer, fetcher string, err error) {
+	message := err.Error()
+	if supplier == AshleySupplier {
+		message = fmt.Sprintf("%v (%s)", err, upstreamHint(err))
+	}
+	log.Printf("ALERT: %s rejected the credentials of customer %q while syncing %s: %s", supplier, customer, fetcher, message)
+
+	sendAlert(Alert{
+		Event:    "credentials_rejected",
+		Supplier: supplier,
+		Customer: customer,
+		Fetcher:  fetcher,
+		Message:  message,
+		At:       time.Now(),
+	})
+}
+
+// sendAlert posts an alert to the webhook. Delivery failures are logged, never
+// returned, so alerting can't fail a sync.
+func sendAlert(alert Alert) {
+	if alertWebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("Error marshaling %s alert: %v", alert.Event, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, alertWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error creating %s alert request: %v", alert.Event, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signWebhook(req, body, alertWebhookSecret, time.Now()); err != nil {
+		log.Printf("Error signing %s alert: %v", alert.Event, err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error sending %s alert: %v", alert.Event, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Error sending %s alert: webhook answered %s", alert.Event, resp.Status)
+	}
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// auditBucketName is the append-only record of admin operations, keyed by big endian
+// sequence number. Retention never prunes it.
+const auditBucketName = "audit"
+
+// maxAuditPayload caps the request body kept with an audit entry. Larger bodies, e.g.
+// contract imports, are cut and marked truncated.
+const maxAuditPayload = 64 << 10
+
+// ActorCLI is the actor of operations run from the command line rather than the API
+const ActorCLI = "cli"
+
+// AuditEntry is an admin operation: who ran it, when, what it was sent and how it ended
+type AuditEntry struct {
+	Seq              string          `json:"seq"`
+	At               time.Time       `json:"at"`
+	Actor            string          `json:"actor"`            // Fingerprint of the API key, or cli
+	Action           string          `json:"action"`           // Route, e.g. "PUT /admin/blacklist/{sku}", or command
+	Target           string          `json:"target,omitempty"` // Request path and query, or command arguments
+	Payload          json.RawMessage `json:"payload,omitempty"`
+	PayloadTruncated bool            `json:"payloadTruncated,omitempty"`
+	Status           int             `json:"status,omitempty"` // HTTP status of the response
+}
+
+// AuditQuery selects audit entries. Empty fields match everything.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	After  uint64 // Only entries past this sequence number
+	Limit  int
+}
+
+// AuditPage is a page of audit entries. Cursor is the sequence to continue after.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Cursor  string       `json:"cursor"`
+	More    bool         `json:"more"`
+}
+
+// auditPayload turns a request body into the payload of an entry: kept as is when it
+// is JSON, as a JSON string otherwise (e.g. CSV imports), cut to maxAuditPayload
+func auditPayload(body []byte) (json.RawMessage, bool) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, false
+	}
+	if len(body) <= maxAuditPayload && json.Valid(body) {
+		return json.RawMessage(body), false
+	}
+	truncated := len(body) > maxAuditPayload
+	if truncated {
+		body = body[:maxAuditPayload]
+	}
+	encoded, _ := json.Marshal(strings.ToValidUTF8(string(body), "\uFFFD"))
+	return encoded, truncated
+}
+
+// RecordAudit appends an admin operation to the audit log
+func RecordAudit(entry AuditEntry) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(auditBucketName))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.Seq = strconv.FormatUint(seq, 10)
+		if entry.At.IsZero() {
+			entry.At = time.Now()
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		key := changeKey(seq)
+		sealed, err := sealValue(auditBucketName, key, data)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, sealed)
+	})
+}
+
+// GetAudit returns the audit entries matching query, oldest first
+func GetAudit(query AuditQuery) (AuditPage, error) {
+	page := AuditPage{Entries: []AuditEntry{}, Cursor: strconv.FormatUint(query.After, 10)}
+
+	db, err := openDB()
+	if err != nil {
+		return page, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(auditBucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(changeKey(query.After + 1)); k != nil; k, v = c.Next() {
+			if len(page.Entries) == query.Limit {
+				page.More = true
+				return nil
+			}
+			v, err := openValue(auditBucketName, k, v)
+			if err != nil {
+				return err
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("error decoding audit entry %d: %v", binary.BigEndian.Uint64(k), err)
+			}
+			page.Cursor = entry.Seq
+			if (query.Actor == "" || entry.Actor == query.Actor) &&
+				(query.Action == "" || entry.Action == query.Action) {
+				page.Entries = append(page.Entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return page, fmt.Errorf("error reading audit log: %v", err)
+	}
+
+	return page, nil
+}
+
+// audit wraps an admin handler so every request reaching it is recorded with the
+// fingerprint of its key, its body and the status it was answered with. Failing to
+// record is logged: the operation already ran.
+func (s *server) audit(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Handlers read the body themselves, up to limits no lower than the import one
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBytes+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		recorder := &usageResponseWriter{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.code == 0 {
+			recorder.code = http.StatusOK
+		}
+
+		payload, truncated := auditPayload(body)
+		entry := AuditEntry{
+			Actor:            keyFingerprint(apiKeyFromRequest(r)),
+			Action:           action,
+			Target:           r.URL.RequestURI(),
+			Payload:          payload,
+			PayloadTruncated: truncated,
+			Status:           recorder.code,
+		}
+		if err := RecordAudit(entry); err != nil {
+			log.Printf("Error recording %s in the audit log: %v", action, err)
+		}
+	}
+}
+
+// auditHandler serves the audit log, filtered with ?actor= and ?action= and paged
+// with ?after=<seq>&limit=
+func (s *server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := AuditQuery{Actor: q.Get("actor"), Action: q.Get("action"), Limit: 1000}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+	if value := q.Get("after"); value != "" {
+		after, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid after %q: expected a sequence number", value), http.StatusBadRequest)
+			return
+		}
+		query.After = after
+	}
+
+	page, err := GetAudit(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Role scopes what an API key is allowed to do
+type Role string
+
+const (
+	RoleRead  Role = "read"
+	RoleWrite Role = "write"
+	RoleAdmin Role = "admin"
+)
+
+// allows reports whether a key with role r may access a route requiring role required
+func (r Role) allows(required Role) bool {
+	switch required {
+	case RoleRead:
+		return r == RoleRead || r == RoleWrite || r == RoleAdmin
+	case RoleWrite:
+		return r == RoleWrite || r == RoleAdmin
+	case RoleAdmin:
+		return r == RoleAdmin
+	}
+	return false
+}
+
+// APIKey is the access granted to an API key
+type APIKey struct {
+	Role    Role
+	Profile *ResponseProfile // Fields hidden from the key's responses, nil for none
+	Tier    *PriceTier       // Price tier the key's price lists and quotes use, nil for any
+	Schema  *ResponseSchema  // Field names the key's responses use unless ?schema= is given, nil for Spanish
+}
+
+// ParseAPIKeys parses a comma separated list of key:role pairs (e.g. "abc:admin,def:read").
+// Further parts name a response profile (read keys only), a price tier or a response
+// schema, e.g. "kiosk:read:nocost", "studio:write:designer" or "erp:read:en".
+func ParseAPIKeys(s string, profiles map[string]*ResponseProfile, tiers map[string]*PriceTier, schemas map[string]*ResponseSchema) (map[string]APIKey, error) {
+	keys := make(map[string]APIKey)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, ":")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid API key entry %q: expected key:role", pair)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		role := strings.TrimSpace(strings.ToLower(parts[1]))
+		if key == "" {
+			return nil, fmt.Errorf("invalid API key entry %q: empty key", pair)
+		}
+
+		apiKey := APIKey{Role: Role(role)}
+		switch apiKey.Role {
+		case RoleRead, RoleWrite, RoleAdmin:
+		default:
+			return nil, fmt.Errorf("invalid role %q for API key: expected read, write or admin", role)
+		}
+
+		for _, name := range parts[2:] {
+			name = strings.TrimSpace(name)
+			profile, isProfile := profiles[name]
+			tier, isTier := tiers[name]
+			schema, isSchema := schemas[name]
+			switch {
+			case isProfile && isTier, isProfile && isSchema, isTier && isSchema:
+				return nil, fmt.Errorf("invalid API key entry: %q names more than one of a response profile, price tier and response schema", name)
+			case isSchema:
+				if apiKey.Schema != nil {
+					return nil, fmt.Errorf("invalid API key entry: more than one response schema")
+				}
+				apiKey.Schema = schema
+			case isTier:
+				if apiKey.Tier != nil {
+					return nil, fmt.Errorf("invalid API key entry: more than one price tier")
+				}
+				apiKey.Tier = tier
+			case isProfile:
+				if apiKey.Role != RoleRead {
+					return nil, fmt.Errorf("invalid API key entry: response profiles only apply to read keys")
+				}
+				if apiKey.Profile != nil {
+					return nil, fmt.Errorf("invalid API key entry: more than one response profile")
+				}
+				apiKey.Profile = profile
+			default:
+				return nil, fmt.Errorf("unknown response profile, price tier or response schema %q for API key (profiles: %s; tiers: %s; schemas: %s)",
+					name, strings.Join(profileNames(profiles), ", "), strings.Join(tierNames(tiers), ", "), strings.Join(schemaNames(schemas), ", "))
+			}
+		}
+
+		keys[key] = apiKey
+	}
+
+	return keys, nil
+}
+
+// apiKeyFromRequest extracts the API key from the X-API-Key header or a Bearer token
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	auth := r.Header.Get("Authorization")
+	if token, found := strings.CutPrefix(auth, "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+
+	return ""
+}
+
+// lookupKey returns the access of a key using a constant time comparison
+func (s *server) lookupKey(key string) (APIKey, bool) {
+	var apiKey APIKey
+	found := false
+
+	for candidate, candidateKey := range s.config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			apiKey = candidateKey
+			found = true
+		}
+	}
+
+	return apiKey, found
+}
+
+// requireRole wraps a handler so it is only reachable with a key of the given role.
+// When no keys are configured read routes stay open, while write and admin routes are refused.
+func (s *server) requireRole(required Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.APIKeys) == 0 {
+			if required == RoleRead {
+				if r, ok := s.withRequestSchema(w, r, nil); ok {
+					next(w, r)
+				}
+				return
+			}
+			http.Error(w, "Write and admin endpoints are disabled: no API keys configured", http.StatusForbidden)
+			return
+		}
+
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		apiKey, ok := s.lookupKey(key)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if !apiKey.Role.allows(required) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		r, ok = s.withRequestSchema(w, withTier(withProfile(r, apiKey.Profile), apiKey.Tier), apiKey.Schema)
+		if !ok {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// keyFingerprint returns a short, non-reversible identifier for an API key
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+type apiKeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Role        Role   `json:"role"`
+	Profile     string `json:"profile,omitempty"`
+	Tier        string `json:"tier,omitempty"`
+	Schema      string `json:"schema,omitempty"`
+}
+
+// listKeysHandler serves the configured keys as fingerprints with their roles, profiles, tiers and schemas
+func (s *server) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := make([]apiKeyInfo, 0, len(s.config.APIKeys))
+	for key, apiKey := range s.config.APIKeys {
+		info := apiKeyInfo{Fingerprint: keyFingerprint(key), Role: apiKey.Role}
+		if apiKey.Profile != nil {
+			info.Profile = apiKey.Profile.Name
+		}
+		if apiKey.Tier != nil {
+			info.Tier = apiKey.Tier.Name
+		}
+		if apiKey.Schema != nil {
+			info.Schema = apiKey.Schema.Name
+		}
+		keys = append(keys, info)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Fingerprint < keys[j].Fingerprint })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
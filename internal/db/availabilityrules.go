@@ -0,0 +1,215 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultAvailabilityRules block blacklisted SKUs, then tell discontinued products
+// apart and finally products with stock left from sold out ones. Products matching
+// none, i.e. current products without synced inventory, carry no disponibilidad.
+const DefaultAvailabilityRules = "bloqueado=blacklisted;descontinuado=status:Discontinued;disponible=stock>0;agotado=stock<=0"
+
+// AvailabilityRule sets disponibilidad to State on the products meeting every one of
+// its conditions
+type AvailabilityRule struct {
+	State      string
+	Conditions []AvailabilityCondition
+}
+
+// AvailabilityCondition is a check on a product's blacklist state, status or stock
+type AvailabilityCondition struct {
+	Kind     string   // blacklisted, status, stock, nostock or * (always holds)
+	Negated  bool     // Prefixed with !, not allowed on stock
+	Statuses []string // Status values for status, matched ignoring case
+	Operator string   // Comparison for stock: >, >=, <, <= or =
+	Value    int      // Compared with the stock left after reservations
+}
+
+// availabilityRules are the configured rules, in the order they are tried
+var availabilityRules []AvailabilityRule
+
+// availabilitySignature identifies the configured rules so cached responses built
+// with different rules are not served
+var availabilitySignature string
+
+// SetAvailabilityRules sets the rules disponibilidad is computed with. Without rules
+// products carry no disponibilidad.
+func SetAvailabilityRules(rules []AvailabilityRule) {
+	availabilityRules = rules
+	availabilitySignature = ""
+	if len(rules) > 0 {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v", rules)))
+		availabilitySignature = hex.EncodeToString(sum[:4])
+	}
+}
+
+// stockOperators are the comparisons of stock conditions, longest first so <= isn't
+// read as <
+var stockOperators = []string{">=", "<=", ">", "<", "="}
+
+// ParseAvailabilityRules parses semicolon separated state=condition,... rules, tried in
+// order, e.g. "bloqueado=blacklisted;disponible=stock>0,!status:Discontinued". A rule
+// matches when every condition holds:
+//
+//	blacklisted        the SKU is on /admin/blacklist
+//	status:A|B         Ashley's status is one of the values
+//	stock>N            the stock left after reservations compares to N (>, >=, <, <=, =);
+//	                   never holds without synced inventory
+//	nostock            the SKU has no synced inventory
+//	*                  always holds
+//
+// Any condition but stock can be negated with !. "none" disables disponibilidad.
+func ParseAvailabilityRules(s string) ([]AvailabilityRule, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "none") {
+		return nil, nil
+	}
+
+	var rules []AvailabilityRule
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		state, conditions, found := strings.Cut(entry, "=")
+		state = strings.TrimSpace(state)
+		if !found || state == "" || strings.TrimSpace(conditions) == "" {
+			return nil, fmt.Errorf("invalid rule %q: expected state=condition,...", entry)
+		}
+
+		rule := AvailabilityRule{State: state}
+		for _, spec := range strings.Split(conditions, ",") {
+			condition, err := parseAvailabilityCondition(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", state, err)
+			}
+			rule.Conditions = append(rule.Conditions, condition)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseAvailabilityCondition(spec string) (AvailabilityCondition, error) {
+	var condition AvailabilityCondition
+	body, negated := strings.CutPrefix(spec, "!")
+	condition.Negated = negated
+
+	switch {
+	case body == "blacklisted", body == "nostock", body == "*":
+		condition.Kind = body
+	case strings.HasPrefix(body, "status:"):
+		condition.Kind = "status"
+		for _, status := range strings.Split(strings.TrimPrefix(body, "status:"), "|") {
+			if status = strings.TrimSpace(status); status != "" {
+				condition.Statuses = append(condition.Statuses, status)
+			}
+		}
+		if len(condition.Statuses) == 0 {
+			return AvailabilityCondition{}, fmt.Errorf("condition %q names no status", spec)
+		}
+	case strings.HasPrefix(body, "stock"):
+		if negated {
+			return AvailabilityCondition{}, fmt.Errorf("condition %q can't be negated: use the opposite comparison", spec)
+		}
+		condition.Kind = "stock"
+		rest := strings.TrimSpace(strings.TrimPrefix(body, "stock"))
+		for _, operator := range stockOperators {
+			if value, ok := strings.CutPrefix(rest, operator); ok {
+				condition.Operator = operator
+				rest = strings.TrimSpace(value)
+				break
+			}
+		}
+		value, err := strconv.Atoi(rest)
+		if condition.Operator == "" || err != nil {
+			return AvailabilityCondition{}, fmt.Errorf("invalid stock condition %q: expected stock, a comparison and a whole number", spec)
+		}
+		condition.Value = value
+	default:
+		return AvailabilityCondition{}, fmt.Errorf("unknown condition %q (available: blacklisted, status:, stock, nostock, *)", spec)
+	}
+
+	return condition, nil
+}
+
+// holds reports whether the condition holds for a product
+func (c AvailabilityCondition) holds(product ProductResponseData, blacklisted bool) bool {
+	var result bool
+	switch c.Kind {
+	case "blacklisted":
+		result = blacklisted
+	case "nostock":
+		result = product.Disponible == nil
+	case "status":
+		for _, status := range c.Statuses {
+			if strings.EqualFold(status, strings.TrimSpace(product.Descontinuado)) {
+				result = true
+			}
+		}
+	case "stock":
+		if product.Disponible == nil {
+			return false
+		}
+		stock := *product.Disponible
+		switch c.Operator {
+		case ">":
+			result = stock > c.Value
+		case ">=":
+			result = stock >= c.Value
+		case "<":
+			result = stock < c.Value
+		case "<=":
+			result = stock <= c.Value
+		default:
+			result = stock == c.Value
+		}
+	default:
+		result = true
+	}
+	return result != c.Negated
+}
+
+// availabilityState returns the state of the first rule the product meets, empty
+// when it meets none
+func availabilityState(product ProductResponseData, blacklisted bool) string {
+	for _, rule := range availabilityRules {
+		met := true
+		for _, condition := range rule.Conditions {
+			if !condition.holds(product, blacklisted) {
+				met = false
+				break
+			}
+		}
+		if met {
+			return rule.State
+		}
+	}
+	return ""
+}
+
+// applyAvailabilityState sets disponibilidad on the products from their status, the
+// stock set by applyAvailability and the blacklist
+func applyAvailabilityState(response []ProductResponseData) error {
+	if len(availabilityRules) == 0 {
+		return nil
+	}
+
+	entries, err := GetBlacklist()
+	if err != nil {
+		return fmt.Errorf("error fetching blacklist: %v", err)
+	}
+	blacklist := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		blacklist[entry.Sku] = true
+	}
+
+	for i := range response {
+		response[i].Disponibilidad = availabilityState(response[i], blacklist[response[i].Clave])
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkProducts is the size of the generated catalog the benchmarks run on
+const benchmarkProducts = 1000
+
+// benchmarkCatalog generates the benchmark catalog, the same on every run
+func benchmarkCatalog() ([]Product, []Price) {
+	return newCatalogGenerator(1).generate(benchmarkProducts)
+}
+
+func BenchmarkProductTransform(b *testing.B) {
+	products, _ := benchmarkCatalog()
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, product := range products {
+			ProductFetcher{}.Transform(product)
+		}
+	}
+}
+
+func BenchmarkPriceTransform(b *testing.B) {
+	_, prices := benchmarkCatalog()
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, price := range prices {
+			PriceFetcher{}.Transform(price)
+		}
+	}
+}
+
+// BenchmarkSaveEntities saves the catalog's products as a sync page does: "changed"
+// rewrites every record, with its change feed entry and journal, and "unchanged" only
+// compares their hashes
+func BenchmarkSaveEntities(b *testing.B) {
+	b.Run("changed", func(b *testing.B) {
+		db := testDatabase(b)
+		products, _ := benchmarkCatalog()
+		descriptions := make([]string, len(products))
+		for i, product := range products {
+			descriptions[i] = product.ConsumerDescription
+		}
+		run, err := newRun(SourceSeed)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		for i := 0; b.Loop(); i++ {
+			b.StopTimer()
+			for j := range products {
+				products[j].ConsumerDescription = fmt.Sprintf("%s %d", descriptions[j], i)
+			}
+			b.StartTimer()
+			if _, err := saveEntitiesToDatabase(db, run, "products", products, ProductFetcher{}.Transform, ValidationConfig{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unchanged", func(b *testing.B) {
+		db := testDatabase(b)
+		products, _ := benchmarkCatalog()
+		run, err := newRun(SourceSeed)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := saveEntitiesToDatabase(db, run, "products", products, ProductFetcher{}.Transform, ValidationConfig{}); err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := saveEntitiesToDatabase(db, run, "products", products, ProductFetcher{}.Transform, ValidationConfig{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkBuildProductResponses merges a seeded catalog with its prices as /products
+// does, whole and for a page of SKUs
+func BenchmarkBuildProductResponses(b *testing.B) {
+	testDatabase(b)
+	if _, err := Seed(SeedOptions{Products: benchmarkProducts, Seed: 1}); err != nil {
+		b.Fatal(err)
+	}
+	products, _ := benchmarkCatalog()
+	skus := make([]string, 0, 50)
+	for _, product := range products[:cap(skus)] {
+		skus = append(skus, product.Sku)
+	}
+
+	b.Run("all", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := buildProductResponses("", nil, nil, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("skus", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := buildProductResponses("", skus, nil, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// blacklistBucketName holds the SKUs blocked from sale through /admin/blacklist
+const blacklistBucketName = "blacklist"
+
+// BlacklistEntry is a SKU we don't sell, whatever Ashley's status and stock say
+type BlacklistEntry struct {
+	Sku       string    `json:"sku"`
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (b BlacklistEntry) GetSKU() string { return b.Sku }
+
+// GetBlacklist returns the blacklisted SKUs in SKU order
+func GetBlacklist() ([]BlacklistEntry, error) {
+	return GetAllEntities[BlacklistEntry](blacklistBucketName)
+}
+
+// SetBlacklistEntry blacklists a SKU, replacing the reason it was blacklisted with
+func SetBlacklistEntry(entry BlacklistEntry) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling blacklist entry for %s: %v", entry.Sku, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(blacklistBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(entry.Sku), data)
+	})
+}
+
+// DeleteBlacklistEntry removes a SKU from the blacklist
+func DeleteBlacklistEntry(sku string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(blacklistBucketName))
+		if bucket == nil || bucket.Get([]byte(sku)) == nil {
+			return fmt.Errorf("%w: %s is not blacklisted", ErrNotFound, sku)
+		}
+		return bucket.Delete([]byte(sku))
+	})
+}
+
+// blacklistHandler lists the blacklisted SKUs
+func (s *server) blacklistHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := GetBlacklist()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching blacklist: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []BlacklistEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// setBlacklistHandler blacklists a SKU with an optional {"reason": "..."} body
+func (s *server) setBlacklistHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	entry := BlacklistEntry{Sku: sku, Reason: strings.TrimSpace(body.Reason), UpdatedAt: time.Now()}
+	if err := SetBlacklistEntry(entry); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving blacklist entry: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// deleteBlacklistHandler removes a SKU from the blacklist
+func (s *server) deleteBlacklistHandler(w http.ResponseWriter, r *http.Request) {
+	err := DeleteBlacklistEntry(lookupSKU(r.PathValue("sku")))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting blacklist entry: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+)
+
+// Catalog responses are encoded into memory first, so a failure halfway still gets an
+// error status and the body goes out with its length. A full catalog buffered for
+// several clients at once is enough to run the service out of memory, so a response
+// outgrowing its buffer, or taking the buffers of every response past their shared
+// budget, is streamed instead: the part encoded so far is sent and the rest is written
+// as it is encoded.
+
+// Defaults of SetResponseBuffering, in bytes
+const (
+	DefaultResponseBufferLimit  = 8 << 20
+	DefaultResponseBufferBudget = 32 << 20
+)
+
+var responseBuffers = struct {
+	mu     sync.Mutex
+	limit  int // Bytes a single response buffers before streaming
+	budget int // Bytes buffered across the responses being built at once
+	used   int
+	peak   int
+}{limit: DefaultResponseBufferLimit, budget: DefaultResponseBufferBudget}
+
+var (
+	responseBufferBytes = metrics.NewGauge("ashley_response_buffer_bytes",
+		"Bytes of responses being built currently held in memory")
+	responseBufferPeakBytes = metrics.NewGauge("ashley_response_buffer_peak_bytes",
+		"Most bytes of responses being built held in memory at once since start")
+	responsesStreamedTotal = metrics.NewCounter("ashley_responses_streamed_total",
+		"Responses streamed because they outgrew their buffer or the shared budget", "endpoint")
+)
+
+// SetResponseBuffering sets how many bytes a response buffers before it is streamed,
+// and how many the responses being built at once may buffer together. 0 streams every
+// response.
+func SetResponseBuffering(limit, budget int) {
+	responseBuffers.mu.Lock()
+	defer responseBuffers.mu.Unlock()
+	responseBuffers.limit = limit
+	responseBuffers.budget = budget
+}
+
+// reserveResponseBuffer takes n more bytes for a response already buffering held bytes,
+// false when that would take it past its limit or every response past the budget
+func reserveResponseBuffer(held, n int) bool {
+	responseBuffers.mu.Lock()
+	defer responseBuffers.mu.Unlock()
+	if held+n > responseBuffers.limit || responseBuffers.used+n > responseBuffers.budget {
+		return false
+	}
+	responseBuffers.used += n
+	if responseBuffers.used > responseBuffers.peak {
+		responseBuffers.peak = responseBuffers.used
+		responseBufferPeakBytes.Set(float64(responseBuffers.peak))
+	}
+	responseBufferBytes.Set(float64(responseBuffers.used))
+	return true
+}
+
+// releaseResponseBuffer returns the n bytes of a response that was sent or discarded
+func releaseResponseBuffer(n int) {
+	responseBuffers.mu.Lock()
+	defer responseBuffers.mu.Unlock()
+	responseBuffers.used -= n
+	responseBufferBytes.Set(float64(responseBuffers.used))
+}
+
+// responseBuffer holds a 200 response until close, or streams it once it grows past
+// what it may buffer. Headers are set on the ResponseWriter before writing.
+type responseBuffer struct {
+	w         http.ResponseWriter
+	endpoint  string
+	buf       bytes.Buffer
+	streaming bool
+}
+
+// newResponseBuffer buffers the response to r, labeled by its route in the metrics
+func newResponseBuffer(w http.ResponseWriter, r *http.Request) *responseBuffer {
+	endpoint := r.Pattern
+	if endpoint == "" {
+		endpoint = r.URL.Path
+	}
+	return &responseBuffer{w: w, endpoint: endpoint}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if !b.streaming {
+		if reserveResponseBuffer(b.buf.Len(), len(p)) {
+			return b.buf.Write(p)
+		}
+		if err := b.stream(); err != nil {
+			return 0, err
+		}
+	}
+	return b.w.Write(p)
+}
+
+// stream sends the status and what was buffered, and has later writes go straight out
+func (b *responseBuffer) stream() error {
+	b.streaming = true
+	responsesStreamedTotal.Inc(b.endpoint)
+
+	b.w.WriteHeader(http.StatusOK)
+	_, err := b.w.Write(b.buf.Bytes())
+	releaseResponseBuffer(b.buf.Len())
+	b.buf = bytes.Buffer{}
+	return err
+}
+
+// close sends the buffered response with its length, unless it was streamed
+func (b *responseBuffer) close() {
+	if b.streaming {
+		return
+	}
+	defer releaseResponseBuffer(b.buf.Len())
+
+	b.w.Header().Set("Content-Length", strconv.Itoa(b.buf.Len()))
+	b.w.WriteHeader(http.StatusOK)
+	if _, err := b.w.Write(b.buf.Bytes()); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// fail answers with an error when nothing was sent yet. A streamed response already
+// went out with a 200, so the error is only logged and the body is left cut short.
+func (b *responseBuffer) fail(status int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if b.streaming {
+		log.Printf("%s (response to %s already streamed)", message, b.endpoint)
+		return
+	}
+	releaseResponseBuffer(b.buf.Len())
+	b.buf = bytes.Buffer{}
+	b.w.Header().Del("Content-Disposition")
+	http.Error(b.w, message, status)
+}
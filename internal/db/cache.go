@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const catalogCacheKey = "catalog"
+
+// RedisCache keeps hot lookups and the merged catalog in Redis so repeated identical
+// reads don't hit the bolt file. Every key lives under Prefix and expires after TTL.
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// cache is the optional cache in front of the store, nil when disabled
+var cache *RedisCache
+
+// NewRedisCache connects to the Redis server at url (e.g. redis://localhost:6379/0)
+func NewRedisCache(url, prefix string, ttl time.Duration) (*RedisCache, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing redis url: %v", err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+
+	return &RedisCache{client: client, prefix: prefix, ttl: ttl}, nil
+}
+
+// SetCache enables the cache for entity lookups and the catalog endpoint
+func SetCache(c *RedisCache) {
+	cache = c
+}
+
+// cacheGet returns a cached value. Redis errors are logged and treated as misses.
+func cacheGet(ctx context.Context, key string) ([]byte, bool) {
+	if cache == nil {
+		return nil, false
+	}
+
+	data, err := cache.client.Get(ctx, cache.prefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Error reading cache key %s: %v", key, err)
+		}
+		debugf(log.Default(), "Cache miss %s", key)
+		return nil, false
+	}
+	debugf(log.Default(), "Cache hit %s", key)
+
+	return data, true
+}
+
+// cacheSet stores a value, logging Redis errors
+func cacheSet(ctx context.Context, key string, data []byte) {
+	if cache == nil {
+		return
+	}
+
+	if err := cache.client.Set(ctx, cache.prefix+key, data, cache.ttl).Err(); err != nil {
+		log.Printf("Error writing cache key %s: %v", key, err)
+	}
+}
+
+type invalidationContextKey struct{}
+
+// withDeferredInvalidation returns ctx under which fetchers leave invalidating the
+// cache to their caller, which does it once they all finished
+func withDeferredInvalidation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, invalidationContextKey{}, true)
+}
+
+// invalidationDeferred reports whether the caller of a fetch invalidates the cache
+func invalidationDeferred(ctx context.Context) bool {
+	deferred, _ := ctx.Value(invalidationContextKey{}).(bool)
+	return deferred
+}
+
+// invalidateCache drops every cached value, called once stored data changes
+func invalidateCache() {
+	dropPromotions()
+	dropPreloadedCatalog()
+	if cache == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deleted := 0
+	iter := cache.client.Scan(ctx, 0, cache.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := cache.client.Del(ctx, iter.Val()).Err(); err != nil {
+			log.Printf("Error invalidating cache: %v", err)
+			return
+		}
+		deleted++
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Error invalidating cache: %v", err)
+		return
+	}
+
+	log.Printf("Invalidated %d cached entries", deleted)
+}
+
+// getCachedEntity reads an entity through the cache. Missing entities are not cached.
+func getCachedEntity[T DatabaseEntity](bucketName, sku string) (*T, error) {
+	key := "entity:" + bucketName + ":" + sku
+	ctx := context.Background()
+
+	if data, ok := cacheGet(ctx, key); ok {
+		var entity T
+		if err := json.Unmarshal(data, &entity); err == nil {
+			return &entity, nil
+		}
+	}
+
+	entity, err := GetEntity[T](bucketName, sku)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if data, err := json.Marshal(entity); err == nil {
+			cacheSet(ctx, key, data)
+		}
+	}
+
+	return entity, nil
+}
@@ -0,0 +1,321 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	changesBucketName       = "changes"
+	changeCursorsBucketName = "change_cursors"
+)
+
+// ChangeRecord is an entry of the change feed: a record of a bucket was written with a
+// different value or removed. Cursor is the position of the entry in the feed.
+type ChangeRecord = api.ChangeRecord
+
+// ChangeFeed is a page of the change feed. Cursor is the position to resume from.
+type ChangeFeed = api.ChangeFeed
+
+// ChangeCursor is the position a consumer committed in the change feed
+type ChangeCursor struct {
+	Consumer  string    `json:"consumer"`
+	Cursor    string    `json:"cursor"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func changeKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// recordChange appends an entry to the change feed within the caller's transaction
+func recordChange(tx *bolt.Tx, bucketName, sku string, deleted bool) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(changesBucketName))
+	if err != nil {
+		return err
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(ChangeRecord{
+		Cursor:  strconv.FormatUint(seq, 10),
+		Bucket:  bucketName,
+		Sku:     sku,
+		Deleted: deleted,
+		At:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(changeKey(seq), data)
+}
+
+// GetChanges returns up to limit changes recorded after cursor
+func GetChanges(cursor uint64, limit int) (ChangeFeed, error) {
+	feed := ChangeFeed{Changes: []ChangeRecord{}, Cursor: strconv.FormatUint(cursor, 10)}
+
+	db, err := openDB()
+	if err != nil {
+		return feed, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(changesBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(changeKey(cursor + 1)); k != nil; k, v = c.Next() {
+			if len(feed.Changes) == limit {
+				feed.More = true
+				break
+			}
+
+			var change ChangeRecord
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			feed.Changes = append(feed.Changes, change)
+			feed.Cursor = change.Cursor
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return feed, err
+	}
+
+	return feed, nil
+}
+
+// changeCursorAt returns the cursor of the last change recorded at or before t,
+// so reading from it returns every change after t
+func changeCursorAt(t time.Time) (uint64, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var cursor uint64
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(changesBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		// Changes are appended in time order, recent timestamps are found fastest from the end
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var change ChangeRecord
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			if !change.At.After(t) {
+				cursor = binary.BigEndian.Uint64(k)
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return cursor, err
+}
+
+// GetChangeCursor returns the cursor committed by a consumer, or ErrNotFound
+func GetChangeCursor(consumer string) (*ChangeCursor, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var cursor ChangeCursor
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(changeCursorsBucketName))
+		if bucket == nil {
+			return fmt.Errorf("%w: no cursor for consumer %s", ErrNotFound, consumer)
+		}
+
+		data := bucket.Get([]byte(consumer))
+		if data == nil {
+			return fmt.Errorf("%w: no cursor for consumer %s", ErrNotFound, consumer)
+		}
+
+		return json.Unmarshal(data, &cursor)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+// SetChangeCursor commits the position a consumer has processed the change feed up to
+func SetChangeCursor(consumer string, cursor uint64) (ChangeCursor, error) {
+	record := ChangeCursor{Consumer: consumer, Cursor: strconv.FormatUint(cursor, 10), UpdatedAt: time.Now()}
+
+	db, err := openDB()
+	if err != nil {
+		return record, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(changeCursorsBucketName))
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(consumer), data)
+	})
+
+	return record, err
+}
+
+// GetChangeCursors returns the committed cursor of every consumer
+func GetChangeCursors() ([]ChangeCursor, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	cursors := []ChangeCursor{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(changeCursorsBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var cursor ChangeCursor
+			if err := json.Unmarshal(v, &cursor); err != nil {
+				return err
+			}
+			cursors = append(cursors, cursor)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
+
+// parseChangeCursor accepts a cursor returned by the feed or an RFC 3339 timestamp
+func parseChangeCursor(value string) (uint64, error) {
+	if cursor, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return cursor, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("since must be a cursor or an RFC 3339 timestamp, got %q", value)
+	}
+	return changeCursorAt(t)
+}
+
+// changesHandler serves the changes after ?since=<cursor or timestamp>. Without since,
+// the feed resumes from the cursor committed by ?consumer=, or from the beginning.
+func (s *server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 1000
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	var cursor uint64
+	if since := query.Get("since"); since != "" {
+		parsed, err := parseChangeCursor(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cursor = parsed
+	} else if consumer := query.Get("consumer"); consumer != "" {
+		committed, err := GetChangeCursor(consumer)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Error fetching cursor: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if committed != nil {
+			cursor, _ = strconv.ParseUint(committed.Cursor, 10, 64)
+		}
+	}
+
+	feed, err := GetChanges(cursor, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching changes: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// setChangeCursorHandler commits the cursor a consumer has processed changes up to
+func (s *server) setChangeCursorHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Cursor string `json:"cursor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := strconv.ParseUint(body.Cursor, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid cursor %q", body.Cursor), http.StatusBadRequest)
+		return
+	}
+
+	record, err := SetChangeCursor(r.PathValue("consumer"), cursor)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving cursor: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, record)
+}
+
+// changeCursorsHandler serves the committed cursor of every consumer
+func (s *server) changeCursorsHandler(w http.ResponseWriter, r *http.Request) {
+	cursors, err := GetChangeCursors()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching cursors: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cursors)
+}
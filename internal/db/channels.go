@@ -0,0 +1,336 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Channel is a sales channel, e.g. web, showroom or marketplace, served the part of
+// the catalog its rules select, priced with its markup
+type Channel struct {
+	Name     string
+	Markup   float64            // Multiplier of the selling cost served as precio (0 serves no precio)
+	Includes []ChannelCondition // A product is served when it meets any of them, or when there are none
+	Excludes []ChannelCondition // A product meeting any of them is never served
+
+	Round  float64 // Step precio is rounded to, e.g. 0.01 or 10
+	Ending float64 // Ending precio is raised to within its step, e.g. 0.99; 0 rounds to the nearest step
+	Symbol string  // Currency symbol of precioFormateado
+	Format string  // Digit grouping of precioFormateado, one of numberFormats
+}
+
+// numberFormats are the thousands and decimal separators of each digit grouping
+var numberFormats = map[string][2]string{
+	"us": {",", "."}, // 1,234.99
+	"eu": {".", ","}, // 1.234,99
+	"si": {" ", ","}, // 1 234,99
+}
+
+// ChannelCondition matches products by one of their fields
+type ChannelCondition struct {
+	Kind   string   // sku, category, status, supplier or availability
+	Values []string // Matched ignoring case; values ending in * match as prefixes
+}
+
+// channelConditionKinds are the product fields channel conditions match
+var channelConditionKinds = []string{"sku", "category", "status", "supplier", "availability"}
+
+// ParseChannels parses semicolon separated name=rule,... channels, e.g.
+// "web=markup:2.2,!status:Discontinued;showroom=markup:2.5,category:UP|BD". Rules are:
+//
+//	markup:N           precio is the selling cost times N
+//	round:N            precio is rounded to a multiple of N (default 0.01, or 1 with ending:)
+//	ending:N           precio is raised to the next price ending in N, e.g. .99 or 9 with round:10
+//	symbol:S           precioFormateado starts with S (default $)
+//	format:us|eu|si    precioFormateado groups digits as 1,234.99, 1.234,99 or 1 234,99 (default us)
+//	sku:A|B*           the SKU is one of the values, * ending a prefix
+//	category:A|B       the itemSalesCategoryCodeKey is one of the values
+//	status:A|B         Ashley's status is one of the values
+//	supplier:A|B       the supplier is one of the values
+//	availability:A|B   disponibilidad (AVAILABILITY_RULES) is one of the values
+//
+// Conditions prefixed with ! exclude the products they match.
+func ParseChannels(s string) (map[string]*Channel, error) {
+	channels := make(map[string]*Channel)
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, rules, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid channel %q: expected name=rule,...", entry)
+		}
+		if _, exists := channels[name]; exists {
+			return nil, fmt.Errorf("channel %q defined twice", name)
+		}
+
+		channel := &Channel{Name: name, Symbol: "$", Format: "us"}
+		for _, rule := range strings.Split(rules, ",") {
+			if rule = strings.TrimSpace(rule); rule == "" {
+				continue
+			}
+			if value, ok := strings.CutPrefix(rule, "markup:"); ok {
+				markup, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || markup <= 0 {
+					return nil, fmt.Errorf("channel %s: markup must be a positive number, got %q", name, value)
+				}
+				channel.Markup = markup
+				continue
+			}
+			if value, ok := strings.CutPrefix(rule, "round:"); ok {
+				step, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || step < 0.01 {
+					return nil, fmt.Errorf("channel %s: round must be a number of at least 0.01, got %q", name, value)
+				}
+				channel.Round = step
+				continue
+			}
+			if value, ok := strings.CutPrefix(rule, "ending:"); ok {
+				ending, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || ending < 0 {
+					return nil, fmt.Errorf("channel %s: ending must be a non-negative number, got %q", name, value)
+				}
+				channel.Ending = ending
+				continue
+			}
+			if value, ok := strings.CutPrefix(rule, "symbol:"); ok {
+				channel.Symbol = strings.TrimSpace(value)
+				continue
+			}
+			if value, ok := strings.CutPrefix(rule, "format:"); ok {
+				value = strings.TrimSpace(value)
+				if _, ok := numberFormats[value]; !ok {
+					return nil, fmt.Errorf("channel %s: format must be us, eu or si, got %q", name, value)
+				}
+				channel.Format = value
+				continue
+			}
+			condition, negated, err := parseChannelCondition(rule)
+			if err != nil {
+				return nil, fmt.Errorf("channel %s: %v", name, err)
+			}
+			if negated {
+				channel.Excludes = append(channel.Excludes, condition)
+			} else {
+				channel.Includes = append(channel.Includes, condition)
+			}
+		}
+		if channel.Round == 0 {
+			channel.Round = 0.01
+			if channel.Ending > 0 {
+				channel.Round = 1
+			}
+		}
+		if channel.Ending >= channel.Round {
+			return nil, fmt.Errorf("channel %s: ending %v must be less than round %v", name, channel.Ending, channel.Round)
+		}
+		channels[name] = channel
+	}
+
+	return channels, nil
+}
+
+func parseChannelCondition(spec string) (ChannelCondition, bool, error) {
+	body, negated := strings.CutPrefix(spec, "!")
+	kind, values, found := strings.Cut(body, ":")
+	kind = strings.TrimSpace(kind)
+	if !found || !slices.Contains(channelConditionKinds, kind) {
+		return ChannelCondition{}, false, fmt.Errorf("unknown condition %q (available: markup:, round:, ending:, symbol:, format:, %s:)", spec, strings.Join(channelConditionKinds, ":, "))
+	}
+
+	condition := ChannelCondition{Kind: kind}
+	for _, value := range strings.Split(values, "|") {
+		if value = strings.TrimSpace(value); value != "" {
+			condition.Values = append(condition.Values, value)
+		}
+	}
+	if len(condition.Values) == 0 {
+		return ChannelCondition{}, false, fmt.Errorf("condition %q names no value", spec)
+	}
+	return condition, negated, nil
+}
+
+// matches reports whether the condition holds for a product
+func (c ChannelCondition) matches(product ProductResponseData) bool {
+	var value string
+	switch c.Kind {
+	case "sku":
+		value = product.Clave
+	case "category":
+		value = product.Categoria
+	case "status":
+		value = product.Descontinuado
+	case "supplier":
+		value = product.Proveedor
+	case "availability":
+		value = product.Disponibilidad
+	}
+	return scopeMatches(c.Values, value)
+}
+
+// serves reports whether the channel's rules select a product
+func (c *Channel) serves(product ProductResponseData) bool {
+	for _, condition := range c.Excludes {
+		if condition.matches(product) {
+			return false
+		}
+	}
+	if len(c.Includes) == 0 {
+		return true
+	}
+	for _, condition := range c.Includes {
+		if condition.matches(product) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the products the channel serves, priced with its markup. Products
+// without a price carry no precio.
+func (c *Channel) apply(response []ProductResponseData) []ProductResponseData {
+	served := make([]ProductResponseData, 0, len(response))
+	currency := sellingCurrency()
+	for _, product := range response {
+		if !c.serves(product) {
+			continue
+		}
+		if cost := productSellingCost(product); c.Markup > 0 && cost > 0 {
+			precio := c.round(cost * c.Markup)
+			product.Precio = &precio
+			product.Moneda = currency
+			product.PrecioFormateado = c.display(precio)
+		}
+		served = append(served, product)
+	}
+	return served
+}
+
+// round rounds a price to the channel's step, raising it to the next price with the
+// channel's ending when it has one
+func (c *Channel) round(price float64) float64 {
+	if c.Ending > 0 {
+		// The tolerance keeps prices already ending in it from moving up a step
+		steps := math.Ceil((price-c.Ending)/c.Round - 1e-9)
+		return roundCents(steps*c.Round + c.Ending)
+	}
+	return roundCents(math.Round(price/c.Round) * c.Round)
+}
+
+// decimals is the number of decimals precioFormateado shows: those of the step and
+// the ending, e.g. 2 for round:0.01 or ending:.99 and 0 for round:10
+func (c *Channel) decimals() int {
+	decimals := 0
+	for _, value := range []float64{c.Round, c.Ending} {
+		if _, fraction, found := strings.Cut(strconv.FormatFloat(value, 'f', -1, 64), "."); found {
+			decimals = max(decimals, len(fraction))
+		}
+	}
+	return min(decimals, 2)
+}
+
+// display formats a price with the channel's symbol and digit grouping, e.g. $1,299.99
+func (c *Channel) display(price float64) string {
+	separators := numberFormats[c.Format]
+	number := strconv.FormatFloat(price, 'f', c.decimals(), 64)
+	whole, fraction, _ := strings.Cut(number, ".")
+
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteString(separators[0])
+		}
+		grouped.WriteRune(digit)
+	}
+	if fraction != "" {
+		grouped.WriteString(separators[1])
+		grouped.WriteString(fraction)
+	}
+	return c.Symbol + grouped.String()
+}
+
+// productSellingCost is sellingCost of a built product: its landed cost when computed,
+// TotalNetPrice otherwise
+func productSellingCost(product ProductResponseData) float64 {
+	if product.CostoImportacion != nil {
+		return product.CostoImportacion.Total
+	}
+	return product.Costo2
+}
+
+// channelNames returns the names of the given channels, sorted
+func channelNames(channels map[string]*Channel) []string {
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// channelsHandler lists the configured channels
+func (s *server) channelsHandler(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}
+
+	// Markups are left out, as they give away the costs of keys not allowed to see them
+	entries := make([]entry, 0, len(s.config.Channels))
+	for _, name := range channelNames(s.config.Channels) {
+		entries = append(entries, entry{name, "/channels/" + name + "/products"})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// channelProductsHandler serves the products of a channel, priced with its markup.
+// Supports ?fields= and ?lang= as /products does.
+func (s *server) channelProductsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	channel, ok := s.config.Channels[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown channel %q (available: %s)", name, strings.Join(channelNames(s.config.Channels), ", ")), http.StatusNotFound)
+		return
+	}
+
+	fields, err := productFieldSelector.parse(requestSchema(r).canonicalFields(r.URL.Query().Get("fields")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusBadRequest)
+		return
+	}
+	profile := requestProfile(r)
+	fields, err = profile.restrictFields(productFieldSelector, fields)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusForbidden)
+		return
+	}
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response, ok := s.servedProducts(w, r, nil, date)
+	if !ok {
+		return
+	}
+
+	response = channel.apply(response)
+	localizeProducts(response, lang)
+	profile.redactProducts(response)
+	writeProductResponses(w, r, response, fields)
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+)
+
+// ChaosConfig injects faults into upstream API requests, to exercise retries, page
+// size tuning and the validation guards in staging before a real incident does.
+// Never enable it in production.
+type ChaosConfig struct {
+	Latency       time.Duration // Maximum random delay added before each request
+	ErrorRate     float64       // Fraction of requests failing with a retryable 503
+	MalformedRate float64       // Fraction of responses whose body is cut in half
+	EmptyRate     float64       // Fraction of responses replaced by a page without entities
+}
+
+// chaosEmptyPage is served in place of the response for the empty fault
+const chaosEmptyPage = `{"links":[],"metadata":{"totalRecords":0,"currentPageRecords":0},"entities":[]}`
+
+var chaosInjectedTotal = metrics.NewCounter("ashley_chaos_injected_total",
+	"Faults injected into upstream requests by chaos mode", "fault")
+
+// Enabled reports whether any fault is configured
+func (c ChaosConfig) Enabled() bool {
+	return c.Latency > 0 || c.ErrorRate > 0 || c.MalformedRate > 0 || c.EmptyRate > 0
+}
+
+// validate checks the rates are fractions
+func (c ChaosConfig) validate() []error {
+	var errs []error
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{
+		{"CHAOS_ERROR_RATE", c.ErrorRate},
+		{"CHAOS_MALFORMED_RATE", c.MalformedRate},
+		{"CHAOS_EMPTY_RATE", c.EmptyRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and 1, got %v", rate.name, rate.value))
+		}
+	}
+	if c.Latency < 0 {
+		errs = append(errs, fmt.Errorf("CHAOS_LATENCY must not be negative, got %v", c.Latency))
+	}
+	return errs
+}
+
+// chaosBeforeRequest delays a request by up to the configured latency and returns
+// the injected failure, if any
+func chaosBeforeRequest(ctx context.Context, c ChaosConfig, url string) error {
+	if c.Latency > 0 {
+		delay := rand.N(c.Latency + 1)
+		chaosInjectedTotal.Inc("latency")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if c.ErrorRate > 0 && rand.Float64() < c.ErrorRate {
+		chaosInjectedTotal.Inc("error")
+		log.Printf("Chaos: failing request to %s", url)
+		return fmt.Errorf("retryable HTTP error - status 503: chaos mode injected failure")
+	}
+
+	return nil
+}
+
+// chaosAfterResponse returns the body to decode in place of the received one
+func chaosAfterResponse(c ChaosConfig, url string, body []byte) []byte {
+	if c.EmptyRate > 0 && rand.Float64() < c.EmptyRate {
+		chaosInjectedTotal.Inc("empty")
+		log.Printf("Chaos: emptying response from %s", url)
+		return []byte(chaosEmptyPage)
+	}
+
+	if c.MalformedRate > 0 && rand.Float64() < c.MalformedRate {
+		chaosInjectedTotal.Inc("malformed")
+		log.Printf("Chaos: truncating response from %s", url)
+		return body[:len(body)/2]
+	}
+
+	return body
+}
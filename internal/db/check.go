@@ -0,0 +1,317 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of issues found by Check. Orphans are left behind by normal operation, e.g.
+// prices of products Ashley stopped listing or index entries of a changed UPC, and
+// don't fail a check.
+const (
+	CheckBolt   = "bolt"   // Bolt's consistency check of the file's pages
+	CheckDecode = "decode" // A value that doesn't open or doesn't unmarshal into its struct
+	CheckKey    = "key"    // A record stored under a key other than its own
+	CheckIndex  = "index"  // A record missing from an index, or indexed under another
+	CheckOrphan = "orphan" // A record or index entry whose record is gone
+)
+
+// maxCheckIssues caps the issues listed by a report; the rest are only counted
+const maxCheckIssues = 1000
+
+// CheckIssue is a problem found in a bucket
+type CheckIssue struct {
+	Kind   string `json:"kind"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// CheckReport is the outcome of Check
+type CheckReport struct {
+	CheckedAt time.Time      `json:"checkedAt"`
+	Values    map[string]int `json:"values"`  // Values checked per bucket
+	Counts    map[string]int `json:"counts"`  // Issues found per kind
+	Issues    []CheckIssue   `json:"issues"`  // The first maxCheckIssues
+	Omitted   int            `json:"omitted"` // Issues found past maxCheckIssues
+}
+
+// Failed reports whether the check found more than orphans
+func (r CheckReport) Failed() bool {
+	for kind, count := range r.Counts {
+		if kind != CheckOrphan && count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CheckReport) add(kind, bucket, key, format string, args ...any) {
+	r.Counts[kind]++
+	if len(r.Issues) == maxCheckIssues {
+		r.Omitted++
+		return
+	}
+	r.Issues = append(r.Issues, CheckIssue{Kind: kind, Bucket: bucket, Key: key, Detail: fmt.Sprintf(format, args...)})
+}
+
+// decodeAs unmarshals a stored value into a T
+func decodeAs[T any](data []byte) (any, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// checkedTypes decode the values of the buckets holding JSON of a known struct.
+// Catalogs imported for other suppliers hold SupplierProduct.
+var checkedTypes = map[string]func(data []byte) (any, error){
+	"products":             decodeAs[ProductRequestData],
+	"prices":               decodeAs[PriceRequestData],
+	inventoryBucketName:    decodeAs[InventoryRequestData],
+	contractsBucketName:    decodeAs[DiscountContract],
+	promotionsBucketName:   decodeAs[PromotionalPrice],
+	reservationsBucketName: decodeAs[Reservation],
+	blacklistBucketName:    decodeAs[BlacklistEntry],
+	replacementsBucketName: decodeAs[ReplacementOverride],
+	customsBucketName:      decodeAs[CustomsClassification],
+	quotesBucketName:       decodeAs[Quote],
+	similarBucketName:      decodeAs[SimilarProducts],
+	jobsBucketName:         decodeAs[Job],
+	changesBucketName:      decodeAs[ChangeRecord],
+	journalBucketName:      decodeAs[journalRecord],
+	auditBucketName:        decodeAs[AuditEntry],
+	versionIndexBucketName: decodeAs[CatalogVersion],
+}
+
+// checkedType returns the decoder of a bucket's values, false for buckets of
+// unstructured values such as indexes, hashes and compressed pages
+func checkedType(bucketName string) (func(data []byte) (any, error), bool) {
+	if decode, ok := checkedTypes[bucketName]; ok {
+		return decode, true
+	}
+	if supplier, ok := catalogSupplier(bucketName); ok && supplier != AshleySupplier {
+		return decodeAs[SupplierProduct], true
+	}
+	return nil, false
+}
+
+// Check validates the database file: bolt's consistency check of its pages, that
+// every stored value opens and unmarshals into its struct, that catalog records are
+// stored under their own SKU, that the UPC, dimension and version indexes agree with
+// the records they index, and which records lost the product or record they belong to.
+// It only reads, so it can run against a file suspected to be corrupt.
+func Check() (CheckReport, error) {
+	report := CheckReport{CheckedAt: time.Now(), Values: make(map[string]int), Counts: make(map[string]int), Issues: []CheckIssue{}}
+
+	db, err := openDB()
+	if err != nil {
+		return report, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			report.add(CheckBolt, "", "", "%v", err)
+		}
+		// Walking the buckets of a file with broken pages can panic
+		if report.Counts[CheckBolt] > 0 {
+			return nil
+		}
+
+		checker := &dbChecker{tx: tx, report: &report, indexed: make(map[string]map[string]bool)}
+		err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if isShard(tx, name) {
+				return nil // Checked with the bucket they belong to
+			}
+			return checker.checkBucket(string(name), bucket)
+		})
+		if err != nil {
+			return err
+		}
+		checker.checkIndexes()
+		checker.checkOrphans()
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error checking database: %v", err)
+	}
+	return report, nil
+}
+
+// dbChecker holds what a check learned about the records so far
+type dbChecker struct {
+	tx     *bolt.Tx
+	report *CheckReport
+	// Index keys the products expect, by index bucket, as key + "\x00" + SKU
+	indexed map[string]map[string]bool
+}
+
+// checkBucket opens and decodes every value of a bucket, or of the shards of a
+// sharded catalog bucket. Products record the index keys they expect.
+func (c *dbChecker) checkBucket(name string, bucket *bolt.Bucket) error {
+	decode, ok := checkedType(name)
+	if !ok {
+		return nil
+	}
+	catalog := catalogBucket(name)
+
+	each := bucket.ForEach
+	if catalog {
+		each = recordsOf(c.tx, name).ForEach
+	}
+	return each(func(k, v []byte) error {
+		if v == nil {
+			return nil // Nested bucket
+		}
+		c.report.Values[name]++
+
+		data, err := openValue(name, k, v)
+		if err != nil {
+			c.report.add(CheckDecode, name, string(k), "%v", err)
+			return nil
+		}
+		value, err := decode(data)
+		if err != nil {
+			c.report.add(CheckDecode, name, string(k), "%v", err)
+			return nil
+		}
+
+		if record, ok := value.(DatabaseEntity); ok && catalog {
+			if key := recordKey(record); key != string(k) {
+				c.report.add(CheckKey, name, string(k), "record of %s", key)
+			}
+		}
+		if product, ok := value.(ProductRequestData); ok && name == "products" {
+			for index, keys := range product.IndexKeys() {
+				if c.indexed[index] == nil {
+					c.indexed[index] = make(map[string]bool)
+				}
+				for _, key := range keys {
+					c.indexed[index][key+"\x00"+string(k)] = true
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// checkIndexes checks every product is found under its index keys, and that version
+// metadata has the snapshot it describes
+func (c *dbChecker) checkIndexes() {
+	indexes := slices.Sorted(maps.Keys(c.indexed))
+	for _, index := range indexes {
+		entries := c.indexed[index]
+		bucket := c.tx.Bucket([]byte(index))
+		for _, entry := range slices.Sorted(maps.Keys(entries)) {
+			key, sku, _ := strings.Cut(entry, "\x00")
+			var value []byte
+			if bucket != nil {
+				value = bucket.Get([]byte(key))
+			}
+			switch {
+			case value == nil:
+				c.report.add(CheckIndex, index, key, "missing, product %s carries it", sku)
+			case string(value) != sku && !entries[key+"\x00"+string(value)]:
+				c.report.add(CheckIndex, index, key, "points at %s, product %s carries it", value, sku)
+			}
+		}
+	}
+
+	if index := c.tx.Bucket([]byte(versionIndexBucketName)); index != nil {
+		versions := c.tx.Bucket([]byte(versionsBucketName))
+		index.ForEach(func(k, v []byte) error {
+			if len(k) == 8 && (versions == nil || versions.Get(k) == nil) {
+				c.report.add(CheckIndex, versionIndexBucketName, fmt.Sprint(binary.BigEndian.Uint64(k)), "snapshot missing from %s", versionsBucketName)
+			}
+			return nil
+		})
+	}
+}
+
+// checkOrphans reports index entries of products that no longer carry the key, and
+// the records kept for a product or record that is gone
+func (c *dbChecker) checkOrphans() {
+	for _, index := range []string{productsByUPCBucketName, productsByDimensionBucketName} {
+		bucket := c.tx.Bucket([]byte(index))
+		if bucket == nil {
+			continue
+		}
+		bucket.ForEach(func(k, v []byte) error {
+			if !c.indexed[index][string(k)+"\x00"+string(v)] {
+				c.report.add(CheckOrphan, index, string(k), "product %s is gone or no longer carries it", v)
+			}
+			return nil
+		})
+	}
+
+	products := recordsOf(c.tx, "products")
+	hasProduct := func(sku string) bool { return products != nil && products.Get([]byte(sku)) != nil }
+
+	// Prices, stock and reservations of products no longer stored
+	for _, name := range []string{"prices", inventoryBucketName, reservationsBucketName} {
+		bucket := c.tx.Bucket([]byte(name))
+		if bucket == nil {
+			continue
+		}
+		forEach := bucket.ForEach
+		if catalogBucket(name) {
+			forEach = recordsOf(c.tx, name).ForEach
+		}
+		forEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			data, err := openValue(name, k, v)
+			if err != nil {
+				return nil // Reported as undecodable
+			}
+			var fields scopeFields
+			if json.Unmarshal(data, &fields) == nil && fields.Sku != "" && !hasProduct(fields.Sku) {
+				c.report.add(CheckOrphan, name, string(k), "product %s is gone", fields.Sku)
+			}
+			return nil
+		})
+	}
+
+	// Raw records and hashes of records no longer stored
+	stored := func(bucketName, sku string) bool {
+		records := recordsOf(c.tx, bucketName)
+		return records != nil && records.Get([]byte(sku)) != nil
+	}
+	if bucket := c.tx.Bucket([]byte(rawEntitiesBucketName)); bucket != nil {
+		bucket.ForEach(func(k, v []byte) error {
+			sku, bucketName, _ := strings.Cut(string(k), "\x00")
+			if !stored(bucketName, sku) {
+				c.report.add(CheckOrphan, rawEntitiesBucketName, sku+" "+bucketName, "%s record is gone", bucketName)
+			}
+			return nil
+		})
+	}
+	if bucket := c.tx.Bucket([]byte(recordHashesBucketName)); bucket != nil {
+		bucket.ForEach(func(k, v []byte) error {
+			bucketName, sku, _ := strings.Cut(string(k), "\x00")
+			if !stored(bucketName, sku) {
+				c.report.add(CheckOrphan, recordHashesBucketName, bucketName+" "+sku, "%s record is gone", bucketName)
+			}
+			return nil
+		})
+	}
+
+	// Snapshots whose metadata is gone are no longer listed nor pruned
+	if versions := c.tx.Bucket([]byte(versionsBucketName)); versions != nil {
+		index := c.tx.Bucket([]byte(versionIndexBucketName))
+		versions.ForEach(func(k, v []byte) error {
+			if len(k) == 8 && (index == nil || index.Get(k) == nil) {
+				c.report.add(CheckOrphan, versionsBucketName, fmt.Sprint(binary.BigEndian.Uint64(k)), "not listed in %s", versionIndexBucketName)
+			}
+			return nil
+		})
+	}
+}
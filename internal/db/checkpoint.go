@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// checkpointsBucketName holds the progress of the fetchers of an interrupted sync, by bucket
+const checkpointsBucketName = "sync_checkpoints"
+
+// syncCheckpoint is how far a fetcher got in the last sync. Checkpoints are written as
+// pages are saved and cleared once every fetcher of a sync completes, so the ones left
+// belong to a sync that failed.
+type syncCheckpoint struct {
+	Offset   int       `json:"offset"`   // Records covered by the pages saved so far
+	RawPages int       `json:"rawPages"` // Raw pages stored so far
+	Entities int       `json:"entities"` // Records saved so far
+	Done     bool      `json:"done"`     // The fetcher reached its last page
+	At       time.Time `json:"at"`
+}
+
+// ResumeConfig controls the automatic resumption of failed syncs
+type ResumeConfig struct {
+	Cooldown    time.Duration // Wait before resuming a failed sync (0 disables resuming)
+	MaxAttempts int           // Resume attempts after a failed sync
+	// Postpone moves a resume due at a time when syncs aren't welcome, e.g. past a
+	// blackout window (nil resumes after Cooldown)
+	Postpone func(at time.Time) time.Time
+}
+
+type resumeContextKey struct{}
+
+// resuming reports whether a sync resumes an interrupted one from its checkpoints
+func resuming(ctx context.Context) bool {
+	resume, _ := ctx.Value(resumeContextKey{}).(bool)
+	return resume
+}
+
+// loadCheckpoint returns the checkpoint of a fetcher's bucket, nil when there is none
+func loadCheckpoint(db *store, bucketName string) (*syncCheckpoint, error) {
+	var checkpoint *syncCheckpoint
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(checkpointsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(bucketName))
+		if data == nil {
+			return nil
+		}
+		checkpoint = &syncCheckpoint{}
+		return json.Unmarshal(data, checkpoint)
+	})
+	return checkpoint, err
+}
+
+// saveCheckpoint records the progress of a fetcher
+func saveCheckpoint(db *store, bucketName string, checkpoint syncCheckpoint) error {
+	checkpoint.At = time.Now()
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(checkpointsBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(bucketName), data)
+	})
+}
+
+// completedBeforeResume reports whether a resuming sync can skip a fetcher, as it
+// completed before the sync was interrupted
+func completedBeforeResume(ctx context.Context, fetcher Syncer) (bool, error) {
+	if !resuming(ctx) {
+		return false, nil
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	checkpoint, err := loadCheckpoint(db, fetcher.BucketName())
+	if err != nil {
+		return false, fmt.Errorf("error reading sync checkpoint: %v", err)
+	}
+	return checkpoint != nil && checkpoint.Done, nil
+}
+
+// clearCheckpoints removes the checkpoints of the given fetchers
+func clearCheckpoints(fetchers []Syncer) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(checkpointsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		for _, fetcher := range fetchers {
+			if err := bucket.Delete([]byte(fetcher.BucketName())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hasCheckpoints reports whether an interrupted sync is left to resume
+func hasCheckpoints() (bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(checkpointsBucketName)); bucket != nil {
+			k, _ := bucket.Cursor().First()
+			found = k != nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// ResumableSync wraps a sync job so that when it fails, a job resuming it from the
+// checkpoints of its fetchers is queued after the cooldown, up to MaxAttempts times.
+// A sync deferred by upstream maintenance is resumed once the maintenance ends instead,
+// without counting as an attempt. Canceled syncs aren't resumed, and neither are syncs
+// another sync completed since.
+func ResumableSync(jobs *JobQueue, config ResumeConfig, sync JobFunc) JobFunc {
+	var attempt func(n int, resume bool) JobFunc
+	attempt = func(n int, resume bool) JobFunc {
+		return func(ctx context.Context) error {
+			if resume {
+				pending, err := hasCheckpoints()
+				if err != nil {
+					return err
+				}
+				if !pending {
+					log.Print("Nothing to resume, a sync completed since the failed one")
+					return nil
+				}
+				ctx = context.WithValue(ctx, resumeContextKey{}, true)
+			}
+
+			err := sync(ctx)
+			if err == nil || config.Cooldown <= 0 || errors.Is(err, context.Canceled) {
+				return err
+			}
+
+			if until, deferred := DeferredUntil(err); deferred {
+				wait := config.postponed(time.Until(until))
+				log.Printf("Upstream under maintenance, resuming the sync in %v", wait)
+				resumeAfter(jobs, wait, attempt(n, true))
+				return err
+			}
+			if n >= config.MaxAttempts {
+				return err
+			}
+
+			wait := config.postponed(config.Cooldown)
+			log.Printf("Sync failed, resuming it in %v (attempt %d of %d)", wait, n+1, config.MaxAttempts)
+			resumeAfter(jobs, wait, attempt(n+1, true))
+			return err
+		}
+	}
+	return attempt(0, false)
+}
+
+// postponed returns the wait before a resume due after wait, moved by Postpone
+func (c ResumeConfig) postponed(wait time.Duration) time.Duration {
+	if c.Postpone == nil {
+		return wait
+	}
+	return time.Until(c.Postpone(time.Now().Add(wait))).Round(time.Second)
+}
+
+// resumeAfter queues a resume job once wait elapsed
+func resumeAfter(jobs *JobQueue, wait time.Duration, resume JobFunc) {
+	time.AfterFunc(wait, func() {
+		if _, err := jobs.Enqueue("sync", TriggerResume, resume); err != nil {
+			log.Printf("Error queueing sync resume: %v", err)
+		}
+	})
+}
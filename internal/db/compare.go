@@ -0,0 +1,130 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// maxCompareSKUs caps the products of a comparison
+const maxCompareSKUs = 20
+
+// ComparisonResponseData sets products side by side
+type ComparisonResponseData = api.Comparison
+
+// ComparedProductResponseData is a product of a comparison
+type ComparedProductResponseData = api.ComparedProduct
+
+var comparedFieldSelector = newFieldSelector(reflect.TypeOf(ComparedProductResponseData{}))
+
+// newComparedProduct takes the compared fields of a built product, pricing it for the
+// tier when there is one
+func newComparedProduct(product ProductResponseData, tier *PriceTier) ComparedProductResponseData {
+	compared := ComparedProductResponseData{
+		Clave:             product.Clave,
+		Nombre:            product.Nombre,
+		Categoria:         product.Categoria,
+		Descontinuado:     product.Descontinuado,
+		Alto:              product.Alto,
+		Largo:             product.Largo,
+		Ancho:             product.Ancho,
+		Volumen:           roundVolume(product.Alto * product.Largo * product.Ancho / 1e9),
+		Peso:              product.Peso,
+		Empaque:           product.Empaque,
+		Costo:             product.Costo,
+		Costo2:            product.Costo2,
+		Promocion:         product.Promocion,
+		Disponible:        product.Disponible,
+		Disponibilidad:    product.Disponibilidad,
+		TiempoEntregaDias: product.TiempoEntregaDias,
+	}
+	if cost := productSellingCost(product); tier != nil && cost > 0 {
+		precio := roundCents(cost * tier.markup(ProductRequestData{ItemSalesCategoryCodeKey: product.Categoria}))
+		compared.Precio = &precio
+		compared.Moneda = sellingCurrency()
+	}
+	return compared
+}
+
+// comparisonDifferences returns the fields, besides clave and nombre, whose value
+// isn't the same for every product, in declaration order
+func comparisonDifferences(products []ComparedProductResponseData) []string {
+	differences := []string{}
+	if len(products) < 2 {
+		return differences
+	}
+	for _, name := range comparedFieldSelector.names {
+		if name == "clave" || name == "nombre" {
+			continue
+		}
+		index := comparedFieldSelector.fields[name].index
+		first := reflect.ValueOf(products[0]).Field(index).Interface()
+		for _, product := range products[1:] {
+			if !reflect.DeepEqual(first, reflect.ValueOf(product).Field(index).Interface()) {
+				differences = append(differences, name)
+				break
+			}
+		}
+	}
+	return differences
+}
+
+// compareProductsHandler serves the products of ?skus=A,B,C side by side: dimensions,
+// weights, packaging, prices and availability, with the fields that differ. Prices
+// follow ?date= and ?tier= (or the API key's tier) as in /products and price lists.
+func (s *server) compareProductsHandler(w http.ResponseWriter, r *http.Request) {
+	skus, err := parseSKUs(r.URL.Query().Get("skus"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid skus: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(skus) < 2 || len(skus) > maxCompareSKUs {
+		http.Error(w, fmt.Sprintf("Invalid skus: compare between 2 and %d SKUs", maxCompareSKUs), http.StatusBadRequest)
+		return
+	}
+	tier, ok := s.requestTier(w, r)
+	if !ok {
+		return
+	}
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response, ok := s.servedProducts(w, r, skus, date)
+	if !ok {
+		return
+	}
+	localizeProducts(response, lang)
+
+	comparison := ComparisonResponseData{Productos: make([]ComparedProductResponseData, 0, len(response))}
+	found := make(map[string]bool, len(response))
+	for _, product := range response {
+		comparison.Productos = append(comparison.Productos, newComparedProduct(product, tier))
+		found[product.Clave] = true
+	}
+	for _, sku := range skus {
+		if !found[sku] {
+			comparison.Faltantes = append(comparison.Faltantes, sku)
+		}
+	}
+
+	// Fields the key doesn't see aren't listed as differing either, and are named as
+	// the request's schema names them
+	profile := requestProfile(r)
+	differences := slices.DeleteFunc(comparisonDifferences(comparison.Productos), func(name string) bool {
+		return profile != nil && profile.Hidden[name]
+	})
+	comparison.Diferencias = requestSchema(r).columns(differences)
+
+	writeRedactedJSON(w, r, http.StatusOK, comparison)
+}
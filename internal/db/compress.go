@@ -0,0 +1,81 @@
+package db
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressedResponseWriter sends the response body through an encoder
+type compressedResponseWriter struct {
+	http.ResponseWriter
+	encoder io.WriteCloser
+}
+
+func (w *compressedResponseWriter) Write(p []byte) (int, error) {
+	return w.encoder.Write(p)
+}
+
+// WriteHeader drops the Content-Length set by the handler, which is the uncompressed length
+func (w *compressedResponseWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// compressed wraps a handler to compress its response with brotli or gzip,
+// whichever the client accepts, preferring brotli
+func compressed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		var encoder io.WriteCloser
+		switch negotiateEncoding(r.Header.Get("Accept-Encoding")) {
+		case "br":
+			encoder = brotli.NewWriterLevel(w, brotli.DefaultCompression)
+			w.Header().Set("Content-Encoding", "br")
+		case "gzip":
+			encoder = gzip.NewWriter(w)
+			w.Header().Set("Content-Encoding", "gzip")
+		default:
+			handler(w, r)
+			return
+		}
+		defer encoder.Close()
+
+		handler(&compressedResponseWriter{ResponseWriter: w, encoder: encoder}, r)
+	}
+}
+
+// negotiateEncoding picks br or gzip from an Accept-Encoding header, honoring q-values.
+// Returns an empty string when neither is acceptable.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		// Prefer brotli on equal weight
+		if q > bestQ || (q == bestQ && q > 0 && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+
+	return best
+}
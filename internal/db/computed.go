@@ -0,0 +1,412 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ComputedField is a response field calculated from the numeric fields of a
+// product and its price, e.g. precioPublico = totalNetPrice * 1.35 * 1.16
+type ComputedField struct {
+	Name string
+	Expr string
+	eval expr
+}
+
+// computedFields are added to every product response under calculados
+var computedFields []ComputedField
+
+// computedSignature identifies the configured fields so cached responses built
+// with a different configuration are not served
+var computedSignature string
+
+// SetComputedFields enables the given computed fields in product responses
+func SetComputedFields(fields []ComputedField) {
+	computedFields = fields
+
+	var spec strings.Builder
+	for _, field := range fields {
+		fmt.Fprintf(&spec, "%s=%s;", field.Name, field.Expr)
+	}
+	if spec.Len() == 0 {
+		computedSignature = ""
+		return
+	}
+	sum := sha256.Sum256([]byte(spec.String()))
+	computedSignature = hex.EncodeToString(sum[:4])
+}
+
+// computedVariables are the names usable in expressions: the numeric JSON fields of
+// stored products and prices, bare or qualified as product.x and price.x
+var computedVariables = func() map[string]bool {
+	names := make(map[string]bool)
+	for prefix, t := range map[string]reflect.Type{
+		"product": reflect.TypeOf(ProductRequestData{}),
+		"price":   reflect.TypeOf(PriceRequestData{}),
+	} {
+		for _, name := range numericFields(t) {
+			names[name] = true
+			names[prefix+"."+name] = true
+		}
+	}
+	return names
+}()
+
+// numericFields returns the JSON names of the int and float fields of a struct type
+func numericFields(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		switch t.Field(i).Type.Kind() {
+		case reflect.Int, reflect.Float64:
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseComputedFields parses semicolon separated name=expression pairs, e.g.
+// "precioPublico=round(totalNetPrice*1.35*1.16, 2);volumen=unitHeightMm*unitWidthMm*unitDepthMm/1e9".
+// Expressions support + - * /, parentheses, numbers, field names and round, min, max and abs.
+func ParseComputedFields(s string) ([]ComputedField, error) {
+	var fields []ComputedField
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, exprStr, found := strings.Cut(entry, "=")
+		name, exprStr = strings.TrimSpace(name), strings.TrimSpace(exprStr)
+		if !found || name == "" || exprStr == "" {
+			return nil, fmt.Errorf("invalid computed field %q: expected name=expression", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("computed field %q defined twice", name)
+		}
+		seen[name] = true
+
+		eval, err := parseExpr(exprStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression for computed field %s: %v", name, err)
+		}
+		fields = append(fields, ComputedField{Name: name, Expr: exprStr, eval: eval})
+	}
+
+	return fields, nil
+}
+
+// computeFields evaluates the computed fields for a product and its price (nil when
+// unpriced). Fields referring to missing price data or without a finite result are
+// left out rather than reported as zero.
+func computeFields(product ProductRequestData, price *PriceRequestData) map[string]float64 {
+	if len(computedFields) == 0 {
+		return nil
+	}
+
+	productValues := reflect.ValueOf(product)
+	var priceValues reflect.Value
+	if price != nil {
+		priceValues = reflect.ValueOf(*price)
+	}
+
+	lookup := func(name string) (float64, bool) {
+		prefix, field, qualified := strings.Cut(name, ".")
+		if !qualified {
+			field = name
+		}
+		// Bare names prefer the price, since that's what most formulas are about
+		if (!qualified || prefix == "price") && priceValues.IsValid() {
+			if v, ok := numericField(priceValues, field); ok {
+				return v, true
+			}
+		}
+		if !qualified || prefix == "product" {
+			return numericField(productValues, field)
+		}
+		return 0, false
+	}
+
+	results := make(map[string]float64, len(computedFields))
+	for _, field := range computedFields {
+		value, ok := field.eval(lookup)
+		if ok && !math.IsNaN(value) && !math.IsInf(value, 0) {
+			results[field.Name] = value
+		}
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+	return results
+}
+
+// numericField reads a numeric field of a struct value by its JSON name
+func numericField(v reflect.Value, name string) (float64, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fieldName, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if fieldName != name {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Int:
+			return float64(f.Int()), true
+		case reflect.Float64:
+			return f.Float(), true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// expr evaluates to a number given a variable lookup, or reports false when a
+// variable is missing
+type expr func(lookup func(string) (float64, bool)) (float64, bool)
+
+// exprParser is a recursive descent parser over
+//
+//	expression = term { ("+" | "-") term }
+//	term       = factor { ("*" | "/") factor }
+//	factor     = ["-"] ( number | name | name "(" args ")" | "(" expression ")" )
+type exprParser struct {
+	src string
+	pos int
+}
+
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{src: s}
+	e, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos:], p.pos+1)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept consumes c when it is the next non-space character
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expression() (expr, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return left, nil
+		}
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func (p *exprParser) term() (expr, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		default:
+			return left, nil
+		}
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func (p *exprParser) factor() (expr, error) {
+	if p.accept('-') {
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(lookup func(string) (float64, bool)) (float64, bool) {
+			v, ok := operand(lookup)
+			return -v, ok
+		}, nil
+	}
+
+	if p.accept('(') {
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos+1)
+		}
+		return inner, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || strings.ContainsRune(".eE", rune(p.src[p.pos])) ||
+			((p.src[p.pos] == '+' || p.src[p.pos] == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E'))) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return func(func(string) (float64, bool)) (float64, bool) { return n, true }, nil
+	}
+
+	for p.pos < len(p.src) && (isNameChar(p.src[p.pos]) || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos+1)
+	}
+
+	if p.accept('(') {
+		return p.call(name)
+	}
+
+	if !computedVariables[name] {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	return func(lookup func(string) (float64, bool)) (float64, bool) { return lookup(name) }, nil
+}
+
+// call parses the arguments of a function whose name and "(" were consumed
+func (p *exprParser) call(name string) (expr, error) {
+	var args []expr
+	if !p.accept(')') {
+		for {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(')') {
+				break
+			}
+			if !p.accept(',') {
+				return nil, fmt.Errorf("expected , or ) in call to %s at position %d", name, p.pos+1)
+			}
+		}
+	}
+
+	var fn func(values []float64) float64
+	switch name {
+	case "round":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, fmt.Errorf("round takes a value and optional digits")
+		}
+		fn = func(values []float64) float64 {
+			scale := 1.0
+			if len(values) == 2 {
+				scale = math.Pow(10, math.Round(values[1]))
+			}
+			return math.Round(values[0]*scale) / scale
+		}
+	case "min", "max":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s takes at least two values", name)
+		}
+		pick := math.Min
+		if name == "max" {
+			pick = math.Max
+		}
+		fn = func(values []float64) float64 {
+			result := values[0]
+			for _, v := range values[1:] {
+				result = pick(result, v)
+			}
+			return result
+		}
+	case "abs":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("abs takes one value")
+		}
+		fn = func(values []float64) float64 { return math.Abs(values[0]) }
+	default:
+		return nil, fmt.Errorf("unknown function %q (available: round, min, max, abs)", name)
+	}
+
+	return func(lookup func(string) (float64, bool)) (float64, bool) {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			v, ok := arg(lookup)
+			if !ok {
+				return 0, false
+			}
+			values[i] = v
+		}
+		return fn(values), true
+	}, nil
+}
+
+func binaryOp(op byte, left, right expr) expr {
+	return func(lookup func(string) (float64, bool)) (float64, bool) {
+		l, ok := left(lookup)
+		if !ok {
+			return 0, false
+		}
+		r, ok := right(lookup)
+		if !ok {
+			return 0, false
+		}
+		switch op {
+		case '+':
+			return l + r, true
+		case '-':
+			return l - r, true
+		case '*':
+			return l * r, true
+		default:
+			return l / r, true
+		}
+	}
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isNameChar(c byte) bool { return c == '_' || unicode.IsLetter(rune(c)) || isDigit(c) }
@@ -0,0 +1,281 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+// skuConflictsBucketName holds the SKUs found in the catalog of more than one supplier
+const skuConflictsBucketName = "sku_conflicts"
+
+// skuPrecedence lists the suppliers whose record wins a SKU collision, highest first.
+// Unlisted suppliers rank after the listed ones, by name.
+var skuPrecedence = []string{AshleySupplier}
+
+// precedenceSignature identifies a non-default precedence so cached catalogs merged
+// with a different one are not served
+var precedenceSignature string
+
+var skuConflictsTotal = metrics.NewCounter("ashley_sku_conflicts_total",
+	"Saved catalog records whose SKU another supplier's catalog also holds", "supplier")
+
+// SkuConflict is a SKU held by the catalogs of several suppliers. Only the winner's
+// record is served in /products.
+type SkuConflict struct {
+	Sku       string    `json:"sku"`
+	Suppliers []string  `json:"suppliers"` // Suppliers holding the SKU, in precedence order
+	Winner    string    `json:"winner"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"` // Last save of one of the colliding records
+}
+
+// SetSKUPrecedence sets the suppliers winning SKU collisions, highest first
+func SetSKUPrecedence(suppliers []string) {
+	skuPrecedence = nil
+	for _, supplier := range suppliers {
+		if supplier = strings.TrimSpace(supplier); supplier != "" && !slices.Contains(skuPrecedence, supplier) {
+			skuPrecedence = append(skuPrecedence, supplier)
+		}
+	}
+	if len(skuPrecedence) == 0 {
+		skuPrecedence = []string{AshleySupplier}
+	}
+
+	precedenceSignature = ""
+	if !slices.Equal(skuPrecedence, []string{AshleySupplier}) {
+		sum := sha256.Sum256([]byte(strings.Join(skuPrecedence, ",")))
+		precedenceSignature = hex.EncodeToString(sum[:4])
+	}
+}
+
+// sortByPrecedence orders suppliers from the winner of a collision down
+func sortByPrecedence(suppliers []string) {
+	rank := func(supplier string) int {
+		if i := slices.Index(skuPrecedence, supplier); i >= 0 {
+			return i
+		}
+		return len(skuPrecedence)
+	}
+	sort.Slice(suppliers, func(i, j int) bool {
+		ri, rj := rank(suppliers[i]), rank(suppliers[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return suppliers[i] < suppliers[j]
+	})
+}
+
+// catalogSupplier returns the supplier whose catalog a bucket holds: Ashley's products
+// or a supplier:<name> bucket
+func catalogSupplier(bucketName string) (string, bool) {
+	if bucketName == "products" {
+		return AshleySupplier, true
+	}
+	if name, ok := strings.CutPrefix(bucketName, supplierBucketPrefix); ok && !strings.Contains(name, ":") {
+		return name, true
+	}
+	return "", false
+}
+
+// conflictDetector checks the SKUs saved into a catalog bucket against the catalogs
+// of the other suppliers
+type conflictDetector struct {
+	tx       *bolt.Tx
+	supplier string
+	others   map[string]*records // Catalog buckets of the other suppliers by supplier
+}
+
+// newConflictDetector returns a detector for saves into bucketName, nil when the bucket
+// holds no catalog
+func newConflictDetector(tx *bolt.Tx, bucketName string) (*conflictDetector, error) {
+	supplier, ok := catalogSupplier(bucketName)
+	if !ok {
+		return nil, nil
+	}
+
+	detector := &conflictDetector{tx: tx, supplier: supplier, others: make(map[string]*records)}
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if other, ok := catalogSupplier(string(name)); ok && other != supplier {
+			detector.others[other] = recordsOf(tx, string(name))
+		}
+		return nil
+	})
+	return detector, err
+}
+
+// check records a conflict when another supplier's catalog holds sku, and clears the
+// conflict recorded for it when none does anymore
+func (d *conflictDetector) check(sku string) error {
+	suppliers := []string{d.supplier}
+	for other, bucket := range d.others {
+		if bucket.Get([]byte(sku)) != nil {
+			suppliers = append(suppliers, other)
+		}
+	}
+
+	bucket, err := d.tx.CreateBucketIfNotExists([]byte(skuConflictsBucketName))
+	if err != nil {
+		return err
+	}
+	stored := bucket.Get([]byte(sku))
+
+	if len(suppliers) == 1 {
+		if stored == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(sku))
+	}
+
+	sortByPrecedence(suppliers)
+	now := time.Now()
+	conflict := SkuConflict{Sku: sku, Suppliers: suppliers, Winner: suppliers[0], FirstSeen: now, LastSeen: now}
+	if stored != nil {
+		var previous SkuConflict
+		if err := json.Unmarshal(stored, &previous); err != nil {
+			return err
+		}
+		conflict.FirstSeen = previous.FirstSeen
+	} else {
+		log.Printf("SKU collision: %s is in the catalogs of %s, serving %s's", sku, strings.Join(suppliers, ", "), conflict.Winner)
+	}
+	skuConflictsTotal.Inc(d.supplier)
+
+	data, err := json.Marshal(conflict)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(sku), data)
+}
+
+// shadowedBy returns the winner of a collision over sku for supplier's record, or ""
+// when the record is served
+func shadowedBy(sku, supplier string, holders map[string][]string) string {
+	suppliers := holders[sku]
+	if len(suppliers) < 2 {
+		return ""
+	}
+	sorted := slices.Clone(suppliers)
+	sortByPrecedence(sorted)
+	if sorted[0] == supplier {
+		return ""
+	}
+	return sorted[0]
+}
+
+// resolveCollisions drops the Ashley and supplier products losing a SKU collision, so
+// the merged catalog holds each SKU once
+func resolveCollisions(products []ProductRequestData, imported map[string][]SupplierProduct) ([]ProductRequestData, []SupplierProduct) {
+	holders := make(map[string][]string)
+	for _, product := range products {
+		holders[product.Sku] = append(holders[product.Sku], AshleySupplier)
+	}
+	suppliers := make([]string, 0, len(imported))
+	for supplier, catalog := range imported {
+		suppliers = append(suppliers, supplier)
+		for _, product := range catalog {
+			holders[product.Sku] = append(holders[product.Sku], supplier)
+		}
+	}
+	sort.Strings(suppliers)
+
+	products = slices.DeleteFunc(products, func(product ProductRequestData) bool {
+		return shadowedBy(product.Sku, AshleySupplier, holders) != ""
+	})
+	var served []SupplierProduct
+	for _, supplier := range suppliers {
+		for _, product := range imported[supplier] {
+			if shadowedBy(product.Sku, supplier, holders) == "" {
+				served = append(served, product)
+			}
+		}
+	}
+	return products, served
+}
+
+// GetSkuConflicts returns the recorded SKU collisions still present, with the suppliers
+// currently holding each SKU
+func GetSkuConflicts() ([]SkuConflict, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	conflicts := []SkuConflict{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(skuConflictsBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		catalogs := make(map[string]*records)
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if supplier, ok := catalogSupplier(string(name)); ok {
+				catalogs[supplier] = recordsOf(tx, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var conflict SkuConflict
+			if err := json.Unmarshal(v, &conflict); err != nil {
+				return fmt.Errorf("error decoding SKU conflict %s: %v", k, err)
+			}
+
+			// A colliding record may have been removed since
+			conflict.Suppliers = conflict.Suppliers[:0]
+			for supplier, catalog := range catalogs {
+				if catalog.Get(k) != nil {
+					conflict.Suppliers = append(conflict.Suppliers, supplier)
+				}
+			}
+			if len(conflict.Suppliers) < 2 {
+				return nil
+			}
+			sortByPrecedence(conflict.Suppliers)
+			conflict.Winner = conflict.Suppliers[0]
+			conflicts = append(conflicts, conflict)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading SKU conflicts: %v", err)
+	}
+
+	return conflicts, nil
+}
+
+// skuConflictsHandler serves the SKUs held by more than one supplier's catalog and
+// which supplier's record is served, optionally only those of ?supplier=
+func (s *server) skuConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	conflicts, err := GetSkuConflicts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching SKU conflicts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if supplier := r.URL.Query().Get("supplier"); supplier != "" {
+		conflicts = slices.DeleteFunc(conflicts, func(conflict SkuConflict) bool {
+			return !slices.Contains(conflict.Suppliers, supplier)
+		})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Precedence []string      `json:"precedence"`
+		Conflicts  []SkuConflict `json:"conflicts"`
+	}{skuPrecedence, conflicts})
+}
@@ -0,0 +1,368 @@
+package db
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// contractsBucketName holds the negotiated discount schedule, synced from Ashley's
+// contract endpoint or imported with POST /admin/contracts
+const contractsBucketName = "contracts"
+
+// DiscountContract is a negotiated discount on Ashley's base price for the products
+// of a category, a series, or a series within a category. Leaving both empty makes
+// it the discount of every product without a more specific one.
+type DiscountContract struct {
+	Category string  `json:"category,omitempty"` // itemSalesCategoryCodeKey
+	Series   string  `json:"series,omitempty"`   // seriesId
+	Discount float64 `json:"discount"`           // Fraction of basePrice
+	Contract string  `json:"contract,omitempty"` // Contract number, for reference
+}
+
+// GetSKU returns the key of the contract: its category and series
+func (c DiscountContract) GetSKU() string { return c.Category + "/" + c.Series }
+
+// validate checks the discount is a fraction
+func (c DiscountContract) validate() error {
+	if c.Discount < 0 || c.Discount >= 1 {
+		return fmt.Errorf("discount must be at least 0 and below 1, got %v", c.Discount)
+	}
+	return nil
+}
+
+// Contract is a discount schedule entry as Ashley's contract endpoint returns it,
+// with the discount in percent
+type Contract struct {
+	ContractNumber           string `json:"contractNumber"`
+	ItemSalesCategoryCodeKey string `json:"itemSalesCategoryCodeKey"`
+	SeriesId                 string `json:"seriesId"`
+	DiscountPercent          string `json:"discountPercent"`
+}
+
+func (c Contract) GetSKU() string { return c.ItemSalesCategoryCodeKey + "/" + c.SeriesId }
+
+type ContractAPIResponse struct {
+	Links    []Link     `json:"links"`
+	Metadata Metadata   `json:"metadata"`
+	Entities []Contract `json:"entities"`
+}
+
+// ContractFetcher syncs the account's discount schedule. It is optional: enable it
+// by listing contracts in API_FETCHERS.
+type ContractFetcher struct{}
+
+func (f ContractFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[Contract], error) {
+	url := fmt.Sprintf("%s/Contracts?Customer=%s&Limit=%d&Page=%d",
+		config.BaseURL, config.Customer, config.Limit, page)
+
+	response, raw, err := makeHTTPRequest[ContractAPIResponse](ctx, url, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GenericAPIResponse[Contract]{
+		Links:    response.Links,
+		Metadata: response.Metadata,
+		Entities: response.Entities,
+		Raw:      raw,
+	}, nil
+}
+
+func (f ContractFetcher) Transform(entity Contract) DatabaseEntity {
+	percent, _ := parseFloat(entity.DiscountPercent)
+	return DiscountContract{
+		Category: strings.TrimSpace(entity.ItemSalesCategoryCodeKey),
+		Series:   strings.TrimSpace(entity.SeriesId),
+		Discount: percent / 100,
+		Contract: entity.ContractNumber,
+	}
+}
+
+func (f ContractFetcher) GetBucketName() string { return contractsBucketName }
+func (f ContractFetcher) GetEndpoint() string   { return "Contracts" }
+
+// GetContracts returns the stored discount schedule, sorted by category and series
+func GetContracts() ([]DiscountContract, error) {
+	contracts, err := GetAllEntities[DiscountContract](contractsBucketName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i].GetSKU() < contracts[j].GetSKU() })
+	return contracts, nil
+}
+
+// contractSchedule finds the discount of a product among the contracts
+type contractSchedule map[string]DiscountContract
+
+func newContractSchedule(contracts []DiscountContract) contractSchedule {
+	schedule := make(contractSchedule, len(contracts))
+	for _, contract := range contracts {
+		schedule[contract.GetSKU()] = contract
+	}
+	return schedule
+}
+
+// match returns the most specific contract of a product: the one of its series within
+// its category, then of its series, of its category, and finally the catch-all one
+func (s contractSchedule) match(product ProductRequestData) (DiscountContract, bool) {
+	for _, key := range []string{
+		product.ItemSalesCategoryCodeKey + "/" + product.SeriesId,
+		"/" + product.SeriesId,
+		product.ItemSalesCategoryCodeKey + "/",
+		"/",
+	} {
+		if contract, ok := s[key]; ok {
+			return contract, true
+		}
+	}
+	return DiscountContract{}, false
+}
+
+// cost returns the contract cost of a priced product: its basePrice less the contract
+// discount, nil when no contract applies or Ashley sent no base price
+func (s contractSchedule) cost(product ProductRequestData, price PriceRequestData) *float64 {
+	contract, ok := s.match(product)
+	if !ok || price.BasePrice <= 0 {
+		return nil
+	}
+	cost := roundCents(price.BasePrice * (1 - contract.Discount))
+	return &cost
+}
+
+// applyContracts sets costoContrato on the responses built from products, in the same
+// order, by the stored discount schedule
+func applyContracts(response []ProductResponseData, products []ProductRequestData, priceMap map[string]PriceRequestData) error {
+	contracts, err := GetContracts()
+	if err != nil {
+		return fmt.Errorf("error fetching contracts: %v", err)
+	}
+	if len(contracts) == 0 {
+		return nil
+	}
+
+	schedule := newContractSchedule(contracts)
+	for i, product := range products {
+		if price, ok := priceMap[product.Sku]; ok {
+			response[i].CostoContrato = schedule.cost(product, price)
+		}
+	}
+	return nil
+}
+
+// ContractImportResult summarizes an import of the discount schedule
+type ContractImportResult struct {
+	Imported int    `json:"imported"`
+	Removed  int    `json:"removed"`
+	Run      string `json:"run"` // Journal run of the import
+}
+
+// ImportContracts stores discount contracts, replacing the ones for the same category
+// and series. With replace set, stored contracts missing from contracts are removed,
+// including synced ones.
+func ImportContracts(contracts []DiscountContract, replace bool, validation ValidationConfig) (ContractImportResult, error) {
+	db, err := openDB()
+	if err != nil {
+		return ContractImportResult{}, err
+	}
+	defer db.Close()
+
+	run, err := newRun(SourceImport)
+	if err != nil {
+		return ContractImportResult{}, err
+	}
+
+	result := ContractImportResult{Imported: len(contracts), Run: run.ID}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := createRecords(tx, contractsBucketName)
+		if err != nil {
+			return err
+		}
+
+		identity := func(c DiscountContract) DatabaseEntity { return c }
+		if _, err := putEntities(tx, run, contractsBucketName, contracts, identity, validation); err != nil {
+			return err
+		}
+
+		if !replace {
+			return nil
+		}
+
+		imported := make(map[string]bool, len(contracts))
+		for _, contract := range contracts {
+			imported[contract.GetSKU()] = true
+		}
+
+		var removed []string
+		err = bucket.ForEach(func(k, v []byte) error {
+			if !imported[string(k)] {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range removed {
+			if err := deleteRecord(tx, run, bucket, contractsBucketName, key); err != nil {
+				return err
+			}
+		}
+		result.Removed = len(removed)
+
+		return nil
+	})
+
+	if err != nil {
+		return ContractImportResult{}, err
+	}
+
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// decodeContracts reads the uploaded contracts as a JSON array or as CSV with a
+// header row naming the category, series, discount and contract columns
+func decodeContracts(r *http.Request) ([]DiscountContract, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var contracts []DiscountContract
+	switch mediaType {
+	case "application/json", "":
+		if err := json.NewDecoder(r.Body).Decode(&contracts); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "text/csv":
+		var err error
+		if contracts, err = decodeContractsCSV(r.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q: use application/json or text/csv", mediaType)
+	}
+
+	seen := make(map[string]int, len(contracts))
+	for i := range contracts {
+		contracts[i].Category = strings.TrimSpace(contracts[i].Category)
+		contracts[i].Series = strings.TrimSpace(contracts[i].Series)
+		if err := contracts[i].validate(); err != nil {
+			return nil, fmt.Errorf("contract %d: %v", i+1, err)
+		}
+		if previous, ok := seen[contracts[i].GetSKU()]; ok {
+			return nil, fmt.Errorf("contracts %d and %d share category %q and series %q",
+				previous+1, i+1, contracts[i].Category, contracts[i].Series)
+		}
+		seen[contracts[i].GetSKU()] = i
+	}
+
+	return contracts, nil
+}
+
+// contractColumns are the CSV columns of a contract import
+var contractColumns = []string{"category", "series", "discount", "contract"}
+
+// decodeContractsCSV converts CSV rows into contracts. Only the discount column is
+// required.
+func decodeContractsCSV(body io.Reader) ([]DiscountContract, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		if !slices.Contains(contractColumns, column) {
+			return nil, fmt.Errorf("unknown CSV column %s; valid columns are %s", column, strings.Join(contractColumns, ", "))
+		}
+		index[column] = i
+	}
+	if _, ok := index["discount"]; !ok {
+		return nil, fmt.Errorf("CSV has no discount column")
+	}
+
+	var contracts []DiscountContract
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+
+		field := func(column string) string {
+			if i, ok := index[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		discount, err := strconv.ParseFloat(field("discount"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: discount %q is not a number", row, field("discount"))
+		}
+		contracts = append(contracts, DiscountContract{
+			Category: field("category"),
+			Series:   field("series"),
+			Discount: discount,
+			Contract: field("contract"),
+		})
+	}
+
+	return contracts, nil
+}
+
+// contractsHandler lists the stored discount schedule
+func (s *server) contractsHandler(w http.ResponseWriter, r *http.Request) {
+	contracts, err := GetContracts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching contracts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if contracts == nil {
+		contracts = []DiscountContract{}
+	}
+	writeJSON(w, http.StatusOK, contracts)
+}
+
+// importContractsHandler stores discount contracts sent as a JSON array or CSV.
+// ?replace=true removes the stored contracts missing from the upload.
+func (s *server) importContractsHandler(w http.ResponseWriter, r *http.Request) {
+	replace := false
+	if value := r.URL.Query().Get("replace"); value != "" {
+		var err error
+		if replace, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid replace: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	contracts, err := decodeContracts(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := ImportContracts(contracts, replace, s.config.Upstream.Validation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error importing contracts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
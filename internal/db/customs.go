@@ -0,0 +1,482 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// customsBucketName holds the HS codes and tax categories set per SKU or category
+// through /admin/customs, which take precedence over CUSTOMS_*
+const customsBucketName = "customs"
+
+// hsCodePattern matches HS codes: the 6 digit heading, optionally extended to the 8
+// digit fracción arancelaria and its 2 digit NICO, with or without dots
+var hsCodePattern = regexp.MustCompile(`^[0-9]{4}(\.?[0-9]{2}){1,3}$`)
+
+// CustomsConfig holds the HS codes and tax categories of the categories, keyed by
+// itemSalesCategoryCodeKey (CUSTOMS_HS_CODES, CUSTOMS_TAX_CATEGORIES)
+type CustomsConfig struct {
+	HSCodes       map[string]string
+	TaxCategories map[string]string
+}
+
+// customs is the configured classification, empty by default
+var customs CustomsConfig
+
+// customsSignature identifies the configuration so cached responses classified
+// differently are not served
+var customsSignature string
+
+// SetCustoms sets the classification of the categories
+func SetCustoms(config CustomsConfig) {
+	customs = config
+	customsSignature = ""
+	if len(config.HSCodes) > 0 || len(config.TaxCategories) > 0 {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v", config)))
+		customsSignature = hex.EncodeToString(sum[:4])
+	}
+}
+
+// ParseCategoryCodes parses comma separated category=code pairs keyed by
+// itemSalesCategoryCodeKey, e.g. "UP=9401.61.01,ZZ=9403.60.99"
+func ParseCategoryCodes(s string) (map[string]string, error) {
+	codes := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		category, code, found := strings.Cut(entry, "=")
+		category, code = strings.TrimSpace(category), strings.TrimSpace(code)
+		if !found || category == "" || code == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected category=code", entry)
+		}
+		codes[category] = code
+	}
+	return codes, nil
+}
+
+// Validate checks the configured HS codes
+func (c CustomsConfig) Validate() error {
+	var errs []string
+	for category, code := range c.HSCodes {
+		if !hsCodePattern.MatchString(code) {
+			errs = append(errs, fmt.Sprintf("CUSTOMS_HS_CODES %s: %q is not an HS code", category, code))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Customs classification scopes
+const (
+	CustomsScopeSKU      = "sku"
+	CustomsScopeCategory = "category"
+)
+
+// CustomsClassification is the HS code and tax category set for a SKU or a category.
+// An empty field falls back to the category's, then to CUSTOMS_*.
+type CustomsClassification struct {
+	Scope       string    `json:"scope"` // sku or category
+	Key         string    `json:"key"`   // The SKU or itemSalesCategoryCodeKey
+	HSCode      string    `json:"hsCode,omitempty"`
+	TaxCategory string    `json:"taxCategory,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func (c CustomsClassification) GetSKU() string { return c.Scope + ":" + c.Key }
+
+// validate checks the scope, key and HS code of a classification
+func (c CustomsClassification) validate() error {
+	if c.Scope != CustomsScopeSKU && c.Scope != CustomsScopeCategory {
+		return fmt.Errorf("unknown scope %q (available: %s, %s)", c.Scope, CustomsScopeSKU, CustomsScopeCategory)
+	}
+	if c.Key == "" {
+		return fmt.Errorf("%s is required", c.Scope)
+	}
+	if c.HSCode == "" && c.TaxCategory == "" {
+		return fmt.Errorf("hsCode or taxCategory is required")
+	}
+	if c.HSCode != "" && !hsCodePattern.MatchString(c.HSCode) {
+		return fmt.Errorf("%q is not an HS code", c.HSCode)
+	}
+	return nil
+}
+
+// GetCustomsClassifications returns the classifications set through /admin/customs,
+// categories first
+func GetCustomsClassifications() ([]CustomsClassification, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var classifications []CustomsClassification
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(customsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var classification CustomsClassification
+			if err := json.Unmarshal(v, &classification); err != nil {
+				return fmt.Errorf("error unmarshaling classification %s: %v", k, err)
+			}
+			classifications = append(classifications, classification)
+			return nil
+		})
+	})
+	return classifications, err
+}
+
+// SetCustomsClassifications stores classifications, replacing the ones for the same
+// SKU or category
+func SetCustomsClassifications(classifications []CustomsClassification) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(customsBucketName))
+		if err != nil {
+			return err
+		}
+		for _, classification := range classifications {
+			data, err := json.Marshal(classification)
+			if err != nil {
+				return fmt.Errorf("error marshaling classification of %s: %v", classification.Key, err)
+			}
+			if err := bucket.Put([]byte(classification.GetSKU()), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteCustomsClassification removes the classification of a SKU or category
+func DeleteCustomsClassification(scope, key string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	id := []byte(CustomsClassification{Scope: scope, Key: key}.GetSKU())
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(customsBucketName))
+		if bucket == nil || bucket.Get(id) == nil {
+			return fmt.Errorf("%w: no customs classification for %s %s", ErrNotFound, scope, key)
+		}
+		return bucket.Delete(id)
+	})
+}
+
+// customsClassifier resolves the classification of products
+type customsClassifier struct {
+	skus       map[string]CustomsClassification
+	categories map[string]CustomsClassification
+}
+
+func newCustomsClassifier(classifications []CustomsClassification) customsClassifier {
+	c := customsClassifier{
+		skus:       make(map[string]CustomsClassification),
+		categories: make(map[string]CustomsClassification),
+	}
+	for _, classification := range classifications {
+		if classification.Scope == CustomsScopeSKU {
+			c.skus[classification.Key] = classification
+		} else {
+			c.categories[classification.Key] = classification
+		}
+	}
+	return c
+}
+
+// classify returns the HS code and tax category of a product: the ones set for its SKU,
+// then for its category, then configured for its category, field by field
+func (c customsClassifier) classify(sku, category string) (string, string) {
+	hsCode := firstNonEmpty(c.skus[sku].HSCode, c.categories[category].HSCode, customs.HSCodes[category])
+	taxCategory := firstNonEmpty(c.skus[sku].TaxCategory, c.categories[category].TaxCategory, customs.TaxCategories[category])
+	return hsCode, taxCategory
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// applyCustoms sets fraccionArancelaria and categoriaFiscal on the classified products
+func applyCustoms(response []ProductResponseData) error {
+	classifications, err := GetCustomsClassifications()
+	if err != nil {
+		return fmt.Errorf("error fetching customs classifications: %v", err)
+	}
+	if len(classifications) == 0 && len(customs.HSCodes) == 0 && len(customs.TaxCategories) == 0 {
+		return nil
+	}
+
+	classifier := newCustomsClassifier(classifications)
+	for i := range response {
+		response[i].FraccionArancelaria, response[i].CategoriaFiscal = classifier.classify(response[i].Clave, response[i].Categoria)
+	}
+	return nil
+}
+
+// customsEntry is an uploaded classification, naming either a SKU or a category
+type customsEntry struct {
+	Sku         string `json:"sku"`
+	Category    string `json:"category"`
+	HSCode      string `json:"hsCode"`
+	TaxCategory string `json:"taxCategory"`
+}
+
+// customsColumns are the columns of a CSV import
+var customsColumns = []string{"sku", "category", "hsCode", "taxCategory"}
+
+// decodeCustoms reads uploaded classifications as a JSON array or as CSV with a header
+// row of sku, category, hsCode and taxCategory. Each names either a SKU or a category.
+func decodeCustoms(r *http.Request) ([]CustomsClassification, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var entries []customsEntry
+	switch mediaType {
+	case "application/json", "":
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "text/csv":
+		rows, err := decodeCustomsCSV(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			entries = append(entries, customsEntry{row["sku"], row["category"], row["hsCode"], row["taxCategory"]})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q: use application/json or text/csv", mediaType)
+	}
+
+	now := time.Now()
+	seen := make(map[string]int, len(entries))
+	classifications := make([]CustomsClassification, 0, len(entries))
+	for i, entry := range entries {
+		sku, category := strings.TrimSpace(entry.Sku), strings.TrimSpace(entry.Category)
+		if (sku == "") == (category == "") {
+			return nil, fmt.Errorf("entry %d: set either sku or category", i+1)
+		}
+		classification := CustomsClassification{
+			Scope:       CustomsScopeCategory,
+			Key:         category,
+			HSCode:      strings.TrimSpace(entry.HSCode),
+			TaxCategory: strings.TrimSpace(entry.TaxCategory),
+			UpdatedAt:   now,
+		}
+		if sku != "" {
+			classification.Scope, classification.Key = CustomsScopeSKU, lookupSKU(sku)
+		}
+		if err := classification.validate(); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		if previous, ok := seen[classification.GetSKU()]; ok {
+			return nil, fmt.Errorf("entries %d and %d classify %s %s", previous+1, i+1, classification.Scope, classification.Key)
+		}
+		seen[classification.GetSKU()] = i
+		classifications = append(classifications, classification)
+	}
+	return classifications, nil
+}
+
+// decodeCustomsCSV reads CSV rows into maps by column name
+func decodeCustomsCSV(body io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if !slices.Contains(customsColumns, header[i]) {
+			return nil, fmt.Errorf("unknown CSV column %s; valid columns are %s", header[i], strings.Join(customsColumns, ", "))
+		}
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// customsHandler lists the classifications set through /admin/customs
+func (s *server) customsHandler(w http.ResponseWriter, r *http.Request) {
+	classifications, err := GetCustomsClassifications()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching customs classifications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if classifications == nil {
+		classifications = []CustomsClassification{}
+	}
+	writeJSON(w, http.StatusOK, classifications)
+}
+
+// importCustomsHandler stores classifications sent as a JSON array or CSV
+func (s *server) importCustomsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	classifications, err := decodeCustoms(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := SetCustomsClassifications(classifications); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving customs classifications: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	writeJSON(w, http.StatusOK, map[string]int{"imported": len(classifications)})
+}
+
+// customsScope returns the scope and key of a /admin/customs/{scope}/{key} request
+func customsScope(r *http.Request) (string, string, error) {
+	key := strings.TrimSpace(r.PathValue("key"))
+	switch r.PathValue("scope") {
+	case "skus":
+		return CustomsScopeSKU, lookupSKU(key), nil
+	case "categories":
+		return CustomsScopeCategory, key, nil
+	default:
+		return "", "", fmt.Errorf("unknown scope %q (available: skus, categories)", r.PathValue("scope"))
+	}
+}
+
+// setCustomsHandler classifies a SKU or category from a
+// {"hsCode": "9401.61.01", "taxCategory": "..."} body
+func (s *server) setCustomsHandler(w http.ResponseWriter, r *http.Request) {
+	scope, key, err := customsScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		HSCode      string `json:"hsCode"`
+		TaxCategory string `json:"taxCategory"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	classification := CustomsClassification{
+		Scope:       scope,
+		Key:         key,
+		HSCode:      strings.TrimSpace(body.HSCode),
+		TaxCategory: strings.TrimSpace(body.TaxCategory),
+		UpdatedAt:   time.Now(),
+	}
+	if err := classification.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := SetCustomsClassifications([]CustomsClassification{classification}); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving customs classification: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	writeJSON(w, http.StatusOK, classification)
+}
+
+// deleteCustomsHandler removes the classification of a SKU or category
+func (s *server) deleteCustomsHandler(w http.ResponseWriter, r *http.Request) {
+	scope, key, err := customsScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = DeleteCustomsClassification(scope, key)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting customs classification: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exportCustomsHandler serves the data of a customs declaration as CSV: HS code, tax
+// category, weight, dimensions and value of every product, or of the ?sku= ones
+// shipped in a container
+func (s *server) exportCustomsHandler(w http.ResponseWriter, r *http.Request) {
+	skus, err := requestedSKUs(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sku: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Declared values are the regular prices, whatever the promotions
+	response, err := buildProductResponses("", skus, nil, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building catalog: %v", err), http.StatusInternalServerError)
+		return
+	}
+	requestProfile(r).redactProducts(response)
+
+	fields := []string{"clave", "nombre", "categoria", "fraccionArancelaria", "categoriaFiscal", "upc",
+		"peso", "alto", "largo", "ancho", "costo2", "costoImportacion"}
+	rows, err := exportRows(response, fields)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building export: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	columns, rows := requestSchema(r).applyColumns(exportColumns(rows, fields), rows)
+	writeCSV(w, r, "customs.csv", columns, rows)
+}
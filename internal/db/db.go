@@ -1,27 +1,41 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
 	bolt "go.etcd.io/bbolt"
 )
 
 const DatabaseName string = "ashley.db"
 
+// ErrNotFound is returned when a looked up entity does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrUnauthorized is returned when the Ashley API rejects our credentials (401/403).
+// Retrying can't fix it, so syncs stop at the first one.
+var ErrUnauthorized = errors.New("upstream rejected credentials")
+
 // Core interfaces
 type DatabaseEntity interface {
 	GetSKU() string
 }
 
 type Fetchable[T DatabaseEntity] interface {
-	FetchPage(config APIConfig, page int) (*GenericAPIResponse[T], error)
+	FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[T], error)
 	Transform(entity T) DatabaseEntity
 	GetBucketName() string
 	GetEndpoint() string
@@ -42,76 +56,139 @@ type GenericAPIResponse[T any] struct {
 	Links    []Link   `json:"links"`
 	Metadata Metadata `json:"metadata"`
 	Entities []T      `json:"entities"`
+	Raw      []byte   `json:"-"` // Upstream payload as received
+	Original []byte   `json:"-"` // Upstream payload as received when Raw was rebuilt, e.g. with merged descriptions
+	Last     bool     `json:"-"` // Set by fetchers whose API doesn't paginate with self/last links
 }
 
 type APIConfig struct {
-	BaseURL       string
-	Authorization string
-	ClientID      string
-	Customer      string
-	Limit         int
+	BaseURL          string
+	Authorization    string
+	ClientID         string
+	Customer         string
+	Limit            int
+	StoreRawPages    bool // Keep compressed upstream pages in the raw_pages bucket for replays
+	StoreRawEntities bool // Keep the upstream JSON of every record in the raw_entities bucket for ?include=raw
+	Validation       ValidationConfig
+	PageTuning       PageTuning
+	KeepVersions     int               // Catalog versions retained after completed syncs (0 disables versioning)
+	QuotaReserve     float64           // Fraction of the upstream quota below which requests are spread out (0 disables)
+	RequestRate      float64           // Upstream requests per second of each customer account, shared by parallel fetchers (0 disables)
+	Parallelism      int               // Fetchers run at once during a sync (1 runs them in order)
+	Chaos            ChaosConfig       // Faults injected into upstream requests, for staging only
+	UserAgent        string            // User-Agent of upstream requests (DefaultUserAgent when empty)
+	Headers          map[string]string // Extra headers of upstream requests
+	Languages        []string          // Accept-Language values product descriptions are fetched in, the first is the primary
+	SkipUnchanged    bool              // Skip fetchers whose endpoint reports the catalog version of their last sync
+	SchemaDrift      string            // Handling of upstream fields the service doesn't model: off, log or strict
+	ConditionalPages bool              // Request pages with If-None-Match, reusing the stored page on 304
+	Scope            SyncScope         // Part of the Ashley line synced, everything when empty
+	Maintenance      MaintenanceConfig // Responses of the gateway under maintenance, which defer syncs
+
+	Supplier  string               // Supplier these settings belong to, empty for Ashley
+	Suppliers map[string]APIConfig // Settings of the other suppliers, resolved with For
 }
 
 // Product types
 type Product struct {
-	ConsumerDescription      string  `json:"consumerDescription"`
-	Sku                      string  `json:"sku"`
-	ItemSalesCategoryCodeKey string  `json:"itemSalesCategoryCodeKey"`
-	SeriesId                 string  `json:"seriesId"`
-	ChairQtyPerCarton        int     `json:"chairQtyPerCarton"`
-	ItemsPerCase             int     `json:"itemsPerCase"`
-	Status                   string  `json:"status"`
-	UnitHeightMm             float64 `json:"unitHeightMm"`
-	UnitWidthMm              float64 `json:"unitWidthMm"`
-	UnitDepthMm              float64 `json:"unitDepthMm"`
-	ItemWeightKg             float64 `json:"itemWeightKg"`
+	ConsumerDescription      string      `json:"consumerDescription"`
+	Sku                      string      `json:"sku"`
+	ItemSalesCategoryCodeKey string      `json:"itemSalesCategoryCodeKey"`
+	SeriesId                 string      `json:"seriesId"`
+	ChairQtyPerCarton        int         `json:"chairQtyPerCarton"`
+	ItemsPerCase             int         `json:"itemsPerCase"`
+	Status                   string      `json:"status"`
+	UnitHeightMm             float64     `json:"unitHeightMm"`
+	UnitWidthMm              float64     `json:"unitWidthMm"`
+	UnitDepthMm              float64     `json:"unitDepthMm"`
+	ItemWeightKg             float64     `json:"itemWeightKg"`
+	Upc                      string      `json:"upc"`
+	Gtin                     string      `json:"gtin"`
+	ModelNumber              string      `json:"modelNumber"`
+	Components               []Component `json:"components"`
+	ReplacementSku           string      `json:"replacementSku"`
+
+	// Carton data, only sent for some products
+	CartonsPerUnit int             `json:"cartonsPerUnit"`
+	Cartons        []ProductCarton `json:"cartons"`
+
+	// Descriptions holds ConsumerDescription in the further languages of API_LANGUAGES,
+	// fetched separately and merged into the page
+	Descriptions map[string]string `json:"descriptions,omitempty"`
 }
 
 func (p Product) GetSKU() string { return p.Sku }
 
+// Component is a child SKU of a kit or sectional
+type Component struct {
+	Sku      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// ProductCarton is one of the cartons a unit ships in
+type ProductCarton struct {
+	CartonNumber int     `json:"cartonNumber"`
+	HeightMm     float64 `json:"heightMm"`
+	WidthMm      float64 `json:"widthMm"`
+	DepthMm      float64 `json:"depthMm"`
+	WeightKg     float64 `json:"weightKg"`
+}
+
 type ProductRequestData struct {
-	ConsumerDescription      string  `json:"consumerDescription"`
-	Sku                      string  `json:"sku"`
-	ItemSalesCategoryCodeKey string  `json:"itemSalesCategoryCodeKey"`
-	ItemSeries               string  `json:"itemSeries"`
-	SeriesId                 string  `json:"seriesId"`
-	Price                    float64 `json:"price"`
-	SellPrice                float64 `json:"sellPrice"`
-	TotalNetPrice            float64 `json:"totalNetPrice"`
-	Supplier                 string  `json:"supplier"`
-	ChairQtyPerCarton        int     `json:"chairQtyPerCarton"`
-	ItemsPerCase             int     `json:"itemsPerCase"`
-	Status                   string  `json:"status"`
-	UnitHeightMm             float64 `json:"unitHeightMm"`
-	UnitWidthMm              float64 `json:"unitWidthMm"`
-	UnitDepthMm              float64 `json:"unitDepthMm"`
-	ItemWeightKg             float64 `json:"itemWeightKg"`
+	ConsumerDescription      string      `json:"consumerDescription"`
+	Sku                      string      `json:"sku"`
+	ItemSalesCategoryCodeKey string      `json:"itemSalesCategoryCodeKey"`
+	ItemSeries               string      `json:"itemSeries"`
+	SeriesId                 string      `json:"seriesId"`
+	Price                    float64     `json:"price"`
+	SellPrice                float64     `json:"sellPrice"`
+	TotalNetPrice            float64     `json:"totalNetPrice"`
+	Supplier                 string      `json:"supplier"`
+	ChairQtyPerCarton        int         `json:"chairQtyPerCarton"`
+	ItemsPerCase             int         `json:"itemsPerCase"`
+	Status                   string      `json:"status"`
+	UnitHeightMm             float64     `json:"unitHeightMm"`
+	UnitWidthMm              float64     `json:"unitWidthMm"`
+	UnitDepthMm              float64     `json:"unitDepthMm"`
+	ItemWeightKg             float64     `json:"itemWeightKg"`
+	Upc                      string      `json:"upc"`
+	Gtin                     string      `json:"gtin"`
+	ModelNumber              string      `json:"modelNumber"`
+	Components               []Component `json:"components,omitempty"`
+	ReplacementSku           string      `json:"replacementSku,omitempty"`
+
+	CartonsPerUnit int             `json:"cartonsPerUnit,omitempty"`
+	Cartons        []ProductCarton `json:"cartons,omitempty"`
+
+	Descriptions map[string]string `json:"descriptions,omitempty"` // ConsumerDescription by further language
 }
 
 func (p ProductRequestData) GetSKU() string { return p.Sku }
 
+// IndexKeys indexes products by UPC and GTIN for point-of-sale lookups, and by their
+// dimensions for ?max_width_mm= and the like
+func (p ProductRequestData) IndexKeys() map[string][]string {
+	var codes []string
+	for _, code := range []string{p.Upc, p.Gtin} {
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return map[string][]string{
+		productsByUPCBucketName:       codes,
+		productsByDimensionBucketName: dimensionIndexKeys(p),
+	}
+}
+
 type ProductAPIResponse struct {
 	Links    []Link    `json:"links"`
 	Metadata Metadata  `json:"metadata"`
 	Entities []Product `json:"entities"`
 }
 
-type ProductResponseData struct {
-	Nombre             string  `json:"nombre"`             // ConsumerDescription
-	Clave              string  `json:"clave"`              // Sku
-	Categoria          string  `json:"categoria"`          // ItemSalesCategoryCodeKey
-	Modelo             string  `json:"modelo"`             // ItemSeries + SeriesId
-	Costo              float64 `json:"costo"`              // SellPrice
-	Costo2             float64 `json:"costo2"`             // TotalNetPrice
-	Proveedor          string  `json:"proveedor"`          // Supplier
-	CantidadSillas     int     `json:"cantidadSillas"`     // ChairQtyPerCarton
-	CantidadPorPaquete int     `json:"cantidadPorPaquete"` // ItemsPerCase
-	Descontinuado      string  `json:"descontinuado"`      // Status
-	Alto               float64 `json:"alto"`               // UnitHeightMm
-	Largo              float64 `json:"largo"`              // UnitWidthMm
-	Ancho              float64 `json:"ancho"`              // UnitDepthMm
-	Peso               float64 `json:"peso"`               // ItemWeightKg
-}
+// ProductResponseData is a product of the /products response. Response types are
+// defined in pkg/api, which the services consuming them import.
+type ProductResponseData = api.Product
 
 // Price types
 type Price struct {
@@ -159,19 +236,28 @@ type PriceAPIResponse struct {
 // Fetcher implementations
 type ProductFetcher struct{}
 
-func (pf ProductFetcher) FetchPage(config APIConfig, page int) (*GenericAPIResponse[Product], error) {
+func (pf ProductFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[Product], error) {
 	url := fmt.Sprintf("%s/products?customer=%s&Limit=%d&Page=%d",
 		config.BaseURL, config.Customer, config.Limit, page)
 
-	response, err := makeHTTPRequest[ProductAPIResponse](url, config)
+	response, raw, err := makeHTTPRequest[ProductAPIResponse](ctx, url, config)
 	if err != nil {
 		return nil, err
 	}
+	var original []byte
+	if len(config.Languages) > 1 {
+		original = raw
+		if raw, err = fetchDescriptions(ctx, url, config, response); err != nil {
+			return nil, err
+		}
+	}
 
 	return &GenericAPIResponse[Product]{
 		Links:    response.Links,
 		Metadata: response.Metadata,
 		Entities: response.Entities,
+		Raw:      raw,
+		Original: original,
 	}, nil
 }
 
@@ -189,6 +275,14 @@ func (pf ProductFetcher) Transform(entity Product) DatabaseEntity {
 		UnitWidthMm:              entity.UnitWidthMm,
 		UnitDepthMm:              entity.UnitDepthMm,
 		ItemWeightKg:             entity.ItemWeightKg,
+		Upc:                      entity.Upc,
+		Gtin:                     entity.Gtin,
+		ModelNumber:              entity.ModelNumber,
+		Components:               entity.Components,
+		ReplacementSku:           entity.ReplacementSku,
+		CartonsPerUnit:           entity.CartonsPerUnit,
+		Cartons:                  entity.Cartons,
+		Descriptions:             entity.Descriptions,
 	}
 }
 
@@ -197,11 +291,11 @@ func (pf ProductFetcher) GetEndpoint() string   { return "products" }
 
 type PriceFetcher struct{}
 
-func (pf PriceFetcher) FetchPage(config APIConfig, page int) (*GenericAPIResponse[Price], error) {
+func (pf PriceFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[Price], error) {
 	url := fmt.Sprintf("%s/Prices?Customer=%s&Limit=%d&Page=%d",
 		config.BaseURL, config.Customer, config.Limit, page)
 
-	response, err := makeHTTPRequest[PriceAPIResponse](url, config)
+	response, raw, err := makeHTTPRequest[PriceAPIResponse](ctx, url, config)
 	if err != nil {
 		return nil, err
 	}
@@ -210,6 +304,7 @@ func (pf PriceFetcher) FetchPage(config APIConfig, page int) (*GenericAPIRespons
 		Links:    response.Links,
 		Metadata: response.Metadata,
 		Entities: response.Entities,
+		Raw:      raw,
 	}, nil
 }
 
@@ -238,52 +333,104 @@ func (pf PriceFetcher) Transform(entity Price) DatabaseEntity {
 func (pf PriceFetcher) GetBucketName() string { return "prices" }
 func (pf PriceFetcher) GetEndpoint() string   { return "Prices" }
 
-// Generic HTTP request function with improved error handling
-func makeHTTPRequest[T any](url string, config APIConfig) (*T, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Generic HTTP request function with improved error handling.
+// Returns the decoded response along with the raw body.
+func makeHTTPRequest[T any](ctx context.Context, url string, config APIConfig) (*T, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		return nil, nil, fmt.Errorf("error creating request: %v", err)
 	}
 
-	req.Header.Set("Authorization", config.Authorization)
-	req.Header.Set("Client_Id", config.ClientID)
-	req.Header.Set("Accept-Language", "en")
+	req.Header.Set("Accept-Language", config.language())
+	setUpstreamHeaders(req, config)
+	authorize(req, config)
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	stored := prepareConditional(ctx, req)
+
+	if err := waitForRequestRate(ctx, config.Customer, config.RequestRate); err != nil {
+		return nil, nil, err
+	}
+	if err := waitForQuota(ctx, config.Customer, config.QuotaReserve); err != nil {
+		return nil, nil, err
+	}
+	if err := chaosBeforeRequest(ctx, config.Chaos, url); err != nil {
+		return nil, nil, err
+	}
 
 	client := &http.Client{Timeout: 120 * time.Second}
+	requestedAt := time.Now()
 	resp, err := client.Do(req)
+	observeUpstreamRequest(config.Customer, req.URL.Path, resp, time.Since(requestedAt))
 	if err != nil {
+		logUpstreamRequest(req, nil, 0, time.Since(requestedAt), err)
 		// Check if it's a timeout or network error (retryable)
 		if isRetryableError(err) {
-			return nil, fmt.Errorf("retryable network error: %v", err)
+			return nil, nil, fmt.Errorf("retryable network error: %v", err)
+		}
+		return nil, nil, fmt.Errorf("non-retryable request error: %v", err)
+	}
+	counted := &countingBody{ReadCloser: resp.Body}
+	resp.Body = counted
+	defer func() {
+		counted.Close()
+		logUpstreamRequest(req, resp, counted.n, time.Since(requestedAt), nil)
+	}()
+	observeQuota(config.Customer, resp)
+	recordCatalogVersion(ctx, resp)
+
+	// A gateway under maintenance isn't retried, the sync is deferred until it ends.
+	// Other responses of the same status are handled as usual.
+	if config.Maintenance.announces(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		if err := config.Maintenance.check(resp, body); err != nil {
+			return nil, nil, err
 		}
-		return nil, fmt.Errorf("non-retryable request error: %v", err)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
 	}
-	defer resp.Body.Close()
 
 	// Check for retryable HTTP status codes
 	if isRetryableStatusCode(resp.StatusCode) {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("retryable HTTP error - status %d: %s", resp.StatusCode, string(body))
+		return nil, nil, fmt.Errorf("retryable HTTP error - status %d: %s", resp.StatusCode, string(body))
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("non-retryable HTTP error - status %d: %s", resp.StatusCode, string(body))
+		return nil, nil, fmt.Errorf("%w - status %d: %s", ErrUnauthorized, resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+	// An unchanged page is decoded from the body stored with its ETag
+	var body []byte
+	if resp.StatusCode == http.StatusNotModified && stored != nil {
+		if body, err = stored.notModifiedBody(); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return nil, nil, fmt.Errorf("non-retryable HTTP error - status %d: %s", resp.StatusCode, string(body))
+		}
+
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return nil, nil, fmt.Errorf("error reading response body: %v", err)
+		}
+	}
+	received := body
+	body = chaosAfterResponse(config.Chaos, url, body)
+	if err := checkSchemaDrift[T](config.SchemaDrift, upstreamEndpoint(req.URL.Path), body); err != nil {
+		return nil, nil, err
 	}
 
 	var result T
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling JSON: %v", err)
+		return nil, nil, fmt.Errorf("error unmarshaling JSON: %v", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		rememberConditional(ctx, req, resp, received)
 	}
 
-	return &result, nil
+	return &result, body, nil
 }
 
 // isRetryableError determines if an error is worth retrying
@@ -334,74 +481,229 @@ func isRetryableStatusCode(statusCode int) bool {
 }
 
 // Generic fetch function with retry logic
-func FetchAllEntities[T DatabaseEntity](config APIConfig, fetcher Fetchable[T]) error {
+// Canceling ctx stops the fetch between pages, leaving every page saved so far committed.
+// The page size starts at the learned value of the endpoint and, when tuning is enabled,
+// is halved after timeouts or 413s and doubled after fast pages.
+func FetchAllEntities[T DatabaseEntity](ctx context.Context, config APIConfig, fetcher Fetchable[T]) error {
 	// Initialize database and bucket
 	if err := initBucket(fetcher.GetBucketName()); err != nil {
 		return err
 	}
 
-	db, err := bolt.Open(DatabaseName, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	db, err := openDB()
 	if err != nil {
-		return fmt.Errorf("error opening database: %v", err)
+		return err
 	}
 	defer db.Close()
 
+	run, err := syncRun(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger := syncLogger(config.Customer)
+	limit := loadPageLimit(db, fetcher.GetEndpoint(), config)
 	page := 1
+	offset := 0   // Records covered by the pages fetched so far
+	rawPages := 0 // Raw pages are numbered by fetch order, as page numbers shift with the size
+	shrunk := false
 	totalEntities := 0
+	var saved saveStats // Records of this fetch written or recognized as unchanged
+	outOfScope := 0     // Records of this fetch dropped by SYNC_SCOPE
+	startedAt := time.Now()
+	var metadata Metadata
+
+	// Report failures to progress subscribers
+	fail := func(err error) error {
+		event := newSyncProgress(fetcher.GetBucketName(), page, totalEntities, metadata, limit, startedAt)
+		event.Done = true
+		event.Error = err.Error()
+		progress.publish(event)
+		return err
+	}
+
+	// Continue an interrupted sync where it stopped, and record progress so a failed
+	// one can be continued
+	checkpoint, err := loadCheckpoint(db, fetcher.GetBucketName())
+	if err != nil {
+		return fmt.Errorf("error reading sync checkpoint of %s: %v", fetcher.GetEndpoint(), err)
+	}
+	if resuming(ctx) && checkpoint != nil && checkpoint.Offset > 0 && checkpoint.Offset%limit == 0 {
+		// Pages start at multiples of their size, which the learned size still divides
+		offset, rawPages, totalEntities = checkpoint.Offset, checkpoint.RawPages, checkpoint.Entities
+		page = offset/limit + 1
+		logger.Printf("Resuming %s at record %d (page %d)", fetcher.GetEndpoint(), offset, page)
+	} else if err := saveCheckpoint(db, fetcher.GetBucketName(), syncCheckpoint{}); err != nil {
+		return fmt.Errorf("error saving sync checkpoint of %s: %v", fetcher.GetEndpoint(), err)
+	}
+
+	// Send the ETag of each page's last response, so unchanged pages cost a 304
+	var conditional *conditionalFetch
+	if config.ConditionalPages {
+		ctx, conditional = withConditionalFetch(ctx)
+		if offset > 0 {
+			conditional = nil // The skipped pages are still current
+		}
+	}
+
+	// Persist a page size change so the next sync starts from it
+	resize := func(newLimit int, reason string) {
+		logger.Printf("%s: %s, page size %d -> %d", fetcher.GetEndpoint(), reason, limit, newLimit)
+		limit = newLimit
+		page = offset/limit + 1
+		if err := savePageLimit(db, fetcher.GetEndpoint(), limit); err != nil {
+			logger.Printf("Error saving page size of %s: %v", fetcher.GetEndpoint(), err)
+		}
+	}
 
 	for {
-		log.Printf("Fetching %s page %d...", fetcher.GetEndpoint(), page)
+		debugf(logger, "Fetching %s page %d (%d per page)...", fetcher.GetEndpoint(), page, limit)
+
+		pageConfig := config
+		pageConfig.Limit = limit
+		smaller, canShrink := config.PageTuning.shrink(limit, offset)
+		requestedAt := time.Now()
 
 		// Retry logic for fetching page
-		response, err := fetchPageWithRetry(config, fetcher, page, 3)
+		response, err := fetchPageWithRetry(ctx, logger, pageConfig, fetcher, page, 3, canShrink)
 		if err != nil {
-			return fmt.Errorf("error fetching %s page %d after retries: %v", fetcher.GetEndpoint(), page, err)
+			if canShrink && ctx.Err() == nil && isPageTooLarge(err) {
+				resize(smaller, "page too large")
+				shrunk = true
+				continue
+			}
+			return fail(fmt.Errorf("error fetching %s page %d after retries: %w", fetcher.GetEndpoint(), page, err))
 		}
+		elapsed := time.Since(requestedAt)
 
-		// Transform and save entities
-		err = saveEntitiesToDatabase(db, fetcher.GetBucketName(), response.Entities, fetcher.Transform)
+		// Keep the upstream payload so transforms can be replayed later
+		if config.StoreRawPages {
+			rawPages++
+			if err := saveRawPage(db, fetcher.GetBucketName(), rawPages, response.Raw); err != nil {
+				return fail(fmt.Errorf("error saving raw %s page %d: %v", fetcher.GetEndpoint(), page, err))
+			}
+		}
+		if config.StoreRawEntities {
+			if err := saveRawEntities(db, fetcher.GetBucketName(), response, fetcher.Transform, config.Scope); err != nil {
+				return fail(fmt.Errorf("error saving raw %s of page %d: %v", fetcher.GetEndpoint(), page, err))
+			}
+		}
+
+		// Drop the records outside SYNC_SCOPE, then transform and save the others
+		entities := response.Entities
+		if !config.Scope.Empty() {
+			err := db.View(func(tx *bolt.Tx) error {
+				var err error
+				entities, err = scopeEntities(tx, config.Scope, fetcher.GetBucketName(), response.Entities, fetcher.Transform)
+				return err
+			})
+			if err != nil {
+				return fail(fmt.Errorf("error scoping %s page %d: %v", fetcher.GetEndpoint(), page, err))
+			}
+			outOfScope += len(response.Entities) - len(entities)
+		}
+		stats, err := saveEntitiesToDatabase(db, run, fetcher.GetBucketName(), entities, fetcher.Transform, config.Validation)
 		if err != nil {
-			return fmt.Errorf("error saving %s to database: %v", fetcher.GetEndpoint(), err)
+			return fail(fmt.Errorf("error saving %s to database: %v", fetcher.GetEndpoint(), err))
 		}
+		saved.add(stats)
 
 		totalEntities += len(response.Entities)
-		log.Printf("Page %d: %d %s processed. Total: %d", page, len(response.Entities), fetcher.GetEndpoint(), totalEntities)
-
-		if isLastPage(response.Links) {
-			log.Printf("Reached last page. Total %s processed: %d", fetcher.GetEndpoint(), totalEntities)
+		logger.Printf("Page %d: %d %s processed (%d written, %d unchanged). Total: %d", page, len(response.Entities), fetcher.GetEndpoint(), stats.Written, stats.Unchanged, totalEntities)
+
+		metadata = response.Metadata
+		event := newSyncProgress(fetcher.GetBucketName(), page, totalEntities, metadata, limit, startedAt)
+		event.Done = response.Last || isLastPage(response.Links)
+		progress.publish(event)
+
+		if event.Done {
+			logger.Printf("Reached last page. Total %s processed: %d (%d written, %d unchanged)", fetcher.GetEndpoint(), totalEntities, saved.Written, saved.Unchanged)
+			if config.StoreRawPages {
+				if err := pruneRawPages(db, fetcher.GetBucketName(), rawPages); err != nil {
+					return fail(fmt.Errorf("error pruning raw %s pages: %v", fetcher.GetEndpoint(), err))
+				}
+			}
+			if !config.Scope.Empty() {
+				var pruned int
+				err := db.Update(func(tx *bolt.Tx) error {
+					var err error
+					pruned, err = pruneOutOfScope(tx, run, config.Scope, fetcher.GetBucketName())
+					return err
+				})
+				if err != nil {
+					return fail(fmt.Errorf("error pruning %s outside the sync scope: %v", fetcher.GetEndpoint(), err))
+				}
+				logger.Printf("Kept %s within scope (%s): %d dropped, %d stored ones deleted", fetcher.GetEndpoint(), config.Scope, outOfScope, pruned)
+			}
+			if conditional != nil {
+				if err := conditional.prune(db, config.BaseURL, fetcher.GetEndpoint()); err != nil {
+					logger.Printf("Error pruning ETags of %s: %v", fetcher.GetEndpoint(), err)
+				}
+			}
+			if err := saveCheckpoint(db, fetcher.GetBucketName(), syncCheckpoint{Offset: offset + len(response.Entities), RawPages: rawPages, Entities: totalEntities, Done: true}); err != nil {
+				logger.Printf("Error saving sync checkpoint of %s: %v", fetcher.GetEndpoint(), err)
+			}
 			break
 		}
 
+		offset += limit
 		page++
-		time.Sleep(100 * time.Millisecond)
+		if err := saveCheckpoint(db, fetcher.GetBucketName(), syncCheckpoint{Offset: offset, RawPages: rawPages, Entities: totalEntities}); err != nil {
+			logger.Printf("Error saving sync checkpoint of %s: %v", fetcher.GetEndpoint(), err)
+		}
+		// Don't grow back within a sync that had to shrink, the upstream is likely still loaded
+		if !shrunk && config.PageTuning.FastPage > 0 && elapsed < config.PageTuning.FastPage {
+			if larger, ok := config.PageTuning.grow(limit, offset); ok {
+				resize(larger, fmt.Sprintf("page fetched in %v", elapsed.Round(time.Millisecond)))
+			}
+		}
+		if err := sleepContext(ctx, 100*time.Millisecond); err != nil {
+			logger.Printf("Fetch of %s canceled after page %d", fetcher.GetEndpoint(), page-1)
+			return fail(err)
+		}
 	}
 
 	return nil
 }
 
-// fetchPageWithRetry attempts to fetch a page with retry logic
-func fetchPageWithRetry[T DatabaseEntity](config APIConfig, fetcher Fetchable[T], page int, maxRetries int) (*GenericAPIResponse[T], error) {
+// fetchPageWithRetry attempts to fetch a page with retry logic. When canShrink is set,
+// failures caused by the page size are returned right away so a smaller page can be tried.
+func fetchPageWithRetry[T DatabaseEntity](ctx context.Context, logger *log.Logger, config APIConfig, fetcher Fetchable[T], page int, maxRetries int, canShrink bool) (*GenericAPIResponse[T], error) {
 	var lastErr error
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		response, err := fetcher.FetchPage(config, page)
+		response, err := fetcher.FetchPage(ctx, config, page)
 		if err == nil {
 			// Success, return the response
 			if attempt > 1 {
-				log.Printf("Successfully fetched %s page %d on attempt %d", fetcher.GetEndpoint(), page, attempt)
+				logger.Printf("Successfully fetched %s page %d on attempt %d", fetcher.GetEndpoint(), page, attempt)
 			}
 			return response, nil
 		}
 
+		// Don't retry a canceled fetch, rejected credentials or a gateway under maintenance
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrUpstreamMaintenance) {
+			return nil, err
+		}
+
 		lastErr = err
-		log.Printf("Attempt %d/%d failed for %s page %d: %v", attempt, maxRetries, fetcher.GetEndpoint(), page, err)
+		logger.Printf("Attempt %d/%d failed for %s page %d: %v", attempt, maxRetries, fetcher.GetEndpoint(), page, err)
+
+		if canShrink && isPageTooLarge(err) {
+			return nil, err
+		}
 
 		// If this isn't the last attempt, wait before retrying
 		if attempt < maxRetries {
 			// Exponential backoff: wait 2^attempt seconds
 			backoffTime := time.Duration(1<<uint(attempt)) * time.Second
-			log.Printf("Waiting %v before retry %d for %s page %d", backoffTime, attempt+1, fetcher.GetEndpoint(), page)
-			time.Sleep(backoffTime)
+			logger.Printf("Waiting %v before retry %d for %s page %d", backoffTime, attempt+1, fetcher.GetEndpoint(), page)
+			if err := sleepContext(ctx, backoffTime); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -410,48 +712,143 @@ func fetchPageWithRetry[T DatabaseEntity](config APIConfig, fetcher Fetchable[T]
 }
 
 // Generic save function
-func saveEntitiesToDatabase[T DatabaseEntity](db *bolt.DB, bucketName string, entities []T, transformer func(T) DatabaseEntity) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+func saveEntitiesToDatabase[T DatabaseEntity](db *store, run applyRun, bucketName string, entities []T, transformer func(T) DatabaseEntity, validation ValidationConfig) (saveStats, error) {
+	var stats saveStats
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stats, err = putEntities(tx, run, bucketName, entities, transformer, validation)
+		return err
+	})
+	return stats, err
+}
 
-		for _, entity := range entities {
-			// Transform entity
-			transformed := transformer(entity)
+// putEntities transforms entities, runs them through the bucket's pipeline and writes them within the
+// caller's transaction. Records failing validation are written to the quarantine bucket, and skipped when rejected.
+// Records whose stored value changes are appended to the change feed and journaled as changes of run.
+// Unchanged records, recognized by their hash, are not written again.
+func putEntities[T DatabaseEntity](tx *bolt.Tx, run applyRun, bucketName string, entities []T, transformer func(T) DatabaseEntity, validation ValidationConfig) (saveStats, error) {
+	var stats saveStats
+	bucket := recordsOf(tx, bucketName)
+	conflicts, err := newConflictDetector(tx, bucketName)
+	if err != nil {
+		return stats, fmt.Errorf("error listing catalogs: %v", err)
+	}
+
+	for _, entity := range entities {
+		// Transform entity and run the normalize, validate, enrich and redact stages
+		result, err := runPipeline(bucketName, transformer(entity), validation)
+		if err != nil {
+			return stats, err
+		}
+		transformed, data := result.record, result.data
+		sku := transformed.GetSKU()
+
+		// Quarantine implausible records
+		err = quarantine(tx, QuarantineRecord{
+			Bucket:   bucketName,
+			Sku:      sku,
+			Issues:   result.issues,
+			Rejected: result.rejected,
+			Record:   data,
+			At:       time.Now(),
+		})
+		if err != nil {
+			return stats, fmt.Errorf("error quarantining entity %s: %v", sku, err)
+		}
+		if result.rejected {
+			log.Printf("Rejected %s %s: %s", bucketName, sku, strings.Join(result.issues, "; "))
+			continue
+		}
 
-			// Serialize to JSON
-			data, err := json.Marshal(transformed)
+		// Unchanged records are left alone so they don't show up in the change feed
+		key := []byte(sku)
+		stored := bucket.Get(key)
+		hash := recordHash(data)
+		unchanged, err := unchangedRecord(tx, bucketName, sku, stored, hash, data)
+		if err != nil {
+			return stats, err
+		}
+		if unchanged {
+			stats.Unchanged++
+			debugf(log.Default(), "Unchanged %s %s", bucketName, sku)
+			continue
+		}
+		var before []byte
+		if stored != nil {
+			opened, err := openValue(bucketName, key, stored)
 			if err != nil {
-				return fmt.Errorf("error marshaling entity %s: %v", entity.GetSKU(), err)
+				return stats, err
 			}
+			before = append([]byte(nil), opened...)
+		}
 
-			// Save using SKU as key
-			err = bucket.Put([]byte(entity.GetSKU()), data)
-			if err != nil {
-				return fmt.Errorf("error saving entity %s: %v", entity.GetSKU(), err)
+		// Save using SKU as key, sealed when the bucket is encrypted
+		sealed, err := sealValue(bucketName, key, data)
+		if err != nil {
+			return stats, fmt.Errorf("error encrypting entity %s: %v", sku, err)
+		}
+		err = bucket.Put(key, sealed)
+		if err != nil {
+			return stats, fmt.Errorf("error saving entity %s: %v", sku, err)
+		}
+		if err := putRecordHash(tx, bucketName, sku, hash); err != nil {
+			return stats, fmt.Errorf("error saving hash of entity %s: %v", sku, err)
+		}
+		stats.Written++
+		debugf(log.Default(), "Wrote %s %s (new: %t)", bucketName, sku, stored == nil)
+
+		if err := recordChange(tx, bucketName, sku, false); err != nil {
+			return stats, fmt.Errorf("error recording change of entity %s: %v", sku, err)
+		}
+		if err := journalChange(tx, run, bucketName, sku, before, data); err != nil {
+			return stats, fmt.Errorf("error journaling change of entity %s: %v", sku, err)
+		}
+
+		// Record SKUs another supplier's catalog also holds
+		if conflicts != nil {
+			if err := conflicts.check(sku); err != nil {
+				return stats, fmt.Errorf("error checking SKU collisions of %s: %v", sku, err)
 			}
 		}
 
-		return nil
-	})
+		// Keep the price history trends are computed from
+		if price, ok := transformed.(PriceRequestData); ok {
+			if err := recordPrice(tx, price); err != nil {
+				return stats, fmt.Errorf("error recording price history of %s: %v", sku, err)
+			}
+		}
+
+		// Point secondary index keys at the SKU
+		if indexed, ok := transformed.(Indexed); ok {
+			if err := putIndexKeys(tx, indexed, sku); err != nil {
+				return stats, fmt.Errorf("error indexing entity %s: %v", sku, err)
+			}
+		}
+	}
+
+	recordsSavedTotal.Add(float64(stats.Written), bucketName, "written")
+	recordsSavedTotal.Add(float64(stats.Unchanged), bucketName, "unchanged")
+	return stats, nil
 }
 
 // Generic get functions
 func GetEntity[T DatabaseEntity](bucketName, sku string) (*T, error) {
-	db, err := bolt.Open(DatabaseName, 0600, &bolt.Options{Timeout: 3 * time.Second})
-	if err != nil {
-		return nil, fmt.Errorf("error opening database: %v", err)
-	}
-	defer db.Close()
-
 	var entity T
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+	err := bucketView(bucketName, func(tx *bolt.Tx) error {
+		bucket := recordsOf(tx, bucketName)
+		if bucket == nil {
+			return fmt.Errorf("%w: entity not found for SKU %s", ErrNotFound, sku)
+		}
 		data := bucket.Get([]byte(sku))
 
 		if data == nil {
-			return fmt.Errorf("entity not found for SKU %s", sku)
+			return fmt.Errorf("%w: entity not found for SKU %s", ErrNotFound, sku)
 		}
 
+		data, err := openValue(bucketName, []byte(sku), data)
+		if err != nil {
+			return err
+		}
 		return json.Unmarshal(data, &entity)
 	})
 
@@ -462,40 +859,162 @@ func GetEntity[T DatabaseEntity](bucketName, sku string) (*T, error) {
 	return &entity, nil
 }
 
+// GetEntities returns the entities stored under the given SKUs, keyed by SKU. Missing
+// SKUs are left out. All lookups share one transaction and seek in key order, so bulk
+// lookups don't pay for an open and a transaction per SKU.
+func GetEntities[T DatabaseEntity](bucketName string, skus []string) (map[string]T, error) {
+	entities := make(map[string]T, len(skus))
+	if len(skus) == 0 {
+		return entities, nil
+	}
+
+	keys := slices.Clone(skus)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	err := bucketView(bucketName, func(tx *bolt.Tx) error {
+		bucket := recordsOf(tx, bucketName)
+		if bucket == nil {
+			// Bucket belongs to a disabled fetcher
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for _, sku := range keys {
+			k, v := cursor.Seek([]byte(sku))
+			if k == nil || string(k) != sku {
+				continue
+			}
+
+			data, err := openValue(bucketName, k, v)
+			if err != nil {
+				return err
+			}
+			var entity T
+			if err := json.Unmarshal(data, &entity); err != nil {
+				return fmt.Errorf("error unmarshaling %s %s: %v", bucketName, sku, err)
+			}
+			entities[sku] = entity
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
 func GetAllEntities[T DatabaseEntity](bucketName string) ([]T, error) {
-	db, err := bolt.Open(DatabaseName, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	var entities []T
+	err := ForEachEntity(bucketName, func(entity T) error {
+		entities = append(entities, entity)
+		return nil
+	})
+
 	if err != nil {
-		return nil, fmt.Errorf("error opening database: %v", err)
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+// ForEachEntity calls fn with every entity of a bucket in SKU order, decoding one
+// record at a time so callers can stream without holding the whole bucket. An error
+// from fn stops the iteration and is returned as is. fn runs inside a read transaction
+// and must not write to the store.
+func ForEachEntity[T DatabaseEntity](bucketName string, fn func(T) error) error {
+	return bucketView(bucketName, func(tx *bolt.Tx) error {
+		return forEachEntityIn(tx, bucketName, fn)
+	})
+}
+
+// forEachEntityIn is ForEachEntity within tx, for reads of the live database
+func forEachEntityIn[T DatabaseEntity](tx *bolt.Tx, bucketName string, fn func(T) error) error {
+	bucket := recordsOf(tx, bucketName)
+	if bucket == nil {
+		// Bucket belongs to a disabled fetcher
+		return nil
+	}
+
+	return bucket.ForEach(func(k, v []byte) error {
+		v, err := openValue(bucketName, k, v)
+		if err != nil {
+			return err
+		}
+		var entity T
+		if err := json.Unmarshal(v, &entity); err != nil {
+			return err
+		}
+		return fn(entity)
+	})
+}
+
+// ListEntities returns up to limit entities of a bucket with SKUs after afterKey (""
+// starts at the beginning), in SKU order. The returned key resumes the listing and is
+// empty once the bucket is exhausted.
+func ListEntities[T DatabaseEntity](bucketName, afterKey string, limit int) ([]T, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d: must be positive", limit)
 	}
-	defer db.Close()
 
 	var entities []T
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
+	var last, next string
+	err := bucketView(bucketName, func(tx *bolt.Tx) error {
+		bucket := recordsOf(tx, bucketName)
+		if bucket == nil {
+			return nil
+		}
 
-		return bucket.ForEach(func(k, v []byte) error {
-			var entity T
-			err := json.Unmarshal(v, &entity)
+		cursor := bucket.Cursor()
+		k, v := cursor.First()
+		if afterKey != "" {
+			k, v = cursor.Seek([]byte(afterKey))
+			if k != nil && string(k) == afterKey {
+				k, v = cursor.Next()
+			}
+		}
+
+		for ; k != nil; k, v = cursor.Next() {
+			if len(entities) == limit {
+				next = last
+				break
+			}
+
+			data, err := openValue(bucketName, k, v)
 			if err != nil {
 				return err
 			}
+			var entity T
+			if err := json.Unmarshal(data, &entity); err != nil {
+				return fmt.Errorf("error unmarshaling %s %s: %v", bucketName, k, err)
+			}
 			entities = append(entities, entity)
-			return nil
-		})
+			last = string(k)
+		}
+		return nil
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return entities, nil
+	return entities, next, nil
 }
 
 // Utility functions
+
+// syncLogger returns a logger labeling every line with the customer account, so syncs
+// of different dealer accounts can be told apart
+func syncLogger(customer string) *log.Logger {
+	return log.New(log.Writer(), fmt.Sprintf("customer=%s ", customer), log.Flags()|log.Lmsgprefix)
+}
+
 func initBucket(bucketName string) error {
-	db, err := bolt.Open(DatabaseName, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	db, err := openDB()
 	if err != nil {
-		return fmt.Errorf("error opening database: %v", err)
+		return err
 	}
 	defer db.Close()
 
@@ -520,6 +1039,19 @@ func isLastPage(links []Link) bool {
 	return selfHref != "" && lastHref != "" && selfHref == lastHref
 }
 
+// sleepContext sleeps for d, returning early with the context error when ctx is canceled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func parseFloat(s string) (float64, error) {
 	if s == "" {
 		return 0.0, nil
@@ -528,26 +1060,34 @@ func parseFloat(s string) (float64, error) {
 }
 
 // Public API - Backward compatibility
-func Init() {
-	for _, bucketName := range []string{"products", "prices"} {
-		if err := initBucket(bucketName); err != nil {
+// Init creates the buckets for the given fetchers, moves the records of catalog
+// buckets in or out of shards to match SHARDED_BUCKETS and applies pending migrations
+func Init(fetchers []Syncer) {
+	for _, fetcher := range fetchers {
+		if err := initBucket(fetcher.BucketName()); err != nil {
 			log.Fatal(err)
 		}
 	}
+	if err := reshardBuckets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := migrate(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func FetchAllProducts(config APIConfig) error {
 	fetcher := ProductFetcher{}
-	return FetchAllEntities(config, fetcher)
+	return FetchAllEntities(context.Background(), config, fetcher)
 }
 
 func FetchAllPrices(config APIConfig) error {
 	fetcher := PriceFetcher{}
-	return FetchAllEntities(config, fetcher)
+	return FetchAllEntities(context.Background(), config, fetcher)
 }
 
 func GetProduct(sku string) (*ProductRequestData, error) {
-	return GetEntity[ProductRequestData]("products", sku)
+	return getCachedEntity[ProductRequestData]("products", sku)
 }
 
 func GetAllProducts() ([]ProductRequestData, error) {
@@ -555,7 +1095,7 @@ func GetAllProducts() ([]ProductRequestData, error) {
 }
 
 func GetPrice(sku string) (*PriceRequestData, error) {
-	return GetEntity[PriceRequestData]("prices", sku)
+	return getCachedEntity[PriceRequestData]("prices", sku)
 }
 
 func GetAllPrices() ([]PriceRequestData, error) {
@@ -563,74 +1103,678 @@ func GetAllPrices() ([]PriceRequestData, error) {
 }
 
 // HTTP Handlers
-// GetAllProductsHandler serves all products in ProductResponseData format
-func GetAllProductsHandler(w http.ResponseWriter, r *http.Request) {
-	// Fetch all products from the database
-	products, err := GetAllProducts()
+// getAllProductsHandler serves all products in ProductResponseData format
+func (s *server) getAllProductsHandler(w http.ResponseWriter, r *http.Request) {
+	// Restrict the response to the fields requested with ?fields=clave,nombre,costo
+	fields, err := productFieldSelector.parse(requestSchema(r).canonicalFields(r.URL.Query().Get("fields")))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching products: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	// Fetch all prices from the database
-	prices, err := GetAllPrices()
+	// Keys with a response profile never see its hidden fields
+	profile := requestProfile(r)
+	fields, err = profile.restrictFields(productFieldSelector, fields)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching prices: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusForbidden)
 		return
 	}
 
-	// Create a map of SKU to price data for quick lookup
-	priceMap := make(map[string]PriceRequestData)
-	for _, price := range prices {
-		priceMap[price.Sku] = price
+	// Look up several products at once with ?sku=A,B,C
+	skus, err := requestedSKUs(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sku: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	// Transform products into ProductResponseData format
+	// Find pieces that fit a space with ?max_width_mm=, ?max_depth_mm=, ?max_height_mm=
+	// and ?max_weight_kg=
+	dims, err := requestedDimensions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid dimensions: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Translate nombre into ?lang= where a description in that language was fetched
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Add the records as received from upstream with ?include=raw
+	raw, err := requestedRaw(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid include: %v", err), http.StatusBadRequest)
+		return
+	}
+	if raw && len(fields) > 0 && !slices.Contains(fields, "raw") {
+		fields = append(fields, "raw")
+	}
+
+	// Price the catalog with the promotions in effect on ?date=, today by default
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Serve a past catalog version for ?version= or ?asOf=
+	version, err := requestedVersion(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid version: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if version > 0 {
+		if raw {
+			http.Error(w, "Raw upstream records are only kept for the current catalog", http.StatusBadRequest)
+			return
+		}
+		snapshot, err := loadVersion(version)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading catalog version: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := buildVersionProductResponses(snapshot, r.URL.Query().Get("upc"), skus)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building catalog: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Catalog-Version", strconv.FormatUint(version, 10))
+		if dims != nil {
+			response = filterDimensions(response, dims)
+		}
+		localizeProducts(response, lang)
+		profile.redactProducts(response)
+		writeProductResponses(w, r, response, fields)
+		return
+	}
+
+	// The dimension index narrows the catalog down to the SKUs that fit, checked again
+	// on the products once built
+	if dims != nil && r.URL.Query().Get("upc") == "" {
+		candidates, err := dims.candidates()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading dimension index: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if len(skus) > 0 {
+			requested := make(map[string]bool, len(skus))
+			for _, sku := range skus {
+				requested[sku] = true
+			}
+			candidates = slices.DeleteFunc(candidates, func(sku string) bool { return !requested[sku] })
+		}
+		if len(candidates) == 0 {
+			writeProductResponses(w, r, []ProductResponseData{}, fields)
+			return
+		}
+		skus = candidates
+	}
+
+	// Serve the full catalog and SKU lookups from memory when preloaded and fresh
+	if r.URL.Query().Get("upc") == "" {
+		if response, ok := preloadedProducts(skus, s.config.StaleAfter, date); ok {
+			if dims != nil {
+				response = filterDimensions(response, dims)
+			}
+			if raw {
+				if err := attachRawEntities(response, profile); err != nil {
+					http.Error(w, fmt.Sprintf("Error reading raw records: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+			localizeProducts(response, lang)
+			profile.redactProducts(response)
+			writeProductResponses(w, r, response, fields)
+			return
+		}
+	}
+
+	// Check whether the last successful sync is too old to be trusted
+	stale, err := staleSince(s.config.Fetchers, s.config.StaleAfter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sync status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if stale != nil {
+		w.Header().Set("X-Stale-Since", stale.UTC().Format(time.RFC3339))
+		if s.config.StaleUnavailable {
+			http.Error(w, fmt.Sprintf("Catalog data is stale: last successful sync at %s", stale.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	// The full catalog is served from the cache while the data is fresh. Cached products
+	// lose their translations, so translated requests build it.
+	upc := r.URL.Query().Get("upc")
+	cacheable := upc == "" && len(skus) == 0 && stale == nil && lang == ""
+
+	promotions, err := promotionsSignature(date)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading promotions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	cacheKey := catalogCacheKey + computedSignature + landedSignature + precedenceSignature + customsSignature + availabilitySignature + promotions
+
 	var response []ProductResponseData
-	for _, product := range products {
-		// Get corresponding price data
-		price, priceExists := priceMap[product.Sku]
-
-		// Create response object
-		respData := ProductResponseData{
-			Nombre:             product.ConsumerDescription,
-			Clave:              product.Sku,
-			Categoria:          product.ItemSalesCategoryCodeKey,
-			Modelo:             fmt.Sprintf("%s %s", product.ItemSeries, product.SeriesId),
-			Proveedor:          product.Supplier,
-			CantidadSillas:     product.ChairQtyPerCarton,
-			CantidadPorPaquete: product.ItemsPerCase,
-			Descontinuado:      product.Status,
-			Alto:               product.UnitHeightMm,
-			Largo:              product.UnitWidthMm,
-			Ancho:              product.UnitDepthMm,
-			Peso:               product.ItemWeightKg,
-		}
-
-		// Add price data if available
-		if priceExists {
-			respData.Costo = price.SellPrice
-			respData.Costo2 = price.TotalNetPrice
+	if cacheable {
+		if data, ok := cacheGet(r.Context(), cacheKey); ok {
+			if len(fields) == 0 && requestSchema(r) == nil && !raw {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				if _, err := w.Write(data); err != nil {
+					log.Printf("Error writing response: %v", err)
+				}
+				return
+			}
+			if err := json.Unmarshal(data, &response); err != nil {
+				response = nil
+			}
 		}
+	}
 
-		response = append(response, respData)
+	if response == nil {
+		response, err = buildProductResponses(upc, skus, stale, date)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building catalog: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if cacheable && cache != nil {
+			if data, err := json.Marshal(response); err == nil {
+				cacheSet(r.Context(), cacheKey, append(data, '\n'))
+			}
+		}
 	}
 
-	// Set response headers
+	if dims != nil {
+		response = filterDimensions(response, dims)
+	}
+	if raw {
+		if err := attachRawEntities(response, profile); err != nil {
+			http.Error(w, fmt.Sprintf("Error reading raw records: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	localizeProducts(response, lang)
+	profile.redactProducts(response)
+	writeProductResponses(w, r, response, fields)
+}
+
+// maxLookupSKUs caps the SKUs of a single ?sku= lookup
+const maxLookupSKUs = 1000
+
+// requestedSKUs returns the distinct SKUs of ?sku=A,B,C in the requested order
+func requestedSKUs(r *http.Request) ([]string, error) {
+	return parseSKUs(r.URL.Query().Get("sku"))
+}
+
+// parseSKUs returns the distinct SKUs of a comma separated list in their order
+func parseSKUs(list string) ([]string, error) {
+	var skus []string
+	seen := make(map[string]bool)
+	for _, sku := range strings.Split(list, ",") {
+		if sku = strings.TrimSpace(sku); sku == "" {
+			continue
+		}
+		sku = lookupSKU(sku)
+		if seen[sku] {
+			continue
+		}
+		seen[sku] = true
+		skus = append(skus, sku)
+	}
+
+	if len(skus) > maxLookupSKUs {
+		return nil, fmt.Errorf("%d SKUs requested, at most %d per lookup", len(skus), maxLookupSKUs)
+	}
+	return skus, nil
+}
+
+// writeProductResponses encodes products, restricted to fields when any were requested
+// and renamed by the request's schema. Products are encoded one at a time, so besides
+// them only the response buffer is held in memory.
+func writeProductResponses(w http.ResponseWriter, r *http.Request, response []ProductResponseData, fields []string) {
+	schema := requestSchema(r)
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	body := newResponseBuffer(w, r)
+	write := func(p []byte) bool {
+		if _, err := body.Write(p); err != nil {
+			log.Printf("Error writing response: %v", err)
+			return false
+		}
+		return true
+	}
 
-	// Encode and send response
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+	if !write([]byte("[")) {
 		return
 	}
+	for i, respData := range response {
+		var element any = respData
+		if len(fields) > 0 {
+			projected, err := productFieldSelector.project(respData, fields)
+			if err != nil {
+				body.fail(http.StatusInternalServerError, "Error selecting fields: %v", err)
+				return
+			}
+			element = projected
+		}
+		element, err := schema.apply(element)
+		if err != nil {
+			body.fail(http.StatusInternalServerError, "Error renaming response fields: %v", err)
+			return
+		}
+		data, err := json.Marshal(element)
+		if err != nil {
+			body.fail(http.StatusInternalServerError, "Error encoding response: %v", err)
+			return
+		}
+
+		if i > 0 && !write([]byte(",")) {
+			return
+		}
+		if !write(data) {
+			return
+		}
+	}
+	if write([]byte("]\n")) {
+		body.close()
+	}
+}
+
+// servedProducts returns the full catalog, or the products with the given SKUs, priced
+// for date: from the preloaded catalog when it can answer, built otherwise with stale
+// data flagged as /products does. It writes the error and returns false on failure.
+func (s *server) servedProducts(w http.ResponseWriter, r *http.Request, skus []string, date string) ([]ProductResponseData, bool) {
+	if response, ok := preloadedProducts(skus, s.config.StaleAfter, date); ok {
+		return response, true
+	}
+
+	stale, err := staleSince(s.config.Fetchers, s.config.StaleAfter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sync status: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	if stale != nil {
+		w.Header().Set("X-Stale-Since", stale.UTC().Format(time.RFC3339))
+		if s.config.StaleUnavailable {
+			http.Error(w, fmt.Sprintf("Catalog data is stale: last successful sync at %s", stale.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable)
+			return nil, false
+		}
+	}
+	response, err := buildProductResponses("", skus, stale, date)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building catalog: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return response, true
+}
+
+// buildProductResponses merges the stored products (all of them, the one carrying upc or
+// those with the given SKUs) with their prices and replacements into the response format.
+// Prices are the promotional ones in effect on date; an empty date keeps regular prices.
+func buildProductResponses(upc string, skus []string, stale *time.Time, date string) ([]ProductResponseData, error) {
+	// Fetch the requested products and their prices from the database
+	var products []ProductRequestData
+	var supplierProducts []SupplierProduct
+	priceMap := make(map[string]PriceRequestData)
+
+	if len(skus) > 0 {
+		found, err := GetEntities[ProductRequestData]("products", skus)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching products: %v", err)
+		}
+
+		// Kit components are priced too, for costoKit
+		priced := slices.Clone(skus)
+		for _, sku := range skus {
+			if product, ok := found[sku]; ok {
+				products = append(products, product)
+				for _, component := range product.Components {
+					priced = append(priced, component.Sku)
+				}
+			}
+		}
+
+		priceMap, err = GetEntities[PriceRequestData]("prices", priced)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching prices: %v", err)
+		}
+	} else if upc != "" {
+		product, err := GetProductByUPC(upc)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("error fetching products: %v", err)
+		}
+		if product != nil {
+			products = append(products, *product)
+			if price, err := GetPrice(product.Sku); err == nil {
+				priceMap[price.Sku] = *price
+			}
+		}
+	} else {
+		var err error
+		products, err = GetAllProducts()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching products: %v", err)
+		}
+
+		// The full catalog also carries the products imported from other suppliers,
+		// each SKU served from the supplier winning its collisions
+		imported, err := GetSupplierProducts()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching supplier products: %v", err)
+		}
+		products, supplierProducts = resolveCollisions(products, imported)
+
+		prices, err := GetAllPrices()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching prices: %v", err)
+		}
+
+		// Create a map of SKU to price data for quick lookup
+		for _, price := range prices {
+			priceMap[price.Sku] = price
+		}
+	}
+
+	// Manual replacements take precedence over the ones from Ashley
+	overrides, err := GetReplacementOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching replacements: %v", err)
+	}
+
+	applied, err := applyPromotions(priceMap, date)
+	if err != nil {
+		return nil, err
+	}
+
+	response := mergeProductResponses(products, priceMap, overrides, stale)
+	markPromotions(response, applied)
+	if err := applyContracts(response, products, priceMap); err != nil {
+		return nil, err
+	}
+	if err := applyAvailability(response, upc == "" && len(skus) == 0); err != nil {
+		return nil, err
+	}
+	response = append(response, supplierProductResponses(supplierProducts)...)
+	if err := applyCustoms(response); err != nil {
+		return nil, err
+	}
+	if err := applyAvailabilityState(response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// mergeProductResponses transforms products into ProductResponseData format with their
+// prices and resolved replacements
+func mergeProductResponses(products []ProductRequestData, priceMap map[string]PriceRequestData, overrides map[string]string, stale *time.Time) []ProductResponseData {
+	productMap := make(map[string]ProductRequestData, len(products))
+	for _, product := range products {
+		productMap[product.Sku] = product
+	}
+	replacementLookup := productReplacementLookup(productMap)
+
+	response := []ProductResponseData{}
+	for _, product := range products {
+		respData := newProductResponseData(product, priceMap)
+		respData.Reemplazo = resolveReplacement(product.Sku, overrides, replacementLookup).Reemplazo
+		respData.StaleSince = stale
+		response = append(response, respData)
+	}
+
+	return response
+}
+
+// newProductResponseData maps a stored product and its price (if any) into the response format
+func newProductResponseData(product ProductRequestData, priceMap map[string]PriceRequestData) ProductResponseData {
+	respData := ProductResponseData{
+		Nombre:             product.ConsumerDescription,
+		Clave:              product.Sku,
+		Categoria:          product.ItemSalesCategoryCodeKey,
+		Modelo:             fmt.Sprintf("%s %s", product.ItemSeries, product.SeriesId),
+		Proveedor:          product.Supplier,
+		CantidadSillas:     product.ChairQtyPerCarton,
+		CantidadPorPaquete: product.ItemsPerCase,
+		Descontinuado:      product.Status,
+		Alto:               product.UnitHeightMm,
+		Largo:              product.UnitWidthMm,
+		Ancho:              product.UnitDepthMm,
+		Peso:               product.ItemWeightKg,
+		Upc:                product.Upc,
+		Gtin:               product.Gtin,
+		NumeroModelo:       product.ModelNumber,
+		Empaque:            productPackaging(product),
+		Descriptions:       product.Descriptions,
+	}
+
+	// Add price data if available
+	var pricePtr *PriceRequestData
+	if price, priceExists := priceMap[product.Sku]; priceExists {
+		respData.Costo = price.SellPrice
+		respData.Costo2 = price.TotalNetPrice
+		respData.CostoImportacion = landedCost.compute(product, price)
+		pricePtr = &price
+	}
+	respData.Calculados = computeFields(product, pricePtr)
+
+	// Offer the rolled up component price for kits whose components are all priced
+	if rollup := rollUpComponents(product.Components, priceMap); rollup.Complete {
+		respData.CostoKit = &rollup.Costo
+	}
+
+	return respData
+}
+
+// productPackaging groups the carton data of a product, nil when Ashley sent none.
+// Without a carton count, the listed cartons are counted.
+func productPackaging(product ProductRequestData) *api.Packaging {
+	if product.CartonsPerUnit == 0 && len(product.Cartons) == 0 {
+		return nil
+	}
+
+	packaging := &api.Packaging{CajasPorUnidad: product.CartonsPerUnit}
+	if packaging.CajasPorUnidad == 0 {
+		packaging.CajasPorUnidad = len(product.Cartons)
+	}
+	for i, carton := range product.Cartons {
+		number := carton.CartonNumber
+		if number == 0 {
+			number = i + 1
+		}
+		packaging.Cajas = append(packaging.Cajas, api.Carton{
+			Numero: number,
+			Alto:   carton.HeightMm,
+			Largo:  carton.WidthMm,
+			Ancho:  carton.DepthMm,
+			Peso:   carton.WeightKg,
+		})
+		packaging.PesoTotal += carton.WeightKg
+	}
+	packaging.PesoTotal = roundCents(packaging.PesoTotal)
+	return packaging
+}
+
+// ServerConfig holds the HTTP server settings
+type ServerConfig struct {
+	Port     string
+	APIKeys  map[string]APIKey
+	Fetchers []Syncer
+
+	// Jobs runs manual syncs and retention runs, which execute Sync and Retention
+	Jobs      *JobQueue
+	Sync      JobFunc
+	Retention JobFunc
+
+	// Data is considered stale when the oldest successful sync is older than StaleAfter (0 disables).
+	// StaleUnavailable answers stale requests with 503 instead of flagging them.
+	StaleAfter       time.Duration
+	StaleUnavailable bool
+
+	// Upstream holds the Ashley API credentials used by live passthrough lookups
+	Upstream    APIConfig
+	Passthrough PassthroughConfig
+
+	Reservations ReservationConfig
+	Quotes       QuoteConfig
+	Tiers        map[string]*PriceTier      // Price tiers by name, selected by API key or ?tier=
+	Schemas      map[string]*ResponseSchema // Response schemas by name, selected by API key or ?schema=
+	Channels     map[string]*Channel        // Sales channels by name, served at /channels/{name}/products
+	Preload      PreloadConfig
+	Vehicles     []ShipmentVehicle // Capacities orders are split by, the first one by default
+	RateLimit    RateLimitConfig
+	Debug        DebugConfig // pprof and expvar, on a port of their own
+
+	// Ready is called once the port is listening, to tell the process manager
+	Ready func()
 }
 
-// StartServer starts the HTTP server with the products endpoint
-func StartServer(port string) error {
-	http.HandleFunc("/products", GetAllProductsHandler)
-	log.Printf("Starting server on port %s...", port)
-	return http.ListenAndServe(":"+port, nil)
+// serverShutdownTimeout is how long requests in flight may take to finish once the
+// server is stopped
+const serverShutdownTimeout = 30 * time.Second
+
+type server struct {
+	config      ServerConfig
+	mux         *http.ServeMux
+	passthrough *passthrough // nil when disabled
+	limiter     *rateLimiter // nil when disabled
+}
+
+// handle registers a handler behind the given role and the rate limit
+func (s *server) handle(pattern string, role Role, handler http.HandlerFunc) {
+	// Admin operations are recorded in the audit log, admin reads aren't
+	if role == RoleAdmin && !strings.HasPrefix(pattern, "GET ") {
+		handler = s.audit(pattern, handler)
+	}
+	s.mux.HandleFunc(pattern, s.trackUsage(pattern, s.limitRate(s.requireRole(role, handler))))
+}
+
+// StartServer serves the products and admin endpoints until ctx is canceled, then
+// lets the requests in flight finish for up to serverShutdownTimeout
+func StartServer(ctx context.Context, config ServerConfig) error {
+	s := &server{config: config, mux: http.NewServeMux()}
+
+	if len(config.APIKeys) == 0 {
+		log.Print("No API keys configured: read endpoints are public, write and admin endpoints are disabled")
+	}
+	if config.Passthrough.Rate > 0 {
+		s.passthrough = newPassthrough(config.Upstream, config.Passthrough)
+	}
+	if config.RateLimit.Rate > 0 {
+		s.limiter = newRateLimiter(config.RateLimit)
+	}
+	if config.Preload.Enabled {
+		if err := startPreload(config.Preload, config.Fetchers); err != nil {
+			return fmt.Errorf("error preloading catalog: %v", err)
+		}
+	}
+
+	s.handle("GET /products", RoleRead, compressed(s.getAllProductsHandler))
+	s.handle("POST /products/import", RoleAdmin, s.importProductsHandler)
+	s.handle("GET /exports/products.csv", RoleRead, compressed(s.exportProductsHandler))
+	s.handle("GET /exports/customs.csv", RoleRead, compressed(s.exportCustomsHandler))
+	s.handle("GET /exports/products-delta.csv", RoleRead, compressed(s.exportProductsDeltaHandler))
+	s.handle("GET /products/compare", RoleRead, s.compareProductsHandler)
+	s.handle("GET /products/{sku}/components", RoleRead, s.componentsHandler)
+	s.handle("GET /products/{sku}/replacement", RoleRead, s.replacementHandler)
+	s.handle("GET /products/{sku}/similar", RoleRead, s.similarProductsHandler)
+	s.handle("GET /upstream/products/{sku}", RoleRead, s.upstreamProductHandler)
+	s.handle("GET /inventory/{sku}", RoleRead, s.inventoryHandler)
+	s.handle("POST /inventory/{sku}/reserve", RoleWrite, s.reserveHandler)
+	s.handle("DELETE /inventory/reservations/{id}", RoleWrite, s.releaseReservationHandler)
+	s.handle("GET /price-list", RoleRead, compressed(s.priceListHandler))
+	s.handle("GET /exports/price-list.csv", RoleRead, compressed(s.exportPriceListHandler))
+	s.handle("POST /quotes", RoleWrite, s.createQuoteHandler)
+	s.handle("GET /quotes/{id}", RoleWrite, s.quoteHandler)
+	s.handle("GET /quotes/{id}/pdf", RoleWrite, s.quotePDFHandler)
+	s.handle("POST /orders/split", RoleWrite, s.splitOrderHandler)
+	s.handle("GET /prices/{sku}/history", RoleRead, s.priceHistoryHandler)
+	s.handle("GET /analytics/price-trends", RoleRead, s.priceTrendsHandler)
+	s.handle("GET /versions", RoleRead, s.versionsHandler)
+	s.handle("GET /versions/{from}/diff/{to}", RoleRead, s.versionDiffHandler)
+	s.handle("GET /changes", RoleRead, s.changesHandler)
+	s.handle("PUT /changes/cursors/{consumer}", RoleWrite, s.setChangeCursorHandler)
+	s.handle("GET /changes/cursors", RoleAdmin, s.changeCursorsHandler)
+	s.handle("POST /sync", RoleAdmin, s.triggerSyncHandler)
+	s.handle("DELETE /sync/{jobID}", RoleAdmin, s.cancelSyncHandler)
+	s.handle("GET /sync/jobs", RoleAdmin, s.jobHistoryHandler)
+	s.handle("GET /sync/jobs/{jobID}", RoleAdmin, s.jobHandler)
+	s.handle("GET /sync/status", RoleAdmin, s.syncStatusHandler)
+	s.handle("GET /sync/progress", RoleAdmin, s.syncProgressHandler)
+	s.handle("GET /metrics", RoleRead, metrics.Handler)
+	s.handle("GET /channels", RoleRead, s.channelsHandler)
+	s.handle("GET /channels/{name}/products", RoleRead, s.channelProductsHandler)
+	s.handle("GET /schemas", RoleRead, s.schemasHandler)
+	s.handle("GET /schemas/{name}", RoleRead, s.jsonSchemaHandler)
+	s.handle("GET /admin/keys", RoleAdmin, s.listKeysHandler)
+	s.handle("GET /admin/usage", RoleAdmin, s.usageHandler)
+	s.handle("GET /admin/sku-conflicts", RoleAdmin, s.skuConflictsHandler)
+	s.handle("GET /admin/journal", RoleAdmin, s.journalHandler)
+	s.handle("GET /admin/audit", RoleAdmin, s.auditHandler)
+	s.handle("POST /admin/journal/rollback", RoleAdmin, s.rollbackHandler)
+	s.handle("POST /admin/rollback", RoleAdmin, s.restoreVersionHandler)
+	s.handle("GET /admin/quarantine", RoleAdmin, s.quarantineHandler)
+	s.handle("POST /admin/retention", RoleAdmin, s.triggerRetentionHandler)
+	s.handle("PUT /admin/replacements/{sku}", RoleAdmin, s.setReplacementHandler)
+	s.handle("DELETE /admin/replacements/{sku}", RoleAdmin, s.deleteReplacementHandler)
+	s.handle("GET /admin/contracts", RoleAdmin, s.contractsHandler)
+	s.handle("POST /admin/contracts", RoleAdmin, s.importContractsHandler)
+	s.handle("GET /admin/promotions", RoleAdmin, s.promotionsHandler)
+	s.handle("POST /admin/promotions", RoleAdmin, s.importPromotionsHandler)
+	s.handle("GET /admin/customs", RoleAdmin, s.customsHandler)
+	s.handle("POST /admin/customs", RoleAdmin, s.importCustomsHandler)
+	s.handle("PUT /admin/customs/{scope}/{key}", RoleAdmin, s.setCustomsHandler)
+	s.handle("DELETE /admin/customs/{scope}/{key}", RoleAdmin, s.deleteCustomsHandler)
+	s.handle("GET /admin/price-audit", RoleAdmin, s.priceAuditHandler)
+	s.handle("POST /admin/price-audit/accept", RoleAdmin, s.acceptPricesHandler)
+	s.handle("GET /admin/blacklist", RoleAdmin, s.blacklistHandler)
+	s.handle("PUT /admin/blacklist/{sku}", RoleAdmin, s.setBlacklistHandler)
+	s.handle("DELETE /admin/blacklist/{sku}", RoleAdmin, s.deleteBlacklistHandler)
+	s.handle("GET /admin/loglevel", RoleAdmin, s.logLevelHandler)
+	s.handle("PUT /admin/loglevel", RoleAdmin, s.setLogLevelHandler)
+	s.handle("DELETE /admin/loglevel", RoleAdmin, s.resetLogLevelHandler)
+	s.handle("GET /admin/upstream-logging", RoleAdmin, s.upstreamLoggingHandler)
+	s.handle("PUT /admin/upstream-logging", RoleAdmin, s.setUpstreamLoggingHandler)
+
+	go s.debugServer(ctx)
+
+	log.Printf("Starting server on port %s...", config.Port)
+	listener, err := net.Listen("tcp", ":"+config.Port)
+	if err != nil {
+		return err
+	}
+	if config.Ready != nil {
+		config.Ready()
+	}
+
+	httpServer := &http.Server{Handler: s.mux}
+	served := make(chan error, 1)
+	go func() { served <- httpServer.Serve(listener) }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Print("Stopping server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error stopping server: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+// testDatabase points the database at an empty file in a temporary directory,
+// migrated and holding the product and price buckets, and silences the log for the
+// test. The shared handle is closed when the test ends, so the next one opens its own
+// file.
+func testDatabase(tb testing.TB) *store {
+	tb.Helper()
+	tb.Chdir(tb.TempDir())
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() {
+		if err := closeDB(); err != nil {
+			tb.Errorf("error closing database: %v", err)
+		}
+		invalidateCache()
+		log.SetOutput(output)
+	})
+
+	if err := migrate(); err != nil {
+		tb.Fatal(err)
+	}
+	for _, bucket := range []string{"products", "prices"} {
+		if err := initBucket(bucket); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	db, err := openDB()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
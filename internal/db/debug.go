@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// DebugConfig serves the runtime profiles of net/http/pprof and the expvar variables
+// on a port of their own, kept off the API port
+type DebugConfig struct {
+	Addr string // host:port to listen on, e.g. 127.0.0.1:6060; empty disables the debug server
+	Auth bool   // Require an admin API key, as the admin endpoints do
+}
+
+// debugServer serves /debug/pprof/ and /debug/vars on config.Debug.Addr until ctx is
+// canceled. Failing to listen is logged rather than stopping the service.
+func (s *server) debugServer(ctx context.Context) {
+	config := s.config.Debug
+	if config.Addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		if config.Auth {
+			handler = s.requireRole(RoleAdmin, handler)
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+	handle("/debug/pprof/", pprof.Index)
+	handle("/debug/pprof/cmdline", pprof.Cmdline)
+	handle("/debug/pprof/profile", pprof.Profile)
+	handle("/debug/pprof/symbol", pprof.Symbol)
+	handle("/debug/pprof/trace", pprof.Trace)
+	handle("/debug/vars", expvar.Handler().ServeHTTP)
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		log.Printf("Error starting debug server: %v", err)
+		return
+	}
+	if !config.Auth {
+		log.Printf("Serving pprof and expvar on %s without authentication", config.Addr)
+	} else {
+		log.Printf("Serving pprof and expvar on %s", config.Addr)
+	}
+
+	// Profiles take as long as ?seconds= asks, so there is no write timeout
+	httpServer := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("Error running debug server: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Operations of the rows of a delta export
+const (
+	DeltaAdded   = "added"
+	DeltaChanged = "changed"
+	DeltaRemoved = "removed"
+)
+
+// deltaOperationColumn is the column of a delta export holding the row's operation
+const deltaOperationColumn = "operacion"
+
+// deltaVersions resolves ?from= and ?to= of a delta export. to defaults to the newest
+// catalog version and from to the retained version before to, so by default the
+// delta covers the last completed sync.
+func deltaVersions(r *http.Request) (uint64, uint64, error) {
+	parse := func(name string) (uint64, error) {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			return 0, nil
+		}
+		version, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || version == 0 {
+			return 0, fmt.Errorf("%s must be a positive integer, got %q", name, value)
+		}
+		return version, nil
+	}
+	from, err := parse("from")
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parse("to")
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > 0 && to > 0 {
+		if from >= to {
+			return 0, 0, fmt.Errorf("from (%d) must be before to (%d)", from, to)
+		}
+		return from, to, nil
+	}
+
+	versions, err := GetVersions() // Newest first
+	if err != nil {
+		return 0, 0, err
+	}
+	if to == 0 {
+		if len(versions) == 0 {
+			return 0, 0, fmt.Errorf("%w: no catalog version retained", ErrNotFound)
+		}
+		to = versions[0].Version
+	}
+	if from == 0 {
+		for _, version := range versions {
+			if version.Version < to {
+				return version.Version, to, nil
+			}
+		}
+		return 0, 0, fmt.Errorf("%w: no catalog version retained before version %d", ErrNotFound, to)
+	}
+	if from >= to {
+		return 0, 0, fmt.Errorf("from (%d) must be before to (%d)", from, to)
+	}
+	return from, to, nil
+}
+
+// versionExportRows returns the export rows of the catalog served at a version, by SKU
+func versionExportRows(version uint64, fields []string, profile *ResponseProfile) (map[string]map[string]string, error) {
+	snapshot, err := loadVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	response, err := buildVersionProductResponses(snapshot, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	profile.redactProducts(response)
+
+	rows, err := exportRows(response, fields)
+	if err != nil {
+		return nil, err
+	}
+	bySKU := make(map[string]map[string]string, len(rows))
+	for i, row := range rows {
+		bySKU[response[i].Clave] = row
+	}
+	return bySKU, nil
+}
+
+// diffExportRows returns the rows added, changed or removed between two exports, by
+// SKU, each with its operation. Removed rows hold the values they had before.
+func diffExportRows(before, after map[string]map[string]string) []map[string]string {
+	skus := make([]string, 0, len(after))
+	for sku := range after {
+		skus = append(skus, sku)
+	}
+	for sku := range before {
+		if _, ok := after[sku]; !ok {
+			skus = append(skus, sku)
+		}
+	}
+	sort.Strings(skus)
+
+	var delta []map[string]string
+	for _, sku := range skus {
+		old, existed := before[sku]
+		row, exists := after[sku]
+		var operation string
+		switch {
+		case !existed:
+			operation = DeltaAdded
+		case !exists:
+			operation, row = DeltaRemoved, old
+		case !maps.Equal(old, row):
+			operation = DeltaChanged
+		default:
+			continue
+		}
+
+		row = maps.Clone(row)
+		row[deltaOperationColumn] = operation
+		delta = append(delta, row)
+	}
+	return delta
+}
+
+// exportProductsDeltaHandler serves the products added, changed or removed between two
+// catalog versions (by default, by the last completed sync) as CSV, with the columns
+// of /exports/products.csv after an operacion column
+func (s *server) exportProductsDeltaHandler(w http.ResponseWriter, r *http.Request) {
+	fields, ok := exportFields(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, err := deltaVersions(r)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid versions: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	profile := requestProfile(r)
+	before, err := versionExportRows(from, fields, profile)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	after, err := versionExportRows(to, fields, profile)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+
+	rows := diffExportRows(before, after)
+	columns := append([]string{deltaOperationColumn}, exportColumns(rows, fields)...)
+	columns, rows = requestSchema(r).applyColumns(columns, rows)
+
+	w.Header().Set("X-Catalog-Version", strconv.FormatUint(to, 10))
+	writeCSV(w, r, fmt.Sprintf("products-delta-%d-%d.csv", from, to), columns, rows)
+}
+
+// writeVersionError answers a failure to load a catalog version
+func writeVersionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Error building export: %v", err), http.StatusInternalServerError)
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+)
+
+// DependsOn declares that a fetcher needs others to complete first within a sync, e.g.
+// inventory needs the SKU list of products. Dependencies left out of a sync (by
+// API_FETCHERS) don't hold the fetcher back: it reads what their last sync stored.
+// Panics on unknown fetchers and on dependency cycles, like registering twice does.
+func DependsOn(name string, dependencies ...string) {
+	if _, ok := registry.syncers[name]; !ok {
+		panic(fmt.Sprintf("dependencies declared for unknown fetcher %q", name))
+	}
+	for _, dependency := range dependencies {
+		if _, ok := registry.syncers[dependency]; !ok {
+			panic(fmt.Sprintf("fetcher %q depends on unknown fetcher %q", name, dependency))
+		}
+		if dependency == name || dependsOn(dependency, name) {
+			panic(fmt.Sprintf("fetcher %q depending on %q creates a cycle", name, dependency))
+		}
+		if !slices.Contains(registry.dependencies[name], dependency) {
+			registry.dependencies[name] = append(registry.dependencies[name], dependency)
+		}
+	}
+}
+
+// dependsOn reports whether name depends on dependency, directly or through others
+func dependsOn(name, dependency string) bool {
+	for _, direct := range registry.dependencies[name] {
+		if direct == dependency || dependsOn(direct, dependency) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dependencies returns the fetchers a fetcher waits for during a sync
+func Dependencies(name string) []string {
+	return slices.Clone(registry.dependencies[name])
+}
+
+// orderByDependencies moves fetchers after the ones they depend on, otherwise keeping
+// their order
+func orderByDependencies(fetchers []Syncer) []Syncer {
+	ordered := make([]Syncer, 0, len(fetchers))
+	placed := make(map[string]bool, len(fetchers))
+	pending := slices.Clone(fetchers)
+	for len(pending) > 0 {
+		for i, fetcher := range pending {
+			// DependsOn refuses cycles, taking the last one is only a safeguard
+			if i == len(pending)-1 || dependenciesIn(fetcher.Name(), pending, placed) {
+				ordered = append(ordered, fetcher)
+				placed[fetcher.Name()] = true
+				pending = slices.Delete(pending, i, i+1)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// dependenciesIn reports whether every dependency of name among pending was placed
+func dependenciesIn(name string, pending []Syncer, placed map[string]bool) bool {
+	for _, dependency := range registry.dependencies[name] {
+		if placed[dependency] {
+			continue
+		}
+		if slices.ContainsFunc(pending, func(s Syncer) bool { return s.Name() == dependency }) {
+			return false
+		}
+	}
+	return true
+}
+
+// dependenciesDone reports whether the dependencies taking part in a sync finished,
+// given the fetchers that did and whether they succeeded. failed names the first that
+// didn't succeed.
+func dependenciesDone(dependencies []string, inSync, finished map[string]bool) (ready bool, failed string) {
+	for _, dependency := range dependencies {
+		if !inSync[dependency] {
+			continue
+		}
+		succeeded, ok := finished[dependency]
+		if !ok {
+			return false, ""
+		}
+		if !succeeded && failed == "" {
+			failed = dependency
+		}
+	}
+	return true, failed
+}
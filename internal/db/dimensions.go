@@ -0,0 +1,191 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// productsByDimensionBucketName indexes products by each of their dimensions, so
+// ?max_width_mm= and the like only read the products that fit
+const productsByDimensionBucketName = "products_by_dimension"
+
+// dimension is a measure products can be filtered by
+type dimension struct {
+	name  string // Index key prefix
+	param string // Query parameter holding the maximum
+	value func(ProductRequestData) float64
+}
+
+// dimensions are the filterable measures, in the order filters are applied
+var dimensions = []dimension{
+	{"width", "max_width_mm", func(p ProductRequestData) float64 { return p.UnitWidthMm }},
+	{"depth", "max_depth_mm", func(p ProductRequestData) float64 { return p.UnitDepthMm }},
+	{"height", "max_height_mm", func(p ProductRequestData) float64 { return p.UnitHeightMm }},
+	{"weight", "max_weight_kg", func(p ProductRequestData) float64 { return p.ItemWeightKg }},
+}
+
+// dimensionKey is the index key of a product's measure: the measure in thousandths,
+// zero padded so keys sort by it, followed by the SKU
+func dimensionKey(d dimension, value float64, sku string) string {
+	return fmt.Sprintf("%s:%020d:%s", d.name, uint64(math.Round(value*1000)), sku)
+}
+
+// dimensionIndexKeys returns the dimension index keys of a product. Unknown (zero)
+// measures are not indexed, so products without them never match a filter.
+func dimensionIndexKeys(p ProductRequestData) []string {
+	var keys []string
+	for _, d := range dimensions {
+		if value := d.value(p); value > 0 {
+			keys = append(keys, dimensionKey(d, value, p.Sku))
+		}
+	}
+	return keys
+}
+
+// dimensionFilter holds the maximum of each filtered measure
+type dimensionFilter map[string]float64
+
+// requestedDimensions parses the max_*_mm and max_weight_kg parameters of a request,
+// nil when there are none
+func requestedDimensions(r *http.Request) (dimensionFilter, error) {
+	var filter dimensionFilter
+	for _, d := range dimensions {
+		value := strings.TrimSpace(r.URL.Query().Get(d.param))
+		if value == "" {
+			continue
+		}
+		maximum, err := strconv.ParseFloat(value, 64)
+		if err != nil || maximum <= 0 || math.IsInf(maximum, 0) {
+			return nil, fmt.Errorf("%s must be a positive number, got %q", d.param, value)
+		}
+		if filter == nil {
+			filter = make(dimensionFilter)
+		}
+		filter[d.name] = maximum
+	}
+	return filter, nil
+}
+
+// fits reports whether a product's measures are within the filter, checked on the
+// records themselves as index entries of former measures are never removed
+func (f dimensionFilter) fits(product ProductResponseData) bool {
+	measures := map[string]float64{
+		"width":  product.Largo,
+		"depth":  product.Ancho,
+		"height": product.Alto,
+		"weight": product.Peso,
+	}
+	for name, maximum := range f {
+		if measure := measures[name]; measure <= 0 || measure > maximum {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the SKUs, sorted, whose index entries are within every maximum
+// of the filter
+func (f dimensionFilter) candidates() ([]string, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var matched map[string]bool
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(productsByDimensionBucketName))
+		if bucket == nil {
+			matched = map[string]bool{}
+			return nil
+		}
+
+		for _, d := range dimensions {
+			maximum, ok := f[d.name]
+			if !ok {
+				continue
+			}
+
+			// Keys sort by measure, so the scan stops at the first one past the maximum
+			within := make(map[string]bool)
+			limit := []byte(dimensionKey(d, maximum, ""))
+			prefix := []byte(d.name + ":")
+			c := bucket.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if bytes.Compare(k[:len(limit)], limit) > 0 {
+					break
+				}
+				if sku := string(v); matched == nil || matched[sku] {
+					within[sku] = true
+				}
+			}
+			matched = within
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	skus := make([]string, 0, len(matched))
+	for sku := range matched {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+	return skus, nil
+}
+
+// filterDimensions keeps the products within the filter
+func filterDimensions(response []ProductResponseData, filter dimensionFilter) []ProductResponseData {
+	fitting := response[:0]
+	for _, product := range response {
+		if filter.fits(product) {
+			fitting = append(fitting, product)
+		}
+	}
+	return fitting
+}
+
+// indexDimensions builds the dimension index of the stored products when it doesn't
+// exist yet, for databases synced before it was added
+func indexDimensions(tx *bolt.Tx) (int, error) {
+	if tx.Bucket([]byte(productsByDimensionBucketName)) != nil {
+		return 0, nil
+	}
+	bucket, err := tx.CreateBucket([]byte(productsByDimensionBucketName))
+	if err != nil {
+		return 0, err
+	}
+
+	products := recordsOf(tx, ProductFetcher{}.GetBucketName())
+	if products == nil {
+		return 0, nil
+	}
+	indexed := 0
+	err = products.ForEach(func(k, v []byte) error {
+		data, err := openValue(ProductFetcher{}.GetBucketName(), k, v)
+		if err != nil {
+			return err
+		}
+		var product ProductRequestData
+		if err := json.Unmarshal(data, &product); err != nil {
+			return fmt.Errorf("error unmarshaling product %s: %v", k, err)
+		}
+		for _, key := range dimensionIndexKeys(product) {
+			if err := bucket.Put([]byte(key), k); err != nil {
+				return err
+			}
+		}
+		indexed++
+		return nil
+	})
+	return indexed, err
+}
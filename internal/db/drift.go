@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+)
+
+// Schema drift modes: how fields of upstream payloads the service doesn't model are handled
+const (
+	SchemaDriftOff    = "off"
+	SchemaDriftLog    = "log"    // Report new fields and keep decoding
+	SchemaDriftStrict = "strict" // Report new fields and fail the request
+)
+
+var upstreamUnknownFieldsTotal = metrics.NewCounter("ashley_upstream_unknown_fields_total",
+	"Upstream responses carrying a field the service doesn't model, by endpoint and field path", "endpoint", "field")
+
+// driftReported holds the endpoint and field pairs already logged, so each new field
+// is logged once per process rather than once per page
+var driftReported = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// ParseSchemaDrift checks a schema drift mode, empty meaning off
+func ParseSchemaDrift(s string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(s)); mode {
+	case "":
+		return SchemaDriftOff, nil
+	case SchemaDriftOff, SchemaDriftLog, SchemaDriftStrict:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q (available: %s, %s, %s)", s, SchemaDriftOff, SchemaDriftLog, SchemaDriftStrict)
+	}
+}
+
+// checkSchemaDrift reports the fields of an upstream payload that T doesn't model. In
+// strict mode the payload is then decoded with DisallowUnknownFields, failing the
+// request on the first of them.
+func checkSchemaDrift[T any](mode, endpoint string, body []byte) error {
+	if mode != SchemaDriftLog && mode != SchemaDriftStrict {
+		return nil
+	}
+
+	var payload any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil // Reported by the regular decoding
+	}
+	fields := make(map[string]bool)
+	unknownFields(payload, reflect.TypeFor[T](), "", fields)
+
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+		upstreamUnknownFieldsTotal.Inc(endpoint, path)
+	}
+	sort.Strings(paths)
+
+	driftReported.Lock()
+	var fresh []string
+	for _, path := range paths {
+		if key := endpoint + " " + path; !driftReported.seen[key] {
+			driftReported.seen[key] = true
+			fresh = append(fresh, path)
+		}
+	}
+	driftReported.Unlock()
+	if len(fresh) > 0 {
+		log.Printf("Schema drift: %s responses carry fields the service doesn't model: %s", endpoint, strings.Join(fresh, ", "))
+	}
+
+	if mode == SchemaDriftStrict && len(paths) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		var strict T
+		if err := decoder.Decode(&strict); err != nil {
+			return fmt.Errorf("schema drift in %s response: %v", endpoint, err)
+		}
+	}
+	return nil
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// unknownFields adds to fields the paths of the values of payload that decoding into t
+// drops, e.g. "entities[].freightClass". Names match case-insensitively, as
+// encoding/json does.
+func unknownFields(payload any, t reflect.Type, path string, fields map[string]bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// Types decoding themselves decide what they drop
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch value := payload.(type) {
+	case map[string]any:
+		switch t.Kind() {
+		case reflect.Map:
+			for _, item := range value {
+				unknownFields(item, t.Elem(), path+"{}", fields)
+			}
+		case reflect.Struct:
+			known := jsonFields(t)
+			for name, item := range value {
+				fieldPath := name
+				if path != "" {
+					fieldPath = path + "." + name
+				}
+				fieldType, ok := known[strings.ToLower(name)]
+				if !ok {
+					fields[fieldPath] = true
+					continue
+				}
+				unknownFields(item, fieldType, fieldPath, fields)
+			}
+		}
+	case []any:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, item := range value {
+				unknownFields(item, t.Elem(), path+"[]", fields)
+			}
+		}
+	}
+}
+
+// jsonFields returns the types of the fields encoding/json decodes into a struct, by
+// lower-cased name, including the promoted fields of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	known := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embedded, fieldType := range jsonFields(field.Type) {
+				known[embedded] = fieldType
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		known[strings.ToLower(name)] = field.Type
+	}
+	return known
+}
@@ -0,0 +1,476 @@
+package db
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A dump is a tar archive holding metadata.json followed by one buckets/<name>.ndjson
+// file per bucket, a line per key. Values are written decrypted and sharded buckets
+// as a single file, so an archive loads into a database with other encryption and
+// sharding settings, or into another store altogether.
+
+// DumpFormatVersion is the version of the archive layout written by Dump
+const DumpFormatVersion = 1
+
+const (
+	dumpMetadataName = "metadata.json"
+	dumpBucketsDir   = "buckets/"
+)
+
+// redactedBuckets are left out of dumps with redacted costs: they hold copies of the
+// records in forms that can't be redacted (compressed pages and snapshots, hashes of
+// the original records) or values derived from costs
+var redactedBuckets = map[string]bool{
+	rawPagesBucketName:      true,
+	rawEntitiesBucketName:   true,
+	pageETagsBucketName:     true,
+	versionsBucketName:      true,
+	versionIndexBucketName:  true,
+	priceHistoryBucketName:  true,
+	priceBaselineBucketName: true,
+	recordHashesBucketName:  true,
+	journalBucketName:       true,
+	quotesBucketName:        true,
+	auditBucketName:         true,
+}
+
+// DumpOptions are the options of Dump
+type DumpOptions struct {
+	// RedactCosts removes the cost fields hidden by the nocost profile from every
+	// record and leaves out redactedBuckets, e.g. to seed a development environment
+	// from production data
+	RedactCosts bool
+}
+
+// DumpMetadata describes a dump
+type DumpMetadata struct {
+	FormatVersion int                   `json:"formatVersion"`
+	SchemaVersion int                   `json:"schemaVersion"` // Schema version of the dumped database
+	CreatedAt     time.Time             `json:"createdAt"`
+	Redacted      bool                  `json:"redacted"`
+	Buckets       map[string]DumpBucket `json:"buckets"`
+}
+
+// DumpBucket describes a dumped bucket
+type DumpBucket struct {
+	Keys     int    `json:"keys"`
+	Sequence uint64 `json:"sequence,omitempty"` // Bolt sequence, e.g. of the change feed
+}
+
+// dumpEntry is a line of a bucket file. Keys that aren't printable text are written in
+// Key64; values that aren't compact JSON in Data, both base64.
+type dumpEntry struct {
+	Key   string          `json:"key,omitempty"`
+	Key64 []byte          `json:"key64,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Data  []byte          `json:"data,omitempty"`
+}
+
+// newDumpEntry returns the line of a key and its plaintext value
+func newDumpEntry(key, value []byte) dumpEntry {
+	var entry dumpEntry
+	if printableKey(key) {
+		entry.Key = string(key)
+	} else {
+		entry.Key64 = key
+	}
+
+	// Values are kept byte for byte, so only compact JSON is written as is
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, value) == nil && bytes.Equal(compacted.Bytes(), value) {
+		entry.Value = value
+	} else {
+		entry.Data = value
+	}
+	return entry
+}
+
+// printableKey reports whether a key reads as text, unlike e.g. big endian sequences.
+// NUL is allowed, as it separates the parts of composite keys.
+func printableKey(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, r := range string(key) {
+		if r == 0xFFFD || (r < 0x20 && r != 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e dumpEntry) key() []byte {
+	if e.Key64 != nil {
+		return e.Key64
+	}
+	return []byte(e.Key)
+}
+
+func (e dumpEntry) value() []byte {
+	if e.Value != nil {
+		return e.Value
+	}
+	return e.Data
+}
+
+// Dump writes every bucket of the database to w as a tar archive, from a single read
+// transaction. Bucket files are spooled to temporary files first, as tar needs their
+// size before their content.
+func Dump(w io.Writer, options DumpOptions) (DumpMetadata, error) {
+	metadata := DumpMetadata{FormatVersion: DumpFormatVersion, CreatedAt: time.Now(), Redacted: options.RedactCosts, Buckets: make(map[string]DumpBucket)}
+
+	dir, err := os.MkdirTemp("", "ashley-dump-")
+	if err != nil {
+		return metadata, fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := openDB()
+	if err != nil {
+		return metadata, err
+	}
+	defer db.Close()
+
+	var names []string
+	err = db.View(func(tx *bolt.Tx) error {
+		if settings := tx.Bucket([]byte(settingsBucketName)); settings != nil {
+			if value := settings.Get([]byte(schemaVersionSetting)); value != nil {
+				if metadata.SchemaVersion, err = strconv.Atoi(string(value)); err != nil {
+					return fmt.Errorf("invalid schema version %q: %v", value, err)
+				}
+			}
+		}
+
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !isShard(tx, name) && !(options.RedactCosts && redactedBuckets[string(name)]) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			bucket, err := spoolBucket(tx, name, path.Join(dir, name+".ndjson"), options)
+			if err != nil {
+				return fmt.Errorf("error dumping %s: %v", name, err)
+			}
+			metadata.Buckets[name] = bucket
+		}
+		return nil
+	})
+	if err != nil {
+		return metadata, fmt.Errorf("error dumping database: %v", err)
+	}
+
+	archive := tar.NewWriter(w)
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return metadata, err
+	}
+	header := &tar.Header{Name: dumpMetadataName, Mode: 0600, Size: int64(len(data)), ModTime: metadata.CreatedAt}
+	if err := archive.WriteHeader(header); err != nil {
+		return metadata, fmt.Errorf("error writing archive: %v", err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return metadata, fmt.Errorf("error writing archive: %v", err)
+	}
+
+	for _, name := range names {
+		if err := addToArchive(archive, path.Join(dir, name+".ndjson"), dumpBucketsDir+name+".ndjson", metadata.CreatedAt); err != nil {
+			return metadata, fmt.Errorf("error writing archive: %v", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return metadata, fmt.Errorf("error writing archive: %v", err)
+	}
+	return metadata, nil
+}
+
+// spoolBucket writes the keys of a bucket and its shards to a file, one dumpEntry per
+// line
+func spoolBucket(tx *bolt.Tx, name, filename string, options DumpOptions) (DumpBucket, error) {
+	var dumped DumpBucket
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return dumped, err
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+
+	var redact *ResponseProfile
+	if options.RedactCosts {
+		redact = newResponseProfile(NoCostProfile, costFields)
+	}
+
+	// Walked as sharded whatever the settings, so shards left by an earlier setting or
+	// of a disabled fetcher are dumped with their bucket rather than skipped
+	records := recordsOf(tx, name)
+	records.sharded = true
+	dumped.Sequence = records.base.Sequence()
+	err = records.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil // Nested bucket
+		}
+		value, err := openValue(name, k, v)
+		if err != nil {
+			return err
+		}
+		if redact != nil {
+			if value, err = redactValue(redact, value); err != nil {
+				return fmt.Errorf("error redacting %s: %v", k, err)
+			}
+		}
+		dumped.Keys++
+		return encoder.Encode(newDumpEntry(k, value))
+	})
+	if err != nil {
+		return dumped, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return dumped, err
+	}
+	return dumped, file.Close()
+}
+
+// redactValue removes the profile's fields from a JSON object value. Other values,
+// e.g. index entries and settings, are returned as they are.
+func redactValue(profile *ResponseProfile, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) || !json.Valid(data) {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	profile.strip(value, "")
+
+	var redacted bytes.Buffer
+	encoder := json.NewEncoder(&redacted)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(redacted.Bytes(), []byte("\n")), nil
+}
+
+// addToArchive copies a file into the archive under name
+func addToArchive(archive *tar.Writer, filename, name string, modTime time.Time) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: modTime}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// LoadOptions are the options of Load
+type LoadOptions struct {
+	// Replace clears a database already holding records, after copying it aside.
+	// Without it, only an empty database is loaded into.
+	Replace bool
+}
+
+// loadBatchSize is how many keys a load writes per transaction
+const loadBatchSize = 10000
+
+// Load writes the buckets of an archive written by Dump into the database, sealing
+// and sharding them with the current settings. Archives of an older schema version
+// are migrated on the next start; newer ones are refused.
+func Load(r io.Reader, options LoadOptions) (DumpMetadata, error) {
+	var metadata DumpMetadata
+	archive := tar.NewReader(r)
+
+	header, err := archive.Next()
+	if err != nil {
+		return metadata, fmt.Errorf("error reading archive: %v", err)
+	}
+	if header.Name != dumpMetadataName {
+		return metadata, fmt.Errorf("not a database dump: starts with %s rather than %s", header.Name, dumpMetadataName)
+	}
+	if err := json.NewDecoder(archive).Decode(&metadata); err != nil {
+		return metadata, fmt.Errorf("error reading %s: %v", dumpMetadataName, err)
+	}
+	if metadata.FormatVersion != DumpFormatVersion {
+		return metadata, fmt.Errorf("unsupported dump format version %d (this build reads %d)", metadata.FormatVersion, DumpFormatVersion)
+	}
+	if latest := schemaVersion(); metadata.SchemaVersion > latest {
+		return metadata, fmt.Errorf("dump schema version %d is newer than this build supports (%d): load it with a newer build", metadata.SchemaVersion, latest)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return metadata, err
+	}
+	defer db.Close()
+
+	if err := prepareLoad(db, options); err != nil {
+		return metadata, err
+	}
+
+	loaded := make(map[string]bool)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return metadata, fmt.Errorf("error reading archive: %v", err)
+		}
+		name, ok := strings.CutPrefix(header.Name, dumpBucketsDir)
+		name, isBucket := strings.CutSuffix(name, ".ndjson")
+		if !ok || !isBucket || name == "" {
+			log.Printf("Skipping %s: not a bucket file", header.Name)
+			continue
+		}
+		bucket, listed := metadata.Buckets[name]
+		if !listed {
+			return metadata, fmt.Errorf("bucket %s is not listed in %s", name, dumpMetadataName)
+		}
+
+		if err := loadBucket(db, name, bucket, archive); err != nil {
+			return metadata, fmt.Errorf("error loading %s, load again with --replace: %v", name, err)
+		}
+		loaded[name] = true
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(metadata.Buckets)) {
+		if !loaded[name] {
+			return metadata, fmt.Errorf("archive is missing bucket %s listed in %s", name, dumpMetadataName)
+		}
+	}
+	return metadata, nil
+}
+
+// prepareLoad refuses to load into a database holding records unless replacing it, in
+// which case the database is copied aside and every bucket deleted
+func prepareLoad(db *store, options LoadOptions) error {
+	var names [][]byte
+	var empty bool
+	err := db.View(func(tx *bolt.Tx) error {
+		empty = !holdsRecords(tx)
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, slices.Clone(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error reading database: %v", err)
+	}
+	if empty {
+		return nil
+	}
+	if !options.Replace {
+		return fmt.Errorf("database already holds records: load with --replace to overwrite it")
+	}
+
+	backup := fmt.Sprintf("%s.pre-load-%s", DatabaseName, time.Now().Format("20060102T150405"))
+	if err := db.View(func(tx *bolt.Tx) error { return tx.CopyFile(backup, 0600) }); err != nil {
+		return fmt.Errorf("error backing up database before loading: %v", err)
+	}
+	log.Printf("Replacing database, backed up to %s", backup)
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return fmt.Errorf("error clearing %s: %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// loadBucket writes the lines of a bucket file, loadBatchSize keys per transaction,
+// and checks they are as many as the metadata lists
+func loadBucket(db *store, name string, bucket DumpBucket, r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	keys := 0
+	for {
+		var batch []dumpEntry
+		for len(batch) < loadBatchSize && decoder.More() {
+			var entry dumpEntry
+			if err := decoder.Decode(&entry); err != nil {
+				return fmt.Errorf("line %d: %v", keys+len(batch)+1, err)
+			}
+			if len(entry.key()) == 0 {
+				return fmt.Errorf("line %d: no key", keys+len(batch)+1)
+			}
+			batch = append(batch, entry)
+		}
+
+		err := db.Update(func(tx *bolt.Tx) error {
+			var put func(k, v []byte) error
+			if catalogBucket(name) {
+				records, err := createRecords(tx, name)
+				if err != nil {
+					return err
+				}
+				put = records.Put
+			} else {
+				created, err := tx.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+				put = created.Put
+			}
+
+			for _, entry := range batch {
+				sealed, err := sealValue(name, entry.key(), entry.value())
+				if err != nil {
+					return err
+				}
+				if err := put(entry.key(), sealed); err != nil {
+					return err
+				}
+			}
+			if keys == 0 && bucket.Sequence > 0 {
+				return tx.Bucket([]byte(name)).SetSequence(bucket.Sequence)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys += len(batch)
+
+		if len(batch) < loadBatchSize {
+			break
+		}
+	}
+
+	if keys != bucket.Keys {
+		return fmt.Errorf("holds %d keys, %s lists %d", keys, dumpMetadataName, bucket.Keys)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// encryptedMagic prefixes sealed values. Plaintext values are JSON or gzip and never
+// start with a zero byte, so both can live in the same bucket while migrating.
+var encryptedMagic = []byte("\x00enc1")
+
+const encryptionKeyIDSize = 4
+
+// Encryption seals the values of selected buckets with AES-256-GCM. The first key
+// encrypts; the others only decrypt, so keys can be rotated.
+type Encryption struct {
+	keys    map[string]cipher.AEAD // By key id
+	primary string
+	buckets []string // Patterns of encrypted bucket names, e.g. prices or supplier:*
+}
+
+// encryption is the optional encryption at rest, nil when disabled
+var encryption *Encryption
+
+// ParseEncryptionKeys parses comma separated base64 encoded 32 byte keys
+func ParseEncryptionKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for i, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not valid base64: %v", i+1, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %d has %d bytes, expected 32", i+1, len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// NewEncryption encrypts the buckets matching the given patterns with the first key.
+// Only buckets holding catalog data can be encrypted: the fetcher buckets,
+// supplier:<name>, versions, raw_pages and quarantine.
+func NewEncryption(keys [][]byte, buckets []string) (*Encryption, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys")
+	}
+
+	e := &Encryption{keys: make(map[string]cipher.AEAD)}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i+1, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i+1, err)
+		}
+
+		id := encryptionKeyID(key)
+		if _, exists := e.keys[id]; exists {
+			return nil, fmt.Errorf("key %d is listed twice", i+1)
+		}
+		e.keys[id] = aead
+		if i == 0 {
+			e.primary = id
+		}
+	}
+
+	for _, pattern := range buckets {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern %q: %v", pattern, err)
+		}
+		if !matchesEncryptable(pattern) {
+			return nil, fmt.Errorf("bucket pattern %q matches no bucket holding catalog data", pattern)
+		}
+		e.buckets = append(e.buckets, pattern)
+	}
+	if len(e.buckets) == 0 {
+		return nil, fmt.Errorf("no buckets to encrypt")
+	}
+
+	return e, nil
+}
+
+// SetEncryption enables encryption at rest for values written from now on. Values
+// stored in plaintext stay readable and are sealed when next written.
+func SetEncryption(e *Encryption) {
+	encryption = e
+}
+
+// encryptionKeyID identifies a key in sealed values without revealing it
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:encryptionKeyIDSize])
+}
+
+// encryptableBucket reports whether a bucket holds catalog data sealed through
+// sealValue
+func encryptableBucket(name string) bool {
+	switch name {
+	case versionsBucketName, rawPagesBucketName, rawEntitiesBucketName, pageETagsBucketName, quarantineBucketName, priceHistoryBucketName, journalBucketName:
+		return true
+	}
+	if strings.HasPrefix(name, supplierBucketPrefix) && strings.Count(name, ":") == 1 {
+		return true
+	}
+	for _, syncer := range registry.syncers {
+		if syncer.BucketName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEncryptable reports whether a bucket pattern can match a bucket holding
+// catalog data
+func matchesEncryptable(pattern string) bool {
+	candidates := []string{versionsBucketName, rawPagesBucketName, rawEntitiesBucketName, pageETagsBucketName, quarantineBucketName, priceHistoryBucketName, journalBucketName, SupplierBucket("x")}
+	for _, syncer := range registry.syncers {
+		candidates = append(candidates, syncer.BucketName())
+	}
+	for _, name := range candidates {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	// Imported suppliers have no registered fetcher to match against
+	return strings.HasPrefix(pattern, supplierBucketPrefix)
+}
+
+// covers reports whether values of a bucket are sealed
+func (e *Encryption) covers(bucketName string) bool {
+	if e == nil || !encryptableBucket(bucketName) {
+		return false
+	}
+	for _, pattern := range e.buckets {
+		if matched, _ := path.Match(pattern, bucketName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptionAAD binds a sealed value to its bucket and key, so values can't be
+// swapped between records
+func encryptionAAD(bucketName string, key []byte) []byte {
+	return append([]byte(bucketName+"\x00"), key...)
+}
+
+// sealValue returns the value to store under key in a bucket: encrypted with the
+// primary key when the bucket is covered, data itself otherwise
+func sealValue(bucketName string, key, data []byte) ([]byte, error) {
+	if !encryption.covers(bucketName) {
+		return data, nil
+	}
+
+	aead := encryption.keys[encryption.primary]
+	sealed := make([]byte, 0, len(encryptedMagic)+encryptionKeyIDSize+aead.NonceSize()+len(data)+aead.Overhead())
+	sealed = append(sealed, encryptedMagic...)
+	sealed = append(sealed, encryption.primary...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, data, encryptionAAD(bucketName, key)), nil
+}
+
+// openValue returns the plaintext of a stored value, sealed or not
+func openValue(bucketName string, key, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, encryptedMagic) {
+		return stored, nil
+	}
+	if encryption == nil {
+		return nil, fmt.Errorf("%s %s is encrypted but no ENCRYPTION_KEYS are configured", bucketName, key)
+	}
+
+	rest := stored[len(encryptedMagic):]
+	if len(rest) < encryptionKeyIDSize {
+		return nil, fmt.Errorf("%s %s: truncated encrypted value", bucketName, key)
+	}
+	aead, ok := encryption.keys[string(rest[:encryptionKeyIDSize])]
+	if !ok {
+		return nil, fmt.Errorf("%s %s is encrypted with a key that is not configured", bucketName, key)
+	}
+
+	rest = rest[encryptionKeyIDSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s %s: truncated encrypted value", bucketName, key)
+	}
+	data, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], encryptionAAD(bucketName, key))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s %s: %v", bucketName, key, err)
+	}
+	return data, nil
+}
+
+// storedAs reports whether stored holds data in the form sealValue would write it
+// now, so unchanged records still get sealed, re-keyed or decrypted on the next write
+func storedAs(bucketName string, key, stored, data []byte) (bool, error) {
+	if stored == nil {
+		return false, nil
+	}
+
+	plaintext, err := openValue(bucketName, key, stored)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(plaintext, data) && sealedAsConfigured(bucketName, stored), nil
+}
+
+// sealedAsConfigured reports whether a stored value is sealed the way sealValue would
+// seal it now: with the primary key when the bucket is covered, not at all otherwise
+func sealedAsConfigured(bucketName string, stored []byte) bool {
+	if !encryption.covers(bucketName) {
+		return !bytes.HasPrefix(stored, encryptedMagic)
+	}
+	return bytes.HasPrefix(stored, append(encryptedMagic[:len(encryptedMagic):len(encryptedMagic)], encryption.primary...))
+}
+
+// Reencrypt rewrites every value of the buckets holding catalog data in the form the
+// current configuration stores it: sealed with the primary key for covered buckets,
+// plaintext otherwise. The file is then compacted, since bolt leaves the replaced
+// values in its free pages. Returns the number of values rewritten per bucket.
+func Reencrypt() (map[string]int, error) {
+	rewritten, err := reencryptValues()
+	if err != nil {
+		return nil, err
+	}
+	if err := compactDatabase(); err != nil {
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+func reencryptValues() (map[string]int, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rewritten := make(map[string]int)
+	err = db.Update(func(tx *bolt.Tx) error {
+		var names []string
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// Shards are rewritten through the records of their bucket
+			if encryptableBucket(string(name)) && !isShard(tx, name) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			bucket := recordsOf(tx, name)
+
+			// Buckets can't be written while iterating them
+			updates := make(map[string][]byte)
+			err := bucket.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return nil // Nested bucket
+				}
+				data, err := openValue(name, k, v)
+				if err != nil {
+					return err
+				}
+				current, err := storedAs(name, k, v, data)
+				if err != nil || current {
+					return err
+				}
+				sealed, err := sealValue(name, k, data)
+				if err != nil {
+					return err
+				}
+				updates[string(k)] = sealed
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for k, v := range updates {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+			if len(updates) > 0 {
+				rewritten[name] = len(updates)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error re-encrypting: %v", err)
+	}
+
+	return rewritten, nil
+}
+
+// compactDatabase copies the live data into a fresh file and replaces the database
+// with it, dropping stale values left in free pages. The shared handle is closed
+// afterwards so the next use opens the new file.
+func compactDatabase() error {
+	src, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	compactName := DatabaseName + ".compact"
+	dst, err := bolt.Open(compactName, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return fmt.Errorf("error opening compacted database: %v", err)
+	}
+	if err := bolt.Compact(dst, src.db, 64<<20); err != nil {
+		dst.Close()
+		os.Remove(compactName)
+		return fmt.Errorf("error compacting database: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(compactName)
+		return fmt.Errorf("error compacting database: %v", err)
+	}
+
+	// Rename while the source is still locked so no other process writes in between
+	if err := os.Rename(compactName, DatabaseName); err != nil {
+		return fmt.Errorf("error replacing database: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// pageETagsBucketName holds the ETag and body of the last response to each page
+// request, keyed by conditionalKey, so unchanged pages come back as 304s
+const pageETagsBucketName = "page_etags"
+
+// conditionalPage is the last response to a page request that carried an ETag
+type conditionalPage struct {
+	ETag string `json:"etag"`
+	Body []byte `json:"body"` // Gzip compressed
+}
+
+// conditionalFetch tracks the page requests of a fetch sent conditionally, so entries of
+// pages the catalog no longer has can be pruned once it completes
+type conditionalFetch struct {
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+type conditionalContextKey struct{}
+
+// withConditionalFetch returns ctx under which page requests carry If-None-Match with
+// the ETag of their last response
+func withConditionalFetch(ctx context.Context) (context.Context, *conditionalFetch) {
+	fetch := &conditionalFetch{used: make(map[string]bool)}
+	return context.WithValue(ctx, conditionalContextKey{}, fetch), fetch
+}
+
+// conditionalKey identifies a page request: its URL and language
+func conditionalKey(req *http.Request) []byte {
+	return []byte(req.URL.String() + "\x00" + req.Header.Get("Accept-Language"))
+}
+
+// prepareConditional adds If-None-Match to req when ctx fetches conditionally and the
+// page was received with an ETag before, returning the stored response
+func prepareConditional(ctx context.Context, req *http.Request) *conditionalPage {
+	fetch, ok := ctx.Value(conditionalContextKey{}).(*conditionalFetch)
+	if !ok {
+		return nil
+	}
+	key := conditionalKey(req)
+	fetch.mu.Lock()
+	fetch.used[string(key)] = true
+	fetch.mu.Unlock()
+
+	page, err := loadConditionalPage(key)
+	if err != nil {
+		log.Printf("Error reading ETag of %s: %v", req.URL.Path, err)
+		return nil
+	}
+	if page != nil {
+		req.Header.Set("If-None-Match", page.ETag)
+	}
+	return page
+}
+
+func loadConditionalPage(key []byte) (*conditionalPage, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var page *conditionalPage
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pageETagsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		stored := bucket.Get(key)
+		if stored == nil {
+			return nil
+		}
+		data, err := openValue(pageETagsBucketName, key, stored)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &page)
+	})
+	return page, err
+}
+
+// notModifiedBody returns the stored body of a page the upstream answered with 304
+func (p *conditionalPage) notModifiedBody() ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(p.Body))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing stored page: %v", err)
+	}
+	defer zr.Close()
+
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing stored page: %v", err)
+	}
+	return body, nil
+}
+
+// rememberConditional stores the ETag and body of a page response received while
+// fetching conditionally. Responses without an ETag remove the stored one.
+func rememberConditional(ctx context.Context, req *http.Request, resp *http.Response, body []byte) {
+	if _, ok := ctx.Value(conditionalContextKey{}).(*conditionalFetch); !ok {
+		return
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" && req.Header.Get("If-None-Match") == "" {
+		return // Nothing stored, nothing to store
+	}
+	if err := saveConditionalPage(conditionalKey(req), etag, body); err != nil {
+		log.Printf("Error saving ETag of %s: %v", req.URL.Path, err)
+	}
+}
+
+func saveConditionalPage(key []byte, etag string, body []byte) error {
+	var value []byte
+	if etag != "" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return fmt.Errorf("error compressing page: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("error compressing page: %v", err)
+		}
+		data, err := json.Marshal(conditionalPage{ETag: etag, Body: buf.Bytes()})
+		if err != nil {
+			return err
+		}
+		if value, err = sealValue(pageETagsBucketName, key, data); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if value == nil {
+			if bucket := tx.Bucket([]byte(pageETagsBucketName)); bucket != nil {
+				return bucket.Delete(key)
+			}
+			return nil
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(pageETagsBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+}
+
+// prune removes the stored pages of an endpoint the fetch didn't request, left over
+// from page sizes or catalog lengths of earlier runs
+func (f *conditionalFetch) prune(db *store, baseURL, endpoint string) error {
+	prefix := []byte(baseURL + "/" + endpoint + "?")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pageETagsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		var unused [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			if !f.used[string(k)] {
+				unused = append(unused, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range unused {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
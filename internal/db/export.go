@@ -0,0 +1,237 @@
+package db
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flattenJSON converts v into a row of CSV cells keyed by column name. Nested objects,
+// such as calculados, become one column per entry named parent.key.
+func flattenJSON(v any) (map[string]string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string, len(object))
+	for key, value := range object {
+		if nested, ok := value.(map[string]any); ok {
+			for child, value := range nested {
+				row[key+"."+child] = csvCell(value)
+			}
+			continue
+		}
+		row[key] = csvCell(value)
+	}
+	return row, nil
+}
+
+// csvCell formats a decoded JSON value as a CSV cell
+func csvCell(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// exportColumns orders the columns present in rows: top-level fields in the given order,
+// each followed by its nested entries sorted by name
+func exportColumns(rows []map[string]string, names []string) []string {
+	present := make(map[string]bool)
+	for _, row := range rows {
+		for column := range row {
+			present[column] = true
+		}
+	}
+	return orderColumns(present, names)
+}
+
+// orderColumns orders the present columns as exportColumns does
+func orderColumns(present map[string]bool, names []string) []string {
+	nested := make(map[string][]string)
+	for column := range present {
+		if parent, _, ok := strings.Cut(column, "."); ok {
+			nested[parent] = append(nested[parent], column)
+		}
+	}
+
+	var columns []string
+	for _, name := range names {
+		if present[name] {
+			columns = append(columns, name)
+		}
+		children := nested[name]
+		sort.Strings(children)
+		columns = append(columns, children...)
+	}
+	return columns
+}
+
+// writeCSV writes rows as CSV with a header row of the given columns
+func writeCSV(w http.ResponseWriter, r *http.Request, filename string, columns []string, rows []map[string]string) {
+	record := make([]string, len(columns))
+	streamCSV(w, r, filename, columns, len(rows), func(i int) ([]string, error) {
+		for j, column := range columns {
+			record[j] = rows[i][column]
+		}
+		return record, nil
+	})
+}
+
+// streamCSV writes count records as CSV after a header row, buffered as other catalog
+// responses are, so the records can be produced one at a time
+func streamCSV(w http.ResponseWriter, r *http.Request, filename string, header []string, count int, record func(i int) ([]string, error)) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	body := newResponseBuffer(w, r)
+
+	writer := csv.NewWriter(body)
+	if err := writer.Write(header); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+	for i := 0; i < count; i++ {
+		values, err := record(i)
+		if err != nil {
+			body.fail(http.StatusInternalServerError, "Error building export: %v", err)
+			return
+		}
+		if err := writer.Write(values); err != nil {
+			log.Printf("Error writing export: %v", err)
+			return
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+	body.close()
+}
+
+// exportFields resolves the columns of a product export: ?fields= in the request's
+// schema, restricted by its profile. Writes the error and returns false when invalid.
+func exportFields(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	fields, err := productFieldSelector.parse(requestSchema(r).canonicalFields(r.URL.Query().Get("fields")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	fields, err = requestProfile(r).restrictFields(productFieldSelector, fields)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid fields: %v", err), http.StatusForbidden)
+		return nil, false
+	}
+	if len(fields) == 0 {
+		fields = productFieldSelector.names
+	}
+	return fields, true
+}
+
+// exportRow projects a product onto fields and flattens it into a CSV row
+func exportRow(respData ProductResponseData, fields []string) (map[string]string, error) {
+	projected, err := productFieldSelector.project(respData, fields)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting fields: %v", err)
+	}
+	return flattenJSON(projected)
+}
+
+// exportRows flattens products into CSV rows as exportRow does
+func exportRows(response []ProductResponseData, fields []string) ([]map[string]string, error) {
+	rows := make([]map[string]string, 0, len(response))
+	for _, respData := range response {
+		row, err := exportRow(respData, fields)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// exportProductsHandler serves the catalog as CSV, one column per response field and
+// computed entry. ?fields= and response profiles restrict the columns as in /products.
+func (s *server) exportProductsHandler(w http.ResponseWriter, r *http.Request) {
+	fields, ok := exportFields(w, r)
+	if !ok {
+		return
+	}
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	stale, err := staleSince(s.config.Fetchers, s.config.StaleAfter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sync status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if stale != nil {
+		w.Header().Set("X-Stale-Since", stale.UTC().Format(time.RFC3339))
+	}
+
+	response, err := buildProductResponses("", nil, stale, date)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building catalog: %v", err), http.StatusInternalServerError)
+		return
+	}
+	localizeProducts(response, lang)
+	requestProfile(r).redactProducts(response)
+
+	// Rows aren't kept for the whole catalog: products are flattened once to find the
+	// columns, and again as their rows are written
+	present := make(map[string]bool)
+	for _, respData := range response {
+		row, err := exportRow(respData, fields)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for column := range row {
+			present[column] = true
+		}
+	}
+
+	columns := orderColumns(present, fields)
+	record := make([]string, len(columns))
+	streamCSV(w, r, "products.csv", requestSchema(r).columns(columns), len(response), func(i int) ([]string, error) {
+		row, err := exportRow(response[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		for j, column := range columns {
+			record[j] = row[column]
+		}
+		return record, nil
+	})
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// externalPageTimeout bounds a single run of an external fetcher, as the HTTP client
+// timeout does for API requests
+const externalPageTimeout = 120 * time.Second
+
+// externalUnauthorizedExit is the exit code an external fetcher uses to report that
+// the supplier rejected its credentials
+const externalUnauthorizedExit = 2
+
+// ExternalRequest is written as JSON to the stdin of an external fetcher, once per page.
+// Credentials travel here rather than in arguments so they don't show up in ps.
+type ExternalRequest struct {
+	Page          int               `json:"page"`
+	Limit         int               `json:"limit"`
+	BaseURL       string            `json:"baseUrl,omitempty"`
+	Authorization string            `json:"authorization,omitempty"`
+	ClientID      string            `json:"clientId,omitempty"`
+	Customer      string            `json:"customer,omitempty"`
+	UserAgent     string            `json:"userAgent"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+// ExternalResponse is the JSON an external fetcher writes to stdout: the page's
+// products as stored records and whether it was the last page
+type ExternalResponse struct {
+	Metadata Metadata          `json:"metadata"`
+	Entities []SupplierProduct `json:"entities"`
+	Last     bool              `json:"last"`
+}
+
+// ExternalFetcher syncs a supplier by running a program for each page, so suppliers
+// can be added without recompiling the service. The program reads an ExternalRequest
+// on stdin and answers with an ExternalResponse on stdout; a non-zero exit fails the
+// page (exit code 2 means rejected credentials) with its stderr as the error.
+type ExternalFetcher struct {
+	Supplier string
+	Command  []string
+}
+
+func (ef ExternalFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[SupplierProduct], error) {
+	request, err := json.Marshal(ExternalRequest{
+		Page:          page,
+		Limit:         config.Limit,
+		BaseURL:       config.BaseURL,
+		Authorization: config.Authorization,
+		ClientID:      config.ClientID,
+		Customer:      config.Customer,
+		UserAgent:     upstreamUserAgent(config),
+		Headers:       config.Headers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling external request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, externalPageTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, ef.Command[0], ef.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	startedAt := time.Now()
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	code := "0"
+	switch {
+	case errors.As(err, &exitErr):
+		code = fmt.Sprintf("exit_%d", exitErr.ExitCode())
+	case err != nil:
+		code = "error"
+	}
+	upstreamRequestsTotal.Inc(config.Customer, ef.GetEndpoint(), code)
+	upstreamRequestSeconds.Add(time.Since(startedAt).Seconds(), config.Customer, ef.GetEndpoint())
+
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > 500 {
+			message = message[len(message)-500:]
+		}
+		if exitErr != nil && exitErr.ExitCode() == externalUnauthorizedExit {
+			return nil, fmt.Errorf("%w - external fetcher %s: %s", ErrUnauthorized, ef.Supplier, message)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("retryable external fetcher error - timeout after %v: %s", externalPageTimeout, message)
+		}
+		return nil, fmt.Errorf("external fetcher %s failed: %v: %s", ef.Supplier, err, message)
+	}
+
+	var response ExternalResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON from external fetcher %s: %v", ef.Supplier, err)
+	}
+
+	return &GenericAPIResponse[SupplierProduct]{
+		Metadata: response.Metadata,
+		Entities: response.Entities,
+		Raw:      stdout.Bytes(),
+		Last:     response.Last || len(response.Entities) == 0,
+	}, nil
+}
+
+func (ef ExternalFetcher) Transform(entity SupplierProduct) DatabaseEntity { return entity }
+func (ef ExternalFetcher) GetBucketName() string                           { return SupplierBucket(ef.Supplier) }
+func (ef ExternalFetcher) GetEndpoint() string                             { return ef.Supplier }
+
+// ExternalSupplier is a supplier synced by an external program
+type ExternalSupplier struct {
+	Name    string
+	Command []string
+}
+
+// ParseExternalSuppliers parses semicolon separated name=command entries, e.g.
+// "acme=/opt/fetchers/acme --region mx;woodco=/opt/fetchers/woodco". Commands are split
+// on whitespace.
+func ParseExternalSuppliers(s string) ([]ExternalSupplier, error) {
+	var external []ExternalSupplier
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, command, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		args := strings.Fields(command)
+		if !found || len(args) == 0 {
+			return nil, fmt.Errorf("invalid external supplier %q: expected name=command", entry)
+		}
+		if !supplierNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid external supplier name %q: expected lowercase letters, digits, - and _", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("external supplier %q defined twice", name)
+		}
+		seen[name] = true
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, fmt.Errorf("external supplier %s: %v", name, err)
+		}
+		external = append(external, ExternalSupplier{Name: name, Command: args})
+	}
+
+	return external, nil
+}
+
+// RegisterExternalSupplier registers a supplier synced by an external program, with a
+// single fetcher named after it. Its settings use the upper-cased name as prefix
+// (ACME_BASE_URL, ...). Must be called before EnabledFetchers.
+func RegisterExternalSupplier(external ExternalSupplier) error {
+	name := external.Name
+	if _, exists := suppliers[name]; exists {
+		return fmt.Errorf("supplier %q already registered", name)
+	}
+	if _, exists := registry.syncers[name]; exists {
+		return fmt.Errorf("supplier %q clashes with the fetcher of the same name", name)
+	}
+
+	RegisterSupplier(Supplier{Name: name, EnvPrefix: strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"})
+	RegisterSupplierFetcher[SupplierProduct](name, name, ExternalFetcher{Supplier: name, Command: external.Command})
+	return nil
+}
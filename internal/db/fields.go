@@ -0,0 +1,96 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// fieldSelector projects a response struct onto a subset of its JSON fields
+type fieldSelector struct {
+	fields map[string]selectableField
+	names  []string // JSON names in declaration order, for error messages
+}
+
+type selectableField struct {
+	index     int
+	omitEmpty bool
+}
+
+var productFieldSelector = newFieldSelector(reflect.TypeOf(ProductResponseData{}))
+
+// newFieldSelector indexes the JSON fields of a struct type
+func newFieldSelector(t reflect.Type) *fieldSelector {
+	selector := &fieldSelector{fields: make(map[string]selectableField)}
+
+	for i := 0; i < t.NumField(); i++ {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		selector.fields[name] = selectableField{index: i, omitEmpty: strings.Contains(options, "omitempty")}
+		selector.names = append(selector.names, name)
+	}
+
+	return selector
+}
+
+// parse validates a comma separated field list such as "clave,nombre,costo".
+// Returns nil when the list is empty, meaning every field.
+func (s *fieldSelector) parse(param string) ([]string, error) {
+	var fields, unknown []string
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if _, ok := s.fields[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		fields = append(fields, name)
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown fields %s; valid fields are %s", strings.Join(unknown, ", "), strings.Join(s.names, ", "))
+	}
+
+	return fields, nil
+}
+
+// project encodes the selected fields of v as a JSON object, in the requested order.
+// Fields tagged omitempty are left out when empty, as in the full response.
+func (s *fieldSelector) project(v any, fields []string) (json.RawMessage, error) {
+	value := reflect.ValueOf(v)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range fields {
+		field := s.fields[name]
+		fieldValue := value.Field(field.index)
+		if field.omitEmpty && fieldValue.IsZero() {
+			continue
+		}
+
+		data, err := json.Marshal(fieldValue.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling field %s: %v", name, err)
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
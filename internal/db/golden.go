@@ -0,0 +1,178 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GoldenFile holds the expected output of a golden case, next to its recorded pages
+const GoldenFile = "golden.json"
+
+// goldenOutput is what recorded upstream pages turn into: the records stored per
+// bucket, the records the pipeline rejected and the /products response
+type goldenOutput struct {
+	Records  map[string]map[string]json.RawMessage `json:"records"`
+	Rejected map[string]map[string][]string        `json:"rejected,omitempty"`
+	Products []ProductResponseData                 `json:"products"`
+}
+
+// transformPage decodes a recorded upstream page, as kept in raw_pages, and runs its
+// records through Transform and the pipeline without touching the store
+func (fs fetcherSyncer[T]) transformPage(payload []byte) ([]processed, error) {
+	var response GenericAPIResponse[T]
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, fmt.Errorf("error unmarshaling %s page: %v", fs.name, err)
+	}
+
+	results := make([]processed, 0, len(response.Entities))
+	for _, entity := range response.Entities {
+		result, err := runPipeline(fs.fetcher.GetBucketName(), fs.fetcher.Transform(entity), ValidationConfig{})
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", fs.name, entity.GetSKU(), err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RenderGolden runs recorded upstream pages of each fetcher through Transform, the
+// pipeline and the /products mapping and returns the outcome as indented JSON with
+// sorted keys, so mapping changes show up as diffs of golden files. Validation bounds,
+// computed fields and manual replacements are left out to keep the output stable.
+func RenderGolden(pages map[string][][]byte) ([]byte, error) {
+	output := goldenOutput{
+		Records:  make(map[string]map[string]json.RawMessage),
+		Rejected: make(map[string]map[string][]string),
+		Products: []ProductResponseData{},
+	}
+
+	fetchers := make([]string, 0, len(pages))
+	for name := range pages {
+		fetchers = append(fetchers, name)
+	}
+	sort.Strings(fetchers)
+
+	for _, name := range fetchers {
+		syncer, ok := registry.syncers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown fetcher %q", name)
+		}
+		transformer, ok := syncer.(interface {
+			transformPage(payload []byte) ([]processed, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("fetcher %q can't replay pages", name)
+		}
+
+		bucketName := syncer.BucketName()
+		if output.Records[bucketName] == nil {
+			output.Records[bucketName] = make(map[string]json.RawMessage)
+		}
+		for _, payload := range pages[name] {
+			results, err := transformer.transformPage(payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, result := range results {
+				sku := result.record.GetSKU()
+				if result.rejected {
+					if output.Rejected[bucketName] == nil {
+						output.Rejected[bucketName] = make(map[string][]string)
+					}
+					output.Rejected[bucketName][sku] = result.issues
+					continue
+				}
+				output.Records[bucketName][sku] = result.data
+			}
+		}
+	}
+
+	// Map the products the way GET /products does, resolving replacements among the
+	// recorded products only
+	productMap := make(map[string]ProductRequestData)
+	for sku, data := range output.Records["products"] {
+		var product ProductRequestData
+		if err := json.Unmarshal(data, &product); err != nil {
+			return nil, fmt.Errorf("error unmarshaling product %s: %v", sku, err)
+		}
+		productMap[sku] = product
+	}
+	priceMap := make(map[string]PriceRequestData)
+	for sku, data := range output.Records["prices"] {
+		var price PriceRequestData
+		if err := json.Unmarshal(data, &price); err != nil {
+			return nil, fmt.Errorf("error unmarshaling price %s: %v", sku, err)
+		}
+		priceMap[sku] = price
+	}
+
+	lookup := func(sku string) string { return productMap[sku].ReplacementSku }
+	for _, product := range productMap {
+		respData := newProductResponseData(product, priceMap)
+		respData.Reemplazo = resolveReplacement(product.Sku, nil, lookup).Reemplazo
+		output.Products = append(output.Products, respData)
+	}
+	sort.Slice(output.Products, func(i, j int) bool { return output.Products[i].Clave < output.Products[j].Clave })
+
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// LoadGoldenCase loads the recorded pages of a golden case directory by fetcher, from
+// files named <fetcher>.json or <fetcher>.<n>.json in the format stored in raw_pages
+func LoadGoldenCase(caseDir string) (map[string][][]byte, error) {
+	files, err := filepath.Glob(filepath.Join(caseDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	pages := make(map[string][][]byte)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if name == GoldenFile {
+			continue
+		}
+		fetcher, _, _ := strings.Cut(name, ".")
+		payload, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pages[fetcher] = append(pages[fetcher], payload)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no recorded pages")
+	}
+	return pages, nil
+}
+
+// GoldenDiff returns the lines around the first line where got differs from want,
+// the expected ones marked with - and the rendered ones with +
+func GoldenDiff(want, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+
+	line := 0
+	for line < len(wantLines) && line < len(gotLines) && wantLines[line] == gotLines[line] {
+		line++
+	}
+
+	var diff strings.Builder
+	for i := max(line-3, 0); i < line; i++ {
+		fmt.Fprintf(&diff, "  %5d    %s\n", i+1, wantLines[i])
+	}
+	for i := line; i < min(line+5, len(wantLines)); i++ {
+		fmt.Fprintf(&diff, "- %5d    %s\n", i+1, wantLines[i])
+	}
+	for i := line; i < min(line+5, len(gotLines)); i++ {
+		fmt.Fprintf(&diff, "+ %5d    %s\n", i+1, gotLines[i])
+	}
+	return diff.String()
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// goldenDir holds the golden cases shared with the golden command
+const goldenDir = "../../testdata/golden"
+
+// TestGolden renders the recorded upstream pages of every golden case and compares
+// the outcome with its golden.json. Run with -update to accept a mapping change:
+//
+//	go test ./internal/db -run TestGolden -update
+func TestGolden(t *testing.T) {
+	cases, err := filepath.Glob(filepath.Join(goldenDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatalf("no golden cases in %s", goldenDir)
+	}
+
+	for _, caseDir := range cases {
+		if info, err := os.Stat(caseDir); err != nil || !info.IsDir() {
+			continue
+		}
+		t.Run(filepath.Base(caseDir), func(t *testing.T) {
+			pages, err := LoadGoldenCase(caseDir)
+			if err != nil {
+				t.Fatalf("error loading: %v", err)
+			}
+			got, err := RenderGolden(pages)
+			if err != nil {
+				t.Fatalf("error rendering: %v", err)
+			}
+
+			goldenPath := filepath.Join(caseDir, GoldenFile)
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("error reading golden file: %v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s; review the change and run with -update to accept it\n%s", goldenPath, GoldenDiff(want, got))
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+// recordHashesBucketName holds the hash of every stored catalog record, keyed by
+// bucket and SKU, so unchanged records are recognized without decrypting them
+const recordHashesBucketName = "record_hashes"
+
+// Change detection modes besides the registered hashers
+const (
+	ChangeDetectionSHA256  = "sha256"
+	ChangeDetectionCompare = "compare" // Compare with the stored value, keeping no hashes
+)
+
+// RecordHasher hashes the encoded form of a transformed record. Equal hashes are taken
+// to mean equal records, so collisions must be negligible for the catalog's size.
+type RecordHasher func(data []byte) []byte
+
+var recordHashers = map[string]RecordHasher{
+	ChangeDetectionSHA256: func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	},
+	"fnv128a": func(data []byte) []byte {
+		h := fnv.New128a()
+		h.Write(data)
+		return h.Sum(nil)
+	},
+}
+
+// changeDetection is the name of the hasher in use, ChangeDetectionCompare for none
+var changeDetection = ChangeDetectionSHA256
+
+var recordsSavedTotal = metrics.NewCounter("ashley_records_saved_total",
+	"Catalog records saved by syncs, imports and replays by result (written, unchanged)", "bucket", "result")
+
+// RegisterRecordHasher adds a hasher selectable with SetChangeDetection. Like Register,
+// it must be called before syncing starts (e.g. from an init function).
+func RegisterRecordHasher(name string, hasher RecordHasher) {
+	if _, exists := recordHashers[name]; exists || name == ChangeDetectionCompare {
+		panic(fmt.Sprintf("record hasher %q registered twice", name))
+	}
+	recordHashers[name] = hasher
+}
+
+// SetChangeDetection selects the hasher recognizing unchanged records, or
+// ChangeDetectionCompare to compare them with the stored values instead
+func SetChangeDetection(name string) error {
+	if name == "" {
+		name = ChangeDetectionSHA256
+	}
+	if _, ok := recordHashers[name]; !ok && name != ChangeDetectionCompare {
+		names := []string{ChangeDetectionCompare}
+		for hasher := range recordHashers {
+			names = append(names, hasher)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown change detection %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	changeDetection = name
+	return nil
+}
+
+// saveStats counts the records of a save by outcome
+type saveStats struct {
+	Written   int
+	Unchanged int
+}
+
+func (s *saveStats) add(other saveStats) {
+	s.Written += other.Written
+	s.Unchanged += other.Unchanged
+}
+
+// recordHashKey is the key of a record's hash
+func recordHashKey(bucketName, sku string) []byte {
+	return []byte(bucketName + "\x00" + sku)
+}
+
+// recordHash returns the hash of data as stored, prefixed with the hasher's name so
+// hashes of another hasher never match. Nil when comparing values instead.
+func recordHash(data []byte) []byte {
+	hasher, ok := recordHashers[changeDetection]
+	if !ok {
+		return nil
+	}
+	return append([]byte(changeDetection+":"), hasher(data)...)
+}
+
+// unchangedRecord reports whether data is what a bucket already holds for sku in the
+// form it would be written now. The stored hash answers when there is one; otherwise,
+// e.g. for records saved before hashing or by another hasher, the stored value is
+// decrypted and compared.
+func unchangedRecord(tx *bolt.Tx, bucketName, sku string, stored, hash, data []byte) (bool, error) {
+	if stored == nil {
+		return false, nil
+	}
+	if hash != nil {
+		if hashes := tx.Bucket([]byte(recordHashesBucketName)); hashes != nil {
+			// A hash of another hasher, e.g. after CHANGE_DETECTION changed, can't be compared
+			known := hashes.Get(recordHashKey(bucketName, sku))
+			if known != nil && bytes.HasPrefix(known, []byte(changeDetection+":")) {
+				return bytes.Equal(known, hash) && sealedAsConfigured(bucketName, stored), nil
+			}
+		}
+	}
+
+	unchanged, err := storedAs(bucketName, []byte(sku), stored, data)
+	if err != nil || !unchanged || hash == nil {
+		return unchanged, err
+	}
+	// Remember the hash so the next save doesn't decrypt the record
+	return true, putRecordHash(tx, bucketName, sku, hash)
+}
+
+// putRecordHash records the hash of a written record, or forgets it when hash is nil
+func putRecordHash(tx *bolt.Tx, bucketName, sku string, hash []byte) error {
+	if hash == nil {
+		return deleteRecordHash(tx, bucketName, sku)
+	}
+	hashes, err := tx.CreateBucketIfNotExists([]byte(recordHashesBucketName))
+	if err != nil {
+		return err
+	}
+	return hashes.Put(recordHashKey(bucketName, sku), hash)
+}
+
+// deleteRecordHash forgets the hash of a deleted or replaced record
+func deleteRecordHash(tx *bolt.Tx, bucketName, sku string) error {
+	hashes := tx.Bucket([]byte(recordHashesBucketName))
+	if hashes == nil {
+		return nil
+	}
+	return hashes.Delete(recordHashKey(bucketName, sku))
+}
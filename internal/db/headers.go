@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultUserAgent identifies the service to upstream APIs unless a supplier sets its own
+const DefaultUserAgent = "ashley-furniture-service"
+
+// managedHeaders are set by the service itself and can't be overridden: credentials
+// have their own settings and responses are decoded for the encodings it asks for
+var managedHeaders = []string{"Authorization", "Client_id", "Accept-Encoding", "Host"}
+
+// ParseHeaders parses semicolon separated Name: value pairs, e.g.
+// "X-Integration: acme-mx; X-Contact: ops@example.com". Values may contain commas.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !found || !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header %q: expected Name: value", entry)
+		}
+		name = http.CanonicalHeaderKey(name)
+		for _, managed := range managedHeaders {
+			if name == http.CanonicalHeaderKey(managed) {
+				return nil, fmt.Errorf("header %s is set by the service", name)
+			}
+		}
+		if name == "User-Agent" {
+			return nil, fmt.Errorf("header %s has its own setting", name)
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether name is an HTTP token. Values can't hold line breaks,
+// as entries are split on one line.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > '~' || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// setUpstreamHeaders sets the User-Agent and the extra headers of config on req
+func setUpstreamHeaders(req *http.Request, config APIConfig) {
+	req.Header.Set("User-Agent", upstreamUserAgent(config))
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// upstreamUserAgent is the User-Agent the requests of config's supplier identify with
+func upstreamUserAgent(config APIConfig) string {
+	if config.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return config.UserAgent
+}
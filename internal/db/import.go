@@ -0,0 +1,331 @@
+package db
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// supplierBucketPrefix namespaces the buckets of imported, non-Ashley products
+const supplierBucketPrefix = "supplier:"
+
+// maxImportBytes caps the size of an import upload
+const maxImportBytes = 32 << 20
+
+var supplierNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SupplierProduct is a product imported from another supplier. It has the fields of
+// a stored Ashley product, including its own prices, but is not indexed by UPC.
+type SupplierProduct ProductRequestData
+
+func (p SupplierProduct) GetSKU() string { return p.Sku }
+
+// ImportResult summarizes an import
+type ImportResult struct {
+	Supplier string `json:"supplier"`
+	Imported int    `json:"imported"`
+	Removed  int    `json:"removed"`
+	Run      string `json:"run"` // Journal run of the import
+}
+
+// ImportSupplierProducts stores the products of a supplier, replacing records with
+// the same SKU. With replace set, records of the supplier missing from products are
+// removed. Imports run through the pipeline, change feed and journal like synced records.
+func ImportSupplierProducts(supplier string, products []SupplierProduct, replace bool, validation ValidationConfig) (ImportResult, error) {
+	db, err := openDB()
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer db.Close()
+
+	run, err := newRun(SourceImport)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	bucketName := SupplierBucket(supplier)
+	result := ImportResult{Supplier: supplier, Imported: len(products), Run: run.ID}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := createRecords(tx, bucketName)
+		if err != nil {
+			return err
+		}
+
+		identity := func(p SupplierProduct) DatabaseEntity { return p }
+		if _, err := putEntities(tx, run, bucketName, products, identity, validation); err != nil {
+			return err
+		}
+
+		if !replace {
+			return nil
+		}
+
+		imported := make(map[string]bool, len(products))
+		for _, product := range products {
+			imported[recordKey(product)] = true
+		}
+
+		var removed []string
+		err = bucket.ForEach(func(k, v []byte) error {
+			if !imported[string(k)] {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sku := range removed {
+			if err := deleteRecord(tx, run, bucket, bucketName, sku); err != nil {
+				return err
+			}
+		}
+		result.Removed = len(removed)
+
+		return nil
+	})
+
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// GetSupplierProducts returns the imported products of every supplier, by supplier
+func GetSupplierProducts() (map[string][]SupplierProduct, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	products := make(map[string][]SupplierProduct)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// Only supplier:<name> buckets hold catalogs, plugins may keep more data beside them
+			if !bytes.HasPrefix(name, []byte(supplierBucketPrefix)) || bytes.Count(name, []byte(":")) != 1 {
+				return nil
+			}
+
+			supplier := strings.TrimPrefix(string(name), supplierBucketPrefix)
+			return recordsOf(tx, string(name)).ForEach(func(k, v []byte) error {
+				v, err := openValue(string(name), k, v)
+				if err != nil {
+					return err
+				}
+				var product SupplierProduct
+				if err := json.Unmarshal(v, &product); err != nil {
+					return fmt.Errorf("error unmarshaling %s product %s: %v", name, k, err)
+				}
+				products[supplier] = append(products[supplier], product)
+				return nil
+			})
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// supplierProductResponses maps imported products into the response format, using
+// their own prices
+func supplierProductResponses(products []SupplierProduct) []ProductResponseData {
+	response := make([]ProductResponseData, 0, len(products))
+	for _, product := range products {
+		priceMap := map[string]PriceRequestData{product.Sku: {
+			Sku:           product.Sku,
+			BasePrice:     product.Price,
+			SellPrice:     product.SellPrice,
+			TotalNetPrice: product.TotalNetPrice,
+		}}
+		respData := newProductResponseData(ProductRequestData(product), priceMap)
+		respData.Reemplazo = product.ReplacementSku
+		response = append(response, respData)
+	}
+	return response
+}
+
+// decodeImport reads the uploaded products as a JSON array or as CSV with a header
+// row of stored field names. Products without a supplier are attributed to supplier.
+func decodeImport(r *http.Request, supplier string) ([]SupplierProduct, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var products []SupplierProduct
+	switch mediaType {
+	case "application/json", "":
+		if err := json.NewDecoder(r.Body).Decode(&products); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "text/csv":
+		var err error
+		if products, err = decodeImportCSV(r.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q: use application/json or text/csv", mediaType)
+	}
+
+	seen := make(map[string]int, len(products))
+	for i := range products {
+		products[i].Sku = strings.TrimSpace(products[i].Sku)
+		if products[i].Sku == "" {
+			return nil, fmt.Errorf("product %d has no sku", i+1)
+		}
+		if previous, ok := seen[products[i].Sku]; ok {
+			return nil, fmt.Errorf("products %d and %d share sku %s", previous+1, i+1, products[i].Sku)
+		}
+		seen[products[i].Sku] = i
+		if products[i].Supplier == "" {
+			products[i].Supplier = supplier
+		}
+	}
+
+	return products, nil
+}
+
+// decodeImportCSV converts CSV rows into products by mapping header names onto the
+// JSON fields of a stored product. Components can't be expressed in CSV.
+func decodeImportCSV(body io.Reader) ([]SupplierProduct, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+
+	columns, kinds := csvColumns()
+	var unknown []string
+	for _, column := range header {
+		if _, ok := kinds[column]; !ok {
+			unknown = append(unknown, column)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown CSV columns %s; valid columns are %s", strings.Join(unknown, ", "), strings.Join(columns, ", "))
+	}
+
+	var products []SupplierProduct
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+
+		fields := make(map[string]any, len(header))
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch kinds[column] {
+			case reflect.Int:
+				if value == "" {
+					continue
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %s %q is not an integer", row, column, value)
+				}
+				fields[column] = n
+			case reflect.Float64:
+				if value == "" {
+					continue
+				}
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %s %q is not a number", row, column, value)
+				}
+				fields[column] = f
+			default:
+				fields[column] = value
+			}
+		}
+
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		var product SupplierProduct
+		if err := json.Unmarshal(data, &product); err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		products = append(products, product)
+	}
+
+	return products, nil
+}
+
+// csvColumns returns the scalar JSON fields of a stored product in declaration order,
+// along with their kind
+func csvColumns() ([]string, map[string]reflect.Kind) {
+	t := reflect.TypeOf(ProductRequestData{})
+	var names []string
+	kinds := make(map[string]reflect.Kind)
+	for i := 0; i < t.NumField(); i++ {
+		switch kind := t.Field(i).Type.Kind(); kind {
+		case reflect.String, reflect.Int, reflect.Float64:
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			names = append(names, name)
+			kinds[name] = kind
+		}
+	}
+	return names, kinds
+}
+
+// importProductsHandler stores products of another supplier, sent as a JSON array or
+// CSV, under ?supplier=<name>. ?replace=true removes that supplier's products missing
+// from the upload.
+func (s *server) importProductsHandler(w http.ResponseWriter, r *http.Request) {
+	supplier := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("supplier")))
+	if !supplierNamePattern.MatchString(supplier) {
+		http.Error(w, "Invalid supplier: expected lowercase letters, digits, - and _", http.StatusBadRequest)
+		return
+	}
+	if supplier == AshleySupplier || hasFetchers(supplier) {
+		http.Error(w, fmt.Sprintf("Invalid supplier: %s products come from the sync", supplier), http.StatusBadRequest)
+		return
+	}
+
+	replace := false
+	if value := r.URL.Query().Get("replace"); value != "" {
+		var err error
+		if replace, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid replace: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	products, err := decodeImport(r, supplier)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := ImportSupplierProducts(supplier, products, replace, s.config.Upstream.Validation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error importing products: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
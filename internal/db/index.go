@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const productsByUPCBucketName = "products_by_upc"
+
+// Indexed is implemented by stored records that maintain secondary indexes.
+// IndexKeys returns, per index bucket, the keys that should resolve to the record's SKU.
+type Indexed interface {
+	IndexKeys() map[string][]string
+}
+
+// putIndexKeys points every index key of a record at its SKU within the caller's transaction
+func putIndexKeys(tx *bolt.Tx, record Indexed, sku string) error {
+	for bucketName, keys := range record.IndexKeys() {
+		if len(keys) == 0 {
+			continue
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := bucket.Put([]byte(key), []byte(sku)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupIndex resolves an index key to the SKU it points at
+func lookupIndex(indexBucketName, key string) (string, error) {
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var sku string
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(indexBucketName))
+		if bucket == nil {
+			return fmt.Errorf("%w: no entry for %s", ErrNotFound, key)
+		}
+
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("%w: no entry for %s", ErrNotFound, key)
+		}
+
+		sku = string(value)
+		return nil
+	})
+
+	return sku, err
+}
+
+// GetProductByUPC returns the product with the given UPC or GTIN
+func GetProductByUPC(upc string) (*ProductRequestData, error) {
+	sku, err := lookupIndex(productsByUPCBucketName, upc)
+	if err != nil {
+		return nil, err
+	}
+
+	product, err := GetProduct(sku)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index entries are never removed, so make sure the product still carries the code
+	if product.Upc != upc && product.Gtin != upc {
+		return nil, fmt.Errorf("%w: no product with UPC %s", ErrNotFound, upc)
+	}
+
+	return product, nil
+}
@@ -0,0 +1,521 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	inventoryBucketName    = "inventory"
+	reservationsBucketName = "reservations"
+)
+
+// ErrInsufficientStock is returned when a reservation exceeds the quantity left after
+// the active reservations
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// Inventory types
+type Inventory struct {
+	Sku                   string `json:"sku"`
+	Warehouse             string `json:"warehouse"`
+	QuantityAvailable     int    `json:"quantityAvailable"`
+	NextAvailableDate     string `json:"nextAvailableDate"`
+	NextAvailableQuantity int    `json:"nextAvailableQuantity"`
+}
+
+func (i Inventory) GetSKU() string { return inventoryKey(i.Sku, i.Warehouse) }
+
+type InventoryRequestData struct {
+	Sku                   string `json:"sku"`
+	Warehouse             string `json:"warehouse,omitempty"`
+	QuantityAvailable     int    `json:"quantityAvailable"`
+	NextAvailableDate     string `json:"nextAvailableDate,omitempty"`
+	NextAvailableQuantity int    `json:"nextAvailableQuantity,omitempty"`
+}
+
+// GetSKU keys records by SKU and warehouse, as Ashley reports stock per distribution center
+func (i InventoryRequestData) GetSKU() string { return inventoryKey(i.Sku, i.Warehouse) }
+
+// inventoryKey is the key of a SKU's stock in a warehouse
+func inventoryKey(sku, warehouse string) string { return sku + "@" + warehouse }
+
+type InventoryAPIResponse struct {
+	Links    []Link      `json:"links"`
+	Metadata Metadata    `json:"metadata"`
+	Entities []Inventory `json:"entities"`
+}
+
+// InventoryFetcher syncs Ashley's available quantities per warehouse. It is optional:
+// enable it by listing inventory in API_FETCHERS.
+type InventoryFetcher struct{}
+
+func (f InventoryFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[Inventory], error) {
+	url := fmt.Sprintf("%s/Inventory?Customer=%s&Limit=%d&Page=%d",
+		config.BaseURL, config.Customer, config.Limit, page)
+
+	response, raw, err := makeHTTPRequest[InventoryAPIResponse](ctx, url, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GenericAPIResponse[Inventory]{
+		Links:    response.Links,
+		Metadata: response.Metadata,
+		Entities: response.Entities,
+		Raw:      raw,
+	}, nil
+}
+
+func (f InventoryFetcher) Transform(entity Inventory) DatabaseEntity {
+	return InventoryRequestData{
+		Sku:                   entity.Sku,
+		Warehouse:             entity.Warehouse,
+		QuantityAvailable:     entity.QuantityAvailable,
+		NextAvailableDate:     entity.NextAvailableDate,
+		NextAvailableQuantity: entity.NextAvailableQuantity,
+	}
+}
+
+func (f InventoryFetcher) GetBucketName() string { return inventoryBucketName }
+func (f InventoryFetcher) GetEndpoint() string   { return "Inventory" }
+
+// synced checks the stock alerts against the fresh inventory
+func (f InventoryFetcher) synced(config APIConfig) { checkStockAlerts(config.Customer) }
+
+// Reservation holds stock of a SKU locally until it expires or is released, so
+// quotes don't promise the same units twice between syncs
+type Reservation struct {
+	ID        string    `json:"id"`
+	Sku       string    `json:"sku"`
+	Quantity  int       `json:"quantity"`
+	Reference string    `json:"reference,omitempty"` // Quote or order the units are held for
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// Allocations are the warehouses the units are held in, empty when the SKU's
+	// inventory wasn't synced at reservation time
+	Allocations []Allocation `json:"allocations,omitempty"`
+}
+
+// Allocation is the part of a reservation held in one warehouse
+type Allocation struct {
+	Warehouse string `json:"warehouse"`
+	Quantity  int    `json:"quantity"`
+}
+
+func (r Reservation) GetSKU() string { return r.ID }
+
+// active reports whether the reservation still holds stock at the given time
+func (r Reservation) active(now time.Time) bool { return now.Before(r.ExpiresAt) }
+
+// ReservationConfig bounds how long reservations hold stock
+type ReservationConfig struct {
+	DefaultTTL time.Duration // Used when a reservation names no ttl
+	MaxTTL     time.Duration // Longest ttl accepted
+}
+
+// InventoryResponseData is the availability of a SKU after local reservations
+type InventoryResponseData struct {
+	Clave           string                   `json:"clave"`
+	Existencia      *int                     `json:"existencia"`      // Ashley's available quantity in the home DCs, null when not synced
+	ExistenciaTotal *int                     `json:"existenciaTotal"` // Ashley's available quantity in every DC
+	Apartado        int                      `json:"apartado"`        // Held by active reservations
+	Disponible      *int                     `json:"disponible"`      // Existencia minus Apartado, never negative
+	Almacenes       []WarehouseInventoryData `json:"almacenes"`       // Per DC, home DCs first in priority order
+	Apartados       []Reservation            `json:"apartados"`       // Active reservations, soonest to expire first
+
+	TiempoEntregaDias *int `json:"tiempoEntregaDias"` // Estimated days to deliver one unit, null when unknown
+}
+
+// WarehouseInventoryData is the availability of a SKU in one distribution center
+type WarehouseInventoryData struct {
+	Almacen      string `json:"almacen"`
+	Local        bool   `json:"local"` // Home DC, counted in disponible
+	Existencia   int    `json:"existencia"`
+	Apartado     int    `json:"apartado"`
+	Disponible   int    `json:"disponible"`
+	ProximaFecha string `json:"proximaFecha,omitempty"` // Next availability date from Ashley
+}
+
+// available returns the stock left after reserved units, never negative
+func available(stock, reserved int) int {
+	return max(stock-reserved, 0)
+}
+
+// storedInventory reads the synced inventory of a SKU in every warehouse within a
+// transaction
+func storedInventory(tx *bolt.Tx, sku string) ([]InventoryRequestData, error) {
+	bucket := recordsOf(tx, inventoryBucketName)
+	if bucket == nil {
+		return nil, nil
+	}
+
+	var records []InventoryRequestData
+	prefix := []byte(inventoryKey(sku, ""))
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		data, err := openValue(inventoryBucketName, k, v)
+		if err != nil {
+			return nil, err
+		}
+		var inventory InventoryRequestData
+		if err := json.Unmarshal(data, &inventory); err != nil {
+			return nil, fmt.Errorf("error unmarshaling inventory %s: %v", k, err)
+		}
+		records = append(records, inventory)
+	}
+	return records, nil
+}
+
+// activeReservations returns the reservations holding stock at the given time, for a
+// single SKU or every SKU when sku is empty
+func activeReservations(tx *bolt.Tx, sku string, now time.Time) ([]Reservation, error) {
+	bucket := tx.Bucket([]byte(reservationsBucketName))
+	if bucket == nil {
+		return nil, nil
+	}
+
+	var reservations []Reservation
+	err := bucket.ForEach(func(k, v []byte) error {
+		var reservation Reservation
+		if err := json.Unmarshal(v, &reservation); err != nil {
+			return fmt.Errorf("error unmarshaling reservation %s: %v", k, err)
+		}
+		if (sku == "" || reservation.Sku == sku) && reservation.active(now) {
+			reservations = append(reservations, reservation)
+		}
+		return nil
+	})
+	return reservations, err
+}
+
+// ReserveInventory holds quantity units of a SKU for ttl. When Ashley's stock of the
+// SKU is synced, the units are allocated to the home DCs in priority order and the
+// reservation fails with ErrInsufficientStock unless enough are left after the active
+// reservations; the check and the insert share a transaction, so concurrent
+// reservations can't oversell.
+func ReserveInventory(sku string, quantity int, reference string, ttl time.Duration) (Reservation, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Reservation{}, fmt.Errorf("error generating reservation ID: %v", err)
+	}
+	now := time.Now()
+	reservation := Reservation{
+		ID:        id.String(),
+		Sku:       sku,
+		Quantity:  quantity,
+		Reference: reference,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		records, err := storedInventory(tx, sku)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			products := recordsOf(tx, "products")
+			if products == nil || products.Get([]byte(sku)) == nil {
+				return fmt.Errorf("%w: product %s", ErrNotFound, sku)
+			}
+		} else {
+			held, err := activeReservations(tx, sku, now)
+			if err != nil {
+				return err
+			}
+			level := newStockLevel(records, held)
+			if quantity > level.available {
+				return fmt.Errorf("%w: %d of %s requested, %d available", ErrInsufficientStock, quantity, sku, level.available)
+			}
+			reservation.Allocations = level.allocate(quantity)
+		}
+
+		data, err := json.Marshal(reservation)
+		if err != nil {
+			return fmt.Errorf("error marshaling reservation: %v", err)
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte(reservationsBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(reservation.ID), data)
+	})
+
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	return reservation, nil
+}
+
+// ReleaseReservation deletes a reservation, returning its units to the available stock
+func ReleaseReservation(id string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(reservationsBucketName))
+		if bucket == nil || bucket.Get([]byte(id)) == nil {
+			return fmt.Errorf("%w: no reservation %s", ErrNotFound, id)
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// GetInventory returns the stock, reserved and available quantities of a SKU, in
+// aggregate and per warehouse
+func GetInventory(sku string) (InventoryResponseData, error) {
+	db, err := openDB()
+	if err != nil {
+		return InventoryResponseData{}, err
+	}
+	defer db.Close()
+
+	response := InventoryResponseData{Clave: sku, Almacenes: []WarehouseInventoryData{}, Apartados: []Reservation{}}
+	err = db.View(func(tx *bolt.Tx) error {
+		records, err := storedInventory(tx, sku)
+		if err != nil {
+			return err
+		}
+		held, err := activeReservations(tx, sku, time.Now())
+		if err != nil {
+			return err
+		}
+
+		for _, r := range held {
+			response.Apartado += r.Quantity
+			response.Apartados = append(response.Apartados, r)
+		}
+		sort.Slice(response.Apartados, func(i, j int) bool {
+			return response.Apartados[i].ExpiresAt.Before(response.Apartados[j].ExpiresAt)
+		})
+
+		if len(records) == 0 {
+			return nil
+		}
+
+		level := newStockLevel(records, held)
+		response.Existencia = &level.stock
+		response.ExistenciaTotal = &level.totalStock
+		response.Disponible = &level.available
+		response.TiempoEntregaDias = leadTime.days(level, time.Now())
+		for _, w := range level.warehouses {
+			response.Almacenes = append(response.Almacenes, WarehouseInventoryData{
+				Almacen:      w.Warehouse,
+				Local:        w.home,
+				Existencia:   w.QuantityAvailable,
+				Apartado:     w.reserved,
+				Disponible:   available(w.QuantityAvailable, w.reserved),
+				ProximaFecha: w.NextAvailableDate,
+			})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return InventoryResponseData{}, err
+	}
+
+	return response, nil
+}
+
+// availability returns the stock levels after active reservations of the given SKUs,
+// or of every SKU when skus is nil. SKUs without synced inventory are left out.
+func availability(skus []string) (map[string]stockLevel, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	result := make(map[string]stockLevel)
+	err = db.View(func(tx *bolt.Tx) error {
+		stock := make(map[string][]InventoryRequestData)
+		if skus != nil {
+			for _, sku := range skus {
+				records, err := storedInventory(tx, sku)
+				if err != nil {
+					return err
+				}
+				if len(records) > 0 {
+					stock[sku] = records
+				}
+			}
+		} else if bucket := recordsOf(tx, inventoryBucketName); bucket != nil {
+			err := bucket.ForEach(func(k, v []byte) error {
+				v, err := openValue(inventoryBucketName, k, v)
+				if err != nil {
+					return err
+				}
+				var inventory InventoryRequestData
+				if err := json.Unmarshal(v, &inventory); err != nil {
+					return fmt.Errorf("error unmarshaling inventory %s: %v", k, err)
+				}
+				stock[inventory.Sku] = append(stock[inventory.Sku], inventory)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(stock) == 0 {
+			return nil
+		}
+
+		held, err := activeReservations(tx, "", time.Now())
+		if err != nil {
+			return err
+		}
+		reservations := make(map[string][]Reservation)
+		for _, r := range held {
+			reservations[r.Sku] = append(reservations[r.Sku], r)
+		}
+		for sku, records := range stock {
+			result[sku] = newStockLevel(records, reservations[sku])
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// applyAvailability sets disponible and tiempoEntregaDias on the products with synced
+// inventory, reading the whole inventory for the full catalog and only the listed
+// products otherwise
+func applyAvailability(response []ProductResponseData, catalog bool) error {
+	var skus []string
+	if !catalog {
+		if len(response) == 0 {
+			return nil
+		}
+		skus = make([]string, 0, len(response))
+		for _, product := range response {
+			skus = append(skus, product.Clave)
+		}
+	}
+
+	levels, err := availability(skus)
+	if err != nil {
+		return fmt.Errorf("error fetching inventory: %v", err)
+	}
+	now := time.Now()
+	for i := range response {
+		if level, ok := levels[response[i].Clave]; ok {
+			response[i].Disponible = &level.available
+			response[i].TiempoEntregaDias = leadTime.days(level, now)
+		}
+	}
+	return nil
+}
+
+// reservationExpiry dates reservations by when they stop holding stock
+func reservationExpiry(k, v []byte) (time.Time, error) {
+	var reservation Reservation
+	if err := json.Unmarshal(v, &reservation); err != nil {
+		return time.Time{}, err
+	}
+	return reservation.ExpiresAt, nil
+}
+
+// inventoryHandler serves the stock of a SKU with its active reservations
+func (s *server) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := GetInventory(lookupSKU(r.PathValue("sku")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching inventory: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeSchemaJSON(w, r, http.StatusOK, response)
+}
+
+// reserveHandler holds stock from a {"quantity": 2, "reference": "Q-1042", "ttl": "72h"}
+// body. Without a ttl the reservation lasts the configured default.
+func (s *server) reserveHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+
+	var body struct {
+		Quantity  int    `json:"quantity"`
+		Reference string `json:"reference"`
+		TTL       string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if body.Quantity <= 0 {
+		http.Error(w, "quantity must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	ttl := s.config.Reservations.DefaultTTL
+	if body.TTL != "" {
+		parsed, err := time.ParseDuration(body.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "ttl must be a positive duration such as 48h", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	if maxTTL := s.config.Reservations.MaxTTL; maxTTL > 0 && ttl > maxTTL {
+		http.Error(w, fmt.Sprintf("ttl must not exceed %v", maxTTL), http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := ReserveInventory(sku, body.Quantity, strings.TrimSpace(body.Reference), ttl)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Product %s not found", sku), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrInsufficientStock) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving reservation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	writeJSON(w, http.StatusCreated, reservation)
+}
+
+// releaseReservationHandler deletes a reservation before it expires
+func (s *server) releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
+	err := ReleaseReservation(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error releasing reservation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
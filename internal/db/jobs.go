@@ -0,0 +1,466 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+const jobsBucketName = "jobs"
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+	JobDeferred  = "deferred" // Stopped by upstream maintenance, see ErrUpstreamMaintenance
+)
+
+// Job triggers
+const (
+	TriggerStartup  = "startup"
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+	TriggerResume   = "resume" // Automatic resumption of a failed sync
+)
+
+// ErrJobFinished is returned when canceling a job that already finished
+var ErrJobFinished = errors.New("job already finished")
+
+// JobFunc is the work of a job. It should stop early when ctx is canceled.
+type JobFunc func(ctx context.Context) error
+
+// Job is the persisted record of a unit of work run by the JobQueue
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Trigger    string     `json:"trigger"`
+	State      string     `json:"state"`
+	EnqueuedAt time.Time  `json:"enqueuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func (j Job) GetSKU() string { return j.ID }
+
+// finished reports whether the job reached a final state
+func (j Job) finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCanceled || j.State == JobDeferred
+}
+
+type queuedJob struct {
+	job    Job
+	run    JobFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// JobQueue runs jobs one at a time in enqueue order, so manual triggers, scheduled
+// runs and the startup sync never overlap. Every job is persisted in the jobs bucket.
+type JobQueue struct {
+	mu     sync.Mutex
+	queue  chan *queuedJob
+	active map[string]*queuedJob
+}
+
+// NewJobQueue creates a queue holding up to size pending jobs. Jobs left queued or
+// running by a previous process are marked as failed.
+func NewJobQueue(size int) (*JobQueue, error) {
+	q := &JobQueue{
+		queue:  make(chan *queuedJob, size),
+		active: make(map[string]*queuedJob),
+	}
+
+	if err := q.failInterruptedJobs(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Start runs the worker executing queued jobs
+func (q *JobQueue) Start() {
+	go func() {
+		for entry := range q.queue {
+			q.execute(entry)
+		}
+	}()
+}
+
+// Enqueue adds a job to the queue. When a job of the same kind is already waiting,
+// that job is returned instead of queueing a duplicate.
+func (q *JobQueue) Enqueue(kind, trigger string, run JobFunc) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, entry := range q.active {
+		if entry.job.Kind == kind && entry.job.State == JobQueued {
+			return entry.job, nil
+		}
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Job{}, fmt.Errorf("error generating job ID: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &queuedJob{
+		job: Job{
+			ID:         id.String(),
+			Kind:       kind,
+			Trigger:    trigger,
+			State:      JobQueued,
+			EnqueuedAt: time.Now(),
+		},
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// The record is saved again when the job starts, so a database busy with a
+	// running sync must not prevent queueing
+	if err := saveJob(entry.job); err != nil {
+		log.Printf("Error saving job %s: %v", entry.job.ID, err)
+	}
+
+	select {
+	case q.queue <- entry:
+	default:
+		cancel()
+		entry.job.State = JobFailed
+		entry.job.Error = "job queue is full"
+		if err := saveJob(entry.job); err != nil {
+			log.Printf("Error saving job %s: %v", entry.job.ID, err)
+		}
+		return entry.job, errors.New("job queue is full")
+	}
+
+	q.active[entry.job.ID] = entry
+	log.Printf("Queued %s job %s (%s)", kind, entry.job.ID, trigger)
+	return entry.job, nil
+}
+
+// Wait blocks until the job finishes and returns its error. Jobs no longer active
+// return their persisted outcome.
+func (q *JobQueue) Wait(id string) error {
+	q.mu.Lock()
+	entry, ok := q.active[id]
+	q.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.err
+	}
+
+	job, err := GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job.Error != "" {
+		return errors.New(job.Error)
+	}
+	return nil
+}
+
+// Get returns an active job from memory or a finished one from the database
+func (q *JobQueue) Get(id string) (*Job, error) {
+	q.mu.Lock()
+	entry, ok := q.active[id]
+	q.mu.Unlock()
+
+	if ok {
+		job := entry.job
+		return &job, nil
+	}
+
+	return GetJob(id)
+}
+
+// Cancel cancels a queued or running job. Queued jobs are skipped when their turn
+// comes; running jobs have their context canceled.
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.active[id]
+	if !ok {
+		job, err := GetJob(id)
+		if err != nil {
+			return Job{}, err
+		}
+		return *job, ErrJobFinished
+	}
+
+	entry.cancel()
+	log.Printf("Cancel requested for %s job %s", entry.job.Kind, id)
+	return entry.job, nil
+}
+
+// CancelAll cancels every queued and running job, e.g. when the service stops
+func (q *JobQueue) CancelAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, entry := range q.active {
+		entry.cancel()
+		log.Printf("Cancel requested for %s job %s", entry.job.Kind, id)
+	}
+}
+
+// execute runs a job and persists its outcome
+func (q *JobQueue) execute(entry *queuedJob) {
+	defer close(entry.done)
+
+	q.mu.Lock()
+	if entry.ctx.Err() != nil {
+		entry.err = context.Canceled
+		q.finish(entry, JobCanceled, entry.err)
+		q.mu.Unlock()
+		return
+	}
+	startedAt := time.Now()
+	entry.job.State = JobRunning
+	entry.job.StartedAt = &startedAt
+	if err := saveJob(entry.job); err != nil {
+		log.Printf("Error saving job %s: %v", entry.job.ID, err)
+	}
+	q.mu.Unlock()
+
+	log.Printf("Running %s job %s (%s)", entry.job.Kind, entry.job.ID, entry.job.Trigger)
+	err := entry.run(withJobID(entry.ctx, entry.job.ID))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry.err = err
+	switch {
+	case err == nil:
+		q.finish(entry, JobSucceeded, nil)
+	case entry.ctx.Err() != nil:
+		q.finish(entry, JobCanceled, err)
+	case deferred(err):
+		q.finish(entry, JobDeferred, err)
+	default:
+		q.finish(entry, JobFailed, err)
+	}
+}
+
+// finish stores the final state of a job and removes it from the active set.
+// Must be called with q.mu held.
+func (q *JobQueue) finish(entry *queuedJob, state string, err error) {
+	finishedAt := time.Now()
+	entry.job.State = state
+	entry.job.FinishedAt = &finishedAt
+	if err != nil {
+		entry.job.Error = err.Error()
+	}
+	entry.cancel()
+
+	if saveErr := saveJob(entry.job); saveErr != nil {
+		log.Printf("Error saving job %s: %v", entry.job.ID, saveErr)
+	}
+	delete(q.active, entry.job.ID)
+
+	log.Printf("%s job %s %s", entry.job.Kind, entry.job.ID, state)
+}
+
+// failInterruptedJobs marks jobs left unfinished by a previous process as failed
+func (q *JobQueue) failInterruptedJobs() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(jobsBucketName))
+		if err != nil {
+			return err
+		}
+
+		var interrupted []Job
+		err = bucket.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if !job.finished() {
+				interrupted = append(interrupted, job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, job := range interrupted {
+			finishedAt := time.Now()
+			job.State = JobFailed
+			job.FinishedAt = &finishedAt
+			job.Error = "interrupted by service restart"
+
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(job.ID), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// saveJob persists a job record
+func saveJob(job Job) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("error marshaling job %s: %v", job.ID, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(jobsBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(job.ID), data)
+	})
+}
+
+// GetJob returns a persisted job
+func GetJob(id string) (*Job, error) {
+	return GetEntity[Job](jobsBucketName, id)
+}
+
+// GetJobHistory returns the most recent jobs, newest first. Job IDs are
+// time ordered, so the bucket is walked backwards.
+func GetJobHistory(limit int) ([]Job, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	jobs := []Job{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(jobsBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(jobs) < limit; k, v = cursor.Prev() {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// writeJSON encodes v as the JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// triggerSyncHandler queues a manual sync of every enabled fetcher
+func (s *server) triggerSyncHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := s.config.Jobs.Enqueue("sync", TriggerManual, s.config.Sync)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error queueing sync: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// cancelSyncHandler cancels a queued or running sync job. A running sync stops
+// between pages, keeping every page committed so far.
+func (s *server) cancelSyncHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := s.config.Jobs.Cancel(r.PathValue("jobID"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrJobFinished) {
+		http.Error(w, fmt.Sprintf("Job already %s", job.State), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error canceling job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// jobHistoryHandler serves the most recent jobs (?limit=, default 50)
+func (s *server) jobHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	jobs, err := GetJobHistory(limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// jobHandler serves a single job
+func (s *server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := s.config.Jobs.Get(r.PathValue("jobID"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
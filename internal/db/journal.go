@@ -0,0 +1,481 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// journalBucketName is the append-only record of every applied catalog change,
+// keyed by big endian sequence number
+const journalBucketName = "journal"
+
+// Journal operations
+const (
+	JournalPut    = "put"
+	JournalDelete = "delete"
+)
+
+// Sources of applied changes
+const (
+	SourceSync        = "sync"
+	SourceImport      = "import"
+	SourceRetransform = "retransform"
+	SourceRollback    = "rollback"
+	SourceSeed        = "seed"
+)
+
+// applyRun identifies the operation applying changes, so the journal tells which run
+// wrote what
+type applyRun struct {
+	ID     string // Job ID of syncs run by the job queue, generated otherwise
+	Source string
+}
+
+type jobIDContextKey struct{}
+
+// newRun returns a run with a generated ID
+func newRun(source string) (applyRun, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return applyRun{}, fmt.Errorf("error generating run ID: %v", err)
+	}
+	return applyRun{ID: id.String(), Source: source}, nil
+}
+
+// withJobID returns ctx carrying the ID of the job running under it
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDContextKey{}, id)
+}
+
+// syncRun returns the run of a sync: the job running it, or a generated run when the
+// sync doesn't run as a job
+func syncRun(ctx context.Context) (applyRun, error) {
+	if id, ok := ctx.Value(jobIDContextKey{}).(string); ok {
+		return applyRun{ID: id, Source: SourceSync}, nil
+	}
+	return newRun(SourceSync)
+}
+
+// JournalEntry is an applied change of a record. Hashes identify the stored value
+// before and after the change, empty when there was none.
+type JournalEntry struct {
+	Seq        string    `json:"seq"`
+	Run        string    `json:"run"`
+	Source     string    `json:"source"`
+	Bucket     string    `json:"bucket"`
+	Sku        string    `json:"sku"`
+	Op         string    `json:"op"`
+	BeforeHash string    `json:"beforeHash,omitempty"`
+	AfterHash  string    `json:"afterHash,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// journalRecord is a stored journal entry with the value it replaced, kept for rollbacks
+type journalRecord struct {
+	JournalEntry
+	Before json.RawMessage `json:"before,omitempty"`
+}
+
+// valueHash identifies a stored value, empty for none
+func valueHash(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// journalChange appends an applied change to the journal within the caller's
+// transaction. before and after are the plaintext values, nil when absent.
+func journalChange(tx *bolt.Tx, run applyRun, bucketName, sku string, before, after []byte) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(journalBucketName))
+	if err != nil {
+		return err
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	record := journalRecord{
+		JournalEntry: JournalEntry{
+			Seq:        strconv.FormatUint(seq, 10),
+			Run:        run.ID,
+			Source:     run.Source,
+			Bucket:     bucketName,
+			Sku:        sku,
+			Op:         JournalPut,
+			BeforeHash: valueHash(before),
+			AfterHash:  valueHash(after),
+			At:         time.Now(),
+		},
+		Before: before,
+	}
+	if after == nil {
+		record.Op = JournalDelete
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := changeKey(seq)
+	sealed, err := sealValue(journalBucketName, key, data)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, sealed)
+}
+
+// JournalQuery selects journal entries. Empty fields match everything.
+type JournalQuery struct {
+	Run    string
+	Bucket string
+	Sku    string
+	After  uint64 // Only entries past this sequence number
+	Limit  int
+}
+
+// JournalPage is a page of journal entries. Cursor is the sequence to continue after.
+type JournalPage struct {
+	Entries []JournalEntry `json:"entries"`
+	Cursor  string         `json:"cursor"`
+	More    bool           `json:"more"`
+}
+
+// forEachJournal calls fn with the stored journal records past after, oldest first,
+// until fn returns false
+func forEachJournal(tx *bolt.Tx, after uint64, fn func(record journalRecord) (bool, error)) error {
+	bucket := tx.Bucket([]byte(journalBucketName))
+	if bucket == nil {
+		return nil
+	}
+
+	c := bucket.Cursor()
+	for k, v := c.Seek(changeKey(after + 1)); k != nil; k, v = c.Next() {
+		v, err := openValue(journalBucketName, k, v)
+		if err != nil {
+			return err
+		}
+		var record journalRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("error decoding journal entry %d: %v", binary.BigEndian.Uint64(k), err)
+		}
+		more, err := fn(record)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetJournal returns the journal entries matching query
+func GetJournal(query JournalQuery) (JournalPage, error) {
+	page := JournalPage{Entries: []JournalEntry{}, Cursor: strconv.FormatUint(query.After, 10)}
+
+	db, err := openDB()
+	if err != nil {
+		return page, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return forEachJournal(tx, query.After, func(record journalRecord) (bool, error) {
+			if len(page.Entries) == query.Limit {
+				page.More = true
+				return false, nil
+			}
+			page.Cursor = record.Seq
+			if (query.Run == "" || record.Run == query.Run) &&
+				(query.Bucket == "" || record.Bucket == query.Bucket) &&
+				(query.Sku == "" || record.Sku == query.Sku) {
+				page.Entries = append(page.Entries, record.JournalEntry)
+			}
+			return true, nil
+		})
+	})
+	if err != nil {
+		return page, fmt.Errorf("error reading journal: %v", err)
+	}
+
+	return page, nil
+}
+
+// RollbackRequest selects the changes of a run to undo. Without SKUs every change of
+// the run (in Bucket, if set) is undone.
+type RollbackRequest struct {
+	Run    string   `json:"run"`
+	Bucket string   `json:"bucket"`
+	Skus   []string `json:"skus"`
+}
+
+// RolledBackRecord is a record a rollback restored, or skipped with the reason
+type RolledBackRecord struct {
+	Bucket string `json:"bucket"`
+	Sku    string `json:"sku"`
+	Op     string `json:"op,omitempty"`     // The operation applied to restore the record
+	Reason string `json:"reason,omitempty"` // Why the record was skipped
+}
+
+// RollbackResult is the outcome of a rollback, itself journaled as Run
+type RollbackResult struct {
+	Run        string             `json:"run"`
+	RolledBack []RolledBackRecord `json:"rolledBack"`
+	Skipped    []RolledBackRecord `json:"skipped"`
+}
+
+// RollbackRun restores the records a run changed to their values before it. Records
+// changed again since the run are skipped rather than overwritten.
+func RollbackRun(request RollbackRequest) (RollbackResult, error) {
+	run, err := newRun(SourceRollback)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+	result := RollbackResult{Run: run.ID, RolledBack: []RolledBackRecord{}, Skipped: []RolledBackRecord{}}
+
+	wanted := make(map[string]bool, len(request.Skus))
+	for _, sku := range request.Skus {
+		wanted[sku] = true
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// The first change of each record holds its value before the run, the last
+		// one the value the run left
+		type span struct {
+			first, last journalRecord
+		}
+		spans := make(map[[2]string]*span)
+		var order [][2]string
+		err := forEachJournal(tx, 0, func(record journalRecord) (bool, error) {
+			if record.Run != request.Run || (request.Bucket != "" && record.Bucket != request.Bucket) {
+				return true, nil
+			}
+			if len(wanted) > 0 && !wanted[record.Sku] {
+				return true, nil
+			}
+			key := [2]string{record.Bucket, record.Sku}
+			if s, ok := spans[key]; ok {
+				s.last = record
+			} else {
+				spans[key] = &span{first: record, last: record}
+				order = append(order, key)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(spans) == 0 {
+			return fmt.Errorf("%w: no journaled changes of run %s match", ErrNotFound, request.Run)
+		}
+
+		sort.Slice(order, func(i, j int) bool {
+			if order[i][0] != order[j][0] {
+				return order[i][0] < order[j][0]
+			}
+			return order[i][1] < order[j][1]
+		})
+
+		for _, key := range order {
+			s := spans[key]
+			bucketName, sku := key[0], key[1]
+			record := RolledBackRecord{Bucket: bucketName, Sku: sku}
+
+			bucket := recordsOf(tx, bucketName)
+			var current []byte
+			if bucket != nil {
+				if stored := bucket.Get([]byte(sku)); stored != nil {
+					current, err = openValue(bucketName, []byte(sku), stored)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if valueHash(current) != s.last.AfterHash {
+				record.Reason = "changed since the run"
+				result.Skipped = append(result.Skipped, record)
+				continue
+			}
+
+			before := []byte(s.first.Before)
+			if err := restoreRecord(tx, run, bucketName, sku, current, before); err != nil {
+				return fmt.Errorf("error restoring %s %s: %v", bucketName, sku, err)
+			}
+			record.Op = JournalPut
+			if before == nil {
+				record.Op = JournalDelete
+			}
+			result.RolledBack = append(result.RolledBack, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// restoreRecord writes before (or deletes the record when nil) in place of current,
+// recording the change like synced ones
+func restoreRecord(tx *bolt.Tx, run applyRun, bucketName, sku string, current, before []byte) error {
+	bucket, err := createRecords(tx, bucketName)
+	if err != nil {
+		return err
+	}
+
+	if before == nil {
+		return deleteRecord(tx, run, bucket, bucketName, sku)
+	}
+
+	sealed, err := sealValue(bucketName, []byte(sku), before)
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put([]byte(sku), sealed); err != nil {
+		return err
+	}
+	if err := putRecordHash(tx, bucketName, sku, recordHash(before)); err != nil {
+		return err
+	}
+
+	// Restored prices count as price changes, restored products get their index keys back
+	switch bucketName {
+	case "prices":
+		var price PriceRequestData
+		if err := json.Unmarshal(before, &price); err != nil {
+			return err
+		}
+		if err := recordPrice(tx, price); err != nil {
+			return err
+		}
+	case "products":
+		var product ProductRequestData
+		if err := json.Unmarshal(before, &product); err != nil {
+			return err
+		}
+		if err := putIndexKeys(tx, product, sku); err != nil {
+			return err
+		}
+	}
+
+	if err := recordChange(tx, bucketName, sku, false); err != nil {
+		return err
+	}
+	return journalChange(tx, run, bucketName, sku, current, before)
+}
+
+// deleteRecord removes a stored record, recording the removal in the change feed and
+// the journal
+func deleteRecord(tx *bolt.Tx, run applyRun, bucket *records, bucketName, sku string) error {
+	var before []byte
+	if stored := bucket.Get([]byte(sku)); stored != nil {
+		opened, err := openValue(bucketName, []byte(sku), stored)
+		if err != nil {
+			return err
+		}
+		before = append([]byte(nil), opened...)
+	}
+
+	if err := bucket.Delete([]byte(sku)); err != nil {
+		return err
+	}
+	if err := deleteRecordHash(tx, bucketName, sku); err != nil {
+		return err
+	}
+	if err := recordChange(tx, bucketName, sku, true); err != nil {
+		return err
+	}
+	return journalChange(tx, run, bucketName, sku, before, nil)
+}
+
+func journalExpiry(k, v []byte) (time.Time, error) {
+	v, err := openValue(journalBucketName, k, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var record journalRecord
+	if err := json.Unmarshal(v, &record); err != nil {
+		return time.Time{}, err
+	}
+	return record.At, nil
+}
+
+// journalHandler serves journal entries, filtered with ?run=, ?bucket= and ?sku= and
+// paged with ?after=<seq>&limit=
+func (s *server) journalHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := JournalQuery{Run: q.Get("run"), Bucket: q.Get("bucket"), Sku: q.Get("sku"), Limit: 1000}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+	if value := q.Get("after"); value != "" {
+		after, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid after %q: expected a sequence number", value), http.StatusBadRequest)
+			return
+		}
+		query.After = after
+	}
+
+	page, err := GetJournal(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching journal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// rollbackHandler undoes the changes of a run from a
+// {"run": ..., "bucket": ..., "skus": [...]} body
+func (s *server) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var request RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if request.Run == "" {
+		http.Error(w, "run is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := RollbackRun(request)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rolling back run: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// jsonSchemaDialect is the JSON Schema version of the published documents
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// responseShape is a response payload whose JSON Schema is published at /schemas/<name>
+type responseShape struct {
+	name     string
+	endpoint string
+	value    any  // Zero value of the payload's type
+	renamed  bool // Whether response schemas rename its fields
+	redacted bool // Whether response profiles remove its fields
+}
+
+// responseShapes are the published payloads, by the endpoint serving them
+var responseShapes = []responseShape{
+	{"products", "GET /products", []ProductResponseData{}, true, true},
+	{"channel-products", "GET /channels/{name}/products", []ProductResponseData{}, true, true},
+	{"components", "GET /products/{sku}/components", KitResponseData{}, true, true},
+	{"upstream-product", "GET /upstream/products/{sku}", ProductResponseData{}, true, true},
+	{"inventory", "GET /inventory/{sku}", InventoryResponseData{}, true, false},
+	{"price-list", "GET /price-list", PriceList{}, true, false},
+	{"price-history", "GET /prices/{sku}/history", []PricePoint{}, true, true},
+	{"price-trends", "GET /analytics/price-trends", PriceTrends{}, false, false},
+	{"quote", "POST /quotes", Quote{}, false, false},
+	{"changes", "GET /changes", ChangeFeed{}, false, false},
+	{"versions", "GET /versions", []CatalogVersion{}, false, false},
+}
+
+// jsonSchema returns the JSON Schema of a payload as served to a request: without the
+// fields its profile hides, named by its response schema
+func (shape responseShape) jsonSchema(r *http.Request) map[string]any {
+	var fields schemaFields
+	if shape.renamed {
+		fields.schema = requestSchema(r)
+	}
+	if shape.redacted {
+		fields.profile = requestProfile(r)
+	}
+	document := typeJSONSchema(reflect.TypeOf(shape.value), fields)
+	document["$schema"] = jsonSchemaDialect
+	document["title"] = shape.name
+	document["description"] = "Response of " + shape.endpoint
+	return document
+}
+
+// schemaFields selects and names the properties of a document
+type schemaFields struct {
+	profile *ResponseProfile
+	schema  *ResponseSchema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// typeJSONSchema describes how encoding/json encodes values of t
+func typeJSONSchema(t reflect.Type, fields schemaFields) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeJSONSchema(t.Elem(), fields)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeJSONSchema(t.Elem(), fields)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeJSONSchema(t.Elem(), fields)}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		required := []string{}
+		addStructProperties(t, fields, properties, &required)
+		return map[string]any{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]any{}
+}
+
+// addStructProperties adds the encoded fields of a struct, including those of embedded
+// structs. Fields not tagged omitempty are always present, so they are required.
+func addStructProperties(t reflect.Type, fields schemaFields, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, fields, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		if fields.profile != nil && fields.profile.Hidden[name] {
+			continue
+		}
+		property := typeJSONSchema(field.Type, fields)
+		if fields.schema != nil {
+			if renamed, ok := fields.schema.Rename[name]; ok {
+				name = renamed
+			}
+		}
+
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+			// Nil pointers are encoded as null unless omitted
+			if kind, ok := property["type"].(string); ok && field.Type.Kind() == reflect.Pointer {
+				property["type"] = []string{kind, "null"}
+			}
+		}
+		properties[name] = property
+	}
+}
+
+// schemasHandler lists the published JSON Schema documents
+func (s *server) schemasHandler(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		Name     string `json:"name"`
+		Endpoint string `json:"endpoint"`
+		Path     string `json:"path"`
+	}
+
+	entries := make([]entry, 0, len(responseShapes))
+	for _, shape := range responseShapes {
+		entries = append(entries, entry{shape.name, shape.endpoint, "/schemas/" + shape.name})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Schemas []string `json:"schemas"` // Response schemas selectable with ?schema=
+		Shapes  []entry  `json:"shapes"`
+	}{schemaNames(s.config.Schemas), entries})
+}
+
+// jsonSchemaHandler serves the JSON Schema of a response payload as served to the request
+func (s *server) jsonSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(r.PathValue("name"), ".json")
+	for _, shape := range responseShapes {
+		if shape.name == name {
+			writeJSON(w, http.StatusOK, shape.jsonSchema(r))
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("Unknown response shape %q: see /schemas", name), http.StatusNotFound)
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// KitComponentResponseData is a component of a kit in the response format
+type KitComponentResponseData = api.KitComponent
+
+// KitResponseData lists the components of a kit with their rolled up prices
+type KitResponseData = api.Kit
+
+// componentRollup is the price of a kit computed from its components
+type componentRollup struct {
+	Costo    float64
+	Costo2   float64
+	Complete bool
+}
+
+// rollUpComponents sums the prices of the components of a kit. Complete is false
+// when the product has no components or any of them is missing a price.
+func rollUpComponents(components []Component, priceMap map[string]PriceRequestData) componentRollup {
+	rollup := componentRollup{Complete: len(components) > 0}
+
+	for _, component := range components {
+		price, ok := priceMap[component.Sku]
+		if !ok {
+			rollup.Complete = false
+			continue
+		}
+		quantity := float64(max(component.Quantity, 1))
+		rollup.Costo += price.SellPrice * quantity
+		rollup.Costo2 += price.TotalNetPrice * quantity
+	}
+
+	return rollup
+}
+
+// componentsHandler serves the components of a kit with their prices rolled up
+func (s *server) componentsHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	product, err := GetProduct(sku)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Product %s not found", sku), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching product: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := KitResponseData{Clave: product.Sku, Componentes: []KitComponentResponseData{}}
+
+	componentSKUs := make([]string, 0, len(product.Components))
+	for _, component := range product.Components {
+		componentSKUs = append(componentSKUs, component.Sku)
+	}
+	children, err := GetEntities[ProductRequestData]("products", componentSKUs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching components: %v", err), http.StatusInternalServerError)
+		return
+	}
+	priceMap, err := GetEntities[PriceRequestData]("prices", componentSKUs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching component prices: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	for _, component := range product.Components {
+		item := KitComponentResponseData{Clave: component.Sku, Cantidad: max(component.Quantity, 1)}
+
+		if child, ok := children[component.Sku]; ok {
+			item.Nombre = child.ConsumerDescription
+			if description, ok := localizedDescription(child.Descriptions, lang); ok {
+				item.Nombre = description
+			}
+		}
+		if price, ok := priceMap[component.Sku]; ok {
+			item.Costo = price.SellPrice
+			item.Costo2 = price.TotalNetPrice
+			item.Precio = true
+		}
+
+		response.Componentes = append(response.Componentes, item)
+	}
+
+	rollup := rollUpComponents(product.Components, priceMap)
+	response.CostoKit = rollup.Costo
+	response.Costo2Kit = rollup.Costo2
+	response.Completo = rollup.Complete
+
+	writeRedactedJSON(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// LandedCostConfig turns Ashley's USD costs into the cost of a unit imported into
+// Mexico: the customs value is TotalNetPrice (which carries Ashley's freight) plus our
+// own freight, converted at the exchange rate; duty and IVA are charged on it and the
+// customs broker's fees are added on top
+type LandedCostConfig struct {
+	ExchangeRate  float64            // MXN per USD, 0 disables landed costs
+	FreightPerM3  float64            // USD per cubic meter of the unit, added to the customs value
+	DutyRate      float64            // Import duty (IGI) as a fraction of the customs value
+	CategoryDuty  map[string]float64 // Duty rates by itemSalesCategoryCodeKey, overriding DutyRate
+	IVARate       float64            // IVA charged on the customs value plus duty
+	BrokerageRate float64            // Broker fee as a fraction of the customs value
+	BrokerageFee  float64            // Fixed broker fee per unit, in MXN
+}
+
+// LandedCost is the per unit cost of an imported product, in MXN
+type LandedCost = api.LandedCost
+
+// landedCost is the configured calculation, disabled by default
+var landedCost LandedCostConfig
+
+// landedSignature identifies the configuration so cached responses built with
+// different rates are not served
+var landedSignature string
+
+// SetLandedCost enables costoImportacion in product responses
+func SetLandedCost(config LandedCostConfig) {
+	landedCost = config
+	landedSignature = ""
+	if config.ExchangeRate > 0 {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v", config)))
+		landedSignature = hex.EncodeToString(sum[:4])
+	}
+}
+
+// ParseCategoryRates parses comma separated category=value pairs keyed by
+// itemSalesCategoryCodeKey, e.g. "UP=0.15,ZZ=0.2"
+func ParseCategoryRates(s string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		category, value, found := strings.Cut(entry, "=")
+		category = strings.TrimSpace(category)
+		if !found || category == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected category=value", entry)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", category, err)
+		}
+		rates[category] = rate
+	}
+	return rates, nil
+}
+
+// Validate checks the rates are fractions and the amounts are not negative
+func (c LandedCostConfig) Validate() error {
+	var errs []string
+	rates := map[string]float64{
+		"LANDED_DUTY_RATE":      c.DutyRate,
+		"LANDED_IVA_RATE":       c.IVARate,
+		"LANDED_BROKERAGE_RATE": c.BrokerageRate,
+	}
+	for category, rate := range c.CategoryDuty {
+		rates["LANDED_DUTY_BY_CATEGORY "+category] = rate
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			errs = append(errs, fmt.Sprintf("%s must be between 0 and 1, got %v", name, rate))
+		}
+	}
+	for name, amount := range map[string]float64{
+		"LANDED_EXCHANGE_RATE":  c.ExchangeRate,
+		"LANDED_FREIGHT_PER_M3": c.FreightPerM3,
+		"LANDED_BROKERAGE_FEE":  c.BrokerageFee,
+	} {
+		if amount < 0 {
+			errs = append(errs, fmt.Sprintf("%s must not be negative, got %v", name, amount))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// compute returns the landed cost of a priced product, nil when disabled
+func (c LandedCostConfig) compute(product ProductRequestData, price PriceRequestData) *LandedCost {
+	if c.ExchangeRate <= 0 {
+		return nil
+	}
+
+	duty := c.DutyRate
+	if rate, ok := c.CategoryDuty[product.ItemSalesCategoryCodeKey]; ok {
+		duty = rate
+	}
+
+	volume := product.UnitHeightMm * product.UnitWidthMm * product.UnitDepthMm / 1e9
+	freight := volume * c.FreightPerM3 * c.ExchangeRate
+	customsValue := price.TotalNetPrice*c.ExchangeRate + freight
+	tariff := customsValue * duty
+	brokerage := customsValue*c.BrokerageRate + c.BrokerageFee
+	iva := (customsValue + tariff) * c.IVARate
+
+	return &LandedCost{
+		TipoCambio:  c.ExchangeRate,
+		Flete:       roundCents(freight),
+		ValorAduana: roundCents(customsValue),
+		Arancel:     roundCents(tariff),
+		Agente:      roundCents(brokerage),
+		IVA:         roundCents(iva),
+		Total:       roundCents(customsValue + tariff + brokerage + iva),
+	}
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
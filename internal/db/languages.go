@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DefaultLanguage is the Accept-Language of upstream requests unless API_LANGUAGES says otherwise
+const DefaultLanguage = "en"
+
+// languageTagPattern matches the language tags of API_LANGUAGES and ?lang=, e.g. es or es-MX
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// language is the Accept-Language of the config's requests: its first language
+func (c APIConfig) language() string {
+	if len(c.Languages) == 0 {
+		return DefaultLanguage
+	}
+	return c.Languages[0]
+}
+
+// inLanguage returns the config requesting lang
+func (c APIConfig) inLanguage(lang string) APIConfig {
+	c.Languages = []string{lang}
+	return c
+}
+
+// validateLanguages checks the language tags of API_LANGUAGES
+func (c APIConfig) validateLanguages() []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for _, lang := range c.Languages {
+		if !languageTagPattern.MatchString(lang) {
+			errs = append(errs, fmt.Errorf("API_LANGUAGES entry %q is not a language tag", lang))
+		}
+		if seen[strings.ToLower(lang)] {
+			errs = append(errs, fmt.Errorf("API_LANGUAGES lists %q twice", lang))
+		}
+		seen[strings.ToLower(lang)] = true
+	}
+	return errs
+}
+
+// fetchDescriptions requests a products page in each further language of config and
+// adds the descriptions found to the page's products by SKU. The raw page is replaced
+// with the merged page so retransforms keep the descriptions.
+func fetchDescriptions(ctx context.Context, url string, config APIConfig, response *ProductAPIResponse) ([]byte, error) {
+	for _, lang := range config.Languages[1:] {
+		translated, _, err := makeHTTPRequest[ProductAPIResponse](ctx, url, config.inLanguage(lang))
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s descriptions: %w", lang, err)
+		}
+
+		descriptions := make(map[string]string, len(translated.Entities))
+		for _, product := range translated.Entities {
+			if product.ConsumerDescription != "" {
+				descriptions[product.Sku] = product.ConsumerDescription
+			}
+		}
+		missing := 0
+		for i := range response.Entities {
+			product := &response.Entities[i]
+			description, ok := descriptions[product.Sku]
+			if !ok {
+				missing++
+				continue
+			}
+			if product.Descriptions == nil {
+				product.Descriptions = make(map[string]string)
+			}
+			product.Descriptions[lang] = description
+		}
+		if missing > 0 {
+			debugf(log.Default(), "%d products of %s have no %s description", missing, url, lang)
+		}
+	}
+
+	raw, err := json.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling products page: %v", err)
+	}
+	return raw, nil
+}
+
+// requestedLanguage returns the language of ?lang=, empty for the primary one
+func requestedLanguage(r *http.Request) (string, error) {
+	lang := strings.TrimSpace(r.URL.Query().Get("lang"))
+	if lang != "" && !languageTagPattern.MatchString(lang) {
+		return "", fmt.Errorf("%q is not a language tag", lang)
+	}
+	return lang, nil
+}
+
+// localizedDescription picks the description in lang from descriptions, falling back
+// from a regional tag to its language (es-MX to es). ok is false when there is none.
+func localizedDescription(descriptions map[string]string, lang string) (string, bool) {
+	if lang == "" || len(descriptions) == 0 {
+		return "", false
+	}
+	for tag, description := range descriptions {
+		if strings.EqualFold(tag, lang) {
+			return description, true
+		}
+	}
+	if base, _, regional := strings.Cut(lang, "-"); regional {
+		return localizedDescription(descriptions, base)
+	}
+	return "", false
+}
+
+// localizeProducts replaces nombre with its translation into lang where there is one
+func localizeProducts(response []ProductResponseData, lang string) {
+	for i := range response {
+		if description, ok := localizedDescription(response[i].Descriptions, lang); ok {
+			response[i].Nombre = description
+		}
+	}
+}
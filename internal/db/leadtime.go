@@ -0,0 +1,55 @@
+package db
+
+import (
+	"math"
+	"time"
+)
+
+// LeadTimeConfig estimates how many days a unit takes to reach a customer: Handling
+// when Ashley has it available, or the days until its next availability date plus
+// Handling when it is backordered
+type LeadTimeConfig struct {
+	Handling int // Days from ordering an available unit to delivering it
+}
+
+// leadTime is the configured estimate, disabled when Handling is negative
+var leadTime = LeadTimeConfig{Handling: -1}
+
+// SetLeadTime enables tiempoEntregaDias for products with synced inventory
+func SetLeadTime(config LeadTimeConfig) {
+	leadTime = config
+}
+
+// nextAvailableLayouts are the formats Ashley's next availability dates come in
+var nextAvailableLayouts = []string{time.DateOnly, time.RFC3339, "2006-01-02T15:04:05", "01/02/2006"}
+
+// parseNextAvailable parses a next availability date, reporting whether it is valid
+func parseNextAvailable(s string) (time.Time, bool) {
+	for _, layout := range nextAvailableLayouts {
+		if at, err := time.Parse(layout, s); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// days returns the estimated delivery time of one unit, nil when it can't be
+// estimated: nothing is left and Ashley gives no (valid) next availability date
+func (c LeadTimeConfig) days(level stockLevel, now time.Time) *int {
+	if c.Handling < 0 {
+		return nil
+	}
+
+	wait := 0
+	if level.available <= 0 {
+		at, ok := parseNextAvailable(level.nextAvailableDate)
+		if !ok {
+			return nil
+		}
+		// Dates in the past mean the shipment is due any day
+		wait = max(int(math.Ceil(at.Sub(now).Hours()/24)), 0)
+	}
+
+	days := wait + c.Handling
+	return &days
+}
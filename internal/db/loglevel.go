@@ -0,0 +1,194 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// settingsBucketName holds settings changed at runtime that outlive a restart
+const settingsBucketName = "settings"
+
+// logLevelSetting is the key of the log level persisted by PUT /admin/loglevel
+const logLevelSetting = "log_level"
+
+// Log levels. Info logs what the service does; debug adds per-record, per-page and
+// per-request detail, including upstream requests as UPSTREAM_LOG does.
+const (
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+var logLevel struct {
+	sync.Mutex
+	level      string
+	configured string // LOG_LEVEL, restored when the persisted level is dropped
+}
+
+// validLogLevel checks a log level name
+func validLogLevel(level string) error {
+	if level != LogLevelInfo && level != LogLevelDebug {
+		return fmt.Errorf("unknown log level %q (available: %s, %s)", level, LogLevelDebug, LogLevelInfo)
+	}
+	return nil
+}
+
+// InitLogLevel sets the log level: the one persisted by PUT /admin/loglevel when there
+// is one, level (LOG_LEVEL) otherwise. Must be called after Init.
+func InitLogLevel(level string) error {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if level == "" {
+		level = LogLevelInfo
+	}
+	if err := validLogLevel(level); err != nil {
+		return err
+	}
+
+	persisted, err := persistedLogLevel()
+	if err != nil {
+		return fmt.Errorf("error reading persisted log level: %v", err)
+	}
+
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	logLevel.configured = level
+	logLevel.level = level
+	if persisted != "" {
+		logLevel.level = persisted
+		log.Printf("Log level %s, as persisted by PUT /admin/loglevel", persisted)
+	}
+	return nil
+}
+
+// debugLogging reports whether debug lines are logged
+func debugLogging() bool {
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	return logLevel.level == LogLevelDebug
+}
+
+// debugf logs a debug line to logger (log.Default() for the standard logger)
+func debugf(logger *log.Logger, format string, v ...any) {
+	if debugLogging() {
+		logger.Printf("DEBUG "+format, v...)
+	}
+}
+
+// persistedLogLevel returns the log level persisted by PUT /admin/loglevel, empty when none
+func persistedLogLevel() (string, error) {
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	level := ""
+	err = db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(settingsBucketName)); bucket != nil {
+			level = string(bucket.Get([]byte(logLevelSetting)))
+		}
+		return nil
+	})
+	if err == nil && level != "" && validLogLevel(level) != nil {
+		return "", nil
+	}
+	return level, err
+}
+
+// persistLogLevel stores the log level used after a restart, or forgets it when empty
+func persistLogLevel(level string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(settingsBucketName))
+		if err != nil {
+			return err
+		}
+		if level == "" {
+			return bucket.Delete([]byte(logLevelSetting))
+		}
+		return bucket.Put([]byte(logLevelSetting), []byte(level))
+	})
+}
+
+// logLevelState is the log level as /admin/loglevel shows it
+type logLevelState struct {
+	Level     string `json:"level"`
+	Persisted string `json:"persisted,omitempty"` // Level used after a restart instead of LOG_LEVEL
+}
+
+// currentLogLevel returns the running and persisted log levels
+func currentLogLevel() (logLevelState, error) {
+	persisted, err := persistedLogLevel()
+	if err != nil {
+		return logLevelState{}, err
+	}
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	return logLevelState{Level: logLevel.level, Persisted: persisted}, nil
+}
+
+// logLevelHandler shows the log level
+func (s *server) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := currentLogLevel()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading log level: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// setLogLevelHandler changes the log level of the running service, e.g.
+// {"level": "debug"}, and with "persist": true also after restarts
+func (s *server) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level   string `json:"level"`
+		Persist bool   `json:"persist"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	level := strings.ToLower(strings.TrimSpace(body.Level))
+	if err := validLogLevel(level); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Persist {
+		if err := persistLogLevel(level); err != nil {
+			http.Error(w, fmt.Sprintf("Error persisting log level: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	logLevel.Lock()
+	logLevel.level = level
+	logLevel.Unlock()
+	log.Printf("Log level set to %s", level)
+
+	s.logLevelHandler(w, r)
+}
+
+// resetLogLevelHandler forgets the persisted log level and goes back to LOG_LEVEL
+func (s *server) resetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if err := persistLogLevel(""); err != nil {
+		http.Error(w, fmt.Sprintf("Error resetting log level: %v", err), http.StatusInternalServerError)
+		return
+	}
+	logLevel.Lock()
+	logLevel.level = logLevel.configured
+	level := logLevel.level
+	logLevel.Unlock()
+	log.Printf("Log level reset to %s", level)
+
+	s.logLevelHandler(w, r)
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaintenancePatterns are the body fragments the Ashley gateway answers with
+// during its maintenance windows
+const DefaultMaintenancePatterns = "maintenance,mantenimiento,scheduled downtime"
+
+// maxMaintenanceBody caps the body kept in a MaintenanceError
+const maxMaintenanceBody = 200
+
+// ErrUpstreamMaintenance is returned when the Ashley gateway answers that it's under
+// maintenance. Retrying before it ends can't succeed, so syncs are deferred instead.
+var ErrUpstreamMaintenance = errors.New("deferred (upstream maintenance)")
+
+// MaintenanceConfig recognizes the responses of the gateway under maintenance
+type MaintenanceConfig struct {
+	Statuses []int         // Status codes of maintenance responses (none disables detection)
+	Patterns []string      // Lowercase fragments of their body, one of which must match (none matches any body)
+	Wait     time.Duration // Expected end of a maintenance whose response has no Retry-After
+}
+
+// ParseMaintenance parses the comma separated status codes and body patterns of
+// maintenance responses. Statuses "off" disables detection.
+func ParseMaintenance(statuses, patterns string) (MaintenanceConfig, error) {
+	var config MaintenanceConfig
+	if strings.EqualFold(strings.TrimSpace(statuses), "off") {
+		return config, nil
+	}
+	for _, value := range strings.Split(statuses, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 400 || status > 599 {
+			return config, fmt.Errorf("invalid status %q: expected an HTTP error status", value)
+		}
+		config.Statuses = append(config.Statuses, status)
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			config.Patterns = append(config.Patterns, pattern)
+		}
+	}
+	return config, nil
+}
+
+// validate checks detected maintenance has a wait to defer syncs by
+func (c MaintenanceConfig) validate() []error {
+	if len(c.Statuses) > 0 && c.Wait <= 0 {
+		return []error{fmt.Errorf("UPSTREAM_MAINTENANCE_WAIT must be positive, got %v", c.Wait)}
+	}
+	return nil
+}
+
+// announces reports whether responses of status may announce maintenance, so their
+// body is read before being handled
+func (c MaintenanceConfig) announces(status int) bool {
+	return slices.Contains(c.Statuses, status)
+}
+
+// check returns a MaintenanceError when the response announces maintenance, nil
+// otherwise. It ends at Retry-After when the gateway says, after Wait otherwise.
+func (c MaintenanceConfig) check(resp *http.Response, body []byte) error {
+	if !c.announces(resp.StatusCode) {
+		return nil
+	}
+	lower := strings.ToLower(string(body))
+	if len(c.Patterns) > 0 && !slices.ContainsFunc(c.Patterns, func(pattern string) bool {
+		return strings.Contains(lower, pattern)
+	}) {
+		return nil
+	}
+
+	until := time.Now().Add(c.Wait)
+	if retryAt, ok := retryAfter(resp.Header.Get("Retry-After")); ok && retryAt.After(time.Now()) {
+		until = retryAt
+	}
+	detail := strings.TrimSpace(string(body))
+	if len(detail) > maxMaintenanceBody {
+		detail = detail[:maxMaintenanceBody] + "..."
+	}
+	return &MaintenanceError{Until: until, Status: resp.StatusCode, Body: detail}
+}
+
+// retryAfter parses a Retry-After header, as seconds or an HTTP date
+func retryAfter(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
+
+// MaintenanceError is an ErrUpstreamMaintenance with when the gateway expects to be back
+type MaintenanceError struct {
+	Until  time.Time
+	Status int
+	Body   string
+}
+
+func (e *MaintenanceError) Error() string {
+	return fmt.Sprintf("%v until %s - status %d: %s", ErrUpstreamMaintenance, e.Until.Format(time.RFC3339), e.Status, e.Body)
+}
+
+func (e *MaintenanceError) Unwrap() error { return ErrUpstreamMaintenance }
+
+// DeferredUntil reports whether err only holds upstream maintenance errors, e.g. the
+// joined errors of a sync whose every failure was a fetcher deferred, and when the
+// last of them expects the gateway back
+func DeferredUntil(err error) (time.Time, bool) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var until time.Time
+		for _, err := range joined.Unwrap() {
+			at, ok := DeferredUntil(err)
+			if !ok {
+				return time.Time{}, false
+			}
+			if at.After(until) {
+				until = at
+			}
+		}
+		return until, !until.IsZero()
+	}
+
+	var maintenance *MaintenanceError
+	if errors.As(err, &maintenance) {
+		return maintenance.Until, true
+	}
+	return time.Time{}, false
+}
+
+// deferred reports whether a job's error only holds upstream maintenance errors
+func deferred(err error) bool {
+	_, ok := DeferredUntil(err)
+	return ok
+}
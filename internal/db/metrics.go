@@ -0,0 +1,54 @@
+package db
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+)
+
+// Sync and upstream metrics are labeled by customer account and fetcher or endpoint,
+// so a failure in one dealer account is distinguishable from another
+var (
+	syncRunsTotal = metrics.NewCounter("ashley_sync_runs_total",
+		"Finished fetcher syncs by result (ok, skipped, failed, canceled, unauthorized)", "customer", "fetcher", "result")
+	syncDurationSeconds = metrics.NewGauge("ashley_sync_duration_seconds",
+		"Duration of the last sync of a fetcher", "customer", "fetcher")
+	syncLastSuccessSeconds = metrics.NewGauge("ashley_sync_last_success_timestamp_seconds",
+		"Unix time of the last successful sync of a fetcher", "customer", "fetcher")
+	upstreamRequestsTotal = metrics.NewCounter("ashley_upstream_requests_total",
+		"Requests to the Ashley API by status code (error when no response was received)", "customer", "endpoint", "code")
+	upstreamRequestSeconds = metrics.NewCounter("ashley_upstream_request_seconds_total",
+		"Time spent waiting on the Ashley API", "customer", "endpoint")
+)
+
+// observeSync records the outcome of a fetcher sync
+func observeSync(customer, fetcher, result string, startedAt time.Time) {
+	syncRunsTotal.Inc(customer, fetcher, result)
+	syncDurationSeconds.Set(time.Since(startedAt).Seconds(), customer, fetcher)
+	if result == SyncStateOK || result == SyncStateSkipped {
+		syncLastSuccessSeconds.Set(float64(time.Now().Unix()), customer, fetcher)
+	}
+}
+
+// observeUpstreamRequest records a request to the Ashley API. resp is nil when the
+// request failed before a response arrived.
+func observeUpstreamRequest(customer, urlPath string, resp *http.Response, elapsed time.Duration) {
+	endpoint := upstreamEndpoint(urlPath)
+
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	upstreamRequestsTotal.Inc(customer, endpoint, code)
+	upstreamRequestSeconds.Add(elapsed.Seconds(), customer, endpoint)
+}
+
+// upstreamEndpoint labels an upstream request by the last segment of its path, e.g. "prices"
+func upstreamEndpoint(urlPath string) string {
+	return strings.ToLower(path.Base(urlPath))
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersionSetting is the key of the settings bucket holding the number of the
+// last migration applied to the database
+const schemaVersionSetting = "schema_version"
+
+// Migration transforms the stored data when the shape of a stored struct changes, so
+// the database never holds records of two shapes. Apply runs in the same transaction
+// that records the migration as applied, returning how many records it changed.
+type Migration struct {
+	Version int
+	Name    string
+	Apply   func(tx *bolt.Tx) (int, error)
+}
+
+// migrations are applied in order to databases at an older schema version. Append
+// new ones with the next version; never change or remove a released one.
+var migrations = []Migration{
+	{Version: 1, Name: "index product dimensions", Apply: indexDimensions},
+}
+
+// schemaVersion returns the schema version the migrations bring databases to
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// migrate applies the pending migrations, after copying the database aside so a failed
+// or mistaken migration can be undone by restoring the copy. A database without any
+// record yet has nothing to migrate and is stamped with the current version.
+func migrate() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var current int
+	var empty bool
+	err = db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(settingsBucketName)); bucket != nil {
+			if value := bucket.Get([]byte(schemaVersionSetting)); value != nil {
+				if current, err = strconv.Atoi(string(value)); err != nil {
+					return fmt.Errorf("invalid schema version %q: %v", value, err)
+				}
+			}
+		}
+		empty = !holdsRecords(tx)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	latest := schemaVersion()
+	switch {
+	case current > latest:
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d): run a newer build or restore a backup", current, latest)
+	case current == latest:
+		return nil
+	case empty:
+		return db.Update(func(tx *bolt.Tx) error { return setSchemaVersion(tx, latest) })
+	}
+
+	backup := fmt.Sprintf("%s.pre-v%d-%s", DatabaseName, latest, time.Now().Format("20060102T150405"))
+	if err := db.View(func(tx *bolt.Tx) error { return tx.CopyFile(backup, 0600) }); err != nil {
+		return fmt.Errorf("error backing up database before migrating: %v", err)
+	}
+	log.Printf("Migrating database from schema version %d to %d, backed up to %s", current, latest, backup)
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		started := time.Now()
+		changed := 0
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			if changed, err = migration.Apply(tx); err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, migration.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("error applying migration %d (%s), restore %s if needed: %v", migration.Version, migration.Name, backup, err)
+		}
+		log.Printf("Applied migration %d (%s): %d records changed in %v", migration.Version, migration.Name, changed, time.Since(started).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// setSchemaVersion records the last applied migration
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(settingsBucketName))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(schemaVersionSetting), []byte(strconv.Itoa(version)))
+}
+
+// holdsRecords reports whether any bucket of the database holds a key
+func holdsRecords(tx *bolt.Tx) bool {
+	found := false
+	tx.ForEach(func(_ []byte, bucket *bolt.Bucket) error {
+		if k, _ := bucket.Cursor().First(); k != nil {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// rewriteRecords passes every record of a bucket to fn as its JSON fields, for
+// migrations renaming or reshaping fields and re-keying buckets. fn edits the fields in
+// place and returns the record's key, a different one to move it. Values are opened
+// and sealed with the encryption settings and sharded buckets are walked shard by
+// shard. Returns how many records changed.
+func rewriteRecords(tx *bolt.Tx, bucketName string, fn func(key []byte, fields map[string]json.RawMessage) ([]byte, error)) (int, error) {
+	bucket := recordsOf(tx, bucketName)
+	if bucket == nil {
+		return 0, nil
+	}
+
+	type rewrite struct {
+		from, to []byte
+		value    []byte
+	}
+	var rewrites []rewrite
+
+	// Buckets can't be written while iterating them
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil // Nested bucket
+		}
+		data, err := openValue(bucketName, k, v)
+		if err != nil {
+			return err
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("error unmarshaling %s record %s: %v", bucketName, k, err)
+		}
+
+		// Compared re-encoded, as maps don't keep the stored field order
+		original, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		key, err := fn(k, fields)
+		if err != nil {
+			return fmt.Errorf("%s record %s: %v", bucketName, k, err)
+		}
+		updated, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if string(key) == string(k) && string(updated) == string(original) {
+			return nil
+		}
+		rewrites = append(rewrites, rewrite{from: append([]byte(nil), k...), to: key, value: updated})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range rewrites {
+		if string(r.to) != string(r.from) {
+			if err := bucket.Delete(r.from); err != nil {
+				return 0, err
+			}
+		}
+		sealed, err := sealValue(bucketName, r.to, r.value)
+		if err != nil {
+			return 0, err
+		}
+		if err := bucket.Put(r.to, sealed); err != nil {
+			return 0, err
+		}
+	}
+	return len(rewrites), nil
+}
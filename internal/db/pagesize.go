@@ -0,0 +1,92 @@
+package db
+
+import (
+	"encoding/binary"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const pageLimitsBucketName = "page_limits"
+
+// PageTuning bounds the page size used against the upstream API. Between syncs the
+// learned size of each endpoint is kept in the page_limits bucket. Tuning is
+// disabled when MinLimit equals MaxLimit.
+type PageTuning struct {
+	MinLimit int           // Smallest page size to downshift to on timeouts and 413s
+	MaxLimit int           // Largest page size to upshift to while pages are fast
+	FastPage time.Duration // Pages fetched faster than this allow an upshift
+}
+
+// shrink returns the next smaller page size, which must divide offset so the
+// records fetched so far still end on a page boundary
+func (t PageTuning) shrink(limit, offset int) (int, bool) {
+	for smaller := limit / 2; smaller >= t.MinLimit && smaller > 0; smaller-- {
+		if offset%smaller == 0 {
+			return smaller, true
+		}
+	}
+	return 0, false
+}
+
+// grow returns double the page size capped at MaxLimit, as long as offset falls on
+// a page boundary of the new size
+func (t PageTuning) grow(limit, offset int) (int, bool) {
+	larger := min(limit*2, t.MaxLimit)
+	if larger <= limit || offset%larger != 0 {
+		return 0, false
+	}
+	return larger, true
+}
+
+// isPageTooLarge reports whether a failed fetch looks caused by the page size:
+// the gateway rejected it with 413 or the request timed out
+func isPageTooLarge(err error) bool {
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "status 413") ||
+		strings.Contains(errStr, "status 504") ||
+		strings.Contains(errStr, "timeout") ||
+		strings.Contains(errStr, "deadline exceeded")
+}
+
+// loadPageLimit returns the learned page size of an endpoint clamped to the tuning
+// bounds, or the configured limit when none was learned yet
+func loadPageLimit(db *store, endpoint string, config APIConfig) int {
+	if config.PageTuning.MinLimit >= config.PageTuning.MaxLimit {
+		return config.Limit
+	}
+
+	limit := config.Limit
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pageLimitsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get([]byte(endpoint)); len(data) == 8 {
+			limit = int(binary.BigEndian.Uint64(data))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error reading learned page size of %s: %v", endpoint, err)
+		return config.Limit
+	}
+
+	return max(config.PageTuning.MinLimit, min(limit, config.PageTuning.MaxLimit))
+}
+
+// savePageLimit persists the learned page size of an endpoint
+func savePageLimit(db *store, endpoint string, limit int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(pageLimitsBucketName))
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(limit))
+		return bucket.Put([]byte(endpoint), data)
+	})
+}
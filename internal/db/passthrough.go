@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// PassthroughConfig controls live single-SKU lookups against the Ashley API
+type PassthroughConfig struct {
+	Rate     float64       // Lookups per second forwarded upstream (0 disables the endpoint)
+	Burst    int           // Lookups allowed at once before Rate applies
+	CacheTTL time.Duration // How long a live lookup is reused for the same SKU
+}
+
+// passthrough forwards single-SKU lookups to the Ashley API with the stored
+// credentials, rate limited and cached so consumers can't hammer the gateway
+type passthrough struct {
+	api     APIConfig
+	ttl     time.Duration
+	limiter *rate.Limiter
+
+	mu    sync.Mutex
+	cache map[string]passthroughEntry
+}
+
+type passthroughEntry struct {
+	product   ProductResponseData
+	fetchedAt time.Time
+}
+
+func newPassthrough(api APIConfig, config PassthroughConfig) *passthrough {
+	return &passthrough{
+		api:     api,
+		ttl:     config.CacheTTL,
+		limiter: rate.NewLimiter(rate.Limit(config.Rate), max(config.Burst, 1)),
+		cache:   make(map[string]passthroughEntry),
+	}
+}
+
+// cached returns a live lookup still within the cache TTL
+func (p *passthrough) cached(sku string) (passthroughEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.cache[sku]
+	if !ok || time.Since(entry.fetchedAt) >= p.ttl {
+		delete(p.cache, sku)
+		return passthroughEntry{}, false
+	}
+	return entry, true
+}
+
+func (p *passthrough) store(sku string, entry passthroughEntry) {
+	if p.ttl <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache[sku] = entry
+}
+
+// fetchProduct requests a single product and its price from the Ashley API
+func (p *passthrough) fetchProduct(ctx context.Context, sku string) (ProductResponseData, error) {
+	productURL := fmt.Sprintf("%s/products?customer=%s&Sku=%s&Limit=1&Page=1",
+		p.api.BaseURL, p.api.Customer, url.QueryEscape(sku))
+	products, _, err := makeHTTPRequest[ProductAPIResponse](ctx, productURL, p.api)
+	if err != nil {
+		return ProductResponseData{}, fmt.Errorf("error fetching product: %v", err)
+	}
+
+	var product *ProductRequestData
+	for _, entity := range products.Entities {
+		if NormalizeSKU(entity.Sku) == sku {
+			record, err := p.process(ProductFetcher{}.GetBucketName(), ProductFetcher{}.Transform(entity))
+			if err != nil {
+				return ProductResponseData{}, err
+			}
+			transformed := record.(ProductRequestData)
+			product = &transformed
+			break
+		}
+	}
+	if product == nil {
+		return ProductResponseData{}, fmt.Errorf("%w: SKU %s not found upstream", ErrNotFound, sku)
+	}
+
+	priceURL := fmt.Sprintf("%s/Prices?Customer=%s&Sku=%s&Limit=1&Page=1",
+		p.api.BaseURL, p.api.Customer, url.QueryEscape(sku))
+	prices, _, err := makeHTTPRequest[PriceAPIResponse](ctx, priceURL, p.api)
+	if err != nil {
+		return ProductResponseData{}, fmt.Errorf("error fetching price: %v", err)
+	}
+
+	priceMap := make(map[string]PriceRequestData)
+	for _, entity := range prices.Entities {
+		if NormalizeSKU(entity.Sku) == sku {
+			record, err := p.process(PriceFetcher{}.GetBucketName(), PriceFetcher{}.Transform(entity))
+			if err != nil {
+				return ProductResponseData{}, err
+			}
+			priceMap[sku] = record.(PriceRequestData)
+		}
+	}
+
+	response := []ProductResponseData{newProductResponseData(*product, priceMap)}
+	if err := applyContracts(response, []ProductRequestData{*product}, priceMap); err != nil {
+		return ProductResponseData{}, err
+	}
+	if err := applyCustoms(response); err != nil {
+		return ProductResponseData{}, err
+	}
+	if err := applyAvailabilityState(response); err != nil {
+		return ProductResponseData{}, err
+	}
+	response[0].Reemplazo = product.ReplacementSku
+	return response[0], nil
+}
+
+// process runs a live record through the same pipeline as synced ones, so lookups
+// are normalized and redacted alike. Rejected records are reported as errors.
+func (p *passthrough) process(bucketName string, record DatabaseEntity) (DatabaseEntity, error) {
+	result, err := runPipeline(bucketName, record, p.api.Validation)
+	if err != nil {
+		return nil, err
+	}
+	if result.rejected {
+		return nil, fmt.Errorf("%s %s rejected: %s", bucketName, record.GetSKU(), strings.Join(result.issues, "; "))
+	}
+	return result.record, nil
+}
+
+// upstreamProductHandler serves a single product fetched live from the Ashley API,
+// for consumers that need fresher data than the last sync
+func (s *server) upstreamProductHandler(w http.ResponseWriter, r *http.Request) {
+	if s.passthrough == nil {
+		http.Error(w, "Upstream passthrough is disabled", http.StatusNotFound)
+		return
+	}
+
+	sku := lookupSKU(r.PathValue("sku"))
+	entry, ok := s.passthrough.cached(sku)
+	if !ok {
+		reservation := s.passthrough.limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+			http.Error(w, "Upstream passthrough rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		product, err := s.passthrough.fetchProduct(r.Context(), sku)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching from upstream: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		entry = passthroughEntry{product: product, fetchedAt: time.Now()}
+		s.passthrough.store(sku, entry)
+	}
+
+	w.Header().Set("X-Fetched-At", entry.fetchedAt.UTC().Format(time.RFC3339))
+	writeRedactedJSON(w, r, http.StatusOK, entry.product)
+}
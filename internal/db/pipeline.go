@@ -0,0 +1,157 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Phase is a step of the transform pipeline. Stages run phase by phase in this
+// order, and in registration order within a phase.
+type Phase int
+
+const (
+	PhaseNormalize Phase = iota // Clean up upstream values (trimming, casing)
+	PhaseValidate               // Reject implausible records; the configured bounds run last
+	PhaseEnrich                 // Add derived or external data
+	PhaseRedact                 // Drop or mask data that must not be stored
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"normalize", "validate", "enrich", "redact"}
+
+func (p Phase) String() string {
+	if p < 0 || p >= numPhases {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
+// StageFunc transforms a record built by a fetcher's Transform (or by the previous
+// stage). Returning an error quarantines and skips the record.
+type StageFunc func(record DatabaseEntity) (DatabaseEntity, error)
+
+type stage struct {
+	name string
+	fn   StageFunc
+}
+
+// StageFor adapts a function over the concrete record type of a bucket into a
+// StageFunc, e.g. StageFor(func(p ProductRequestData) (ProductRequestData, error) {...})
+func StageFor[R DatabaseEntity](fn func(R) (R, error)) StageFunc {
+	return func(record DatabaseEntity) (DatabaseEntity, error) {
+		typed, ok := record.(R)
+		if !ok {
+			return nil, fmt.Errorf("stage expects %T, got %T", *new(R), record)
+		}
+		return fn(typed)
+	}
+}
+
+// pipelines holds the stages of each bucket by phase
+var pipelines = make(map[string]*[numPhases][]stage)
+
+// AddStage appends a named stage to a phase of a registered fetcher's pipeline.
+// Like Register, it must be called before syncing starts (e.g. from an init function).
+func AddStage(fetcher string, phase Phase, name string, fn StageFunc) {
+	syncer, ok := registry.syncers[fetcher]
+	if !ok {
+		panic(fmt.Sprintf("stage %q added to unknown fetcher %q", name, fetcher))
+	}
+	if phase < 0 || phase >= numPhases {
+		panic(fmt.Sprintf("stage %q added to unknown %v", name, phase))
+	}
+
+	bucketName := syncer.BucketName()
+	if pipelines[bucketName] == nil {
+		pipelines[bucketName] = new([numPhases][]stage)
+	}
+	pipelines[bucketName][phase] = append(pipelines[bucketName][phase], stage{name: name, fn: fn})
+}
+
+// Stages lists the stages of a bucket's pipeline as "phase/name", in run order
+func Stages(bucketName string) []string {
+	var names []string
+	if phases := pipelines[bucketName]; phases != nil {
+		for phase, stages := range phases {
+			for _, s := range stages {
+				names = append(names, Phase(phase).String()+"/"+s.name)
+			}
+		}
+	}
+	return names
+}
+
+// processed is a record after the pipeline ran
+type processed struct {
+	record   DatabaseEntity
+	data     []byte   // record serialized for storage
+	issues   []string // validation issues, quarantined when not empty
+	rejected bool     // the record must not be stored
+}
+
+// runPipeline runs a transformed record through the stages of its bucket, after
+// normalizing its SKUs. A stage error or a bound set to reject marks the record
+// rejected instead of failing.
+func runPipeline(bucketName string, record DatabaseEntity, validation ValidationConfig) (processed, error) {
+	record = normalizeRecord(record)
+	phases := pipelines[bucketName]
+	if phases == nil {
+		phases = new([numPhases][]stage)
+	}
+
+	var issues []string
+	for phase, stages := range phases {
+		for _, s := range stages {
+			next, err := s.fn(record)
+			if err != nil {
+				issues = append(issues, fmt.Sprintf("%v/%s: %v", Phase(phase), s.name, err))
+				return rejectedRecord(record, issues)
+			}
+			record = next
+		}
+
+		if Phase(phase) != PhaseValidate || len(validation.Bounds[bucketName]) == 0 {
+			continue
+		}
+
+		// Flagged records keep going and are stored along with their issues
+		data, err := json.Marshal(record)
+		if err != nil {
+			return processed{}, fmt.Errorf("error marshaling entity %s: %v", record.GetSKU(), err)
+		}
+		boundIssues, rejected, err := validation.validateRecord(bucketName, data)
+		if err != nil {
+			return processed{}, fmt.Errorf("error validating entity %s: %v", record.GetSKU(), err)
+		}
+		issues = append(issues, boundIssues...)
+		if rejected {
+			return rejectedRecord(record, issues)
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return processed{}, fmt.Errorf("error marshaling entity %s: %v", record.GetSKU(), err)
+	}
+
+	return processed{record: record, data: data, issues: issues}, nil
+}
+
+func rejectedRecord(record DatabaseEntity, issues []string) (processed, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return processed{}, fmt.Errorf("error marshaling entity %s: %v", record.GetSKU(), err)
+	}
+	return processed{record: record, data: data, issues: issues, rejected: true}, nil
+}
+
+// trimStrings is the built-in normalize stage of products: identifiers pasted with
+// stray whitespace upstream would otherwise miss lookups
+func trimStrings(p ProductRequestData) (ProductRequestData, error) {
+	p.Upc = strings.TrimSpace(p.Upc)
+	p.Gtin = strings.TrimSpace(p.Gtin)
+	p.ModelNumber = strings.TrimSpace(p.ModelNumber)
+	p.ReplacementSku = strings.TrimSpace(p.ReplacementSku)
+	return p, nil
+}
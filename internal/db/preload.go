@@ -0,0 +1,226 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PreloadConfig keeps the merged catalog in memory so /products and ?sku= lookups are
+// answered without reading the bolt file
+type PreloadConfig struct {
+	Enabled bool
+	Refresh time.Duration // Age after which the catalog is rebuilt in the background, for reservations expiring
+}
+
+// preloadedCatalog is the merged catalog as built from the stored data at one point
+type preloadedCatalog struct {
+	generation  uint64
+	builtAt     time.Time
+	products    []ProductResponseData          // The full catalog, as /products serves it
+	bySKU       map[string]ProductResponseData // Ashley products, as ?sku= serves them
+	lastSuccess *time.Time                     // Oldest successful sync of the enabled fetchers
+	promotions  string                         // Signature of the promotions its prices carry
+}
+
+var preload struct {
+	sync.Mutex
+	config     PreloadConfig
+	fetchers   []Syncer
+	generation uint64 // Bumped whenever stored data changes
+	building   bool
+	current    *preloadedCatalog
+}
+
+// startPreload builds the catalog before the server starts answering
+func startPreload(config PreloadConfig, fetchers []Syncer) error {
+	preload.Lock()
+	preload.config = config
+	preload.fetchers = fetchers
+	generation := preload.generation
+	preload.Unlock()
+
+	started := time.Now()
+	catalog, err := buildPreloadedCatalog(generation)
+	if err != nil {
+		return err
+	}
+	preload.Lock()
+	if preload.current == nil { // Unless a rebuild for a sync finished first
+		preload.current = catalog
+	}
+	preload.Unlock()
+
+	log.Printf("Preloaded %d products in %v", len(catalog.products), time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// dropPreloadedCatalog stops serving the preloaded catalog after stored data changed,
+// rebuilding it in the background
+func dropPreloadedCatalog() {
+	preload.Lock()
+	defer preload.Unlock()
+	if !preload.config.Enabled {
+		return
+	}
+	preload.generation++
+	rebuildPreloadedCatalog()
+}
+
+// rebuildPreloadedCatalog starts a rebuild unless one is running, which then starts
+// another when data changed meanwhile. preload must be locked.
+func rebuildPreloadedCatalog() {
+	if preload.building {
+		return
+	}
+	preload.building = true
+	generation := preload.generation
+
+	go func() {
+		catalog, err := buildPreloadedCatalog(generation)
+
+		preload.Lock()
+		defer preload.Unlock()
+		preload.building = false
+		if err != nil {
+			log.Printf("Error preloading catalog: %v", err)
+			return
+		}
+		preload.current = catalog
+		debugf(log.Default(), "Rebuilt preloaded catalog (%d products)", len(catalog.products))
+		if generation != preload.generation {
+			rebuildPreloadedCatalog()
+		}
+	}()
+}
+
+// buildPreloadedCatalog merges the stored catalog like buildProductResponses does for
+// the full catalog and for SKU lookups, priced with the promotions in effect today
+func buildPreloadedCatalog(generation uint64) (*preloadedCatalog, error) {
+	builtAt := time.Now()
+	date := builtAt.Format(time.DateOnly)
+
+	products, err := GetAllProducts()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching products: %v", err)
+	}
+	imported, err := GetSupplierProducts()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching supplier products: %v", err)
+	}
+	prices, err := GetAllPrices()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching prices: %v", err)
+	}
+	priceMap := make(map[string]PriceRequestData, len(prices))
+	for _, price := range prices {
+		priceMap[price.Sku] = price
+	}
+	applied, err := applyPromotions(priceMap, date)
+	if err != nil {
+		return nil, err
+	}
+	promotions, err := promotionsSignature(date)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := GetReplacementOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching replacements: %v", err)
+	}
+
+	// Lookups serve Ashley's record of a SKU even when another supplier wins it
+	merged := mergeProductResponses(products, priceMap, overrides, nil)
+	markPromotions(merged, applied)
+	if err := applyContracts(merged, products, priceMap); err != nil {
+		return nil, err
+	}
+	if err := applyCustoms(merged); err != nil {
+		return nil, err
+	}
+	if err := applyAvailability(merged, true); err != nil {
+		return nil, err
+	}
+	if err := applyAvailabilityState(merged); err != nil {
+		return nil, err
+	}
+	bySKU := make(map[string]ProductResponseData, len(merged))
+	for _, product := range merged {
+		bySKU[product.Clave] = product
+	}
+
+	resolved, supplierProducts := resolveCollisions(products, imported)
+	catalog := make([]ProductResponseData, 0, len(resolved)+len(supplierProducts))
+	for _, product := range resolved {
+		catalog = append(catalog, bySKU[product.Sku])
+	}
+	supplierResponses := supplierProductResponses(supplierProducts)
+	if err := applyCustoms(supplierResponses); err != nil {
+		return nil, err
+	}
+	if err := applyAvailabilityState(supplierResponses); err != nil {
+		return nil, err
+	}
+	catalog = append(catalog, supplierResponses...)
+
+	preload.Lock()
+	fetchers := preload.fetchers
+	preload.Unlock()
+	lastSuccess, err := oldestSuccess(fetchers)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync status: %v", err)
+	}
+
+	return &preloadedCatalog{
+		generation:  generation,
+		builtAt:     builtAt,
+		products:    catalog,
+		bySKU:       bySKU,
+		lastSuccess: lastSuccess,
+		promotions:  promotions,
+	}, nil
+}
+
+// preloadedProducts returns the full catalog, or the products with the given SKUs,
+// from the preloaded catalog, priced for date. ok is false when it can't answer: it is
+// disabled, out of date, priced with other promotions or the data is stale
+// (staleAfter > 0), which requests flag.
+func preloadedProducts(skus []string, staleAfter time.Duration, date string) (response []ProductResponseData, ok bool) {
+	promotions, err := promotionsSignature(date)
+	if err != nil {
+		return nil, false
+	}
+
+	preload.Lock()
+	catalog := preload.current
+	current := catalog != nil && catalog.generation == preload.generation
+	if current && preload.config.Refresh > 0 && time.Since(catalog.builtAt) > preload.config.Refresh {
+		rebuildPreloadedCatalog()
+	}
+	// A promotion started or ended since the catalog was built, e.g. at midnight
+	if current && catalog.promotions != promotions && date == time.Now().Format(time.DateOnly) {
+		rebuildPreloadedCatalog()
+	}
+	preload.Unlock()
+
+	if !current || catalog.promotions != promotions {
+		return nil, false
+	}
+	if staleAfter > 0 && catalog.lastSuccess != nil && time.Since(*catalog.lastSuccess) >= staleAfter {
+		return nil, false
+	}
+
+	if len(skus) == 0 {
+		// Responses are redacted in place
+		return slices.Clone(catalog.products), true
+	}
+	response = make([]ProductResponseData, 0, len(skus))
+	for _, sku := range skus {
+		if product, ok := catalog.bySKU[sku]; ok {
+			response = append(response, product)
+		}
+	}
+	return response, true
+}
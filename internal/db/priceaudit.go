@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// priceBaselineBucketName holds the derived prices accepted after the last audit, keyed
+// by price list and SKU (list + "\x00" + sku), which the next audit compares against
+const priceBaselineBucketName = "price_baseline"
+
+// priceBaselineSetting is the key of the settings bucket holding when the baseline was accepted
+const priceBaselineSetting = "price_baseline_at"
+
+// DefaultPriceAuditThreshold is the relative price change audits report by default
+const DefaultPriceAuditThreshold = 0.05
+
+// PriceChange is a derived price that moved beyond the audit threshold
+type PriceChange struct {
+	List   string  `json:"list"` // landed, tier:<name> or channel:<name>
+	Sku    string  `json:"sku"`
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+	Change float64 `json:"change"` // Relative to Before, e.g. 0.12 for 12% up
+}
+
+// PriceAudit compares the derived prices of the current catalog and settings with the
+// accepted baseline
+type PriceAudit struct {
+	GeneratedAt time.Time     `json:"generatedAt"`
+	BaselineAt  *time.Time    `json:"baselineAt,omitempty"` // Unset until prices were accepted once
+	Threshold   float64       `json:"threshold"`
+	Compared    int           `json:"compared"` // Prices found in both
+	Added       int           `json:"added"`    // Prices without a baseline, e.g. new products
+	Removed     int           `json:"removed"`  // Baseline prices no longer derived
+	Changes     []PriceChange `json:"changes"`  // Largest changes first
+}
+
+// priceKey is the key of a derived price in the baseline
+func priceKey(list, sku string) string { return list + "\x00" + sku }
+
+// derivedPrices recomputes every derived price of the catalog: the landed cost, the
+// price of each tier and the price of each channel, by priceKey. Unpriced products
+// have none.
+func derivedPrices(tiers map[string]*PriceTier, channels map[string]*Channel) (map[string]float64, error) {
+	// Promotions are scheduled, not drift: the baseline holds regular prices
+	response, err := buildProductResponses("", nil, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("error building catalog: %v", err)
+	}
+
+	prices := make(map[string]float64)
+	for _, product := range response {
+		if product.CostoImportacion != nil && product.CostoImportacion.Total > 0 {
+			prices[priceKey("landed", product.Clave)] = product.CostoImportacion.Total
+		}
+		cost := productSellingCost(product)
+		if cost <= 0 {
+			continue
+		}
+		for name, tier := range tiers {
+			markup := tier.markup(ProductRequestData{ItemSalesCategoryCodeKey: product.Categoria})
+			prices[priceKey("tier:"+name, product.Clave)] = roundCents(cost * markup)
+		}
+	}
+	for name, channel := range channels {
+		for _, product := range channel.apply(response) {
+			if product.Precio != nil {
+				prices[priceKey("channel:"+name, product.Clave)] = *product.Precio
+			}
+		}
+	}
+	return prices, nil
+}
+
+// AuditPrices recomputes the derived prices and reports the ones that moved more than
+// threshold (a fraction) since the baseline was accepted
+func AuditPrices(tiers map[string]*PriceTier, channels map[string]*Channel, threshold float64) (PriceAudit, error) {
+	audit := PriceAudit{GeneratedAt: time.Now(), Threshold: threshold, Changes: []PriceChange{}}
+
+	prices, err := derivedPrices(tiers, channels)
+	if err != nil {
+		return audit, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return audit, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if settings := tx.Bucket([]byte(settingsBucketName)); settings != nil {
+			if value := settings.Get([]byte(priceBaselineSetting)); value != nil {
+				at, err := time.Parse(time.RFC3339, string(value))
+				if err != nil {
+					return fmt.Errorf("invalid price baseline time %q: %v", value, err)
+				}
+				audit.BaselineAt = &at
+			}
+		}
+
+		seen := make(map[string]bool, len(prices))
+		if bucket := tx.Bucket([]byte(priceBaselineBucketName)); bucket != nil {
+			err := bucket.ForEach(func(k, v []byte) error {
+				before, err := strconv.ParseFloat(string(v), 64)
+				if err != nil || before <= 0 {
+					return fmt.Errorf("invalid baseline price %q of %q", v, k)
+				}
+				after, ok := prices[string(k)]
+				if !ok {
+					audit.Removed++
+					return nil
+				}
+				seen[string(k)] = true
+				audit.Compared++
+
+				change := (after - before) / before
+				if math.Abs(change) > threshold {
+					list, sku, _ := bytes.Cut(k, []byte{0})
+					audit.Changes = append(audit.Changes, PriceChange{
+						List:   string(list),
+						Sku:    string(sku),
+						Before: before,
+						After:  after,
+						Change: math.Round(change*10000) / 10000,
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		audit.Added = len(prices) - len(seen)
+		return nil
+	})
+	if err != nil {
+		return audit, fmt.Errorf("error reading price baseline: %v", err)
+	}
+
+	sort.SliceStable(audit.Changes, func(i, j int) bool {
+		a, b := math.Abs(audit.Changes[i].Change), math.Abs(audit.Changes[j].Change)
+		if a != b {
+			return a > b
+		}
+		if audit.Changes[i].List != audit.Changes[j].List {
+			return audit.Changes[i].List < audit.Changes[j].List
+		}
+		return audit.Changes[i].Sku < audit.Changes[j].Sku
+	})
+	return audit, nil
+}
+
+// AcceptPrices recomputes the derived prices and stores them as the baseline of the
+// next audit, returning how many it stored
+func AcceptPrices(tiers map[string]*PriceTier, channels map[string]*Channel) (int, error) {
+	prices, err := derivedPrices(tiers, channels)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(priceBaselineBucketName)) != nil {
+			if err := tx.DeleteBucket([]byte(priceBaselineBucketName)); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket([]byte(priceBaselineBucketName))
+		if err != nil {
+			return err
+		}
+		for key, price := range prices {
+			if err := bucket.Put([]byte(key), []byte(strconv.FormatFloat(price, 'f', -1, 64))); err != nil {
+				return err
+			}
+		}
+
+		settings, err := tx.CreateBucketIfNotExists([]byte(settingsBucketName))
+		if err != nil {
+			return err
+		}
+		return settings.Put([]byte(priceBaselineSetting), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error saving price baseline: %v", err)
+	}
+	return len(prices), nil
+}
+
+// ParsePriceAuditThreshold parses a relative change, e.g. 0.05 for 5%
+func ParsePriceAuditThreshold(s string) (float64, error) {
+	if s == "" {
+		return DefaultPriceAuditThreshold, nil
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("expected a fraction of at least 0, e.g. 0.05, got %q", s)
+	}
+	return threshold, nil
+}
+
+// priceAuditHandler reports the derived prices that moved beyond ?threshold= since
+// the baseline was accepted
+func (s *server) priceAuditHandler(w http.ResponseWriter, r *http.Request) {
+	threshold, err := ParsePriceAuditThreshold(r.URL.Query().Get("threshold"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid threshold: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	audit, err := AuditPrices(s.config.Tiers, s.config.Channels, threshold)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error auditing prices: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, audit)
+}
+
+// acceptPricesHandler stores the current derived prices as the baseline of later audits
+func (s *server) acceptPricesHandler(w http.ResponseWriter, r *http.Request) {
+	count, err := AcceptPrices(s.config.Tiers, s.config.Channels)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error accepting prices: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"accepted": count})
+}
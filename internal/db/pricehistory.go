@@ -0,0 +1,410 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+// priceHistoryBucketName holds a point per SKU each time its synced price changes,
+// keyed by SKU, a zero byte and the big endian UnixNano of the change
+const priceHistoryBucketName = "price_history"
+
+// PricePoint is the price of a SKU from At until its next point
+type PricePoint struct {
+	Sku            string    `json:"sku"`
+	At             time.Time `json:"at"`
+	SellPrice      float64   `json:"sellPrice"`
+	TotalNetPrice  float64   `json:"totalNetPrice"`
+	ContainerPrice float64   `json:"containerPrice"`
+}
+
+func (p PricePoint) value(field string) float64 {
+	switch field {
+	case "sellPrice":
+		return p.SellPrice
+	case "containerPrice":
+		return p.ContainerPrice
+	default:
+		return p.TotalNetPrice
+	}
+}
+
+// priceTrendFields are the prices trends can be computed on
+var priceTrendFields = []string{"totalNetPrice", "sellPrice", "containerPrice"}
+
+func priceHistoryKey(sku string, at time.Time) []byte {
+	key := make([]byte, 0, len(sku)+9)
+	key = append(key, sku...)
+	key = append(key, 0)
+	return binary.BigEndian.AppendUint64(key, uint64(at.UnixNano()))
+}
+
+// parsePriceHistoryKey splits a key into its SKU and time
+func parsePriceHistoryKey(k []byte) (string, time.Time, error) {
+	if len(k) < 9 || k[len(k)-9] != 0 {
+		return "", time.Time{}, fmt.Errorf("invalid price history key %q", k)
+	}
+	nanos := binary.BigEndian.Uint64(k[len(k)-8:])
+	return string(k[:len(k)-9]), time.Unix(0, int64(nanos)), nil
+}
+
+// recordPrice appends a point to the SKU's price history within the caller's
+// transaction, unless its prices equal those of the latest point
+func recordPrice(tx *bolt.Tx, price PriceRequestData) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(priceHistoryBucketName))
+	if err != nil {
+		return err
+	}
+
+	point := PricePoint{
+		Sku:            price.Sku,
+		At:             time.Now(),
+		SellPrice:      price.SellPrice,
+		TotalNetPrice:  price.TotalNetPrice,
+		ContainerPrice: price.ContainerPrice,
+	}
+
+	// The latest point of the SKU sorts right before the first key past its prefix
+	prefix := append([]byte(price.Sku), 0)
+	c := bucket.Cursor()
+	k, v := c.Seek(append([]byte(price.Sku), 1))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	if k != nil && bytes.HasPrefix(k, prefix) {
+		v, err := openValue(priceHistoryBucketName, k, v)
+		if err != nil {
+			return err
+		}
+		var latest PricePoint
+		if err := json.Unmarshal(v, &latest); err != nil {
+			return err
+		}
+		if latest.SellPrice == point.SellPrice && latest.TotalNetPrice == point.TotalNetPrice && latest.ContainerPrice == point.ContainerPrice {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	key := priceHistoryKey(point.Sku, point.At)
+	sealed, err := sealValue(priceHistoryBucketName, key, data)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, sealed)
+}
+
+// forEachPriceHistory calls fn with the points of every SKU, oldest first
+func forEachPriceHistory(fn func(sku string, points []PricePoint) error) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(priceHistoryBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		var sku string
+		var points []PricePoint
+		err := bucket.ForEach(func(k, v []byte) error {
+			v, err := openValue(priceHistoryBucketName, k, v)
+			if err != nil {
+				return err
+			}
+			var point PricePoint
+			if err := json.Unmarshal(v, &point); err != nil {
+				return fmt.Errorf("error decoding price history %q: %v", k, err)
+			}
+			if point.Sku != sku && len(points) > 0 {
+				if err := fn(sku, points); err != nil {
+					return err
+				}
+				points = nil
+			}
+			sku = point.Sku
+			points = append(points, point)
+			return nil
+		})
+		if err != nil || len(points) == 0 {
+			return err
+		}
+		return fn(sku, points)
+	})
+}
+
+// GetPriceHistory returns the price points of a SKU, oldest first
+func GetPriceHistory(sku string) ([]PricePoint, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	points := []PricePoint{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(priceHistoryBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		prefix := append([]byte(sku), 0)
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			v, err := openValue(priceHistoryBucketName, k, v)
+			if err != nil {
+				return err
+			}
+			var point PricePoint
+			if err := json.Unmarshal(v, &point); err != nil {
+				return err
+			}
+			points = append(points, point)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading price history: %v", err)
+	}
+
+	return points, nil
+}
+
+// expirePriceHistory removes the points superseded by a newer point of their SKU before
+// cutoff, keeping the price every SKU had at cutoff
+func expirePriceHistory(tx *bolt.Tx, cutoff time.Time) (int, error) {
+	bucket := tx.Bucket([]byte(priceHistoryBucketName))
+	if bucket == nil {
+		return 0, nil
+	}
+
+	var expired [][]byte
+	var previous []byte
+	var previousSku string
+	err := bucket.ForEach(func(k, v []byte) error {
+		sku, at, err := parsePriceHistoryKey(k)
+		if err != nil {
+			return err
+		}
+		if sku == previousSku && at.Before(cutoff) {
+			expired = append(expired, previous)
+		}
+		previous, previousSku = append([]byte(nil), k...), sku
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := bucket.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// PriceTrend is how the average price of a category or series moved over a window
+type PriceTrend = api.PriceTrend
+
+// PriceTrends are the trends of every category or series over a window
+type PriceTrends = api.PriceTrends
+
+// PriceTrendQuery selects the SKUs and prices trends are computed on
+type PriceTrendQuery struct {
+	Window   time.Duration
+	GroupBy  string // category or series
+	Field    string // One of priceTrendFields
+	Category string // Only this itemSalesCategoryCodeKey, if set
+	Series   string // Only this itemSeries, if set
+}
+
+// BuildPriceTrends compares the price of every SKU at the start of the window with its
+// price now, averaged per group. SKUs first priced within the window start from their
+// first price.
+func BuildPriceTrends(query PriceTrendQuery) (PriceTrends, error) {
+	now := time.Now()
+	trends := PriceTrends{GroupBy: query.GroupBy, Field: query.Field, From: now.Add(-query.Window), To: now, Trends: []PriceTrend{}}
+
+	products, err := GetAllProducts()
+	if err != nil {
+		return trends, fmt.Errorf("error fetching products: %v", err)
+	}
+	productMap := make(map[string]ProductRequestData, len(products))
+	for _, product := range products {
+		productMap[product.Sku] = product
+	}
+
+	type totals struct {
+		trend        PriceTrend
+		start, end   float64
+		changeSum    float64
+		changeCounts int
+	}
+	groups := make(map[string]*totals)
+
+	err = forEachPriceHistory(func(sku string, points []PricePoint) error {
+		product, ok := productMap[sku]
+		if !ok {
+			return nil
+		}
+		if query.Category != "" && product.ItemSalesCategoryCodeKey != query.Category {
+			return nil
+		}
+		if query.Series != "" && product.ItemSeries != query.Series {
+			return nil
+		}
+
+		// The price at the start is the last one set at or before it
+		start := points[0]
+		for _, point := range points[1:] {
+			if point.At.After(trends.From) {
+				break
+			}
+			start = point
+		}
+		end := points[len(points)-1]
+
+		group := product.ItemSalesCategoryCodeKey
+		if query.GroupBy == "series" {
+			group = product.ItemSeries
+		}
+		t, ok := groups[group]
+		if !ok {
+			t = &totals{trend: PriceTrend{Group: group}}
+			groups[group] = t
+		}
+
+		t.trend.Skus++
+		startValue, endValue := start.value(query.Field), end.value(query.Field)
+		if startValue != endValue {
+			t.trend.Changed++
+		}
+		t.start += startValue
+		t.end += endValue
+		if startValue > 0 {
+			t.changeSum += (endValue - startValue) / startValue * 100
+			t.changeCounts++
+		}
+		return nil
+	})
+	if err != nil {
+		return trends, fmt.Errorf("error reading price history: %v", err)
+	}
+
+	for _, t := range groups {
+		trend := t.trend
+		trend.AverageStart = roundCents(t.start / float64(trend.Skus))
+		trend.AverageEnd = roundCents(t.end / float64(trend.Skus))
+		if t.start > 0 {
+			trend.Change = roundCents((t.end - t.start) / t.start * 100)
+		}
+		if t.changeCounts > 0 {
+			trend.AverageChange = roundCents(t.changeSum / float64(t.changeCounts))
+		}
+		trends.Trends = append(trends.Trends, trend)
+	}
+	sort.Slice(trends.Trends, func(i, j int) bool { return trends.Trends[i].Group < trends.Trends[j].Group })
+
+	return trends, nil
+}
+
+// parseWindow parses a duration that may be given in days, e.g. 90d or 36h
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return window, nil
+}
+
+// priceHistoryHandler serves the price points of a SKU
+func (s *server) priceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	points, err := GetPriceHistory(lookupSKU(r.PathValue("sku")))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching price history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeRedactedJSON(w, r, http.StatusOK, points)
+}
+
+// priceTrendsHandler serves the average price change per category or series over
+// ?window= (default 90d), optionally restricted with ?category= or ?series=
+func (s *server) priceTrendsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := PriceTrendQuery{
+		Window:   90 * 24 * time.Hour,
+		GroupBy:  q.Get("group"),
+		Field:    q.Get("field"),
+		Category: q.Get("category"),
+		Series:   q.Get("series"),
+	}
+
+	if value := q.Get("window"); value != "" {
+		window, err := parseWindow(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Window = window
+	}
+
+	switch query.GroupBy {
+	case "":
+		query.GroupBy = "category"
+		if query.Category != "" {
+			query.GroupBy = "series"
+		}
+	case "category", "series":
+	default:
+		http.Error(w, fmt.Sprintf("invalid group %q: expected category or series", query.GroupBy), http.StatusBadRequest)
+		return
+	}
+
+	if query.Field == "" {
+		query.Field = priceTrendFields[0]
+	}
+	if !slices.Contains(priceTrendFields, query.Field) {
+		http.Error(w, fmt.Sprintf("invalid field %q: expected one of %s", query.Field, strings.Join(priceTrendFields, ", ")), http.StatusBadRequest)
+		return
+	}
+	if profile := requestProfile(r); profile != nil && profile.Hidden[query.Field] {
+		http.Error(w, fmt.Sprintf("field %s is not available to this API key", query.Field), http.StatusForbidden)
+		return
+	}
+
+	trends, err := BuildPriceTrends(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building price trends: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeRedactedJSON(w, r, http.StatusOK, trends)
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// PriceTier is a customer tier, e.g. retail, wholesale or interior designer, whose
+// prices are the synced cost times its markup
+type PriceTier struct {
+	Name           string
+	Markup         float64            // Multiplier applied to the cost of every product
+	CategoryMarkup map[string]float64 // Multipliers by itemSalesCategoryCodeKey, overriding Markup
+}
+
+type tierContextKey struct{}
+
+// ParsePriceTiers parses semicolon separated name=markup entries, each optionally followed
+// by category overrides, e.g. "retail=2.2,UP=2.5;wholesale=1.6;designer=1.8"
+func ParsePriceTiers(s string) (map[string]*PriceTier, error) {
+	tiers := make(map[string]*PriceTier)
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		head, overrides, _ := strings.Cut(entry, ",")
+		name, value, found := strings.Cut(head, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid price tier %q: expected name=markup", entry)
+		}
+		if _, exists := tiers[name]; exists {
+			return nil, fmt.Errorf("price tier %q defined twice", name)
+		}
+
+		markup, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid markup for price tier %s: %v", name, err)
+		}
+		categoryMarkup, err := ParseCategoryRates(overrides)
+		if err != nil {
+			return nil, fmt.Errorf("invalid category markup for price tier %s: %v", name, err)
+		}
+
+		tier := &PriceTier{Name: name, Markup: markup, CategoryMarkup: categoryMarkup}
+		if err := tier.validate(); err != nil {
+			return nil, err
+		}
+		tiers[name] = tier
+	}
+
+	return tiers, nil
+}
+
+// validate checks the markups are positive
+func (t *PriceTier) validate() error {
+	if t.Markup <= 0 {
+		return fmt.Errorf("price tier %s: markup must be positive, got %v", t.Name, t.Markup)
+	}
+	for category, markup := range t.CategoryMarkup {
+		if markup <= 0 {
+			return fmt.Errorf("price tier %s: markup for %s must be positive, got %v", t.Name, category, markup)
+		}
+	}
+	return nil
+}
+
+// markup returns the multiplier for a product
+func (t *PriceTier) markup(product ProductRequestData) float64 {
+	if markup, ok := t.CategoryMarkup[product.ItemSalesCategoryCodeKey]; ok {
+		return markup
+	}
+	return t.Markup
+}
+
+// sellingCost is the cost prices are marked up from: the landed cost in MXN when
+// LANDED_EXCHANGE_RATE is set, TotalNetPrice in USD otherwise
+func sellingCost(product ProductRequestData, price PriceRequestData) float64 {
+	if landed := landedCost.compute(product, price); landed != nil {
+		return landed.Total
+	}
+	return price.TotalNetPrice
+}
+
+// sellingCurrency is the currency of sellingCost
+func sellingCurrency() string {
+	if landedCost.ExchangeRate > 0 {
+		return "MXN"
+	}
+	return "USD"
+}
+
+// withTier returns r carrying the price tier of its API key
+func withTier(r *http.Request, tier *PriceTier) *http.Request {
+	if tier == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), tierContextKey{}, tier))
+}
+
+// requestTier resolves the price tier of a request: the one of its API key, or the one
+// named by ?tier=. Keys bound to a tier can't ask for another. Writes the error and
+// returns false when the tier can't be used; the tier is nil when none applies.
+func (s *server) requestTier(w http.ResponseWriter, r *http.Request) (*PriceTier, bool) {
+	keyTier, _ := r.Context().Value(tierContextKey{}).(*PriceTier)
+
+	name := r.URL.Query().Get("tier")
+	if name == "" {
+		return keyTier, true
+	}
+
+	tier, ok := s.config.Tiers[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown price tier %q (available: %s)", name, strings.Join(tierNames(s.config.Tiers), ", ")), http.StatusBadRequest)
+		return nil, false
+	}
+	if keyTier != nil && keyTier != tier {
+		http.Error(w, fmt.Sprintf("Price tier %q is not available to this API key", name), http.StatusForbidden)
+		return nil, false
+	}
+	return tier, true
+}
+
+// tierNames returns the names of the given tiers, sorted
+func tierNames(tiers map[string]*PriceTier) []string {
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PriceListEntry is the price of a product for a tier
+type PriceListEntry = api.PriceListEntry
+
+// PriceList is the catalog priced for a tier
+type PriceList = api.PriceList
+
+// BuildPriceList prices every priced product of the catalog for a tier, with the
+// promotions in effect on date
+func BuildPriceList(tier *PriceTier, date string) (PriceList, error) {
+	products, err := GetAllProducts()
+	if err != nil {
+		return PriceList{}, fmt.Errorf("error fetching products: %v", err)
+	}
+	prices, err := GetAllPrices()
+	if err != nil {
+		return PriceList{}, fmt.Errorf("error fetching prices: %v", err)
+	}
+	priceMap := make(map[string]PriceRequestData, len(prices))
+	for _, price := range prices {
+		priceMap[price.Sku] = price
+	}
+	if _, err := applyPromotions(priceMap, date); err != nil {
+		return PriceList{}, err
+	}
+
+	list := PriceList{Nivel: tier.Name, Generado: time.Now(), Precios: []PriceListEntry{}}
+	currency := sellingCurrency()
+	for _, product := range products {
+		price, ok := priceMap[product.Sku]
+		if !ok {
+			continue
+		}
+		list.Precios = append(list.Precios, PriceListEntry{
+			Clave:     product.Sku,
+			Nombre:    product.ConsumerDescription,
+			Categoria: product.ItemSalesCategoryCodeKey,
+			Precio:    roundCents(sellingCost(product, price) * tier.markup(product)),
+			Moneda:    currency,
+		})
+	}
+
+	return list, nil
+}
+
+// priceListFor resolves the tier of a request and builds its price list, writing the
+// error and returning false on failure
+func (s *server) priceListFor(w http.ResponseWriter, r *http.Request) (PriceList, bool) {
+	tier, ok := s.requestTier(w, r)
+	if !ok {
+		return PriceList{}, false
+	}
+	if tier == nil {
+		http.Error(w, fmt.Sprintf("No price tier: pass ?tier= (available: %s)", strings.Join(tierNames(s.config.Tiers), ", ")), http.StatusBadRequest)
+		return PriceList{}, false
+	}
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return PriceList{}, false
+	}
+
+	stale, err := staleSince(s.config.Fetchers, s.config.StaleAfter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sync status: %v", err), http.StatusInternalServerError)
+		return PriceList{}, false
+	}
+	if stale != nil {
+		w.Header().Set("X-Stale-Since", stale.UTC().Format(time.RFC3339))
+		if s.config.StaleUnavailable {
+			http.Error(w, fmt.Sprintf("Catalog data is stale: last successful sync at %s", stale.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable)
+			return PriceList{}, false
+		}
+	}
+
+	list, err := BuildPriceList(tier, date)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error building price list: %v", err), http.StatusInternalServerError)
+		return PriceList{}, false
+	}
+	list.StaleSince = stale
+	return list, true
+}
+
+// priceListHandler serves the price list of the request's tier
+func (s *server) priceListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := s.priceListFor(w, r)
+	if !ok {
+		return
+	}
+	writeSchemaJSON(w, r, http.StatusOK, list)
+}
+
+// exportPriceListHandler serves the price list of the request's tier as CSV
+func (s *server) exportPriceListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := s.priceListFor(w, r)
+	if !ok {
+		return
+	}
+
+	rows := make([]map[string]string, 0, len(list.Precios))
+	for _, entry := range list.Precios {
+		row, err := flattenJSON(entry)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error building export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		rows = append(rows, row)
+	}
+
+	columns, rows := requestSchema(r).applyColumns([]string{"clave", "nombre", "categoria", "precio", "moneda"}, rows)
+	writeCSV(w, r, "price-list-"+list.Nivel+".csv", columns, rows)
+}
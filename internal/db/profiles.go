@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// NoCostProfile is the built-in profile hiding every cost and price field
+const NoCostProfile = "nocost"
+
+// costFields are the fields hidden by the nocost profile: the costs of product and
+// kit responses, computed fields (usually derived from costs) and the prices of
+// stored and upstream records
+var costFields = api.CostFields
+
+// ResponseProfile hides fields from the responses served to the API keys assigned
+// to it, e.g. costs from sales kiosks
+type ResponseProfile struct {
+	Name string
+
+	// Hidden holds JSON field names removed at any depth of a response. A name
+	// qualified with its parent, e.g. calculados.margen, only removes that entry.
+	Hidden map[string]bool
+}
+
+type profileContextKey struct{}
+
+// ParseResponseProfiles parses semicolon separated name=field,... entries, e.g.
+// "kiosk=costo,costo2,costoKit,calculados.margen". The nocost profile is always defined.
+func ParseResponseProfiles(s string) (map[string]*ResponseProfile, error) {
+	profiles := map[string]*ResponseProfile{
+		NoCostProfile: newResponseProfile(NoCostProfile, costFields),
+	}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, fieldList, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid response profile %q: expected name=field,...", entry)
+		}
+		if _, exists := profiles[name]; exists {
+			return nil, fmt.Errorf("response profile %q defined twice", name)
+		}
+
+		var fields []string
+		for _, field := range strings.Split(fieldList, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("response profile %q hides no fields", name)
+		}
+		profiles[name] = newResponseProfile(name, fields)
+	}
+
+	return profiles, nil
+}
+
+func newResponseProfile(name string, fields []string) *ResponseProfile {
+	profile := &ResponseProfile{Name: name, Hidden: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		profile.Hidden[field] = true
+	}
+	return profile
+}
+
+// withProfile returns r carrying the profile of its API key
+func withProfile(r *http.Request, profile *ResponseProfile) *http.Request {
+	if profile == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), profileContextKey{}, profile))
+}
+
+// requestProfile returns the profile of the request's API key, nil when unrestricted
+func requestProfile(r *http.Request) *ResponseProfile {
+	profile, _ := r.Context().Value(profileContextKey{}).(*ResponseProfile)
+	return profile
+}
+
+// restrictFields applies the profile to the fields requested from a selector. Hidden
+// fields can't be requested; without a selection every visible field is returned,
+// so restricted responses always go through projection.
+func (p *ResponseProfile) restrictFields(selector *fieldSelector, fields []string) ([]string, error) {
+	if p == nil {
+		return fields, nil
+	}
+
+	var hidden []string
+	for _, name := range fields {
+		if p.Hidden[name] {
+			hidden = append(hidden, name)
+		}
+	}
+	if len(hidden) > 0 {
+		return nil, fmt.Errorf("fields %s are not available to this API key", strings.Join(hidden, ", "))
+	}
+	if len(fields) > 0 {
+		return fields, nil
+	}
+
+	visible := make([]string, 0, len(selector.names))
+	for _, name := range selector.names {
+		if !p.Hidden[name] {
+			visible = append(visible, name)
+		}
+	}
+	return visible, nil
+}
+
+// redactProducts removes the computed fields hidden as calculados.<name>
+func (p *ResponseProfile) redactProducts(response []ProductResponseData) {
+	if p == nil {
+		return
+	}
+	for i := range response {
+		if len(response[i].Calculados) == 0 {
+			continue
+		}
+		visible := make(map[string]float64, len(response[i].Calculados))
+		for name, value := range response[i].Calculados {
+			if !p.Hidden["calculados."+name] {
+				visible[name] = value
+			}
+		}
+		response[i].Calculados = visible
+	}
+}
+
+// redact returns v with the hidden fields removed, by round-tripping it through JSON
+func (p *ResponseProfile) redact(v any) (any, error) {
+	if p == nil {
+		return v, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	p.strip(value, "")
+	return value, nil
+}
+
+// strip deletes the hidden keys of the JSON objects within value, parent being the
+// key value is stored under
+func (p *ResponseProfile) strip(value any, parent string) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, child := range value {
+			if p.Hidden[key] || (parent != "" && p.Hidden[parent+"."+key]) {
+				delete(value, key)
+				continue
+			}
+			p.strip(child, key)
+		}
+	case []any:
+		for _, child := range value {
+			p.strip(child, parent)
+		}
+	}
+}
+
+// writeRedactedJSON writes v as JSON with the fields hidden from the request's API key removed,
+// renamed by the request's schema
+func writeRedactedJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	redacted, err := requestProfile(r).redact(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error redacting response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeSchemaJSON(w, r, status, redacted)
+}
+
+// profileNames returns the names of the given profiles, sorted
+func profileNames(profiles map[string]*ResponseProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
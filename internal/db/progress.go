@@ -0,0 +1,157 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SyncProgress is a progress event of a running fetch, emitted after every page
+type SyncProgress struct {
+	Fetcher       string     `json:"fetcher"`
+	Page          int        `json:"page"`
+	TotalPages    int        `json:"totalPages"` // 0 when the upstream did not report a total
+	Limit         int        `json:"limit"`      // Current page size
+	Entities      int        `json:"entities"`
+	TotalEntities int        `json:"totalEntities"`
+	StartedAt     time.Time  `json:"startedAt"`
+	ETA           *time.Time `json:"eta,omitempty"`
+	Done          bool       `json:"done"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// progressHub keeps the latest progress of each fetcher and fans events out to subscribers
+type progressHub struct {
+	mu          sync.Mutex
+	latest      map[string]SyncProgress
+	order       []string
+	subscribers map[chan SyncProgress]struct{}
+}
+
+var progress = &progressHub{
+	latest:      make(map[string]SyncProgress),
+	subscribers: make(map[chan SyncProgress]struct{}),
+}
+
+// publish records an event and sends it to every subscriber, dropping it for
+// subscribers that are not keeping up rather than blocking the sync
+func (h *progressHub) publish(event SyncProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.latest[event.Fetcher]; !ok {
+		h.order = append(h.order, event.Fetcher)
+	}
+	h.latest[event.Fetcher] = event
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe returns the latest event of every fetcher and a channel receiving new ones
+func (h *progressHub) subscribe() ([]SyncProgress, chan SyncProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := make([]SyncProgress, 0, len(h.order))
+	for _, fetcher := range h.order {
+		snapshot = append(snapshot, h.latest[fetcher])
+	}
+
+	ch := make(chan SyncProgress, 64)
+	h.subscribers[ch] = struct{}{}
+	return snapshot, ch
+}
+
+func (h *progressHub) unsubscribe(ch chan SyncProgress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// newSyncProgress builds a progress event, estimating total pages and time left
+// from the total record count reported by the upstream
+func newSyncProgress(fetcher string, page, entities int, metadata Metadata, limit int, startedAt time.Time) SyncProgress {
+	event := SyncProgress{
+		Fetcher:       fetcher,
+		Page:          page,
+		Entities:      entities,
+		TotalEntities: metadata.TotalRecords,
+		Limit:         limit,
+		StartedAt:     startedAt,
+	}
+
+	if metadata.TotalRecords > 0 && limit > 0 {
+		event.TotalPages = (metadata.TotalRecords + limit - 1) / limit
+	}
+
+	if entities > 0 && metadata.TotalRecords > entities {
+		elapsed := time.Since(startedAt)
+		remaining := time.Duration(float64(elapsed) / float64(entities) * float64(metadata.TotalRecords-entities))
+		eta := time.Now().Add(remaining)
+		event.ETA = &eta
+	}
+
+	return event
+}
+
+// syncProgressHandler streams sync progress as Server-Sent Events. The latest event of
+// each fetcher is sent on connect, then every new event until the client disconnects.
+func (s *server) syncProgressHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot, events := progress.subscribe()
+	defer progress.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event SyncProgress) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for _, event := range snapshot {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// promotionsBucketName holds the promotional prices of products for a window of dates,
+// synced from Ashley's promotions endpoint or imported with POST /admin/promotions
+const promotionsBucketName = "promotions"
+
+// PromotionalPrice replaces the prices of a product from Start to End, both dates
+// included. An empty End leaves the promotion open. Prices left at zero keep the
+// regular price.
+type PromotionalPrice struct {
+	Sku           string  `json:"sku"`
+	Start         string  `json:"start"`         // YYYY-MM-DD
+	End           string  `json:"end,omitempty"` // YYYY-MM-DD
+	SellPrice     float64 `json:"sellPrice,omitempty"`
+	TotalNetPrice float64 `json:"totalNetPrice,omitempty"`
+	Promotion     string  `json:"promotion,omitempty"` // Promotion code, served as promocion
+}
+
+// GetSKU returns the key of the promotional price: its SKU and start date, so a
+// product can hold several windows
+func (p PromotionalPrice) GetSKU() string { return p.Sku + "/" + p.Start }
+
+func (p PromotionalPrice) normalizeSKUs() DatabaseEntity {
+	p.Sku = NormalizeSKU(p.Sku)
+	return p
+}
+
+// validate checks the window's dates and that it replaces a price
+func (p PromotionalPrice) validate() error {
+	if p.Sku == "" {
+		return fmt.Errorf("sku is required")
+	}
+	if _, err := time.Parse(time.DateOnly, p.Start); err != nil {
+		return fmt.Errorf("start %q is not a YYYY-MM-DD date", p.Start)
+	}
+	if p.End != "" {
+		if _, err := time.Parse(time.DateOnly, p.End); err != nil {
+			return fmt.Errorf("end %q is not a YYYY-MM-DD date", p.End)
+		}
+		if p.End < p.Start {
+			return fmt.Errorf("end %s is before start %s", p.End, p.Start)
+		}
+	}
+	if p.SellPrice < 0 || p.TotalNetPrice < 0 {
+		return fmt.Errorf("prices must not be negative")
+	}
+	if p.SellPrice == 0 && p.TotalNetPrice == 0 {
+		return fmt.Errorf("sellPrice or totalNetPrice is required")
+	}
+	return nil
+}
+
+// covers reports whether the window includes date
+func (p PromotionalPrice) covers(date string) bool {
+	return p.Start <= date && (p.End == "" || date <= p.End)
+}
+
+// label names the promotion in responses: its code, or its key when it has none
+func (p PromotionalPrice) label() string {
+	if p.Promotion != "" {
+		return p.Promotion
+	}
+	return p.GetSKU()
+}
+
+// Promotion is a promotional price as Ashley's promotions endpoint returns it
+type Promotion struct {
+	Sku                string `json:"sku"`
+	PromotionCode      string `json:"promotionCode"`
+	StartDate          string `json:"startDate"`
+	EndDate            string `json:"endDate"`
+	PromoSellPrice     string `json:"promoSellPrice"`
+	PromoTotalNetPrice string `json:"promoTotalNetPrice"`
+}
+
+func (p Promotion) GetSKU() string { return p.Sku + "/" + promotionDate(p.StartDate) }
+
+type PromotionAPIResponse struct {
+	Links    []Link      `json:"links"`
+	Metadata Metadata    `json:"metadata"`
+	Entities []Promotion `json:"entities"`
+}
+
+// PromotionFetcher syncs the account's promotional prices. It is optional: enable it
+// by listing promotions in API_FETCHERS.
+type PromotionFetcher struct{}
+
+func (f PromotionFetcher) FetchPage(ctx context.Context, config APIConfig, page int) (*GenericAPIResponse[Promotion], error) {
+	url := fmt.Sprintf("%s/Promotions?Customer=%s&Limit=%d&Page=%d",
+		config.BaseURL, config.Customer, config.Limit, page)
+
+	response, raw, err := makeHTTPRequest[PromotionAPIResponse](ctx, url, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GenericAPIResponse[Promotion]{
+		Links:    response.Links,
+		Metadata: response.Metadata,
+		Entities: response.Entities,
+		Raw:      raw,
+	}, nil
+}
+
+func (f PromotionFetcher) Transform(entity Promotion) DatabaseEntity {
+	result := PromotionalPrice{
+		Sku:       strings.TrimSpace(entity.Sku),
+		Start:     promotionDate(entity.StartDate),
+		End:       promotionDate(entity.EndDate),
+		Promotion: entity.PromotionCode,
+	}
+	result.SellPrice, _ = parseFloat(entity.PromoSellPrice)
+	result.TotalNetPrice, _ = parseFloat(entity.PromoTotalNetPrice)
+	return result
+}
+
+func (f PromotionFetcher) GetBucketName() string { return promotionsBucketName }
+func (f PromotionFetcher) GetEndpoint() string   { return "Promotions" }
+
+// promotionDate returns the date of an upstream date or timestamp, e.g.
+// 2026-11-27T00:00:00 becomes 2026-11-27
+func promotionDate(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > len(time.DateOnly) {
+		value = value[:len(time.DateOnly)]
+	}
+	return value
+}
+
+// promotionCache holds the stored promotional prices by SKU, as every catalog request
+// looks them up. invalidateCache drops it when stored data changes.
+var promotionCache struct {
+	sync.Mutex
+	bySKU map[string][]PromotionalPrice // nil until loaded
+}
+
+// storedPromotions returns the promotional prices by SKU, loading them on first use
+func storedPromotions() (map[string][]PromotionalPrice, error) {
+	promotionCache.Lock()
+	defer promotionCache.Unlock()
+	if promotionCache.bySKU != nil {
+		return promotionCache.bySKU, nil
+	}
+
+	stored, err := GetAllEntities[PromotionalPrice](promotionsBucketName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching promotions: %v", err)
+	}
+	bySKU := make(map[string][]PromotionalPrice)
+	for _, promotion := range stored {
+		bySKU[promotion.Sku] = append(bySKU[promotion.Sku], promotion)
+	}
+	promotionCache.bySKU = bySKU
+	return bySKU, nil
+}
+
+// dropPromotions has the next lookup read the stored promotional prices again
+func dropPromotions() {
+	promotionCache.Lock()
+	defer promotionCache.Unlock()
+	promotionCache.bySKU = nil
+}
+
+// effectivePromotions returns the promotional price of each product on date. When
+// windows overlap, the one starting last wins. An empty date has none.
+func effectivePromotions(date string) (map[string]PromotionalPrice, error) {
+	effective := make(map[string]PromotionalPrice)
+	if date == "" {
+		return effective, nil
+	}
+	bySKU, err := storedPromotions()
+	if err != nil {
+		return nil, err
+	}
+	for sku, windows := range bySKU {
+		// Windows are in key order, so by start date
+		for _, window := range windows {
+			if window.covers(date) {
+				effective[sku] = window
+			}
+		}
+	}
+	return effective, nil
+}
+
+// promotionsSignature identifies the promotional prices in effect on date, empty when
+// there are none. Catalogs built for a date are reused for the dates sharing it.
+func promotionsSignature(date string) (string, error) {
+	effective, err := effectivePromotions(date)
+	if err != nil || len(effective) == 0 {
+		return "", err
+	}
+	keys := make([]string, 0, len(effective))
+	for _, promotion := range effective {
+		keys = append(keys, promotion.GetSKU())
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:4]), nil
+}
+
+// applyPromotions replaces the prices in priceMap by the promotional prices in effect
+// on date, and returns the promotion applied to each product. Products without a
+// regular price are left unpriced.
+func applyPromotions(priceMap map[string]PriceRequestData, date string) (map[string]PromotionalPrice, error) {
+	effective, err := effectivePromotions(date)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]PromotionalPrice)
+	for sku, promotion := range effective {
+		price, ok := priceMap[sku]
+		if !ok {
+			continue
+		}
+		if promotion.SellPrice > 0 {
+			price.SellPrice = promotion.SellPrice
+		}
+		if promotion.TotalNetPrice > 0 {
+			price.TotalNetPrice = promotion.TotalNetPrice
+		}
+		priceMap[sku] = price
+		applied[sku] = promotion
+	}
+	return applied, nil
+}
+
+// markPromotions sets promocion on the responses whose prices are promotional
+func markPromotions(response []ProductResponseData, applied map[string]PromotionalPrice) {
+	for i := range response {
+		if promotion, ok := applied[response[i].Clave]; ok {
+			response[i].Promocion = promotion.label()
+		}
+	}
+}
+
+// requestedDate returns the date prices are served for: ?date= as YYYY-MM-DD, today
+// by default
+func requestedDate(r *http.Request) (string, error) {
+	value := strings.TrimSpace(r.URL.Query().Get("date"))
+	if value == "" {
+		return time.Now().Format(time.DateOnly), nil
+	}
+	if _, err := time.Parse(time.DateOnly, value); err != nil {
+		return "", fmt.Errorf("%q is not a YYYY-MM-DD date", value)
+	}
+	return value, nil
+}
+
+// GetPromotions returns the stored promotional prices, sorted by SKU and start date
+func GetPromotions() ([]PromotionalPrice, error) {
+	return GetAllEntities[PromotionalPrice](promotionsBucketName)
+}
+
+// PromotionImportResult summarizes an import of promotional prices
+type PromotionImportResult struct {
+	Imported int    `json:"imported"`
+	Removed  int    `json:"removed"`
+	Run      string `json:"run"` // Journal run of the import
+}
+
+// ImportPromotions stores promotional prices, replacing the ones of the same SKU and
+// start date. With replace set, stored promotional prices missing from promotions
+// are removed, including synced ones.
+func ImportPromotions(promotions []PromotionalPrice, replace bool, validation ValidationConfig) (PromotionImportResult, error) {
+	db, err := openDB()
+	if err != nil {
+		return PromotionImportResult{}, err
+	}
+	defer db.Close()
+
+	run, err := newRun(SourceImport)
+	if err != nil {
+		return PromotionImportResult{}, err
+	}
+
+	result := PromotionImportResult{Imported: len(promotions), Run: run.ID}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := createRecords(tx, promotionsBucketName)
+		if err != nil {
+			return err
+		}
+
+		identity := func(p PromotionalPrice) DatabaseEntity { return p }
+		if _, err := putEntities(tx, run, promotionsBucketName, promotions, identity, validation); err != nil {
+			return err
+		}
+
+		if !replace {
+			return nil
+		}
+
+		imported := make(map[string]bool, len(promotions))
+		for _, promotion := range promotions {
+			imported[recordKey(promotion)] = true
+		}
+
+		var removed []string
+		err = bucket.ForEach(func(k, v []byte) error {
+			if !imported[string(k)] {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range removed {
+			if err := deleteRecord(tx, run, bucket, promotionsBucketName, key); err != nil {
+				return err
+			}
+		}
+		result.Removed = len(removed)
+
+		return nil
+	})
+
+	if err != nil {
+		return PromotionImportResult{}, err
+	}
+
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// decodePromotions reads the uploaded promotional prices as a JSON array or as CSV
+// with a header row naming the promotionColumns
+func decodePromotions(r *http.Request) ([]PromotionalPrice, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var promotions []PromotionalPrice
+	switch mediaType {
+	case "application/json", "":
+		if err := json.NewDecoder(r.Body).Decode(&promotions); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	case "text/csv":
+		var err error
+		if promotions, err = decodePromotionsCSV(r.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q: use application/json or text/csv", mediaType)
+	}
+
+	seen := make(map[string]int, len(promotions))
+	for i := range promotions {
+		promotions[i].Sku = strings.TrimSpace(promotions[i].Sku)
+		promotions[i].Start = strings.TrimSpace(promotions[i].Start)
+		promotions[i].End = strings.TrimSpace(promotions[i].End)
+		if err := promotions[i].validate(); err != nil {
+			return nil, fmt.Errorf("promotion %d: %v", i+1, err)
+		}
+		key := recordKey(promotions[i])
+		if previous, ok := seen[key]; ok {
+			return nil, fmt.Errorf("promotions %d and %d share SKU %q and start %s",
+				previous+1, i+1, promotions[i].Sku, promotions[i].Start)
+		}
+		seen[key] = i
+	}
+
+	return promotions, nil
+}
+
+// promotionColumns are the CSV columns of a promotion import
+var promotionColumns = []string{"sku", "start", "end", "sellPrice", "totalNetPrice", "promotion"}
+
+// decodePromotionsCSV converts CSV rows into promotional prices. The sku and start
+// columns are required, and at least one of the prices.
+func decodePromotionsCSV(body io.Reader) ([]PromotionalPrice, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %v", err)
+	}
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		if !slices.Contains(promotionColumns, column) {
+			return nil, fmt.Errorf("unknown CSV column %s; valid columns are %s", column, strings.Join(promotionColumns, ", "))
+		}
+		index[column] = i
+	}
+	for _, column := range []string{"sku", "start"} {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("CSV has no %s column", column)
+		}
+	}
+	_, hasSellPrice := index["sellPrice"]
+	_, hasTotalNetPrice := index["totalNetPrice"]
+	if !hasSellPrice && !hasTotalNetPrice {
+		return nil, fmt.Errorf("CSV has no sellPrice or totalNetPrice column")
+	}
+
+	var promotions []PromotionalPrice
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+
+		field := func(column string) string {
+			if i, ok := index[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		promotion := PromotionalPrice{
+			Sku:       field("sku"),
+			Start:     field("start"),
+			End:       field("end"),
+			Promotion: field("promotion"),
+		}
+		for column, price := range map[string]*float64{"sellPrice": &promotion.SellPrice, "totalNetPrice": &promotion.TotalNetPrice} {
+			if value := field(column); value != "" {
+				if *price, err = strconv.ParseFloat(value, 64); err != nil {
+					return nil, fmt.Errorf("row %d: %s %q is not a number", row, column, value)
+				}
+			}
+		}
+		promotions = append(promotions, promotion)
+	}
+
+	return promotions, nil
+}
+
+// promotionsHandler lists the stored promotional prices, only the ones in effect on
+// ?date= when given, and only those of ?sku=
+func (s *server) promotionsHandler(w http.ResponseWriter, r *http.Request) {
+	promotions, err := GetPromotions()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching promotions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("date") != "" {
+		date, err := requestedDate(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+			return
+		}
+		promotions = slices.DeleteFunc(promotions, func(p PromotionalPrice) bool { return !p.covers(date) })
+	}
+	if sku := r.URL.Query().Get("sku"); sku != "" {
+		sku = lookupSKU(sku)
+		promotions = slices.DeleteFunc(promotions, func(p PromotionalPrice) bool { return p.Sku != sku })
+	}
+	if promotions == nil {
+		promotions = []PromotionalPrice{}
+	}
+	writeJSON(w, http.StatusOK, promotions)
+}
+
+// importPromotionsHandler stores promotional prices sent as a JSON array or CSV.
+// ?replace=true removes the stored ones missing from the upload.
+func (s *server) importPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	replace := false
+	if value := r.URL.Query().Get("replace"); value != "" {
+		var err error
+		if replace, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid replace: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	promotions, err := decodePromotions(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := ImportPromotions(promotions, replace, s.config.Upstream.Validation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error importing promotions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Quota is the upstream rate limit state last reported by the Ashley gateway for a
+// customer account. Fields the gateway didn't send are left zero.
+type Quota struct {
+	Limit      int       `json:"limit,omitempty"`
+	Remaining  int       `json:"remaining"`
+	ResetAt    time.Time `json:"resetAt,omitempty"`
+	ObservedAt time.Time `json:"observedAt"`
+}
+
+var (
+	upstreamQuotaLimit = metrics.NewGauge("ashley_upstream_quota_limit",
+		"Calls allowed per quota window as reported by the Ashley gateway", "customer")
+	upstreamQuotaRemaining = metrics.NewGauge("ashley_upstream_quota_remaining",
+		"Calls left in the current quota window as reported by the Ashley gateway", "customer")
+	upstreamQuotaResetSeconds = metrics.NewGauge("ashley_upstream_quota_reset_timestamp_seconds",
+		"Unix time the current quota window resets", "customer")
+	upstreamThrottleSeconds = metrics.NewCounter("ashley_upstream_throttle_seconds_total",
+		"Time requests were delayed to stay within the upstream quota", "customer")
+)
+
+// quotas holds the last reported quota of each customer account
+var quotas = struct {
+	mu sync.Mutex
+	m  map[string]Quota
+}{m: make(map[string]Quota)}
+
+// Header names used by common gateways, most specific first
+var (
+	quotaLimitHeaders     = []string{"X-RateLimit-Limit", "RateLimit-Limit", "X-Rate-Limit-Limit"}
+	quotaRemainingHeaders = []string{"X-RateLimit-Remaining", "RateLimit-Remaining", "X-Rate-Limit-Remaining"}
+	quotaResetHeaders     = []string{"X-RateLimit-Reset", "RateLimit-Reset", "X-Rate-Limit-Reset"}
+)
+
+// parseQuota reads the rate limit headers of a response. ok is false when the
+// gateway didn't report the remaining calls.
+func parseQuota(header http.Header, now time.Time) (quota Quota, ok bool) {
+	remaining, ok := headerInt(header, quotaRemainingHeaders)
+	if !ok {
+		return Quota{}, false
+	}
+
+	quota = Quota{Remaining: remaining, ObservedAt: now}
+	quota.Limit, _ = headerInt(header, quotaLimitHeaders)
+
+	// The reset is either a unix timestamp or seconds until the window resets
+	if reset, ok := headerInt(header, quotaResetHeaders); ok {
+		if reset > 1_000_000_000 {
+			quota.ResetAt = time.Unix(int64(reset), 0)
+		} else {
+			quota.ResetAt = now.Add(time.Duration(reset) * time.Second)
+		}
+	}
+
+	return quota, true
+}
+
+// headerInt returns the first of names present in header as an integer. Values
+// like "100;w=60" (the IETF draft format) keep only the leading number.
+func headerInt(header http.Header, names []string) (int, bool) {
+	for _, name := range names {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		value, _, _ = strings.Cut(value, ";")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// observeQuota records the quota reported on a response from the Ashley API
+func observeQuota(customer string, resp *http.Response) {
+	quota, ok := parseQuota(resp.Header, time.Now())
+	if !ok {
+		return
+	}
+
+	quotas.mu.Lock()
+	quotas.m[customer] = quota
+	quotas.mu.Unlock()
+	debugf(log.Default(), "customer=%s Upstream quota %d of %d left, resets %s", customer, quota.Remaining, quota.Limit, quota.ResetAt.Format(time.RFC3339))
+
+	upstreamQuotaRemaining.Set(float64(quota.Remaining), customer)
+	if quota.Limit > 0 {
+		upstreamQuotaLimit.Set(float64(quota.Limit), customer)
+	}
+	if !quota.ResetAt.IsZero() {
+		upstreamQuotaResetSeconds.Set(float64(quota.ResetAt.Unix()), customer)
+	}
+}
+
+// currentQuota returns the last reported quota of a customer account
+func currentQuota(customer string) (Quota, bool) {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	quota, ok := quotas.m[customer]
+	return quota, ok
+}
+
+// quotaDelay is how long to wait before the next request so the calls left are
+// spread over the rest of the window. Nothing is delayed while more than reserve
+// (a fraction of the limit) remains, or once the window has reset.
+func quotaDelay(quota Quota, reserve float64, now time.Time) time.Duration {
+	if reserve <= 0 || quota.ResetAt.IsZero() || !now.Before(quota.ResetAt) {
+		return 0
+	}
+	if quota.Limit > 0 && float64(quota.Remaining) > reserve*float64(quota.Limit) {
+		return 0
+	}
+
+	untilReset := quota.ResetAt.Sub(now)
+	if quota.Remaining <= 0 {
+		return untilReset
+	}
+	return untilReset / time.Duration(quota.Remaining+1)
+}
+
+// waitForQuota slows down requests of a customer account whose quota is nearly spent
+func waitForQuota(ctx context.Context, customer string, reserve float64) error {
+	quota, ok := currentQuota(customer)
+	if !ok {
+		return nil
+	}
+
+	delay := quotaDelay(quota, reserve, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	log.Printf("customer=%s Upstream quota nearly exhausted (%d left, resets %s), waiting %v",
+		customer, quota.Remaining, quota.ResetAt.Format(time.RFC3339), delay.Round(time.Millisecond))
+	upstreamThrottleSeconds.Add(delay.Seconds(), customer)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// requestLimiters space out the upstream requests of each customer account, shared by
+// the fetchers of a sync running in parallel
+var requestLimiters = struct {
+	mu sync.Mutex
+	m  map[string]*rate.Limiter
+}{m: make(map[string]*rate.Limiter)}
+
+// waitForRequestRate holds a request of a customer account until it fits within
+// perSecond requests per second (0 disables the limit)
+func waitForRequestRate(ctx context.Context, customer string, perSecond float64) error {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	requestLimiters.mu.Lock()
+	limiter, ok := requestLimiters.m[customer]
+	if !ok || limiter.Limit() != rate.Limit(perSecond) {
+		limiter = rate.NewLimiter(rate.Limit(perSecond), 1)
+		requestLimiters.m[customer] = limiter
+	}
+	requestLimiters.mu.Unlock()
+
+	return limiter.Wait(ctx)
+}
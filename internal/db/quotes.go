@@ -0,0 +1,384 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/pdf"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+const quotesBucketName = "quotes"
+
+// maxQuoteItems caps the lines of a single quote
+const maxQuoteItems = 200
+
+// ErrUnquotable is returned when a quote names SKUs that are unknown or unpriced
+var ErrUnquotable = errors.New("can't quote")
+
+// QuoteConfig holds the markup rules and terms of quotes. Items are priced at their
+// landed cost in MXN when LANDED_EXCHANGE_RATE is set, at TotalNetPrice in USD otherwise,
+// with the markups of the customer's price tier when the quote is made for one.
+type QuoteConfig struct {
+	Markup         float64            // Multiplier applied to the cost of every item
+	CategoryMarkup map[string]float64 // Multipliers by itemSalesCategoryCodeKey, overriding Markup
+	TaxRate        float64            // IVA added to the subtotal
+	Validity       time.Duration      // How long quoted prices hold
+}
+
+// Validate checks the markups and tax rate are usable
+func (c QuoteConfig) Validate() error {
+	if c.Markup <= 0 {
+		return fmt.Errorf("QUOTE_MARKUP must be positive, got %v", c.Markup)
+	}
+	for category, markup := range c.CategoryMarkup {
+		if markup <= 0 {
+			return fmt.Errorf("QUOTE_MARKUP_BY_CATEGORY %s must be positive, got %v", category, markup)
+		}
+	}
+	if c.TaxRate < 0 || c.TaxRate > 1 {
+		return fmt.Errorf("QUOTE_TAX_RATE must be between 0 and 1, got %v", c.TaxRate)
+	}
+	return nil
+}
+
+// markup returns the multiplier for a product
+func (c QuoteConfig) markup(product ProductRequestData) float64 {
+	if markup, ok := c.CategoryMarkup[product.ItemSalesCategoryCodeKey]; ok {
+		return markup
+	}
+	return c.Markup
+}
+
+// QuoteCustomer is who a quote is made out to
+type QuoteCustomer struct {
+	Name    string `json:"name"`
+	Company string `json:"company,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+// QuoteItem is a priced line of a quote
+type QuoteItem struct {
+	Sku         string  `json:"sku"`
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unitPrice"`
+	Total       float64 `json:"total"`
+	Promotion   string  `json:"promotion,omitempty"` // Promotion the unit price comes from
+}
+
+// Quote is a persisted price offer, priced from the synced costs at creation
+type Quote struct {
+	ID         string        `json:"id"`
+	Number     string        `json:"number"` // Sequential, e.g. Q-000042
+	CreatedAt  time.Time     `json:"createdAt"`
+	ValidUntil time.Time     `json:"validUntil"`
+	Customer   QuoteCustomer `json:"customer"`
+	Currency   string        `json:"currency"`
+	Tier       string        `json:"tier,omitempty"`      // Price tier whose markups apply
+	PricedFor  string        `json:"pricedFor,omitempty"` // Date whose promotions apply, YYYY-MM-DD
+	Items      []QuoteItem   `json:"items"`
+	Subtotal   float64       `json:"subtotal"`
+	Tax        float64       `json:"tax"`
+	Total      float64       `json:"total"`
+	Notes      string        `json:"notes,omitempty"`
+}
+
+func (q Quote) GetSKU() string { return q.ID }
+
+// QuoteRequest is the body of POST /quotes
+type QuoteRequest struct {
+	Customer QuoteCustomer `json:"customer"`
+	Items    []struct {
+		Sku      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+	} `json:"items"`
+	Notes string `json:"notes"`
+}
+
+// CreateQuote prices the requested items from the stored products and prices, with the
+// promotions in effect on date, and persists the quote under the next quote number. A
+// non-nil tier replaces the quote markups.
+func CreateQuote(config QuoteConfig, tier *PriceTier, request QuoteRequest, date string) (Quote, error) {
+	skus := make([]string, 0, len(request.Items))
+	for _, item := range request.Items {
+		skus = append(skus, item.Sku)
+	}
+	products, err := GetEntities[ProductRequestData]("products", skus)
+	if err != nil {
+		return Quote{}, fmt.Errorf("error fetching products: %v", err)
+	}
+	prices, err := GetEntities[PriceRequestData]("prices", skus)
+	if err != nil {
+		return Quote{}, fmt.Errorf("error fetching prices: %v", err)
+	}
+	applied, err := applyPromotions(prices, date)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Quote{}, fmt.Errorf("error generating quote ID: %v", err)
+	}
+	now := time.Now()
+	quote := Quote{
+		ID:         id.String(),
+		CreatedAt:  now,
+		ValidUntil: now.Add(config.Validity),
+		Customer:   request.Customer,
+		Currency:   sellingCurrency(),
+		Items:      []QuoteItem{},
+		Notes:      request.Notes,
+		PricedFor:  date,
+	}
+	markup := config.markup
+	if tier != nil {
+		quote.Tier = tier.Name
+		markup = tier.markup
+	}
+
+	var unknown, unpriced []string
+	for _, item := range request.Items {
+		product, ok := products[item.Sku]
+		if !ok {
+			unknown = append(unknown, item.Sku)
+			continue
+		}
+		price, ok := prices[item.Sku]
+		if !ok {
+			unpriced = append(unpriced, item.Sku)
+			continue
+		}
+
+		unitPrice := roundCents(sellingCost(product, price) * markup(product))
+		line := QuoteItem{
+			Sku:         item.Sku,
+			Description: product.ConsumerDescription,
+			Quantity:    item.Quantity,
+			UnitPrice:   unitPrice,
+			Total:       roundCents(unitPrice * float64(item.Quantity)),
+		}
+		if promotion, ok := applied[item.Sku]; ok {
+			line.Promotion = promotion.label()
+		}
+		quote.Items = append(quote.Items, line)
+		quote.Subtotal += line.Total
+	}
+
+	var problems []string
+	if len(unknown) > 0 {
+		problems = append(problems, "unknown SKUs "+strings.Join(unknown, ", "))
+	}
+	if len(unpriced) > 0 {
+		problems = append(problems, "unpriced SKUs "+strings.Join(unpriced, ", "))
+	}
+	if len(problems) > 0 {
+		return Quote{}, fmt.Errorf("%w: %s", ErrUnquotable, strings.Join(problems, "; "))
+	}
+
+	quote.Subtotal = roundCents(quote.Subtotal)
+	quote.Tax = roundCents(quote.Subtotal * config.TaxRate)
+	quote.Total = roundCents(quote.Subtotal + quote.Tax)
+
+	db, err := openDB()
+	if err != nil {
+		return Quote{}, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(quotesBucketName))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		quote.Number = fmt.Sprintf("Q-%06d", seq)
+
+		data, err := json.Marshal(quote)
+		if err != nil {
+			return fmt.Errorf("error marshaling quote: %v", err)
+		}
+		return bucket.Put([]byte(quote.ID), data)
+	})
+
+	if err != nil {
+		return Quote{}, fmt.Errorf("error saving quote: %v", err)
+	}
+
+	return quote, nil
+}
+
+// GetQuote returns a persisted quote
+func GetQuote(id string) (*Quote, error) {
+	quote, err := GetEntity[Quote](quotesBucketName, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: no quote %s", ErrNotFound, id)
+	}
+	return quote, err
+}
+
+// formatMoney formats an amount with thousands separators, e.g. 12,345.60
+func formatMoney(amount float64) string {
+	s := strconv.FormatFloat(amount, 'f', 2, 64)
+	whole, cents, _ := strings.Cut(s, ".")
+	sign := ""
+	if strings.HasPrefix(whole, "-") {
+		sign, whole = "-", whole[1:]
+	}
+
+	var b strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	return sign + b.String() + "." + cents
+}
+
+// renderQuotePDF lays out a quote for the customer
+func renderQuotePDF(quote Quote) []byte {
+	const size = 10
+	doc := pdf.New()
+	row := func(font, sku, description, quantity, unitPrice, total string) {
+		doc.Line(font, size, fmt.Sprintf("%-12.12s %-33.33s %6s %15s %15s", sku, description, quantity, unitPrice, total))
+	}
+
+	doc.Line(pdf.Bold, 16, "Cotización "+quote.Number)
+	doc.Space(6)
+	doc.Line(pdf.Regular, size, "Fecha:        "+quote.CreatedAt.Format("02/01/2006"))
+	doc.Line(pdf.Regular, size, "Válida hasta: "+quote.ValidUntil.Format("02/01/2006"))
+	doc.Space(size)
+
+	doc.Line(pdf.Bold, size, "Cliente")
+	for _, line := range []string{quote.Customer.Name, quote.Customer.Company, quote.Customer.Email, quote.Customer.Phone} {
+		if line != "" {
+			doc.Line(pdf.Regular, size, line)
+		}
+	}
+	doc.Space(size)
+
+	row(pdf.Bold, "Clave", "Descripción", "Cant.", "Precio unit.", "Importe")
+	doc.Line(pdf.Regular, size, strings.Repeat("-", pdf.Columns(size)))
+	for _, item := range quote.Items {
+		row(pdf.Regular, item.Sku, item.Description, strconv.Itoa(item.Quantity), formatMoney(item.UnitPrice), formatMoney(item.Total))
+	}
+	doc.Line(pdf.Regular, size, strings.Repeat("-", pdf.Columns(size)))
+
+	total := func(font, label string, amount float64) {
+		doc.Line(font, size, fmt.Sprintf("%69s %15s", label, formatMoney(amount)))
+	}
+	total(pdf.Regular, "Subtotal", quote.Subtotal)
+	total(pdf.Regular, "IVA", quote.Tax)
+	total(pdf.Bold, "Total "+quote.Currency, quote.Total)
+
+	if quote.Notes != "" {
+		doc.Space(size)
+		doc.Line(pdf.Bold, size, "Notas")
+		for _, line := range strings.Split(quote.Notes, "\n") {
+			doc.Line(pdf.Regular, size, line)
+		}
+	}
+
+	var buf bytes.Buffer
+	doc.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// createQuoteHandler prices and persists a quote from a
+// {"customer": {"name": ...}, "items": [{"sku": ..., "quantity": 2}], "notes": ...} body,
+// for the price tier of the API key or ?tier= if any
+func (s *server) createQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	tier, ok := s.requestTier(w, r)
+	if !ok {
+		return
+	}
+
+	// Quote future-dated orders with the promotions in effect on ?date=
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var request QuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	request.Customer.Name = strings.TrimSpace(request.Customer.Name)
+	if request.Customer.Name == "" {
+		http.Error(w, "customer.name is required", http.StatusBadRequest)
+		return
+	}
+	if len(request.Items) == 0 || len(request.Items) > maxQuoteItems {
+		http.Error(w, fmt.Sprintf("a quote needs between 1 and %d items", maxQuoteItems), http.StatusBadRequest)
+		return
+	}
+	for i, item := range request.Items {
+		request.Items[i].Sku = strings.TrimSpace(item.Sku)
+		if request.Items[i].Sku == "" || item.Quantity <= 0 {
+			http.Error(w, fmt.Sprintf("item %d needs a sku and a positive quantity", i+1), http.StatusBadRequest)
+			return
+		}
+		request.Items[i].Sku = lookupSKU(request.Items[i].Sku)
+	}
+
+	quote, err := CreateQuote(s.config.Quotes, tier, request, date)
+	if errors.Is(err, ErrUnquotable) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating quote: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/quotes/"+quote.ID)
+	writeJSON(w, http.StatusCreated, quote)
+}
+
+// quoteHandler serves a persisted quote
+func (s *server) quoteHandler(w http.ResponseWriter, r *http.Request) {
+	quote, err := GetQuote(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching quote: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quote)
+}
+
+// quotePDFHandler serves a persisted quote as PDF
+func (s *server) quotePDFHandler(w http.ResponseWriter, r *http.Request) {
+	quote, err := GetQuote(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching quote: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", quote.Number+".pdf"))
+	w.Write(renderQuotePDF(*quote))
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig limits the requests of each consumer with a token bucket, so a
+// client stuck in a loop can't keep the store busy for everyone else
+type RateLimitConfig struct {
+	Rate       float64            // Requests per second of each API key, or client IP without a valid key (0 disables)
+	Burst      int                // Requests allowed at once before Rate applies
+	KeyRates   map[string]float64 // Rates by API key fingerprint, overriding Rate; 0 exempts the key
+	TrustProxy bool               // Tell clients without a key apart by the last X-Forwarded-For address
+}
+
+// rateLimiterIdle is how long a consumer's bucket is kept without requests. A full
+// bucket is the same as a new one, so dropping it loses nothing.
+const rateLimiterIdle = 10 * time.Minute
+
+// ParseKeyRates parses comma separated fingerprint=rate pairs, e.g. "4573a839ffe2=50"
+func ParseKeyRates(s string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fingerprint, value, found := strings.Cut(entry, "=")
+		fingerprint = strings.TrimSpace(fingerprint)
+		if !found || fingerprint == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected fingerprint=rate", entry)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("rate of %s must be a number of at least 0, got %q", fingerprint, value)
+		}
+		rates[fingerprint] = limit
+	}
+	return rates, nil
+}
+
+// rateLimiter holds a token bucket per consumer
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*consumerBucket
+	lastSweep time.Time
+}
+
+type consumerBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{config: config, buckets: make(map[string]*consumerBucket), lastSweep: time.Now()}
+}
+
+// reserve takes a token from the consumer's bucket, returning how long to wait
+// before retrying when there is none
+func (l *rateLimiter) reserve(consumer string, limit float64) (time.Duration, bool) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimiterIdle {
+		for id, bucket := range l.buckets {
+			if now.Sub(bucket.lastSeen) > rateLimiterIdle {
+				delete(l.buckets, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[consumer]
+	if !ok {
+		bucket = &consumerBucket{limiter: rate.NewLimiter(rate.Limit(limit), max(l.config.Burst, 1))}
+		l.buckets[consumer] = bucket
+	}
+	bucket.lastSeen = now
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// clientIP returns the address of the client, the one the last proxy saw when
+// trusted
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRate wraps a handler to answer 429 with Retry-After to consumers over their rate
+func (s *server) limitRate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next(w, r)
+			return
+		}
+
+		consumer, _ := s.identify(r)
+		limit := s.limiter.config.Rate
+		switch consumer {
+		case consumerAnonymous, consumerInvalid:
+			consumer = "ip:" + s.limiter.clientIP(r)
+		default:
+			if keyRate, ok := s.limiter.config.KeyRates[consumer]; ok {
+				limit = keyRate
+			}
+		}
+		if limit == 0 {
+			next(w, r)
+			return
+		}
+
+		if delay, ok := s.limiter.reserve(consumer, limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())+1))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const rawPagesBucketName = "raw_pages"
+
+// rawPageKey builds the key of a raw page, zero padded so pages sort numerically
+func rawPageKey(bucketName string, page int) []byte {
+	return []byte(fmt.Sprintf("%s/%06d", bucketName, page))
+}
+
+// saveRawPage stores the gzip compressed upstream payload of the page fetched in position page
+func saveRawPage(db *store, bucketName string, page int, payload []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.ModTime = time.Now() // Dates the page for retention
+	if _, err := zw.Write(payload); err != nil {
+		return fmt.Errorf("error compressing raw page: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error compressing raw page: %v", err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(rawPagesBucketName))
+		if err != nil {
+			return err
+		}
+		key := rawPageKey(bucketName, page)
+		sealed, err := sealValue(rawPagesBucketName, key, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, sealed)
+	})
+}
+
+// pruneRawPages removes raw pages of a bucket numbered after lastPage,
+// left over from earlier runs when the catalog had more pages
+func pruneRawPages(db *store, bucketName string, lastPage int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(rawPagesBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(rawPageKey(bucketName, lastPage+1)); k != nil; k, _ = cursor.Next() {
+			if _, ok := parseRawPageKey(k, bucketName); !ok {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// parseRawPageKey returns the page number of a raw page key belonging to bucketName
+func parseRawPageKey(key []byte, bucketName string) (int, bool) {
+	pageStr, found := strings.CutPrefix(string(key), bucketName+"/")
+	if !found {
+		return 0, false
+	}
+
+	page, err := strconv.Atoi(pageStr)
+	if err != nil {
+		return 0, false
+	}
+
+	return page, true
+}
+
+// decompressRawPage returns the original upstream payload of a stored raw page
+func decompressRawPage(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing raw page: %v", err)
+	}
+	defer zr.Close()
+
+	payload, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing raw page: %v", err)
+	}
+
+	return payload, nil
+}
+
+// RetransformEntities rebuilds the bucket of a fetcher by running Transform over its
+// stored raw pages, without contacting the upstream API. The bucket is rewritten in a
+// single transaction, so a failed replay leaves the previous data untouched. Records
+// missing from the pages are removed; both edits and removals reach the change feed
+// and the journal.
+// Returns the number of entities processed.
+func RetransformEntities[T DatabaseEntity](config APIConfig, fetcher Fetchable[T]) (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	run, err := newRun(SourceRetransform)
+	if err != nil {
+		return 0, err
+	}
+
+	bucketName := fetcher.GetBucketName()
+	total := 0
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		rawBucket := tx.Bucket([]byte(rawPagesBucketName))
+		if rawBucket == nil {
+			return fmt.Errorf("no raw pages stored for %s: enable STORE_RAW_PAGES and run a sync first", bucketName)
+		}
+
+		// Decode every stored page before touching the entity bucket
+		var pages []*GenericAPIResponse[T]
+		cursor := rawBucket.Cursor()
+		for k, v := cursor.Seek(rawPageKey(bucketName, 0)); k != nil; k, v = cursor.Next() {
+			page, ok := parseRawPageKey(k, bucketName)
+			if !ok {
+				break
+			}
+
+			stored, err := openValue(rawPagesBucketName, k, v)
+			if err != nil {
+				return err
+			}
+			payload, err := decompressRawPage(stored)
+			if err != nil {
+				return fmt.Errorf("page %d: %v", page, err)
+			}
+
+			var response GenericAPIResponse[T]
+			if err := json.Unmarshal(payload, &response); err != nil {
+				return fmt.Errorf("error unmarshaling raw %s page %d: %v", bucketName, page, err)
+			}
+			pages = append(pages, &response)
+		}
+
+		if len(pages) == 0 {
+			return fmt.Errorf("no raw pages stored for %s: enable STORE_RAW_PAGES and run a sync first", bucketName)
+		}
+
+		bucket, err := createRecords(tx, bucketName)
+		if err != nil {
+			return err
+		}
+
+		replayed := make(map[string]bool)
+		for _, response := range pages {
+			entities, err := scopeEntities(tx, config.Scope, bucketName, response.Entities, fetcher.Transform)
+			if err != nil {
+				return err
+			}
+			if _, err := putEntities(tx, run, bucketName, entities, fetcher.Transform, config.Validation); err != nil {
+				return err
+			}
+			for _, entity := range entities {
+				replayed[recordKey(fetcher.Transform(entity))] = true
+			}
+			total += len(entities)
+		}
+
+		// Drop records that are no longer in the stored pages, or outside SYNC_SCOPE
+		var removed []string
+		err = bucket.ForEach(func(k, v []byte) error {
+			if !replayed[string(k)] {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sku := range removed {
+			if err := deleteRecord(tx, run, bucket, bucketName, sku); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Retransformed %s as journal run %s", bucketName, run.ID)
+	return total, nil
+}
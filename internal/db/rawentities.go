@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// rawEntitiesBucketName holds the upstream JSON of every synced record, keyed by
+// rawEntityKey, so fields not mapped yet can be served as they were received
+const rawEntitiesBucketName = "raw_entities"
+
+// rawEntityKey builds the key of a raw record: its SKU first, so the records of every
+// bucket for a SKU are adjacent
+func rawEntityKey(sku, bucketName string) []byte {
+	return []byte(sku + "\x00" + bucketName)
+}
+
+// upstreamEntities splits the entities of an upstream page into their raw JSON
+func upstreamEntities(payload []byte) ([]json.RawMessage, error) {
+	var page struct {
+		Entities []json.RawMessage `json:"entities"`
+	}
+	if err := json.Unmarshal(payload, &page); err != nil {
+		return nil, fmt.Errorf("error unmarshaling raw entities: %v", err)
+	}
+	return page.Entities, nil
+}
+
+// saveRawEntities stores the upstream JSON of every entity of a page under the key its
+// transformed record is stored under. Rejected records keep theirs too, as the raw
+// record is often what explains the rejection. Records outside scope are left out.
+func saveRawEntities[T DatabaseEntity](db *store, bucketName string, response *GenericAPIResponse[T], transformer func(T) DatabaseEntity, scope SyncScope) error {
+	payload := response.Original
+	if payload == nil {
+		payload = response.Raw
+	}
+	entities, err := upstreamEntities(payload)
+	if err != nil {
+		return err
+	}
+	if len(entities) != len(response.Entities) {
+		return fmt.Errorf("page holds %d raw entities for %d decoded ones", len(entities), len(response.Entities))
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(rawEntitiesBucketName))
+		if err != nil {
+			return err
+		}
+		for i, entity := range response.Entities {
+			record := transformer(entity)
+			if in, err := scope.includesRecord(tx, bucketName, record); err != nil {
+				return err
+			} else if !in {
+				continue
+			}
+			key := rawEntityKey(recordKey(record), bucketName)
+			sealed, err := sealValue(rawEntitiesBucketName, key, entities[i])
+			if err != nil {
+				return fmt.Errorf("error encrypting raw entity %s: %v", entity.GetSKU(), err)
+			}
+			if err := bucket.Put(key, sealed); err != nil {
+				return fmt.Errorf("error saving raw entity %s: %v", entity.GetSKU(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// requestedRaw returns whether ?include= asks for the raw upstream records
+func requestedRaw(r *http.Request) (bool, error) {
+	raw := false
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		switch include = strings.TrimSpace(include); include {
+		case "":
+		case "raw":
+			raw = true
+		default:
+			return false, fmt.Errorf("unknown include %q (available: raw)", include)
+		}
+	}
+	return raw, nil
+}
+
+// attachRawEntities sets the raw upstream records of each product, by the bucket they
+// were synced into (e.g. products and prices), without the fields hidden by profile.
+// Products synced without STORE_RAW_ENTITIES have none.
+func attachRawEntities(response []ProductResponseData, profile *ResponseProfile) error {
+	return catalogView(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(rawEntitiesBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for i := range response {
+			prefix := []byte(response[i].Clave + "\x00")
+			for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+				data, err := openValue(rawEntitiesBucketName, k, v)
+				if err != nil {
+					return err
+				}
+				record := append(json.RawMessage(nil), data...)
+				if profile != nil {
+					redacted, err := profile.redact(record)
+					if err != nil {
+						return fmt.Errorf("error redacting raw records of %s: %v", response[i].Clave, err)
+					}
+					if record, err = json.Marshal(redacted); err != nil {
+						return err
+					}
+				}
+				if response[i].Raw == nil {
+					response[i].Raw = make(map[string]json.RawMessage)
+				}
+				response[i].Raw[string(k[len(prefix):])] = record
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Syncer is a registered fetcher with its entity type erased, so fetchers of
+// different types can be listed, initialized and scheduled together
+type Syncer interface {
+	Name() string
+	Supplier() string
+	BucketName() string
+	Sync(ctx context.Context, config APIConfig) error
+	Retransform(config APIConfig) (int, error)
+	Probe(ctx context.Context, config APIConfig) error
+}
+
+// syncedHook is implemented by fetchers acting on their records once a sync of them
+// succeeds, e.g. inventory checking stock alerts
+type syncedHook interface {
+	synced(config APIConfig)
+}
+
+type fetcherSyncer[T DatabaseEntity] struct {
+	supplier string
+	name     string
+	fetcher  Fetchable[T]
+}
+
+func (fs fetcherSyncer[T]) Name() string       { return fs.name }
+func (fs fetcherSyncer[T]) Supplier() string   { return fs.supplier }
+func (fs fetcherSyncer[T]) BucketName() string { return fs.fetcher.GetBucketName() }
+
+// Sync fetches every page with the settings of the fetcher's supplier. With
+// SkipUnchanged it returns errNoChanges instead when the endpoint reports the catalog
+// version of the last successful sync.
+func (fs fetcherSyncer[T]) Sync(ctx context.Context, config APIConfig) error {
+	config = config.For(fs.supplier)
+	startedAt := time.Now()
+	var last SyncStatus
+	if config.SkipUnchanged {
+		statuses, err := GetSyncStatuses([]Syncer{fs})
+		if err != nil {
+			return fmt.Errorf("error reading sync status for %s: %v", fs.name, err)
+		}
+		last = statuses[0]
+	}
+	if err := recordSyncStart(fs.name, config.Customer, startedAt); err != nil {
+		log.Printf("Error recording sync status for %s: %v", fs.name, err)
+	}
+
+	var version string
+	if config.SkipUnchanged {
+		var unchanged bool
+		if unchanged, version = fs.unchangedSince(ctx, config, last); unchanged {
+			observeSync(config.Customer, fs.name, SyncStateSkipped, startedAt)
+			if err := recordSyncSkipped(fs.name, time.Now()); err != nil {
+				return fmt.Errorf("error recording sync status for %s: %v", fs.name, err)
+			}
+			return errNoChanges
+		}
+	}
+
+	// Even a failed sync may have written some pages
+	if !invalidationDeferred(ctx) {
+		defer invalidateCache()
+	}
+
+	if err := FetchAllEntities(ctx, config, fs.fetcher); err != nil {
+		result := SyncStateFailed
+		record := func() error { return recordSyncFailure(fs.name, time.Now(), err) }
+		switch {
+		case ctx.Err() != nil:
+			result = SyncStateCanceled
+			record = func() error { return recordSyncCanceled(fs.name) }
+		case errors.Is(err, ErrUnauthorized):
+			result = SyncStateUnauthorized
+			record = func() error {
+				first, statusErr := recordSyncUnauthorized(fs.name, time.Now(), err)
+				if first {
+					alertCredentialsRejected(fs.supplier, config.Customer, fs.name, err)
+				}
+				return statusErr
+			}
+		case errors.Is(err, ErrUpstreamMaintenance):
+			result = SyncStateDeferred
+			until, _ := DeferredUntil(err)
+			record = func() error { return recordSyncDeferred(fs.name, until, err) }
+		}
+		observeSync(config.Customer, fs.name, result, startedAt)
+		if statusErr := record(); statusErr != nil {
+			log.Printf("Error recording sync status for %s: %v", fs.name, statusErr)
+		}
+		return err
+	}
+
+	observeSync(config.Customer, fs.name, SyncStateOK, startedAt)
+	if err := recordSyncSuccess(fs.name, time.Now(), version); err != nil {
+		return fmt.Errorf("error recording sync status for %s: %v", fs.name, err)
+	}
+	if hook, ok := fs.fetcher.(syncedHook); ok {
+		hook.synced(config)
+	}
+
+	return nil
+}
+
+// Probe requests a single record to check the endpoint answers with our credentials
+func (fs fetcherSyncer[T]) Probe(ctx context.Context, config APIConfig) error {
+	config = config.For(fs.supplier)
+	config.Limit = 1
+	_, err := fs.fetcher.FetchPage(ctx, config, 1)
+	return err
+}
+
+func (fs fetcherSyncer[T]) Retransform(config APIConfig) (int, error) {
+	defer invalidateCache()
+	return RetransformEntities(config.For(fs.supplier), fs.fetcher)
+}
+
+// registry holds every known fetcher in registration order
+var registry = struct {
+	order        []string
+	syncers      map[string]Syncer
+	optional     map[string]bool     // Fetchers only run when listed in API_FETCHERS
+	dependencies map[string][]string // Fetchers each fetcher waits for, see DependsOn
+}{syncers: make(map[string]Syncer), optional: make(map[string]bool), dependencies: make(map[string][]string)}
+
+// Register adds an Ashley fetcher to the registry under the given name.
+// Registration order is the order fetchers start in during a sync, after the ones
+// they depend on.
+func Register[T DatabaseEntity](name string, fetcher Fetchable[T]) {
+	register(AshleySupplier, name, fetcher)
+}
+
+// RegisterOptional adds an Ashley fetcher that only runs when named in API_FETCHERS,
+// for endpoints not every account has access to
+func RegisterOptional[T DatabaseEntity](name string, fetcher Fetchable[T]) {
+	register(AshleySupplier, name, fetcher)
+	registry.optional[name] = true
+}
+
+func register[T DatabaseEntity](supplier, name string, fetcher Fetchable[T]) {
+	if _, exists := registry.syncers[name]; exists {
+		panic(fmt.Sprintf("fetcher %q already registered", name))
+	}
+
+	registry.order = append(registry.order, name)
+	registry.syncers[name] = fetcherSyncer[T]{supplier: supplier, name: name, fetcher: fetcher}
+}
+
+func init() {
+	Register[Product]("products", ProductFetcher{})
+	Register[Price]("prices", PriceFetcher{})
+	RegisterOptional[Inventory]("inventory", InventoryFetcher{})
+	RegisterOptional[Contract]("contracts", ContractFetcher{})
+	RegisterOptional[Promotion]("promotions", PromotionFetcher{})
+	DependsOn("inventory", "products")
+
+	AddStage("products", PhaseNormalize, "trim", StageFor(trimStrings))
+}
+
+// RegisteredFetchers returns the names of all registered fetchers
+func RegisteredFetchers() []string {
+	return append([]string(nil), registry.order...)
+}
+
+// EnabledFetchers resolves a comma separated list of fetcher names (e.g. "products,prices")
+// into syncers, in registration order moved after their dependencies. An empty list enables
+// every registered fetcher except the optional ones.
+func EnabledFetchers(names string) ([]Syncer, error) {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := registry.syncers[name]; !ok {
+			known := RegisteredFetchers()
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown fetcher %q (registered: %s)", name, strings.Join(known, ", "))
+		}
+		enabled[name] = true
+	}
+
+	var syncers []Syncer
+	for _, name := range registry.order {
+		if enabled[name] || (len(enabled) == 0 && !registry.optional[name]) {
+			syncers = append(syncers, registry.syncers[name])
+		}
+	}
+
+	return orderByDependencies(syncers), nil
+}
+
+// SyncAll runs every fetcher in order, config.Parallelism of them at once, each once
+// the fetchers it depends on finished (see DependsOn, and SyncScope for the products
+// a scoped sync waits for). A failing fetcher does not stop
+// the ones after it, so one flaky endpoint can't starve the other datasets; only the
+// fetchers depending on it are skipped. The returned error joins every failure.
+// Canceling ctx skips the fetchers not yet started, and rejected credentials or a
+// gateway under maintenance skip the remaining fetchers of that supplier.
+// When every fetcher succeeds the catalog is snapshotted as a new version. A sync
+// resuming a failed one skips the fetchers that completed and continues the others
+// from their checkpoints. Fetchers skipped for an unchanged catalog count as succeeded.
+func SyncAll(ctx context.Context, config APIConfig, fetchers []Syncer) error {
+	var errs []error
+	rejected := make(map[string]bool)     // Suppliers whose credentials were rejected
+	maintenance := make(map[string]error) // Suppliers under maintenance, with the error deferring them
+	skipped := 0                          // Fetchers whose catalog reported no changes
+
+	// A fresh sync starts every fetcher over
+	if !resuming(ctx) {
+		if err := clearCheckpoints(fetchers); err != nil {
+			return fmt.Errorf("error clearing sync checkpoints: %v", err)
+		}
+	}
+
+	// Fetchers running in parallel rebuild the merged catalog once, after the last one,
+	// rather than each from a half synced catalog
+	parallel := max(config.Parallelism, 1)
+	if parallel > 1 {
+		ctx = withDeferredInvalidation(ctx)
+		defer invalidateCache()
+	}
+	startedAt := time.Now()
+
+	type result struct {
+		fetcher Syncer
+		err     error
+	}
+	results := make(chan result)
+	inSync := make(map[string]bool, len(fetchers))
+	for _, fetcher := range fetchers {
+		inSync[fetcher.Name()] = true
+	}
+	finished := make(map[string]bool, len(fetchers)) // Whether each finished fetcher succeeded
+	pending := slices.Clone(fetchers)
+	running := 0
+
+	for len(pending) > 0 || running > 0 {
+		if err := ctx.Err(); err != nil && len(pending) > 0 {
+			log.Printf("Sync canceled before %s fetch", pending[0].Name())
+			errs = append(errs, err)
+			pending = nil
+		}
+
+		// Start the fetchers whose dependencies finished, in order, while slots are free
+		for i := 0; i < len(pending) && running < parallel; {
+			fetcher := pending[i]
+			dependencies := append(Dependencies(fetcher.Name()), config.Scope.dependencies(fetcher)...)
+			ready, failed := dependenciesDone(dependencies, inSync, finished)
+			if !ready {
+				i++
+				continue
+			}
+			pending = slices.Delete(pending, i, i+1)
+
+			if failed != "" {
+				log.Printf("Skipping %s fetch, it depends on %s, which failed", fetcher.Name(), failed)
+				finished[fetcher.Name()] = false
+				continue
+			}
+			if rejected[fetcher.Supplier()] {
+				log.Printf("Skipping %s fetch, %s rejected our credentials", fetcher.Name(), fetcher.Supplier())
+				finished[fetcher.Name()] = false
+				continue
+			}
+			if err := maintenance[fetcher.Supplier()]; err != nil {
+				log.Printf("Skipping %s fetch, %s is under maintenance", fetcher.Name(), fetcher.Supplier())
+				until, _ := DeferredUntil(err)
+				if statusErr := recordSyncDeferred(fetcher.Name(), until, err); statusErr != nil {
+					log.Printf("Error recording sync status for %s: %v", fetcher.Name(), statusErr)
+				}
+				finished[fetcher.Name()] = false
+				continue
+			}
+			if done, err := completedBeforeResume(ctx, fetcher); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", fetcher.Name(), err))
+				finished[fetcher.Name()] = false
+				continue
+			} else if done {
+				log.Printf("Skipping %s fetch, it completed before the sync was interrupted", fetcher.Name())
+				finished[fetcher.Name()] = true
+				continue
+			}
+
+			running++
+			go func() {
+				log.Printf("Starting %s fetch...", fetcher.Name())
+				results <- result{fetcher: fetcher, err: fetcher.Sync(ctx, config)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		name := r.fetcher.Name()
+		switch {
+		case errors.Is(r.err, errNoChanges):
+			log.Printf("%s %v", name, r.err)
+			skipped++
+			finished[name] = true
+		case r.err != nil:
+			log.Printf("Error fetching %s: %v", name, r.err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, r.err))
+			finished[name] = false
+			// The supplier's other fetchers share the credentials and would be rejected too
+			if errors.Is(r.err, ErrUnauthorized) {
+				rejected[r.fetcher.Supplier()] = true
+			}
+			// And would find the gateway under maintenance too; the resume runs them
+			if errors.Is(r.err, ErrUpstreamMaintenance) {
+				maintenance[r.fetcher.Supplier()] = r.err
+			}
+		default:
+			log.Printf("%s fetched successfully!", name)
+			finished[name] = true
+		}
+	}
+	if parallel > 1 {
+		log.Printf("Ran %d fetchers, %d at a time, in %v", len(fetchers), parallel, time.Since(startedAt).Round(time.Millisecond))
+	}
+
+	// A sync where every fetcher succeeded becomes a new catalog version and is served,
+	// unless nothing changed since the current one
+	if len(errs) == 0 {
+		if skipped < len(fetchers) {
+			snapshotAfterSync(fetchers, config.KeepVersions)
+		}
+		similarAfterSync()
+		refreshServingFile()
+		if err := clearCheckpoints(fetchers); err != nil {
+			log.Printf("Error clearing sync checkpoints: %v", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const replacementsBucketName = "replacements"
+
+// maxReplacementHops bounds how far replacement chains are followed, guarding against cycles
+const maxReplacementHops = 10
+
+// ReplacementOverride is a manually maintained "replaced-by" relationship.
+// Overrides take precedence over the replacement data pulled from Ashley.
+type ReplacementOverride struct {
+	Sku        string    `json:"sku"`
+	ReplacedBy string    `json:"replacedBy"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func (r ReplacementOverride) GetSKU() string { return r.Sku }
+
+// ReplacementResponseData describes the successor of a SKU
+type ReplacementResponseData = api.Replacement
+
+// GetReplacementOverrides returns the manual replacements keyed by SKU
+func GetReplacementOverrides() (map[string]string, error) {
+	overrides, err := GetAllEntities[ReplacementOverride](replacementsBucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	replacements := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		replacements[override.Sku] = override.ReplacedBy
+	}
+	return replacements, nil
+}
+
+// SetReplacementOverride stores a manual replacement for a SKU
+func SetReplacementOverride(sku, replacedBy string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	data, err := json.Marshal(ReplacementOverride{Sku: sku, ReplacedBy: replacedBy, UpdatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("error marshaling replacement for %s: %v", sku, err)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(replacementsBucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(sku), data)
+	})
+}
+
+// DeleteReplacementOverride removes the manual replacement of a SKU
+func DeleteReplacementOverride(sku string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(replacementsBucketName))
+		if bucket == nil || bucket.Get([]byte(sku)) == nil {
+			return fmt.Errorf("%w: no replacement override for %s", ErrNotFound, sku)
+		}
+		return bucket.Delete([]byte(sku))
+	})
+}
+
+// directReplacement returns the immediate successor of a SKU and where it came from
+func directReplacement(sku string, overrides map[string]string, lookup func(sku string) string) (string, string) {
+	if replacedBy, ok := overrides[sku]; ok {
+		return replacedBy, "override"
+	}
+	if replacedBy := lookup(sku); replacedBy != "" {
+		return replacedBy, "ashley"
+	}
+	return "", ""
+}
+
+// resolveReplacement follows the replacement chain of a SKU to its final successor
+func resolveReplacement(sku string, overrides map[string]string, lookup func(sku string) string) ReplacementResponseData {
+	response := ReplacementResponseData{Clave: sku, Cadena: []string{}}
+	seen := map[string]bool{sku: true}
+
+	current := sku
+	for hop := 0; hop < maxReplacementHops; hop++ {
+		next, origin := directReplacement(current, overrides, lookup)
+		if next == "" || seen[next] {
+			break
+		}
+		if hop == 0 {
+			response.Origen = origin
+		}
+		response.Cadena = append(response.Cadena, next)
+		seen[next] = true
+		current = next
+	}
+
+	if len(response.Cadena) > 0 {
+		response.Reemplazo = response.Cadena[len(response.Cadena)-1]
+	}
+	return response
+}
+
+// productReplacementLookup returns a lookup of the Ashley replacement SKU of stored products,
+// served from the already loaded products when possible
+func productReplacementLookup(products map[string]ProductRequestData) func(sku string) string {
+	return func(sku string) string {
+		if product, ok := products[sku]; ok {
+			return product.ReplacementSku
+		}
+		product, err := GetProduct(sku)
+		if err != nil {
+			return ""
+		}
+		return product.ReplacementSku
+	}
+}
+
+// replacementHandler serves the successor of a SKU
+func (s *server) replacementHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+
+	overrides, err := GetReplacementOverrides()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching replacements: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := resolveReplacement(sku, overrides, productReplacementLookup(nil))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// setReplacementHandler stores a manual replacement from a {"replacedBy": "..."} body
+func (s *server) setReplacementHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+
+	var body struct {
+		ReplacedBy string `json:"replacedBy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if body.ReplacedBy = strings.TrimSpace(body.ReplacedBy); body.ReplacedBy != "" {
+		body.ReplacedBy = lookupSKU(body.ReplacedBy)
+	}
+	if body.ReplacedBy == "" || body.ReplacedBy == sku {
+		http.Error(w, "replacedBy must be a different, non-empty SKU", http.StatusBadRequest)
+		return
+	}
+
+	if err := SetReplacementOverride(sku, body.ReplacedBy); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving replacement: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteReplacementHandler removes a manual replacement
+func (s *server) deleteReplacementHandler(w http.ResponseWriter, r *http.Request) {
+	err := DeleteReplacementOverride(lookupSKU(r.PathValue("sku")))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting replacement: %v", err), http.StatusInternalServerError)
+		return
+	}
+	invalidateCache()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+// RetentionConfig is the maximum age of each kind of accumulated data. A zero age
+// keeps that kind forever.
+type RetentionConfig struct {
+	Jobs         time.Duration // Finished sync jobs
+	Changes      time.Duration // Change feed entries
+	Versions     time.Duration // Catalog versions (the newest one is always kept)
+	RawPages     time.Duration // Raw upstream pages
+	Quarantine   time.Duration // Quarantined records
+	Reservations time.Duration // Inventory reservations, counted from their expiry
+	PriceHistory time.Duration // Price points, counted from when a newer price replaced them
+	Journal      time.Duration // Journal entries of applied changes
+}
+
+var retentionDeletedTotal = metrics.NewCounter("ashley_retention_deleted_total",
+	"Records removed by the retention job", "kind")
+
+// ApplyRetention deletes data older than its configured age and returns the number
+// of records deleted per kind
+func ApplyRetention(config RetentionConfig) (map[string]int, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	deleted := make(map[string]int)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		sweeps := []struct {
+			kind   string
+			bucket string
+			maxAge time.Duration
+			expiry func(k, v []byte) (time.Time, error)
+		}{
+			{"jobs", jobsBucketName, config.Jobs, jobExpiry},
+			{"changes", changesBucketName, config.Changes, changeExpiry},
+			{"raw_pages", rawPagesBucketName, config.RawPages, rawPageExpiry},
+			{"quarantine", quarantineBucketName, config.Quarantine, quarantineExpiry},
+			{"reservations", reservationsBucketName, config.Reservations, reservationExpiry},
+			{"journal", journalBucketName, config.Journal, journalExpiry},
+		}
+
+		for _, sweep := range sweeps {
+			if sweep.maxAge <= 0 {
+				continue
+			}
+			count, err := deleteOlderThan(tx, sweep.bucket, now.Add(-sweep.maxAge), sweep.expiry)
+			if err != nil {
+				return fmt.Errorf("error applying %s retention: %v", sweep.kind, err)
+			}
+			deleted[sweep.kind] = count
+		}
+
+		if config.Versions > 0 {
+			count, err := expireVersions(tx, now.Add(-config.Versions))
+			if err != nil {
+				return fmt.Errorf("error applying versions retention: %v", err)
+			}
+			deleted["versions"] = count
+		}
+
+		if config.PriceHistory > 0 {
+			count, err := expirePriceHistory(tx, now.Add(-config.PriceHistory))
+			if err != nil {
+				return fmt.Errorf("error applying price history retention: %v", err)
+			}
+			deleted["price_history"] = count
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, count := range deleted {
+		retentionDeletedTotal.Add(float64(count), kind)
+	}
+
+	return deleted, nil
+}
+
+// deleteOlderThan removes the records of a bucket whose timestamp is before cutoff.
+// Records without a known timestamp are kept.
+func deleteOlderThan(tx *bolt.Tx, bucketName string, cutoff time.Time, expiry func(k, v []byte) (time.Time, error)) (int, error) {
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return 0, nil
+	}
+
+	var expired [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		at, err := expiry(k, v)
+		if err != nil {
+			return err
+		}
+		if !at.IsZero() && at.Before(cutoff) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := bucket.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// jobExpiry dates finished jobs by when they finished; queued and running jobs never expire
+func jobExpiry(k, v []byte) (time.Time, error) {
+	var job Job
+	if err := json.Unmarshal(v, &job); err != nil {
+		return time.Time{}, err
+	}
+	if !job.finished() || job.FinishedAt == nil {
+		return time.Time{}, nil
+	}
+	return *job.FinishedAt, nil
+}
+
+func changeExpiry(k, v []byte) (time.Time, error) {
+	var change ChangeRecord
+	if err := json.Unmarshal(v, &change); err != nil {
+		return time.Time{}, err
+	}
+	return change.At, nil
+}
+
+func quarantineExpiry(k, v []byte) (time.Time, error) {
+	v, err := openValue(quarantineBucketName, k, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var record QuarantineRecord
+	if err := json.Unmarshal(v, &record); err != nil {
+		return time.Time{}, err
+	}
+	return record.At, nil
+}
+
+// rawPageExpiry dates raw pages by the modification time in their gzip header
+func rawPageExpiry(k, v []byte) (time.Time, error) {
+	v, err := openValue(rawPagesBucketName, k, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading raw page %s: %v", k, err)
+	}
+	defer zr.Close()
+	return zr.Header.ModTime, nil
+}
+
+// expireVersions removes catalog versions created before cutoff, except the newest one
+func expireVersions(tx *bolt.Tx, cutoff time.Time) (int, error) {
+	index := tx.Bucket([]byte(versionIndexBucketName))
+	versions := tx.Bucket([]byte(versionsBucketName))
+	if index == nil || versions == nil {
+		return 0, nil
+	}
+
+	var expired [][]byte
+	c := index.Cursor()
+	newest, _ := c.Last()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if bytes.Equal(k, newest) {
+			break
+		}
+
+		var version CatalogVersion
+		if err := json.Unmarshal(v, &version); err != nil {
+			return 0, err
+		}
+		if version.CreatedAt.Before(cutoff) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+	}
+
+	for _, key := range expired {
+		if err := versions.Delete(key); err != nil {
+			return 0, err
+		}
+		if err := index.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// RetentionJob returns the job applying the retention policy
+func RetentionJob(config RetentionConfig) JobFunc {
+	return func(ctx context.Context) error {
+		deleted, err := ApplyRetention(config)
+		if err != nil {
+			return err
+		}
+		log.Printf("Retention removed %d jobs, %d changes, %d versions, %d raw pages, %d quarantined records, %d reservations, %d price points, %d journal entries",
+			deleted["jobs"], deleted["changes"], deleted["versions"], deleted["raw_pages"], deleted["quarantine"],
+			deleted["reservations"], deleted["price_history"], deleted["journal"])
+		return nil
+	}
+}
+
+// triggerRetentionHandler queues a run of the retention policy
+func (s *server) triggerRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := s.config.Jobs.Enqueue("retention", TriggerManual, s.config.Retention)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error queueing retention: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+)
+
+// Built-in response schemas. Spanish is how responses are built, so it renames nothing.
+const (
+	SpanishSchema = "es"
+	EnglishSchema = "en"
+)
+
+// englishFields are the English names of the Spanish response fields
+var englishFields = api.EnglishFields
+
+// ResponseSchema renames the fields of the responses served with it, e.g. to English
+// for consumers that can't handle the Spanish names
+type ResponseSchema struct {
+	Name string
+
+	// Rename maps Spanish field names to the names served, at any depth of a response.
+	// Fields missing from it keep their Spanish name.
+	Rename map[string]string
+
+	canonical map[string]string // Served names back to the Spanish ones
+}
+
+type schemaContextKey struct{}
+
+// ParseResponseSchemas parses semicolon separated name=field:renamed,... entries, e.g.
+// "erp=clave:itemCode,nombre:title". The es and en schemas are always defined.
+func ParseResponseSchemas(s string) (map[string]*ResponseSchema, error) {
+	schemas := map[string]*ResponseSchema{
+		SpanishSchema: newResponseSchema(SpanishSchema, nil),
+		EnglishSchema: newResponseSchema(EnglishSchema, englishFields),
+	}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, mappings, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid response schema %q: expected name=field:renamed,...", entry)
+		}
+		if _, exists := schemas[name]; exists {
+			return nil, fmt.Errorf("response schema %q defined twice", name)
+		}
+
+		rename := make(map[string]string)
+		served := make(map[string]bool)
+		for _, mapping := range strings.Split(mappings, ",") {
+			mapping = strings.TrimSpace(mapping)
+			if mapping == "" {
+				continue
+			}
+			field, renamed, found := strings.Cut(mapping, ":")
+			field, renamed = strings.TrimSpace(field), strings.TrimSpace(renamed)
+			if !found || field == "" || renamed == "" {
+				return nil, fmt.Errorf("invalid mapping %q in response schema %s: expected field:renamed", mapping, name)
+			}
+			if _, exists := rename[field]; exists {
+				return nil, fmt.Errorf("response schema %s renames %s twice", name, field)
+			}
+			if served[renamed] {
+				return nil, fmt.Errorf("response schema %s maps several fields to %s", name, renamed)
+			}
+			rename[field] = renamed
+			served[renamed] = true
+		}
+		if len(rename) == 0 {
+			return nil, fmt.Errorf("response schema %q renames no fields", name)
+		}
+		schemas[name] = newResponseSchema(name, rename)
+	}
+
+	return schemas, nil
+}
+
+func newResponseSchema(name string, rename map[string]string) *ResponseSchema {
+	schema := &ResponseSchema{Name: name, Rename: rename, canonical: make(map[string]string, len(rename))}
+	for field, renamed := range rename {
+		schema.canonical[renamed] = field
+	}
+	return schema
+}
+
+// withRequestSchema returns r carrying the schema named by ?schema=, or else the one of
+// its API key. Writes the error and returns false for an unknown schema.
+func (s *server) withRequestSchema(w http.ResponseWriter, r *http.Request, keySchema *ResponseSchema) (*http.Request, bool) {
+	schema := keySchema
+	if name := r.URL.Query().Get("schema"); name != "" {
+		var ok bool
+		schema, ok = s.config.Schemas[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown response schema %q (available: %s)", name, strings.Join(schemaNames(s.config.Schemas), ", ")), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if schema == nil || len(schema.Rename) == 0 {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), schemaContextKey{}, schema)), true
+}
+
+// requestSchema returns the schema of the request, nil when fields keep their Spanish names
+func requestSchema(r *http.Request) *ResponseSchema {
+	schema, _ := r.Context().Value(schemaContextKey{}).(*ResponseSchema)
+	return schema
+}
+
+// canonicalFields translates a ?fields= list given in the schema's names to the
+// Spanish ones. Spanish names are accepted as well.
+func (sc *ResponseSchema) canonicalFields(param string) string {
+	if sc == nil || param == "" {
+		return param
+	}
+	names := strings.Split(param, ",")
+	for i, name := range names {
+		if field, ok := sc.canonical[strings.TrimSpace(name)]; ok {
+			names[i] = field
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// apply returns v encoded with its fields renamed, keeping their order
+func (sc *ResponseSchema) apply(v any) (any, error) {
+	if sc == nil {
+		return v, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := sc.rename(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(renamed), nil
+}
+
+// rename rewrites a JSON document token by token, renaming the keys of its objects
+func (sc *ResponseSchema) rename(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	// Open containers, with the number of tokens written in each so far. Objects
+	// alternate keys and values.
+	type container struct {
+		object bool
+		tokens int
+	}
+	var open []container
+
+	var buf bytes.Buffer
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			buf.WriteByte(byte(delim))
+			open = open[:len(open)-1]
+			continue
+		}
+
+		isKey := false
+		if len(open) > 0 {
+			top := &open[len(open)-1]
+			if top.tokens > 0 {
+				if top.object && top.tokens%2 == 1 {
+					buf.WriteByte(':')
+				} else {
+					buf.WriteByte(',')
+				}
+			}
+			isKey = top.object && top.tokens%2 == 0
+			top.tokens++
+		}
+
+		switch token := token.(type) {
+		case json.Delim:
+			buf.WriteByte(byte(token))
+			open = append(open, container{object: token == '{'})
+		case json.Number:
+			buf.WriteString(token.String())
+		default:
+			if name, ok := token.(string); ok && isKey {
+				if renamed, ok := sc.Rename[name]; ok {
+					token = renamed
+				}
+			}
+			encoded, err := json.Marshal(token)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(encoded)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// column renames each part of a flattened export column, e.g. calculados.margen
+func (sc *ResponseSchema) column(name string) string {
+	if sc == nil {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if renamed, ok := sc.Rename[part]; ok {
+			parts[i] = renamed
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// columns renames export columns
+func (sc *ResponseSchema) columns(columns []string) []string {
+	if sc == nil {
+		return columns
+	}
+	renamed := make([]string, len(columns))
+	for i, column := range columns {
+		renamed[i] = sc.column(column)
+	}
+	return renamed
+}
+
+// applyColumns renames the columns of export rows
+func (sc *ResponseSchema) applyColumns(columns []string, rows []map[string]string) ([]string, []map[string]string) {
+	if sc == nil {
+		return columns, rows
+	}
+
+	renamed := sc.columns(columns)
+	renamedRows := make([]map[string]string, len(rows))
+	for i, row := range rows {
+		renamedRows[i] = make(map[string]string, len(row))
+		for column, value := range row {
+			renamedRows[i][sc.column(column)] = value
+		}
+	}
+	return renamed, renamedRows
+}
+
+// writeSchemaJSON writes v as JSON with the fields renamed by the request's schema
+func writeSchemaJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	renamed, err := requestSchema(r).apply(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error renaming response fields: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, renamed)
+}
+
+// schemaNames returns the names of the given schemas, sorted
+func schemaNames(schemas map[string]*ResponseSchema) []string {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
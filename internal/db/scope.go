@@ -0,0 +1,189 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SyncScope limits the Ashley records a sync keeps to part of the line, for stores
+// that only carry some of it. A product is in scope when its SKU, series or category
+// is listed; prices, stock and other records keyed by SKU follow their product. Ashley
+// filters requests by a single SKU at most, so scoped syncs still walk every page and
+// drop the other records before storing them. An empty scope keeps everything.
+type SyncScope struct {
+	SKUs       []string // SKUs, or SKU prefixes ending in *
+	Series     []string // seriesId values
+	Categories []string // itemSalesCategoryCodeKey values
+}
+
+// Empty reports whether the scope keeps every record
+func (s SyncScope) Empty() bool {
+	return len(s.SKUs) == 0 && len(s.Series) == 0 && len(s.Categories) == 0
+}
+
+// byProduct reports whether records keyed by SKU need their product to tell whether
+// they are in scope, as their series and category are only on the product
+func (s SyncScope) byProduct() bool {
+	return len(s.Series) > 0 || len(s.Categories) > 0
+}
+
+// String describes the scope for logs, e.g. "SKUs B100*; series 100"
+func (s SyncScope) String() string {
+	var parts []string
+	if len(s.SKUs) > 0 {
+		parts = append(parts, "SKUs "+strings.Join(s.SKUs, ", "))
+	}
+	if len(s.Series) > 0 {
+		parts = append(parts, "series "+strings.Join(s.Series, ", "))
+	}
+	if len(s.Categories) > 0 {
+		parts = append(parts, "categories "+strings.Join(s.Categories, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// dependencies returns the fetchers a fetcher waits for because of the scope: with
+// series or categories, the Ashley fetchers keyed by SKU need this sync's products
+func (s SyncScope) dependencies(fetcher Syncer) []string {
+	if !s.byProduct() || fetcher.Supplier() != AshleySupplier || fetcher.BucketName() == "products" {
+		return nil
+	}
+	return []string{"products"}
+}
+
+// scopeMatches reports whether value is listed, or starts with a listed prefix ending
+// in *. Matching ignores case, as Ashley's SKUs and codes are upper case.
+func scopeMatches(list []string, value string) bool {
+	for _, entry := range list {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if len(value) >= len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(value, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeFields are the fields of a stored record the scope is checked against
+type scopeFields struct {
+	Sku      string `json:"sku"`
+	Series   string `json:"seriesId"`
+	Category string `json:"itemSalesCategoryCodeKey"`
+}
+
+// includes reports whether the record of bucketName stored as data is in scope.
+// Records without a SKU, e.g. discount contracts, apply across products and are
+// kept. Records of SKUs without a stored product are out of scope when series or
+// categories are listed.
+func (s SyncScope) includes(tx *bolt.Tx, bucketName string, data []byte) (bool, error) {
+	if s.Empty() {
+		return true, nil
+	}
+	var fields scopeFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, fmt.Errorf("error unmarshaling %s record: %v", bucketName, err)
+	}
+	if fields.Sku == "" {
+		return true, nil
+	}
+	if scopeMatches(s.SKUs, fields.Sku) {
+		return true, nil
+	}
+	if !s.byProduct() {
+		return false, nil
+	}
+
+	if bucketName != "products" {
+		products := recordsOf(tx, "products")
+		if products == nil {
+			return false, nil
+		}
+		key := []byte(fields.Sku)
+		stored := products.Get(key)
+		if stored == nil {
+			return false, nil
+		}
+		product, err := openValue("products", key, stored)
+		if err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal(product, &fields); err != nil {
+			return false, fmt.Errorf("error unmarshaling product %s: %v", fields.Sku, err)
+		}
+	}
+	return scopeMatches(s.Series, fields.Series) || scopeMatches(s.Categories, fields.Category), nil
+}
+
+// includesRecord reports whether a transformed record of bucketName is in scope
+func (s SyncScope) includesRecord(tx *bolt.Tx, bucketName string, record DatabaseEntity) (bool, error) {
+	if s.Empty() {
+		return true, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, fmt.Errorf("error marshaling entity %s: %v", record.GetSKU(), err)
+	}
+	return s.includes(tx, bucketName, data)
+}
+
+// scopeEntities returns the entities whose transformed record is in scope
+func scopeEntities[T DatabaseEntity](tx *bolt.Tx, scope SyncScope, bucketName string, entities []T, transformer func(T) DatabaseEntity) ([]T, error) {
+	if scope.Empty() {
+		return entities, nil
+	}
+	kept := make([]T, 0, len(entities))
+	for _, entity := range entities {
+		in, err := scope.includesRecord(tx, bucketName, transformer(entity))
+		if err != nil {
+			return nil, err
+		}
+		if in {
+			kept = append(kept, entity)
+		}
+	}
+	return kept, nil
+}
+
+// pruneOutOfScope deletes the stored records of a bucket outside the scope, left from
+// syncs with a wider one, journaling the deletions as changes of run. Returns how many
+// it deleted.
+func pruneOutOfScope(tx *bolt.Tx, run applyRun, scope SyncScope, bucketName string) (int, error) {
+	bucket := recordsOf(tx, bucketName)
+	if scope.Empty() || bucket == nil {
+		return 0, nil
+	}
+
+	// Buckets can't be written while iterating them
+	var removed []string
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil // Nested bucket
+		}
+		data, err := openValue(bucketName, k, v)
+		if err != nil {
+			return err
+		}
+		in, err := scope.includes(tx, bucketName, data)
+		if err != nil {
+			return fmt.Errorf("%s record %s: %v", bucketName, k, err)
+		}
+		if !in {
+			removed = append(removed, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, sku := range removed {
+		if err := deleteRecord(tx, run, bucket, bucketName, sku); err != nil {
+			return 0, err
+		}
+	}
+	return len(removed), nil
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// seedBatchSize is how many generated records Seed writes per transaction
+const seedBatchSize = 1000
+
+// seedCategory is a kind of product Seed generates: its category code, what it is
+// called and the ranges of its measures and base price
+type seedCategory struct {
+	code, noun    string
+	prefix        byte       // First letter of the SKUs
+	height, width [2]float64 // mm
+	depth, weight [2]float64 // mm, kg
+	price         [2]float64
+	chairs        bool // Shipped as a carton of chairs
+}
+
+var seedCategories = []seedCategory{
+	{code: "UPH", noun: "Sofa", prefix: 'U', height: [2]float64{800, 1050}, width: [2]float64{1800, 2600}, depth: [2]float64{850, 1100}, weight: [2]float64{45, 110}, price: [2]float64{350, 1400}},
+	{code: "REC", noun: "Recliner", prefix: 'R', height: [2]float64{950, 1100}, width: [2]float64{800, 1050}, depth: [2]float64{900, 1050}, weight: [2]float64{35, 70}, price: [2]float64{250, 900}},
+	{code: "BED", noun: "Bed", prefix: 'B', height: [2]float64{900, 1600}, width: [2]float64{1000, 2100}, depth: [2]float64{2000, 2300}, weight: [2]float64{40, 120}, price: [2]float64{200, 1200}},
+	{code: "DRS", noun: "Dresser", prefix: 'B', height: [2]float64{800, 1000}, width: [2]float64{1300, 1700}, depth: [2]float64{450, 550}, weight: [2]float64{50, 110}, price: [2]float64{180, 800}},
+	{code: "DIN", noun: "Dining Table", prefix: 'D', height: [2]float64{740, 780}, width: [2]float64{1200, 2200}, depth: [2]float64{900, 1100}, weight: [2]float64{30, 90}, price: [2]float64{150, 900}},
+	{code: "DCH", noun: "Dining Chair", prefix: 'D', height: [2]float64{900, 1050}, width: [2]float64{450, 550}, depth: [2]float64{500, 620}, weight: [2]float64{6, 12}, price: [2]float64{40, 180}, chairs: true},
+	{code: "OCC", noun: "Coffee Table", prefix: 'T', height: [2]float64{400, 500}, width: [2]float64{900, 1400}, depth: [2]float64{500, 800}, weight: [2]float64{12, 40}, price: [2]float64{80, 400}},
+	{code: "MAT", noun: "Mattress", prefix: 'M', height: [2]float64{200, 350}, width: [2]float64{970, 1930}, depth: [2]float64{1900, 2030}, weight: [2]float64{20, 60}, price: [2]float64{150, 1100}},
+	{code: "RUG", noun: "Rug", prefix: 'R', height: [2]float64{8, 20}, width: [2]float64{1500, 2400}, depth: [2]float64{2000, 3000}, weight: [2]float64{4, 15}, price: [2]float64{60, 350}},
+	{code: "LMP", noun: "Table Lamp", prefix: 'L', height: [2]float64{500, 800}, width: [2]float64{300, 450}, depth: [2]float64{300, 450}, weight: [2]float64{2, 6}, price: [2]float64{25, 120}},
+}
+
+// Words series names and finishes are made of, invented so no generated product
+// resembles a real one
+var (
+	seedSyllables = []string{"bar", "cal", "den", "dor", "fen", "gal", "har", "kel", "lan", "mar", "nor", "pel", "ros", "sal", "tam", "ven", "wil", "zan"}
+	seedFinishes  = []string{"Oak", "Walnut", "Ivory", "Charcoal", "Gray", "Sand", "Espresso", "Slate", "Linen", "Chestnut"}
+)
+
+// SeedOptions are the options of Seed
+type SeedOptions struct {
+	Products   int    // Products generated, kits included
+	Seed       uint64 // The same seed generates the same catalog
+	Validation ValidationConfig
+}
+
+// SeedResult summarizes a generated catalog
+type SeedResult struct {
+	Products int    `json:"products"`
+	Kits     int    `json:"kits"`
+	Prices   int    `json:"prices"`
+	Run      string `json:"run"` // Journal run of the seed
+}
+
+// Seed fills an empty catalog with generated products and prices, so the service can
+// be run without Ashley credentials or production data. Products come in series of a
+// category with plausible measures and prices, some discontinued in favor of another
+// and some kits of others. UPCs use the GS1 prefix 2, reserved for internal use, so
+// they never match a real product. Records go through the pipeline, indexes, change
+// feed and journal like synced ones.
+func Seed(options SeedOptions) (SeedResult, error) {
+	if options.Products <= 0 {
+		return SeedResult{}, fmt.Errorf("products must be positive, got %d", options.Products)
+	}
+
+	// Stamps a new database with the current schema version, as generated records have its shape
+	if err := migrate(); err != nil {
+		return SeedResult{}, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return SeedResult{}, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if products := recordsOf(tx, "products"); products != nil {
+			if k, _ := products.Cursor().First(); k != nil {
+				return fmt.Errorf("the catalog already holds products: seed an empty database so generated and real records don't mix")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SeedResult{}, err
+	}
+
+	run, err := newRun(SourceSeed)
+	if err != nil {
+		return SeedResult{}, err
+	}
+	products, prices := newCatalogGenerator(options.Seed).generate(options.Products)
+	result := SeedResult{Run: run.ID}
+
+	for start := 0; start < len(products); start += seedBatchSize {
+		end := min(start+seedBatchSize, len(products))
+		err := db.Update(func(tx *bolt.Tx) error {
+			if _, err := createRecords(tx, "products"); err != nil {
+				return err
+			}
+			if _, err := createRecords(tx, "prices"); err != nil {
+				return err
+			}
+			productStats, err := putEntities(tx, run, "products", products[start:end], ProductFetcher{}.Transform, options.Validation)
+			if err != nil {
+				return err
+			}
+			priceStats, err := putEntities(tx, run, "prices", prices[start:end], PriceFetcher{}.Transform, options.Validation)
+			if err != nil {
+				return err
+			}
+			result.Products += productStats.Written
+			result.Prices += priceStats.Written
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("error seeding catalog: %v", err)
+		}
+	}
+	for _, product := range products {
+		if len(product.Components) > 0 {
+			result.Kits++
+		}
+	}
+
+	similarAfterSync()
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// catalogGenerator generates the records of a fake catalog in the shape the Ashley
+// API returns them
+type catalogGenerator struct {
+	rand *rand.Rand
+	skus map[string]bool
+	upcs map[string]bool
+}
+
+func newCatalogGenerator(seed uint64) *catalogGenerator {
+	return &catalogGenerator{rand: rand.New(rand.NewPCG(seed, seed)), skus: make(map[string]bool), upcs: make(map[string]bool)}
+}
+
+// generate returns count products and their prices. One in twenty is a kit of earlier
+// products, priced as the sum of its components.
+func (g *catalogGenerator) generate(count int) ([]Product, []Price) {
+	products := make([]Product, 0, count)
+	prices := make([]Price, 0, count)
+	basePrices := make(map[string]float64, count)
+
+	for len(products) < count {
+		category := seedCategories[g.rand.IntN(len(seedCategories))]
+		series := strconv.Itoa(100 + g.rand.IntN(9900))
+		name := g.seriesName()
+
+		// Series hold a few items of one category, in different finishes and sizes
+		items := min(1+g.rand.IntN(6), count-len(products))
+		for i := 0; i < items; i++ {
+			var product Product
+			var basePrice float64
+			if len(products) >= 10 && g.rand.IntN(20) == 0 {
+				product, basePrice = g.kit(category, series, name, products, basePrices)
+			} else {
+				product, basePrice = g.product(category, series, name)
+			}
+			if product.Sku == "" {
+				continue // Out of SKUs for the series
+			}
+			basePrices[product.Sku] = basePrice
+			products = append(products, product)
+			prices = append(prices, g.price(product, basePrice))
+		}
+	}
+
+	// Discontinue a few products in favor of a current one of the same category
+	for i := range products {
+		if g.rand.IntN(25) != 0 || len(products[i].Components) > 0 {
+			continue
+		}
+		replacement := products[g.rand.IntN(len(products))]
+		if replacement.Sku != products[i].Sku && replacement.ItemSalesCategoryCodeKey == products[i].ItemSalesCategoryCodeKey &&
+			replacement.Status == "Current" && len(replacement.Components) == 0 {
+			products[i].Status = "Discontinued"
+			products[i].ReplacementSku = replacement.Sku
+		}
+	}
+	return products, prices
+}
+
+// sku returns an unused SKU of a series, e.g. U4821-38, empty when the series ran out
+func (g *catalogGenerator) sku(prefix byte, series, suffix string) string {
+	for attempt := 0; attempt < 20; attempt++ {
+		sku := fmt.Sprintf("%c%s-%d%s", prefix, series, 10+g.rand.IntN(90), suffix)
+		if !g.skus[sku] {
+			g.skus[sku] = true
+			return sku
+		}
+	}
+	return ""
+}
+
+func (g *catalogGenerator) product(category seedCategory, series, name string) (Product, float64) {
+	sku := g.sku(category.prefix, series, "")
+	finish := seedFinishes[g.rand.IntN(len(seedFinishes))]
+	product := Product{
+		ConsumerDescription:      fmt.Sprintf("%s %s %s", name, finish, category.noun),
+		Sku:                      sku,
+		ItemSalesCategoryCodeKey: category.code,
+		SeriesId:                 series,
+		ItemsPerCase:             1,
+		Status:                   "Current",
+		UnitHeightMm:             g.between(category.height, 0),
+		UnitWidthMm:              g.between(category.width, 0),
+		UnitDepthMm:              g.between(category.depth, 0),
+		ItemWeightKg:             g.between(category.weight, 1),
+		Upc:                      g.upc(),
+		ModelNumber:              sku,
+	}
+	if category.chairs {
+		product.ChairQtyPerCarton = 2
+		product.ItemsPerCase = 2
+	}
+	if g.rand.IntN(2) == 0 {
+		product.Gtin = "0" + product.Upc
+	}
+	return product, g.between(category.price, 2)
+}
+
+// kit returns a kit of two to four earlier products, e.g. a dining set
+func (g *catalogGenerator) kit(category seedCategory, series, name string, products []Product, basePrices map[string]float64) (Product, float64) {
+	sku := g.sku(category.prefix, series, "K")
+	product := Product{
+		ConsumerDescription:      fmt.Sprintf("%s %s Set", name, category.noun),
+		Sku:                      sku,
+		ItemSalesCategoryCodeKey: category.code,
+		SeriesId:                 series,
+		ItemsPerCase:             1,
+		Status:                   "Current",
+		Upc:                      g.upc(),
+		ModelNumber:              sku,
+	}
+
+	basePrice := 0.0
+	seen := make(map[string]bool)
+	want := 2 + g.rand.IntN(3)
+	for attempt := 0; len(product.Components) < want && attempt < 20; attempt++ {
+		component := products[g.rand.IntN(len(products))]
+		if seen[component.Sku] || len(component.Components) > 0 {
+			continue
+		}
+		seen[component.Sku] = true
+		quantity := 1
+		if component.ChairQtyPerCarton > 0 {
+			quantity = 2 * (1 + g.rand.IntN(2))
+		}
+		product.Components = append(product.Components, Component{Sku: component.Sku, Quantity: quantity})
+		product.ItemWeightKg += component.ItemWeightKg * float64(quantity)
+		basePrice += basePrices[component.Sku] * float64(quantity)
+	}
+	product.ItemWeightKg = math.Round(product.ItemWeightKg*10) / 10
+	return product, math.Round(basePrice*100) / 100
+}
+
+// price returns the price list entry of a product, with the amounts as the strings
+// the Ashley API sends
+func (g *catalogGenerator) price(product Product, basePrice float64) Price {
+	discount := math.Round(basePrice*float64(g.rand.IntN(4))*5) / 100 // 0, 5, 10 or 15%
+	net := basePrice - discount
+	freight := math.Round(product.ItemWeightKg*(1.5+g.rand.Float64())*100) / 100
+	amount := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+
+	return Price{
+		Description:           product.ConsumerDescription,
+		Sku:                   product.Sku,
+		BasePrice:             amount(basePrice),
+		SellPrice:             amount(math.Round(basePrice*(1.8+0.6*g.rand.Float64())) - 0.01),
+		Surcharge:             amount(0),
+		FobPoint:              "Arcadia",
+		Discount:              amount(discount),
+		DfiDiscount:           amount(0),
+		NetPriceBeforeFreight: amount(net),
+		Freight:               amount(freight),
+		ExpressFreight:        amount(math.Round(freight*180) / 100),
+		TotalNetPrice:         amount(net + freight),
+		ContainerPrice:        amount(math.Round(net*95) / 100),
+	}
+}
+
+// between returns a random value of a range, rounded to decimals
+func (g *catalogGenerator) between(r [2]float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	return math.Round((r[0]+g.rand.Float64()*(r[1]-r[0]))*scale) / scale
+}
+
+// seriesName returns an invented series name of two or three syllables
+func (g *catalogGenerator) seriesName() string {
+	name := ""
+	for i := 2 + g.rand.IntN(2); i > 0; i-- {
+		name += seedSyllables[g.rand.IntN(len(seedSyllables))]
+	}
+	return string(name[0]-'a'+'A') + name[1:]
+}
+
+// upc returns an unused UPC-A with the GS1 prefix 2 and a valid check digit
+func (g *catalogGenerator) upc() string {
+	for {
+		if upc := g.randomUPC(); !g.upcs[upc] {
+			g.upcs[upc] = true
+			return upc
+		}
+	}
+}
+
+func (g *catalogGenerator) randomUPC() string {
+	digits := make([]byte, 11)
+	digits[0] = '2'
+	for i := 1; i < len(digits); i++ {
+		digits[i] = byte('0' + g.rand.IntN(10))
+	}
+	sum := 0
+	for i, digit := range digits {
+		weight := 1
+		if i%2 == 0 {
+			weight = 3
+		}
+		sum += int(digit-'0') * weight
+	}
+	return string(digits) + strconv.Itoa((10-sum%10)%10)
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const selfCheckBucketName = "self_check"
+
+// Validate reports every missing or malformed upstream setting at once, including
+// the settings of other suppliers
+func (c APIConfig) Validate() error {
+	errs := c.validateUpstream(SupplierEnvPrefix(AshleySupplier), true)
+	if c.KeepVersions < 0 {
+		errs = append(errs, fmt.Errorf("CATALOG_VERSIONS must not be negative, got %d", c.KeepVersions))
+	}
+	if c.Parallelism < 1 {
+		errs = append(errs, fmt.Errorf("SYNC_PARALLELISM must be at least 1, got %d", c.Parallelism))
+	}
+	if c.RequestRate < 0 {
+		errs = append(errs, fmt.Errorf("API_REQUEST_RATE must not be negative, got %v", c.RequestRate))
+	}
+	errs = append(errs, c.Chaos.validate()...)
+	errs = append(errs, c.Maintenance.validate()...)
+	errs = append(errs, c.validateLanguages()...)
+
+	names := make([]string, 0, len(c.Suppliers))
+	for name := range c.Suppliers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, c.For(name).validateUpstream(SupplierEnvPrefix(name), false)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateUpstream checks the connection settings read from the variables starting
+// with prefix. Ashley needs all of them; plugins check their own credentials, and
+// external fetchers may not call an HTTP API at all.
+func (c APIConfig) validateUpstream(prefix string, ashley bool) []error {
+	var errs []error
+
+	if c.BaseURL == "" {
+		if ashley {
+			errs = append(errs, fmt.Errorf("%sBASE_URL is not set", prefix))
+		}
+	} else if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("%sBASE_URL %q is not an http(s) URL", prefix, c.BaseURL))
+	} else if strings.HasSuffix(c.BaseURL, "/") {
+		errs = append(errs, fmt.Errorf("%sBASE_URL %q must not end with a slash", prefix, c.BaseURL))
+	}
+	if ashley {
+		if c.Authorization == "" {
+			errs = append(errs, fmt.Errorf("%sAUTHORIZATION is not set", prefix))
+		}
+		if c.ClientID == "" {
+			errs = append(errs, fmt.Errorf("%sCLIENT_ID is not set", prefix))
+		}
+		if c.Customer == "" {
+			errs = append(errs, fmt.Errorf("%sCUSTOMER is not set", prefix))
+		}
+	}
+	if c.Limit <= 0 {
+		errs = append(errs, fmt.Errorf("%sLIMIT must be positive, got %d", prefix, c.Limit))
+	}
+
+	return errs
+}
+
+// SelfCheck verifies the database is writable and that the Ashley API accepts our
+// credentials for every enabled fetcher, with a single one-record request each
+func SelfCheck(ctx context.Context, config APIConfig, fetchers []Syncer) error {
+	if err := checkWritable(); err != nil {
+		return fmt.Errorf("database %s is not writable: %v (check file permissions and that no other process holds it open)", DatabaseName, err)
+	}
+
+	for _, fetcher := range fetchers {
+		if err := fetcher.Probe(ctx, config); err != nil {
+			return fmt.Errorf("%s: %v (%s)", fetcher.Name(), err, upstreamHint(err))
+		}
+	}
+
+	return nil
+}
+
+// checkWritable writes and removes a marker key
+func checkWritable() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(selfCheckBucketName))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("probe"), []byte("ok")); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(selfCheckBucketName))
+	})
+}
+
+// upstreamHint suggests which setting to look at for a failed upstream request
+func upstreamHint(err error) string {
+	errStr := err.Error()
+	switch {
+	case errors.Is(err, ErrUpstreamMaintenance):
+		return "the Ashley gateway is under maintenance, retry later or start with SELF_CHECK=false"
+	case strings.Contains(errStr, "status 401"):
+		return "the API rejected our credentials: check API_AUTHORIZATION"
+	case strings.Contains(errStr, "status 403"):
+		return "the API refused access: check API_CLIENT_ID and that API_CUSTOMER belongs to it"
+	case strings.Contains(errStr, "status 404"):
+		return "endpoint not found: check API_BASE_URL"
+	case strings.Contains(errStr, "status 400"):
+		return "the API rejected the request: check API_CUSTOMER and API_LIMIT"
+	case strings.Contains(errStr, "no such host"), strings.Contains(errStr, "connection refused"):
+		return "the API is unreachable: check API_BASE_URL and network access"
+	case strings.Contains(errStr, "unmarshaling JSON"):
+		return "unexpected response body: check API_BASE_URL points at the Ashley API"
+	default:
+		return "the Ashley API may be down, retry later or start with SELF_CHECK=false"
+	}
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ServingLink is the symlink naming the serving file: a read-only copy of the
+// database taken after each completed sync, which catalog reads are served from so
+// they never share a file with sync writes
+const ServingLink = "ashley.serving.db"
+
+// servingFilePrefix starts the names of serving files, followed by their creation time
+const servingFilePrefix = "ashley.serving-"
+
+// servingHandle is an open serving file and the reads still running on it
+type servingHandle struct {
+	db    *bolt.DB
+	path  string
+	reads sync.WaitGroup
+}
+
+var serving struct {
+	sync.Mutex
+	enabled bool
+	current *servingHandle
+	publish sync.Mutex // Publications run one at a time
+}
+
+// EnableServingFile serves catalog reads from serving files, publishing a first one.
+// Commands may have changed the database since the last one was published, so it is
+// never reused.
+func EnableServingFile() error {
+	serving.Lock()
+	serving.enabled = true
+	serving.Unlock()
+
+	if err := publishServingFile(); err != nil {
+		return err
+	}
+
+	serving.Lock()
+	current := serving.current.path
+	serving.Unlock()
+	removeStaleServingFiles(current)
+	return nil
+}
+
+// openServingFile opens a serving file read-only
+func openServingFile(path string) (*servingHandle, error) {
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &servingHandle{db: db, path: path}, nil
+}
+
+// publishServingFile copies the database into a fresh serving file and points the
+// link and the catalog reads at it. The previous file is closed and removed once the
+// reads running on it finish.
+func publishServingFile() error {
+	serving.Lock()
+	enabled := serving.enabled
+	serving.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	serving.publish.Lock()
+	defer serving.publish.Unlock()
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	name := fmt.Sprintf("%s%d.db", servingFilePrefix, time.Now().UnixNano())
+	path := filepath.Join(filepath.Dir(ServingLink), name)
+	if err := db.View(func(tx *bolt.Tx) error { return tx.CopyFile(path, 0400) }); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error writing serving file: %v", err)
+	}
+	handle, err := openServingFile(path)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error opening serving file: %v", err)
+	}
+
+	// Renaming a new link over the old one swaps it atomically
+	link := ServingLink + ".tmp"
+	os.Remove(link)
+	if err := os.Symlink(name, link); err != nil {
+		handle.db.Close()
+		os.Remove(path)
+		return fmt.Errorf("error linking serving file: %v", err)
+	}
+	if err := os.Rename(link, ServingLink); err != nil {
+		handle.db.Close()
+		os.Remove(path)
+		return fmt.Errorf("error linking serving file: %v", err)
+	}
+
+	swapServingFile(handle)
+	invalidateCache()
+	log.Printf("Serving catalog reads from %s", name)
+	return nil
+}
+
+// refreshServingFile publishes the catalog after a completed sync or another change to
+// it, e.g. a rollback. The previous file keeps being served when it fails.
+func refreshServingFile() {
+	if err := publishServingFile(); err != nil {
+		log.Printf("Error publishing serving file: %v", err)
+	}
+}
+
+// swapServingFile points catalog reads at handle, retiring the previous file
+func swapServingFile(handle *servingHandle) {
+	serving.Lock()
+	previous := serving.current
+	serving.current = handle
+	serving.Unlock()
+
+	if previous != nil {
+		go func() {
+			previous.reads.Wait()
+			if err := previous.db.Close(); err != nil {
+				log.Printf("Error closing serving file %s: %v", previous.path, err)
+			}
+			if err := os.Remove(previous.path); err != nil {
+				log.Printf("Error removing serving file %s: %v", previous.path, err)
+			}
+		}()
+	}
+}
+
+// removeStaleServingFiles removes the serving files left by earlier runs other than
+// the current one
+func removeStaleServingFiles(current string) {
+	dir := filepath.Dir(ServingLink)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), servingFilePrefix) && path != current {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing stale serving file %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// bucketView runs fn on the serving file for catalog buckets and on the database for
+// the rest. Jobs, quotes, blacklist and replacements are written outside syncs and
+// must be read back at once, not when the next serving file is published.
+func bucketView(bucketName string, fn func(*bolt.Tx) error) error {
+	if catalogBucket(bucketName) {
+		return catalogView(fn)
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// catalogView runs fn in a read-only transaction on the serving file when there is
+// one, on the database otherwise
+func catalogView(fn func(*bolt.Tx) error) error {
+	serving.Lock()
+	handle := serving.current
+	if handle != nil {
+		handle.reads.Add(1)
+	}
+	serving.Unlock()
+
+	if handle == nil {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.View(fn)
+	}
+
+	defer handle.reads.Done()
+	return handle.db.View(fn)
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// testServingFile serves catalog reads from serving files until the test ends
+func testServingFile(t *testing.T) {
+	t.Helper()
+	if err := EnableServingFile(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		serving.Lock()
+		current := serving.current
+		serving.enabled, serving.current = false, nil
+		serving.Unlock()
+		if current != nil {
+			current.db.Close()
+		}
+	})
+}
+
+// TestServingFileAdminWrites checks that blacklist and replacement changes are read
+// back at once with a serving file, while catalog writes wait for the next one
+func TestServingFileAdminWrites(t *testing.T) {
+	db := testDatabase(t)
+	testServingFile(t)
+
+	if err := SetBlacklistEntry(BlacklistEntry{Sku: "B736-38", Reason: "recall"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := GetBlacklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Sku != "B736-38" {
+		t.Errorf("blacklist after set = %+v, want B736-38", entries)
+	}
+	if err := DeleteBlacklistEntry("B736-38"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := GetBlacklist(); err != nil || len(entries) != 0 {
+		t.Errorf("blacklist after delete = %+v, %v, want empty", entries, err)
+	}
+
+	if err := SetReplacementOverride("B736-38", "B736-39"); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := GetReplacementOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overrides["B736-38"] != "B736-39" {
+		t.Errorf("replacements after set = %v, want B736-38 replaced by B736-39", overrides)
+	}
+	if err := DeleteReplacementOverride("B736-38"); err != nil {
+		t.Fatal(err)
+	}
+	if overrides, err := GetReplacementOverrides(); err != nil || len(overrides) != 0 {
+		t.Errorf("replacements after delete = %v, %v, want none", overrides, err)
+	}
+
+	products, _ := newCatalogGenerator(1).generate(1)
+	run, err := newRun(SourceSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveEntitiesToDatabase(db, run, "products", products, ProductFetcher{}.Transform, ValidationConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetEntity[ProductRequestData]("products", products[0].Sku); !errors.Is(err, ErrNotFound) {
+		t.Errorf("product before publishing: err = %v, want ErrNotFound", err)
+	}
+	if err := publishServingFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetEntity[ProductRequestData]("products", products[0].Sku); err != nil {
+		t.Errorf("product after publishing: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// shardedBuckets are the catalog buckets whose records are spread over shard buckets
+// by the first byte of their SKU, e.g. products:A and products:B. Bolt transactions and
+// cursors slow down as a bucket grows past a few hundred thousand keys.
+var shardedBuckets = map[string]bool{}
+
+// SetShardedBuckets sets the catalog buckets kept in shards: the buckets of registered
+// fetchers and supplier catalogs. It must be called after registering fetchers and
+// before the database is used; Init then moves existing records to match.
+func SetShardedBuckets(names []string) error {
+	sharded := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !catalogBucket(name) {
+			return fmt.Errorf("%q is not a catalog bucket", name)
+		}
+		sharded[name] = true
+	}
+	shardedBuckets = sharded
+	return nil
+}
+
+// catalogBucket reports whether a bucket holds the records of a fetcher or an
+// imported supplier catalog, read and written through records
+func catalogBucket(name string) bool {
+	if _, ok := catalogSupplier(name); ok {
+		return true
+	}
+	for _, syncer := range registry.syncers {
+		if syncer.BucketName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// shardName is the bucket holding a record of a sharded bucket
+func shardName(bucketName string, key []byte) []byte {
+	return append([]byte(bucketName+":"), key[0])
+}
+
+// isShardOf reports whether name is a shard of bucketName
+func isShardOf(name []byte, bucketName string) bool {
+	return len(name) == len(bucketName)+2 && bytes.HasPrefix(name, []byte(bucketName+":"))
+}
+
+// records is a catalog bucket as its callers see it: the bolt bucket itself, or the
+// shards of a sharded bucket routed to by SKU. The bolt bucket exists either way, so
+// checks for a disabled fetcher's bucket keep working.
+type records struct {
+	tx      *bolt.Tx
+	name    string
+	base    *bolt.Bucket
+	sharded bool
+}
+
+// recordsOf returns the records of a bucket, nil when the bucket doesn't exist
+func recordsOf(tx *bolt.Tx, bucketName string) *records {
+	base := tx.Bucket([]byte(bucketName))
+	if base == nil {
+		return nil
+	}
+	return &records{tx: tx, name: bucketName, base: base, sharded: shardedBuckets[bucketName]}
+}
+
+// createRecords returns the records of a bucket, creating the bucket if needed
+func createRecords(tx *bolt.Tx, bucketName string) (*records, error) {
+	base, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return nil, err
+	}
+	return &records{tx: tx, name: bucketName, base: base, sharded: shardedBuckets[bucketName]}, nil
+}
+
+// shard returns the bucket holding key, nil when it doesn't exist yet
+func (r *records) shard(key []byte) *bolt.Bucket {
+	if !r.sharded || len(key) == 0 {
+		return r.base
+	}
+	return r.tx.Bucket(shardName(r.name, key))
+}
+
+// shards returns the buckets holding the records in key order
+func (r *records) shards() []*bolt.Bucket {
+	if !r.sharded {
+		return []*bolt.Bucket{r.base}
+	}
+
+	buckets := []*bolt.Bucket{r.base}
+	prefix := []byte(r.name + ":")
+	c := r.tx.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if isShardOf(k, r.name) {
+			buckets = append(buckets, r.tx.Bucket(k))
+		}
+	}
+	return buckets
+}
+
+func (r *records) Get(key []byte) []byte {
+	if bucket := r.shard(key); bucket != nil {
+		return bucket.Get(key)
+	}
+	return nil
+}
+
+func (r *records) Put(key, value []byte) error {
+	if !r.sharded {
+		return r.base.Put(key, value)
+	}
+	bucket, err := r.tx.CreateBucketIfNotExists(shardName(r.name, key))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
+
+func (r *records) Delete(key []byte) error {
+	if bucket := r.shard(key); bucket != nil {
+		return bucket.Delete(key)
+	}
+	return nil
+}
+
+// ForEach calls fn for every record in key order. Like bolt's, fn must not modify
+// the records.
+func (r *records) ForEach(fn func(k, v []byte) error) error {
+	for _, bucket := range r.shards() {
+		if err := bucket.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cursor returns a cursor over the records in key order
+func (r *records) Cursor() *recordCursor {
+	return &recordCursor{buckets: r.shards()}
+}
+
+// recordCursor walks the shards of a bucket one after another. Shards are split by
+// the first byte of the key, so their keys don't interleave.
+type recordCursor struct {
+	buckets []*bolt.Bucket
+	current int
+	cursor  *bolt.Cursor
+}
+
+// First moves to the first record
+func (c *recordCursor) First() ([]byte, []byte) {
+	return c.from(0, nil)
+}
+
+// Seek moves to key, or to the record after it when it doesn't exist
+func (c *recordCursor) Seek(key []byte) ([]byte, []byte) {
+	for i, bucket := range c.buckets {
+		// Skip the shards holding only keys before key
+		last, _ := bucket.Cursor().Last()
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			return c.from(i, key)
+		}
+	}
+	c.current = len(c.buckets)
+	return nil, nil
+}
+
+// Next moves to the next record
+func (c *recordCursor) Next() ([]byte, []byte) {
+	if c.cursor == nil {
+		return nil, nil
+	}
+	if k, v := c.cursor.Next(); k != nil {
+		return k, v
+	}
+	return c.from(c.current+1, nil)
+}
+
+// from moves to key (the first record when nil) in the i-th shard, or to the first
+// record of the following shards when it holds none from there
+func (c *recordCursor) from(i int, key []byte) ([]byte, []byte) {
+	for c.current = i; c.current < len(c.buckets); c.current++ {
+		c.cursor = c.buckets[c.current].Cursor()
+		var k, v []byte
+		if key != nil {
+			k, v = c.cursor.Seek(key)
+			key = nil
+		} else {
+			k, v = c.cursor.First()
+		}
+		if k != nil {
+			return k, v
+		}
+	}
+	c.cursor = nil
+	return nil, nil
+}
+
+// isShard reports whether a root bucket is a shard, so walks over the root buckets
+// can leave shards to the records of the bucket they belong to
+func isShard(tx *bolt.Tx, name []byte) bool {
+	if len(name) < 3 || name[len(name)-2] != ':' {
+		return false
+	}
+	return tx.Bucket(name[:len(name)-2]) != nil
+}
+
+// reshardBuckets moves the records of the catalog buckets into shards when they are
+// sharded, and back into the bucket itself when they no longer are
+func reshardBuckets() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		var bucketNames []string
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if catalogBucket(string(name)) {
+				bucketNames = append(bucketNames, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, bucketName := range bucketNames {
+			moved, err := reshardBucket(tx, bucketName)
+			if err != nil {
+				return fmt.Errorf("error resharding %s: %v", bucketName, err)
+			}
+			if moved > 0 {
+				log.Printf("Moved %d %s records to match SHARDED_BUCKETS", moved, bucketName)
+			}
+		}
+		return nil
+	})
+}
+
+// reshardBucket moves the records of a bucket to where records routes them,
+// returning how many moved
+func reshardBucket(tx *bolt.Tx, bucketName string) (int, error) {
+	target, err := createRecords(tx, bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	// Records are in the wrong place when they sit in the bucket itself while it's
+	// sharded, or in a shard while it's not
+	var sources [][]byte
+	if target.sharded {
+		sources = append(sources, []byte(bucketName))
+	} else {
+		prefix := []byte(bucketName + ":")
+		c := tx.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if isShardOf(k, bucketName) {
+				sources = append(sources, append([]byte(nil), k...))
+			}
+		}
+	}
+
+	moved := 0
+	for _, name := range sources {
+		source := tx.Bucket(name)
+		var keys, values [][]byte
+		err := source.ForEach(func(k, v []byte) error {
+			if v != nil && len(k) > 0 {
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+
+		for i, key := range keys {
+			if err := source.Delete(key); err != nil {
+				return moved, err
+			}
+			// Values are sealed for the bucket, not the shard, so they move as they are
+			if err := target.Put(key, values[i]); err != nil {
+				return moved, err
+			}
+		}
+		moved += len(keys)
+
+		if !target.sharded {
+			if err := tx.DeleteBucket(name); err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
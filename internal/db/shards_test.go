@@ -0,0 +1,176 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// shardedKeys spread over the shards of A, B and D, leaving no C shard
+var shardedKeys = []string{"A100", "A200", "B100", "B300", "D100", "D200"}
+
+// testShardedProducts shards the products bucket until the test ends
+func testShardedProducts(t *testing.T, sharded bool) {
+	t.Helper()
+	var names []string
+	if sharded {
+		names = []string{"products"}
+	}
+	if err := SetShardedBuckets(names); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetShardedBuckets(nil) })
+}
+
+// putShardedKeys writes shardedKeys to the products bucket, each valued by its key
+func putShardedKeys(t *testing.T, db *store) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		products, err := createRecords(tx, "products")
+		if err != nil {
+			return err
+		}
+		for _, key := range shardedKeys {
+			if err := products.Put([]byte(key), []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedKeys returns the keys of the products bucket in cursor order, checking each
+// value was kept
+func storedKeys(t *testing.T, tx *bolt.Tx) []string {
+	t.Helper()
+	var keys []string
+	c := recordsOf(tx, "products").Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if string(v) != "value of "+string(k) {
+			t.Errorf("value of %s = %q", k, v)
+		}
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// shardNames returns the shards of the products bucket
+func shardNames(tx *bolt.Tx) []string {
+	var names []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if isShardOf(name, "products") {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	return names
+}
+
+func TestRecordCursor(t *testing.T) {
+	db := testDatabase(t)
+	testShardedProducts(t, true)
+	putShardedKeys(t, db)
+
+	err := db.View(func(tx *bolt.Tx) error {
+		if shards := shardNames(tx); !slices.Equal(shards, []string{"products:A", "products:B", "products:D"}) {
+			t.Errorf("shards = %v, want products:A, products:B and products:D", shards)
+		}
+		if k, _ := tx.Bucket([]byte("products")).Cursor().First(); k != nil {
+			t.Errorf("base bucket holds %s, want no records", k)
+		}
+		if keys := storedKeys(t, tx); !slices.Equal(keys, shardedKeys) {
+			t.Errorf("First/Next order = %v, want %v", keys, shardedKeys)
+		}
+
+		tests := []struct {
+			seek string
+			want []string // Keys from the sought one to the end
+		}{
+			{seek: "", want: shardedKeys},
+			{seek: "A100", want: shardedKeys},
+			{seek: "A150", want: shardedKeys[1:]},
+			{seek: "A300", want: shardedKeys[2:]}, // Past the end of a shard
+			{seek: "B300", want: shardedKeys[3:]},
+			{seek: "C", want: shardedKeys[4:]}, // Missing shard
+			{seek: "D200", want: shardedKeys[5:]},
+			{seek: "E", want: nil}, // Past the last shard
+		}
+		for _, test := range tests {
+			var keys []string
+			c := recordsOf(tx, "products").Cursor()
+			for k, _ := c.Seek([]byte(test.seek)); k != nil; k, _ = c.Next() {
+				keys = append(keys, string(k))
+			}
+			if !slices.Equal(keys, test.want) {
+				t.Errorf("Seek(%q)/Next = %v, want %v", test.seek, keys, test.want)
+			}
+		}
+
+		c := recordsOf(tx, "products").Cursor()
+		if k, _ := c.Seek([]byte("E")); k != nil {
+			t.Errorf("Seek past the end = %s, want nil", k)
+		}
+		if k, _ := c.Next(); k != nil {
+			t.Errorf("Next after the end = %s, want nil", k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReshardBucket(t *testing.T) {
+	db := testDatabase(t)
+	testShardedProducts(t, false)
+	putShardedKeys(t, db)
+
+	tests := []struct {
+		sharded bool
+		shards  []string
+	}{
+		{sharded: true, shards: []string{"products:A", "products:B", "products:D"}},
+		{sharded: false, shards: nil},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("sharded=%t", test.sharded), func(t *testing.T) {
+			testShardedProducts(t, test.sharded)
+
+			err := db.Update(func(tx *bolt.Tx) error {
+				moved, err := reshardBucket(tx, "products")
+				if err != nil {
+					return err
+				}
+				if moved != len(shardedKeys) {
+					t.Errorf("moved %d records, want %d", moved, len(shardedKeys))
+				}
+				// A second pass finds everything in place
+				if moved, err := reshardBucket(tx, "products"); err != nil || moved != 0 {
+					t.Errorf("second pass moved %d records (%v), want 0", moved, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.View(func(tx *bolt.Tx) error {
+				if shards := shardNames(tx); !slices.Equal(shards, test.shards) {
+					t.Errorf("shards = %v, want %v", shards, test.shards)
+				}
+				if keys := storedKeys(t, tx); !slices.Equal(keys, shardedKeys) {
+					t.Errorf("records = %v, want %v", keys, shardedKeys)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultShipmentVehicles is a 40' high cube container, loaded to what fits in practice
+const DefaultShipmentVehicles = "hc40=26500,68"
+
+// maxSplitUnits caps the units of a single split, as each is placed on its own
+const maxSplitUnits = 10000
+
+// ErrUnsplittable is returned when an order names SKUs that are unknown, have no
+// stored dimensions or don't fit the vehicle on their own
+var ErrUnsplittable = errors.New("can't split")
+
+// ShipmentVehicle is the capacity of a truck or container
+type ShipmentVehicle struct {
+	Name        string  `json:"name"`
+	MaxWeightKg float64 `json:"maxWeightKg"`
+	MaxVolumeM3 float64 `json:"maxVolumeM3"`
+}
+
+// ParseShipmentVehicles parses semicolon separated name=maxWeightKg,maxVolumeM3 entries,
+// e.g. "hc40=26500,68;truck=12000,55". The first one is the default.
+func ParseShipmentVehicles(s string) ([]ShipmentVehicle, error) {
+	var vehicles []ShipmentVehicle
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, capacity, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		weight, volume, both := strings.Cut(capacity, ",")
+		if !found || !both || name == "" {
+			return nil, fmt.Errorf("invalid vehicle %q: expected name=maxWeightKg,maxVolumeM3", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("vehicle %q defined twice", name)
+		}
+		seen[name] = true
+
+		vehicle := ShipmentVehicle{Name: name}
+		var err error
+		if vehicle.MaxWeightKg, err = strconv.ParseFloat(strings.TrimSpace(weight), 64); err != nil || vehicle.MaxWeightKg <= 0 {
+			return nil, fmt.Errorf("vehicle %s: max weight must be a positive number, got %q", name, weight)
+		}
+		if vehicle.MaxVolumeM3, err = strconv.ParseFloat(strings.TrimSpace(volume), 64); err != nil || vehicle.MaxVolumeM3 <= 0 {
+			return nil, fmt.Errorf("vehicle %s: max volume must be a positive number, got %q", name, volume)
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	return vehicles, nil
+}
+
+// SplitRequest is the body of POST /orders/split
+type SplitRequest struct {
+	Vehicle string `json:"vehicle"` // Name from SHIPMENT_VEHICLES, the first one when empty
+	Items   []struct {
+		Sku      string `json:"sku"`
+		Quantity int    `json:"quantity"`
+	} `json:"items"`
+}
+
+// ShipmentItem is the quantity of a SKU loaded on a shipment
+type ShipmentItem struct {
+	Sku      string  `json:"sku"`
+	Quantity int     `json:"quantity"`
+	WeightKg float64 `json:"weightKg"`
+	VolumeM3 float64 `json:"volumeM3"`
+}
+
+// Shipment is one truck or container of a split order
+type Shipment struct {
+	Number   int            `json:"number"`
+	Items    []ShipmentItem `json:"items"`
+	WeightKg float64        `json:"weightKg"`
+	VolumeM3 float64        `json:"volumeM3"`
+}
+
+// SplitResult is an order split into shipments
+type SplitResult struct {
+	Vehicle   ShipmentVehicle `json:"vehicle"`
+	Shipments []Shipment      `json:"shipments"`
+	WeightKg  float64         `json:"weightKg"`
+	VolumeM3  float64         `json:"volumeM3"`
+}
+
+// splitUnit is a single unit of an ordered SKU
+type splitUnit struct {
+	sku    string
+	weight float64
+	volume float64
+}
+
+// SplitOrder splits the requested units into as few shipments as it can without any
+// exceeding the vehicle's weight or volume: units are loaded largest first, each on the
+// first shipment it fits in, from the dimensions of the stored products
+func SplitOrder(vehicle ShipmentVehicle, request SplitRequest) (SplitResult, error) {
+	skus := make([]string, 0, len(request.Items))
+	for _, item := range request.Items {
+		skus = append(skus, item.Sku)
+	}
+	products, err := GetEntities[ProductRequestData]("products", skus)
+	if err != nil {
+		return SplitResult{}, fmt.Errorf("error fetching products: %v", err)
+	}
+
+	var units []splitUnit
+	var problems []string
+	for _, item := range request.Items {
+		product, ok := products[item.Sku]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is unknown", item.Sku))
+			continue
+		}
+		unit := splitUnit{
+			sku:    item.Sku,
+			weight: product.ItemWeightKg,
+			volume: product.UnitHeightMm * product.UnitWidthMm * product.UnitDepthMm / 1e9,
+		}
+		switch {
+		case unit.weight <= 0 || unit.volume <= 0:
+			problems = append(problems, fmt.Sprintf("%s has no stored weight or dimensions", item.Sku))
+		case unit.weight > vehicle.MaxWeightKg || unit.volume > vehicle.MaxVolumeM3:
+			problems = append(problems, fmt.Sprintf("%s doesn't fit a %s on its own", item.Sku, vehicle.Name))
+		default:
+			for i := 0; i < item.Quantity; i++ {
+				units = append(units, unit)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return SplitResult{}, fmt.Errorf("%w: %s", ErrUnsplittable, strings.Join(problems, "; "))
+	}
+
+	// Largest first, by the share of the vehicle each unit takes
+	share := func(u splitUnit) float64 {
+		return max(u.volume/vehicle.MaxVolumeM3, u.weight/vehicle.MaxWeightKg)
+	}
+	sort.SliceStable(units, func(i, j int) bool { return share(units[i]) > share(units[j]) })
+
+	type load struct {
+		weight, volume float64
+		quantities     map[string]int
+		order          []string // SKUs in the order they were first loaded
+	}
+	var loads []*load
+	for _, unit := range units {
+		var target *load
+		for _, l := range loads {
+			if l.weight+unit.weight <= vehicle.MaxWeightKg && l.volume+unit.volume <= vehicle.MaxVolumeM3 {
+				target = l
+				break
+			}
+		}
+		if target == nil {
+			target = &load{quantities: make(map[string]int)}
+			loads = append(loads, target)
+		}
+		target.weight += unit.weight
+		target.volume += unit.volume
+		if target.quantities[unit.sku] == 0 {
+			target.order = append(target.order, unit.sku)
+		}
+		target.quantities[unit.sku]++
+	}
+
+	result := SplitResult{Vehicle: vehicle, Shipments: []Shipment{}}
+	for i, l := range loads {
+		shipment := Shipment{Number: i + 1, Items: []ShipmentItem{}}
+		for _, sku := range l.order {
+			product := products[sku]
+			quantity := l.quantities[sku]
+			shipment.Items = append(shipment.Items, ShipmentItem{
+				Sku:      sku,
+				Quantity: quantity,
+				WeightKg: roundCents(product.ItemWeightKg * float64(quantity)),
+				VolumeM3: roundVolume(product.UnitHeightMm * product.UnitWidthMm * product.UnitDepthMm / 1e9 * float64(quantity)),
+			})
+		}
+		shipment.WeightKg = roundCents(l.weight)
+		shipment.VolumeM3 = roundVolume(l.volume)
+		result.Shipments = append(result.Shipments, shipment)
+		result.WeightKg += l.weight
+		result.VolumeM3 += l.volume
+	}
+	result.WeightKg = roundCents(result.WeightKg)
+	result.VolumeM3 = roundVolume(result.VolumeM3)
+
+	return result, nil
+}
+
+// roundVolume rounds cubic meters to liters
+func roundVolume(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// splitOrderHandler splits a {"vehicle": "hc40", "items": [{"sku": ..., "quantity": 2}]}
+// order into shipments
+func (s *server) splitOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var request SplitRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(s.config.Vehicles) == 0 {
+		http.Error(w, "No vehicles configured: set SHIPMENT_VEHICLES", http.StatusServiceUnavailable)
+		return
+	}
+	vehicle := s.config.Vehicles[0]
+	if request.Vehicle != "" {
+		found := false
+		var names []string
+		for _, v := range s.config.Vehicles {
+			names = append(names, v.Name)
+			if v.Name == request.Vehicle {
+				vehicle, found = v, true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Unknown vehicle %q (available: %s)", request.Vehicle, strings.Join(names, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(request.Items) == 0 || len(request.Items) > maxQuoteItems {
+		http.Error(w, fmt.Sprintf("an order needs between 1 and %d items", maxQuoteItems), http.StatusBadRequest)
+		return
+	}
+	units := 0
+	for i, item := range request.Items {
+		request.Items[i].Sku = strings.TrimSpace(item.Sku)
+		if request.Items[i].Sku == "" || item.Quantity <= 0 {
+			http.Error(w, fmt.Sprintf("item %d needs a sku and a positive quantity", i+1), http.StatusBadRequest)
+			return
+		}
+		request.Items[i].Sku = lookupSKU(request.Items[i].Sku)
+		if units += item.Quantity; item.Quantity > maxSplitUnits || units > maxSplitUnits {
+			http.Error(w, fmt.Sprintf("an order can't hold more than %d units", maxSplitUnits), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := SplitOrder(vehicle, request)
+	if errors.Is(err, ErrUnsplittable) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error splitting order: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,349 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+// similarBucketName holds the suggestions of each product, computed after every
+// completed sync
+const similarBucketName = "similar"
+
+// Reasons a product is suggested for another
+const (
+	SimilarSeries   = "series"   // Same seriesId
+	SimilarCategory = "category" // Same category, within the price band and size tolerance
+)
+
+// SimilarityConfig decides which products of a category are similar enough to suggest
+// for one another
+type SimilarityConfig struct {
+	PriceBand     float64 // Largest difference in totalNetPrice, as a fraction of the product's
+	SizeTolerance float64 // Largest difference of each dimension, as a fraction of the product's
+	Limit         int     // Suggestions kept per product
+}
+
+// Validate checks the fractions aren't negative and some suggestions are kept
+func (c SimilarityConfig) Validate() error {
+	if c.PriceBand < 0 || c.SizeTolerance < 0 {
+		return fmt.Errorf("price band and size tolerance must not be negative")
+	}
+	if c.Limit <= 0 {
+		return fmt.Errorf("limit must be positive, got %d", c.Limit)
+	}
+	return nil
+}
+
+// similarity is the configured similarity
+var similarity = SimilarityConfig{PriceBand: 0.2, SizeTolerance: 0.15, Limit: 10}
+
+// SetSimilarity sets how suggestions are computed from the next completed sync on
+func SetSimilarity(config SimilarityConfig) {
+	similarity = config
+}
+
+// SimilarProducts are the suggestions stored for a product, best first
+type SimilarProducts struct {
+	Sku         string              `json:"sku"`
+	Suggestions []SimilarSuggestion `json:"suggestions"`
+}
+
+func (s SimilarProducts) GetSKU() string { return s.Sku }
+
+// SimilarSuggestion is a product suggested for another
+type SimilarSuggestion struct {
+	Sku      string   `json:"sku"`
+	Reasons  []string `json:"reasons"`  // SimilarSeries and/or SimilarCategory
+	Distance float64  `json:"distance"` // Price and size difference, 0 when alike
+}
+
+// rank orders suggestions: the same series and alike first, then alike, then the rest
+// of the series
+func (s SimilarSuggestion) rank() int {
+	switch {
+	case len(s.Reasons) == 2:
+		return 0
+	case s.Reasons[0] == SimilarCategory:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// SimilarProductResponseData is a suggestion as served by /products/{sku}/similar
+type SimilarProductResponseData = api.SimilarProduct
+
+// similarCandidate is a product with what its suggestions are compared on
+type similarCandidate struct {
+	product ProductRequestData
+	price   float64 // totalNetPrice, 0 when unpriced
+}
+
+// relativeDifference is |a - b| as a fraction of a
+func relativeDifference(a, b float64) float64 {
+	return math.Abs(a-b) / a
+}
+
+// hasSize reports whether every dimension of the product is known
+func (c similarCandidate) hasSize() bool {
+	return c.product.UnitHeightMm > 0 && c.product.UnitWidthMm > 0 && c.product.UnitDepthMm > 0
+}
+
+// alike reports whether other is within the price band and size tolerance of c, and
+// how far from it. Sizes are only compared when both are known.
+func (c similarCandidate) alike(other similarCandidate, config SimilarityConfig) (bool, float64) {
+	if c.price <= 0 || other.price <= 0 {
+		return false, 0
+	}
+	distance := relativeDifference(c.price, other.price)
+	if distance > config.PriceBand {
+		return false, 0
+	}
+	if c.hasSize() && other.hasSize() {
+		for _, dimensions := range [][2]float64{
+			{c.product.UnitHeightMm, other.product.UnitHeightMm},
+			{c.product.UnitWidthMm, other.product.UnitWidthMm},
+			{c.product.UnitDepthMm, other.product.UnitDepthMm},
+		} {
+			difference := relativeDifference(dimensions[0], dimensions[1])
+			if difference > config.SizeTolerance {
+				return false, 0
+			}
+			distance += difference / 3
+		}
+	}
+	return true, distance
+}
+
+// distance is the price and size difference of other from c, for suggestions of the
+// same series that aren't alike
+func (c similarCandidate) distance(other similarCandidate) float64 {
+	distance := 0.0
+	if c.price > 0 && other.price > 0 {
+		distance += relativeDifference(c.price, other.price)
+	}
+	if c.hasSize() && other.hasSize() {
+		distance += (relativeDifference(c.product.UnitHeightMm, other.product.UnitHeightMm) +
+			relativeDifference(c.product.UnitWidthMm, other.product.UnitWidthMm) +
+			relativeDifference(c.product.UnitDepthMm, other.product.UnitDepthMm)) / 3
+	}
+	return distance
+}
+
+// suggestSimilar computes the suggestions of every product: the other products of its
+// series and the alike ones of its category. Discontinued products aren't suggested.
+func suggestSimilar(products []ProductRequestData, prices map[string]PriceRequestData, config SimilarityConfig) []SimilarProducts {
+	bySeries := make(map[string][]similarCandidate)
+	byCategory := make(map[string][]similarCandidate)
+	for _, product := range products {
+		if strings.EqualFold(product.Status, "Discontinued") {
+			continue
+		}
+		candidate := similarCandidate{product: product, price: prices[product.Sku].TotalNetPrice}
+		if product.SeriesId != "" {
+			bySeries[product.SeriesId] = append(bySeries[product.SeriesId], candidate)
+		}
+		if product.ItemSalesCategoryCodeKey != "" {
+			byCategory[product.ItemSalesCategoryCodeKey] = append(byCategory[product.ItemSalesCategoryCodeKey], candidate)
+		}
+	}
+
+	var all []SimilarProducts
+	for _, product := range products {
+		self := similarCandidate{product: product, price: prices[product.Sku].TotalNetPrice}
+		suggestions := make(map[string]*SimilarSuggestion)
+
+		if product.ItemSalesCategoryCodeKey != "" {
+			for _, other := range byCategory[product.ItemSalesCategoryCodeKey] {
+				if other.product.Sku == product.Sku {
+					continue
+				}
+				if ok, distance := self.alike(other, config); ok {
+					suggestions[other.product.Sku] = &SimilarSuggestion{Sku: other.product.Sku, Reasons: []string{SimilarCategory}, Distance: distance}
+				}
+			}
+		}
+		if product.SeriesId != "" {
+			for _, other := range bySeries[product.SeriesId] {
+				if other.product.Sku == product.Sku {
+					continue
+				}
+				if suggestion, ok := suggestions[other.product.Sku]; ok {
+					suggestion.Reasons = []string{SimilarSeries, SimilarCategory}
+					continue
+				}
+				suggestions[other.product.Sku] = &SimilarSuggestion{Sku: other.product.Sku, Reasons: []string{SimilarSeries}, Distance: self.distance(other)}
+			}
+		}
+		if len(suggestions) == 0 {
+			continue
+		}
+
+		ranked := make([]SimilarSuggestion, 0, len(suggestions))
+		for _, suggestion := range suggestions {
+			suggestion.Distance = math.Round(suggestion.Distance*1000) / 1000
+			ranked = append(ranked, *suggestion)
+		}
+		slices.SortFunc(ranked, func(a, b SimilarSuggestion) int {
+			if a.rank() != b.rank() {
+				return a.rank() - b.rank()
+			}
+			if a.Distance != b.Distance {
+				if a.Distance < b.Distance {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a.Sku, b.Sku)
+		})
+		if len(ranked) > config.Limit {
+			ranked = ranked[:config.Limit]
+		}
+		all = append(all, SimilarProducts{Sku: product.Sku, Suggestions: ranked})
+	}
+	return all
+}
+
+// ComputeSimilarProducts replaces the stored suggestions by the ones of the stored
+// catalog, returning how many products have some. It reads the database itself rather
+// than the serving file, which is published after it.
+func ComputeSimilarProducts() (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var suggested []SimilarProducts
+	err = db.Update(func(tx *bolt.Tx) error {
+		var products []ProductRequestData
+		err := forEachEntityIn(tx, "products", func(product ProductRequestData) error {
+			products = append(products, product)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error fetching products: %v", err)
+		}
+		prices := make(map[string]PriceRequestData)
+		err = forEachEntityIn(tx, "prices", func(price PriceRequestData) error {
+			prices[price.Sku] = price
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error fetching prices: %v", err)
+		}
+		suggested = suggestSimilar(products, prices, similarity)
+
+		if err := tx.DeleteBucket([]byte(similarBucketName)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		bucket, err := tx.CreateBucket([]byte(similarBucketName))
+		if err != nil {
+			return err
+		}
+		for _, similar := range suggested {
+			data, err := json.Marshal(similar)
+			if err != nil {
+				return fmt.Errorf("error marshaling suggestions for %s: %v", similar.Sku, err)
+			}
+			if err := bucket.Put([]byte(similar.Sku), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error storing suggestions: %v", err)
+	}
+	return len(suggested), nil
+}
+
+// similarAfterSync recomputes the suggestions once a sync completed
+func similarAfterSync() {
+	count, err := ComputeSimilarProducts()
+	if err != nil {
+		log.Printf("Error computing similar products: %v", err)
+		return
+	}
+	log.Printf("Computed similar products for %d products", count)
+}
+
+// GetSimilarProducts returns the stored suggestions of a product, none when it has none
+func GetSimilarProducts(sku string) ([]SimilarSuggestion, error) {
+	similar, err := GetEntity[SimilarProducts](similarBucketName, sku)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return similar.Suggestions, nil
+}
+
+// similarProductsHandler serves the suggestions of a product, best first, as products
+// priced for ?date= like /products. Suggestions out of stock are left out.
+func (s *server) similarProductsHandler(w http.ResponseWriter, r *http.Request) {
+	sku := lookupSKU(r.PathValue("sku"))
+	lang, err := requestedLanguage(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid lang: %v", err), http.StatusBadRequest)
+		return
+	}
+	date, err := requestedDate(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid date: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := GetProduct(sku); errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Product %s not found", sku), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching product: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	suggestions, err := GetSimilarProducts(sku)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching similar products: %v", err), http.StatusInternalServerError)
+		return
+	}
+	response := []SimilarProductResponseData{}
+	if len(suggestions) == 0 {
+		writeRedactedJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	skus := make([]string, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		skus = append(skus, suggestion.Sku)
+	}
+	products, ok := s.servedProducts(w, r, skus, date)
+	if !ok {
+		return
+	}
+	localizeProducts(products, lang)
+	requestProfile(r).redactProducts(products)
+
+	bySKU := make(map[string]ProductResponseData, len(products))
+	for _, product := range products {
+		bySKU[product.Clave] = product
+	}
+	for _, suggestion := range suggestions {
+		product, ok := bySKU[suggestion.Sku]
+		if !ok || (product.Disponible != nil && *product.Disponible <= 0) {
+			continue
+		}
+		response = append(response, SimilarProductResponseData{Product: product, Motivos: suggestion.Reasons, Distancia: suggestion.Distance})
+	}
+	writeRedactedJSON(w, r, http.StatusOK, response)
+}
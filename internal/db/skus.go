@@ -0,0 +1,144 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SKURules are the normalizations applied to SKUs when records are written and when
+// clients look them up, so "b736-38 " finds B736-38
+type SKURules struct {
+	Trim            bool              // Remove surrounding whitespace
+	Upper           bool              // Upper-case letters
+	StripSeparators bool              // Remove dashes and spaces, e.g. B736-38 becomes B73638
+	Aliases         map[string]string // Legacy SKU formats by normalized form, resolved on lookups only
+}
+
+// skuRules are the rules in use. Trimming and upper-casing leave Ashley's SKUs as they are.
+var skuRules = SKURules{Trim: true, Upper: true}
+
+// SetSKURules sets the SKU normalization. Records stored under other rules keep their
+// keys until they are retransformed.
+func SetSKURules(rules SKURules) {
+	aliases := make(map[string]string, len(rules.Aliases))
+	for alias, sku := range rules.Aliases {
+		aliases[rules.normalize(alias)] = rules.normalize(sku)
+	}
+	rules.Aliases = aliases
+	skuRules = rules
+}
+
+// ParseSKUNormalization parses the comma separated rules of SKU_NORMALIZE: trim, upper
+// and strip, or none
+func ParseSKUNormalization(s string) (SKURules, error) {
+	var rules SKURules
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "none":
+		case "trim":
+			rules.Trim = true
+		case "upper":
+			rules.Upper = true
+		case "strip":
+			rules.StripSeparators = true
+		default:
+			return SKURules{}, fmt.Errorf("unknown rule %q (available: trim, upper, strip, none)", name)
+		}
+	}
+	return rules, nil
+}
+
+// ParseSKUAliases parses comma separated alias=sku pairs mapping legacy SKU formats to
+// current SKUs, e.g. "B736/38=B736-38,OLD100=100-10"
+func ParseSKUAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		alias, sku, found := strings.Cut(entry, "=")
+		alias, sku = strings.TrimSpace(alias), strings.TrimSpace(sku)
+		if !found || alias == "" || sku == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected alias=sku", entry)
+		}
+		aliases[alias] = sku
+	}
+	return aliases, nil
+}
+
+// normalize applies the rules to a SKU
+func (r SKURules) normalize(sku string) string {
+	if r.Trim {
+		sku = strings.TrimSpace(sku)
+	}
+	if r.Upper {
+		sku = strings.ToUpper(sku)
+	}
+	if r.StripSeparators {
+		sku = strings.NewReplacer("-", "", " ", "").Replace(sku)
+	}
+	return sku
+}
+
+// NormalizeSKU returns a SKU as records are keyed by it
+func NormalizeSKU(sku string) string {
+	return skuRules.normalize(sku)
+}
+
+// lookupSKU returns the key of a SKU sent by a client: normalized, and resolved when
+// it is an alias
+func lookupSKU(sku string) string {
+	sku = NormalizeSKU(sku)
+	if canonical, ok := skuRules.Aliases[sku]; ok {
+		return canonical
+	}
+	return sku
+}
+
+// skuNormalizer is implemented by records holding SKUs, normalized before the
+// pipeline runs
+type skuNormalizer interface {
+	normalizeSKUs() DatabaseEntity
+}
+
+// normalizeRecord normalizes the SKUs of a record that holds any
+func normalizeRecord(record DatabaseEntity) DatabaseEntity {
+	if normalizer, ok := record.(skuNormalizer); ok {
+		return normalizer.normalizeSKUs()
+	}
+	return record
+}
+
+// recordKey is the key a transformed record is stored under
+func recordKey(record DatabaseEntity) string {
+	return normalizeRecord(record).GetSKU()
+}
+
+func (p ProductRequestData) normalizeSKUs() DatabaseEntity {
+	p.Sku = NormalizeSKU(p.Sku)
+	if p.ReplacementSku != "" {
+		p.ReplacementSku = NormalizeSKU(p.ReplacementSku)
+	}
+	p.Components = slices.Clone(p.Components)
+	for i := range p.Components {
+		p.Components[i].Sku = NormalizeSKU(p.Components[i].Sku)
+	}
+	return p
+}
+
+func (p SupplierProduct) normalizeSKUs() DatabaseEntity {
+	return SupplierProduct(ProductRequestData(p).normalizeSKUs().(ProductRequestData))
+}
+
+func (p PriceRequestData) normalizeSKUs() DatabaseEntity {
+	p.Sku = NormalizeSKU(p.Sku)
+	return p
+}
+
+func (i InventoryRequestData) normalizeSKUs() DatabaseEntity {
+	i.Sku = NormalizeSKU(i.Sku)
+	return i
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const statusBucketName = "sync_status"
+
+// Sync states of a fetcher
+const (
+	SyncStateRunning  = "running"
+	SyncStateOK       = "ok"
+	SyncStateFailed   = "failed"
+	SyncStateCanceled = "canceled"
+	// The upstream catalog reported the version of the last sync, so no page was fetched
+	SyncStateSkipped = "skipped"
+	// The Ashley API rejected the credentials; syncs keep failing until they are fixed
+	SyncStateUnauthorized = "unauthorized"
+	// The Ashley gateway was under maintenance; the sync resumes once it ends
+	SyncStateDeferred = "deferred"
+)
+
+// SyncStatus tracks the sync history of a single fetcher
+type SyncStatus struct {
+	Fetcher             string    `json:"fetcher"`
+	Customer            string    `json:"customer,omitempty"` // Ashley customer account of the last attempt
+	State               string    `json:"state,omitempty"`
+	LastAttempt         time.Time `json:"lastAttempt"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastFailure         time.Time `json:"lastFailure"`
+	LastSkipped         time.Time `json:"lastSkipped,omitzero"`
+	LastError           string    `json:"lastError,omitempty"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	CredentialsRejected bool      `json:"credentialsRejected,omitempty"` // Set from a 401/403 until the next success
+	CatalogVersion      string    `json:"catalogVersion,omitempty"`      // Version header reported upstream at the last success
+	DeferredUntil       time.Time `json:"deferredUntil,omitzero"`        // Expected end of the maintenance deferring the last attempt
+	Quota               *Quota    `json:"quota,omitempty"`               // Upstream quota of the customer account, not stored
+	DependsOn           []string  `json:"dependsOn,omitempty"`           // Fetchers it waits for during a sync, not stored
+}
+
+// updateSyncStatus loads the status of a fetcher, applies update and stores it back
+func updateSyncStatus(fetcher string, update func(status *SyncStatus)) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(statusBucketName))
+		if err != nil {
+			return err
+		}
+
+		status := SyncStatus{Fetcher: fetcher}
+		if data := bucket.Get([]byte(fetcher)); data != nil {
+			if err := json.Unmarshal(data, &status); err != nil {
+				return fmt.Errorf("error unmarshaling sync status for %s: %v", fetcher, err)
+			}
+		}
+
+		update(&status)
+
+		data, err := json.Marshal(status)
+		if err != nil {
+			return fmt.Errorf("error marshaling sync status for %s: %v", fetcher, err)
+		}
+		return bucket.Put([]byte(fetcher), data)
+	})
+}
+
+// recordSyncStart marks a fetcher as running for a customer account
+func recordSyncStart(fetcher, customer string, at time.Time) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateRunning
+		status.Customer = customer
+		status.LastAttempt = at
+		status.DeferredUntil = time.Time{}
+	})
+}
+
+// recordSyncSuccess marks the given time as the last successful sync of a fetcher,
+// storing the catalog version reported before it started (empty when unknown)
+func recordSyncSuccess(fetcher string, at time.Time, version string) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateOK
+		status.LastSuccess = at
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+		status.CredentialsRejected = false
+		status.CatalogVersion = version
+	})
+}
+
+// recordSyncSkipped marks a fetcher's sync as skipped for an unchanged catalog. The
+// stored data is as current as after a success, so it counts as one for staleness.
+func recordSyncSkipped(fetcher string, at time.Time) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateSkipped
+		status.LastSkipped = at
+		status.LastSuccess = at
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+	})
+}
+
+// recordSyncFailure stores the error of a failed sync of a fetcher
+func recordSyncFailure(fetcher string, at time.Time, syncErr error) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateFailed
+		status.LastFailure = at
+		status.LastError = syncErr.Error()
+		status.ConsecutiveFailures++
+	})
+}
+
+// recordSyncUnauthorized stores a sync rejected by the Ashley API and reports whether
+// the fetcher was healthy before, so the operator is alerted once per outage
+func recordSyncUnauthorized(fetcher string, at time.Time, syncErr error) (bool, error) {
+	var wasUnauthorized bool
+	err := updateSyncStatus(fetcher, func(status *SyncStatus) {
+		wasUnauthorized = status.CredentialsRejected
+		status.CredentialsRejected = true
+		status.State = SyncStateUnauthorized
+		status.LastFailure = at
+		status.LastError = syncErr.Error()
+		status.ConsecutiveFailures++
+	})
+	return !wasUnauthorized, err
+}
+
+// recordSyncDeferred marks a fetcher's sync as deferred by upstream maintenance until
+// the given time. Maintenance isn't a failure, so consecutive failures are left alone.
+func recordSyncDeferred(fetcher string, until time.Time, syncErr error) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateDeferred
+		status.DeferredUntil = until
+		status.LastError = syncErr.Error()
+	})
+}
+
+// recordSyncCanceled marks a fetcher's sync as canceled, which does not count as a failure
+func recordSyncCanceled(fetcher string) error {
+	return updateSyncStatus(fetcher, func(status *SyncStatus) {
+		status.State = SyncStateCanceled
+	})
+}
+
+// GetSyncStatuses returns the stored sync status of each given fetcher.
+// Fetchers that never synced are returned with a zero LastSuccess.
+func GetSyncStatuses(fetchers []Syncer) ([]SyncStatus, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	statuses := make([]SyncStatus, 0, len(fetchers))
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(statusBucketName))
+
+		for _, fetcher := range fetchers {
+			status := SyncStatus{Fetcher: fetcher.Name()}
+			if bucket != nil {
+				if data := bucket.Get([]byte(fetcher.Name())); data != nil {
+					if err := json.Unmarshal(data, &status); err != nil {
+						return fmt.Errorf("error unmarshaling sync status for %s: %v", fetcher.Name(), err)
+					}
+				}
+			}
+			status.DependsOn = Dependencies(fetcher.Name())
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return statuses, nil
+}
+
+// staleSince returns the oldest last successful sync among the given fetchers when it
+// is older than threshold. A zero threshold disables the check, and fetchers that
+// never completed a sync are ignored since there is no data to be stale.
+func staleSince(fetchers []Syncer, threshold time.Duration) (*time.Time, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	oldest, err := oldestSuccess(fetchers)
+	if err != nil || oldest == nil || time.Since(*oldest) < threshold {
+		return nil, err
+	}
+
+	return oldest, nil
+}
+
+// oldestSuccess returns the oldest last successful sync of the fetchers, nil when none
+// has succeeded yet
+func oldestSuccess(fetchers []Syncer) (*time.Time, error) {
+	statuses, err := GetSyncStatuses(fetchers)
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest *time.Time
+	for _, status := range statuses {
+		if status.LastSuccess.IsZero() {
+			continue
+		}
+		if oldest == nil || status.LastSuccess.Before(*oldest) {
+			lastSuccess := status.LastSuccess
+			oldest = &lastSuccess
+		}
+	}
+	return oldest, nil
+}
+
+// syncStatusHandler serves the sync status of every enabled fetcher
+func (s *server) syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, err := GetSyncStatuses(s.config.Fetchers)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading sync status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range statuses {
+		if quota, ok := currentQuota(statuses[i].Customer); ok {
+			statuses[i].Quota = &quota
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// stockAlertsBucketName holds the alert state (low or out) of the flagged SKUs whose
+// stock is below their threshold, so each drop is alerted once rather than every sync
+const stockAlertsBucketName = "stock_alerts"
+
+// Stock alert states, also the events of their alerts
+const (
+	stockLow = "stock_low"
+	stockOut = "stock_out"
+)
+
+// StockThreshold flags the SKUs matching Sku (a prefix when it ends in *) for an alert
+// when their available stock drops below Below
+type StockThreshold struct {
+	Sku   string
+	Below int
+}
+
+// stockThresholds are the configured thresholds, in the order they are tried
+var stockThresholds []StockThreshold
+
+// SetStockAlerts sets the thresholds checked after each inventory sync
+func SetStockAlerts(thresholds []StockThreshold) {
+	stockThresholds = thresholds
+}
+
+// ParseStockAlerts parses comma separated sku=threshold pairs, e.g. "B736-38=5,W267*=2".
+// A SKU takes the threshold of the first pair matching it.
+func ParseStockAlerts(s string) ([]StockThreshold, error) {
+	var thresholds []StockThreshold
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		sku, value, found := strings.Cut(entry, "=")
+		sku = strings.TrimSpace(sku)
+		if !found || sku == "" {
+			return nil, fmt.Errorf("invalid stock alert %q: expected sku=threshold", entry)
+		}
+		below, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || below < 1 {
+			return nil, fmt.Errorf("invalid threshold for %s: expected a positive whole number, got %q", sku, value)
+		}
+		thresholds = append(thresholds, StockThreshold{Sku: sku, Below: below})
+	}
+	return thresholds, nil
+}
+
+// stockThreshold returns the threshold of a SKU, false when it isn't flagged
+func stockThreshold(sku string) (int, bool) {
+	for _, threshold := range stockThresholds {
+		if scopeMatches([]string{threshold.Sku}, sku) {
+			return threshold.Below, true
+		}
+	}
+	return 0, false
+}
+
+// checkStockAlerts alerts on the flagged SKUs whose available stock (home DCs, less
+// active reservations) dropped below their threshold or to zero since the last check.
+// SKUs back above their threshold are cleared silently, to alert again on the next drop.
+func checkStockAlerts(customer string) {
+	if len(stockThresholds) == 0 {
+		return
+	}
+
+	levels, err := availability(nil)
+	if err != nil {
+		log.Printf("Error checking stock alerts: %v", err)
+		return
+	}
+
+	db, err := openDB()
+	if err != nil {
+		log.Printf("Error checking stock alerts: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var alerts []Alert
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(stockAlertsBucketName))
+		if err != nil {
+			return err
+		}
+		skus := make([]string, 0, len(levels))
+		for sku := range levels {
+			skus = append(skus, sku)
+		}
+		sort.Strings(skus)
+
+		for _, sku := range skus {
+			level := levels[sku]
+			below, ok := stockThreshold(sku)
+			if !ok {
+				continue
+			}
+			state := ""
+			switch {
+			case level.available <= 0:
+				state = stockOut
+			case level.available < below:
+				state = stockLow
+			}
+
+			previous := string(bucket.Get([]byte(sku)))
+			if state == previous {
+				continue
+			}
+			if state == "" {
+				if err := bucket.Delete([]byte(sku)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bucket.Put([]byte(sku), []byte(state)); err != nil {
+				return err
+			}
+			// Partly restocked SKUs are still low, which was already alerted
+			if state == stockLow && previous == stockOut {
+				continue
+			}
+
+			available := level.available
+			message := fmt.Sprintf("%s has %d available, below %d", sku, available, below)
+			if state == stockOut {
+				message = fmt.Sprintf("%s is out of stock", sku)
+			}
+			alerts = append(alerts, Alert{
+				Event:     state,
+				Supplier:  AshleySupplier,
+				Customer:  customer,
+				Fetcher:   "inventory",
+				Message:   message,
+				Sku:       sku,
+				Available: &available,
+				At:        time.Now(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving stock alert states: %v", err)
+		return
+	}
+
+	for _, alert := range alerts {
+		log.Printf("ALERT: %s", alert.Message)
+		sendAlert(alert)
+	}
+}
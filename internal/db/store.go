@@ -0,0 +1,118 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// store is the process wide handle of the database. Bolt locks the file for each
+// handle, so opening one per operation made a sync and an overlapping admin job or
+// request time out waiting on each other. Reads run concurrently on the shared
+// handle; writes are queued to a single goroutine owning it, which applies them in
+// order.
+type store struct {
+	db     *bolt.DB
+	writes chan writeRequest
+}
+
+// writeRequest is a write transaction submitted to the writer. A nil fn stops it.
+type writeRequest struct {
+	fn   func(*bolt.Tx) error
+	done chan writeResult
+}
+
+type writeResult struct {
+	err       error
+	recovered any // Panic raised by fn, raised again in the submitting goroutine
+}
+
+var (
+	storeMu sync.Mutex
+	shared  *store
+)
+
+// openDB returns the shared database handle, opening it and starting its writer on
+// first use
+func openDB() (*store, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if shared != nil {
+		return shared, nil
+	}
+
+	db, err := bolt.Open(DatabaseName, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	shared = &store{db: db, writes: make(chan writeRequest)}
+	go shared.writer()
+	return shared, nil
+}
+
+// closeDB stops the writer and closes the shared handle; the next openDB reopens the
+// file. Only for commands replacing the file, with no other database use in flight.
+func closeDB() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if shared == nil {
+		return nil
+	}
+
+	done := make(chan writeResult, 1)
+	shared.writes <- writeRequest{done: done}
+	<-done
+
+	err := shared.db.Close()
+	shared = nil
+	return err
+}
+
+// writer applies the submitted write transactions one at a time
+func (s *store) writer() {
+	for request := range s.writes {
+		if request.fn == nil {
+			request.done <- writeResult{}
+			return
+		}
+		request.done <- s.write(request.fn)
+	}
+}
+
+// write runs fn in a read-write transaction, rolled back when fn fails or panics
+func (s *store) write(fn func(*bolt.Tx) error) (result writeResult) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result.recovered = recovered
+		}
+	}()
+	result.err = s.db.Update(fn)
+	return result
+}
+
+// Update runs fn in a read-write transaction on the writer and waits for it. fn must
+// not itself write through openDB, which would wait on the writer running it.
+func (s *store) Update(fn func(*bolt.Tx) error) error {
+	done := make(chan writeResult, 1)
+	s.writes <- writeRequest{fn: fn, done: done}
+
+	result := <-done
+	if result.recovered != nil {
+		panic(result.recovered)
+	}
+	return result.err
+}
+
+// View runs fn in a read-only transaction, concurrently with other reads and the writer
+func (s *store) View(fn func(*bolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+// Close ends the caller's use of the handle. The handle is shared, so it stays open.
+func (s *store) Close() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// AshleySupplier is the name of the built-in supplier
+const AshleySupplier = "ashley"
+
+// Supplier is a furniture vendor whose API is synced into the store. Ashley is built
+// in; other vendors are plugins that register a Supplier and its fetchers from an
+// init function, each with its own settings, auth, pagination and transform.
+type Supplier struct {
+	Name      string // Lowercase name, e.g. "acme"; its catalog lives in the supplier:<name> bucket
+	EnvPrefix string // Prefix of its settings, e.g. "ACME_" for ACME_BASE_URL
+
+	// Authorize sets the credentials of a request. Nil sends the Authorization and
+	// Client_Id headers, as Ashley expects.
+	Authorize func(req *http.Request, config APIConfig)
+}
+
+// suppliers holds every known supplier by name
+var suppliers = map[string]Supplier{
+	AshleySupplier: {Name: AshleySupplier, EnvPrefix: "API_"},
+}
+
+// RegisterSupplier adds a vendor plugin. Its fetchers are registered with
+// RegisterSupplierFetcher.
+func RegisterSupplier(supplier Supplier) {
+	if !supplierNamePattern.MatchString(supplier.Name) {
+		panic(fmt.Sprintf("invalid supplier name %q", supplier.Name))
+	}
+	if _, exists := suppliers[supplier.Name]; exists {
+		panic(fmt.Sprintf("supplier %q already registered", supplier.Name))
+	}
+	suppliers[supplier.Name] = supplier
+}
+
+// RegisterSupplierFetcher adds a fetcher of a registered supplier. A fetcher whose
+// bucket is the supplier's catalog bucket (see SupplierBucket) must transform into
+// SupplierProduct records; they are merged into /products with proveedor defaulting
+// to the supplier name.
+func RegisterSupplierFetcher[T DatabaseEntity](supplier, name string, fetcher Fetchable[T]) {
+	if _, ok := suppliers[supplier]; !ok {
+		panic(fmt.Sprintf("fetcher %q registered for unknown supplier %q", name, supplier))
+	}
+
+	register(supplier, name, fetcher)
+
+	if fetcher.GetBucketName() == SupplierBucket(supplier) {
+		AddStage(name, PhaseNormalize, "supplier", StageFor(func(p SupplierProduct) (SupplierProduct, error) {
+			if p.Supplier == "" {
+				p.Supplier = supplier
+			}
+			return p, nil
+		}))
+	}
+}
+
+// RegisteredSuppliers returns the names of all registered suppliers, sorted
+func RegisteredSuppliers() []string {
+	names := make([]string, 0, len(suppliers))
+	for name := range suppliers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SupplierEnvPrefix returns the settings prefix of a registered supplier
+func SupplierEnvPrefix(supplier string) string {
+	return suppliers[supplier].EnvPrefix
+}
+
+// SupplierBucket returns the bucket holding the catalog of a supplier, shared by
+// its fetchers and POST /products/import
+func SupplierBucket(supplier string) string {
+	return supplierBucketPrefix + supplier
+}
+
+// hasFetchers reports whether any registered fetcher belongs to supplier
+func hasFetchers(supplier string) bool {
+	for _, syncer := range registry.syncers {
+		if syncer.Supplier() == supplier {
+			return true
+		}
+	}
+	return false
+}
+
+// For returns the settings of a supplier: the config itself for Ashley, otherwise the
+// supplier's own settings. Sync wide settings (validation, raw pages, quota reserve,
+// request rate, chaos mode, schema drift, conditional pages) are shared.
+func (c APIConfig) For(supplier string) APIConfig {
+	if supplier == AshleySupplier || supplier == "" {
+		return c
+	}
+
+	config := c.Suppliers[supplier]
+	config.Supplier = supplier
+	config.StoreRawPages = c.StoreRawPages
+	config.StoreRawEntities = c.StoreRawEntities
+	config.Validation = c.Validation
+	config.QuotaReserve = c.QuotaReserve
+	config.RequestRate = c.RequestRate
+	config.Chaos = c.Chaos
+	config.SchemaDrift = c.SchemaDrift
+	config.ConditionalPages = c.ConditionalPages
+	return config
+}
+
+// authorize sets the credentials of the config's supplier on req
+func authorize(req *http.Request, config APIConfig) {
+	if supplier, ok := suppliers[config.Supplier]; ok && supplier.Authorize != nil {
+		supplier.Authorize(req, config)
+		return
+	}
+
+	req.Header.Set("Authorization", config.Authorization)
+	req.Header.Set("Client_Id", config.ClientID)
+}
+
+// FetchJSON requests url with the credentials of config's supplier and decodes the
+// JSON answer, with the same metrics, quota tracking and error classification as
+// Ashley requests. Returns the raw body for the raw page cache.
+func FetchJSON[T any](ctx context.Context, url string, config APIConfig) (*T, []byte, error) {
+	return makeHTTPRequest[T](ctx, url, config)
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// errNoChanges is returned by a fetcher's Sync when the upstream catalog reports the
+// same version as its last successful sync, so the page walk was skipped
+var errNoChanges = errors.New("skipped (no changes)")
+
+// catalogVersionHeaders report the version of a whole endpoint, tried in order. ETag is
+// left out: it identifies the page that was requested, not the catalog.
+var catalogVersionHeaders = []string{"X-Catalog-Version", "Last-Modified"}
+
+type versionContextKey struct{}
+
+// withVersionProbe returns ctx recording into version the catalog version reported by
+// the first upstream response received under it
+func withVersionProbe(ctx context.Context, version *string) context.Context {
+	return context.WithValue(ctx, versionContextKey{}, version)
+}
+
+// recordCatalogVersion stores the catalog version of resp when ctx is probing for one
+func recordCatalogVersion(ctx context.Context, resp *http.Response) {
+	version, ok := ctx.Value(versionContextKey{}).(*string)
+	if !ok || *version != "" {
+		return
+	}
+	for _, name := range catalogVersionHeaders {
+		if value := strings.TrimSpace(resp.Header.Get(name)); value != "" {
+			*version = name + ": " + value
+			return
+		}
+	}
+}
+
+// catalogVersion requests a single record of the fetcher and returns the catalog version
+// the response reports, empty when the endpoint reports none
+func (fs fetcherSyncer[T]) catalogVersion(ctx context.Context, config APIConfig) (string, error) {
+	config.Limit = 1
+	// Descriptions in further languages don't change the version
+	if len(config.Languages) > 1 {
+		config.Languages = config.Languages[:1]
+	}
+
+	var version string
+	if _, err := fs.fetcher.FetchPage(withVersionProbe(ctx, &version), config, 1); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// unchangedSince checks, before a page walk, whether the endpoint still reports the
+// version of the fetcher's last successful sync. Any doubt (no version, a failed probe,
+// a last sync that didn't complete) means the sync runs. The probed version is returned
+// to be stored once the sync succeeds.
+func (fs fetcherSyncer[T]) unchangedSince(ctx context.Context, config APIConfig, last SyncStatus) (bool, string) {
+	version, err := fs.catalogVersion(ctx, config)
+	if err != nil {
+		syncLogger(config.Customer).Printf("Error checking the %s catalog version, syncing: %v", fs.name, err)
+		return false, ""
+	}
+	if version == "" {
+		return false, ""
+	}
+
+	completed := last.State == SyncStateOK || last.State == SyncStateSkipped
+	return completed && version == last.CatalogVersion, version
+}
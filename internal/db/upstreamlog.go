@@ -0,0 +1,199 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces credentials in logged requests
+const redacted = "REDACTED"
+
+// upstreamLogging is the debug mode logging every upstream request
+var upstreamLogging struct {
+	sync.Mutex
+	enabled bool
+	until   time.Time // When it switches itself off, zero for never
+	timer   *time.Timer
+}
+
+// upstreamLoggingState is the debug mode as GET/PUT /admin/upstream-logging show it
+type upstreamLoggingState struct {
+	Enabled bool       `json:"enabled"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// SetUpstreamLogging switches the logging of upstream requests on or off. When
+// enabled for a duration (> 0), it switches itself off afterwards.
+func SetUpstreamLogging(enabled bool, duration time.Duration) {
+	upstreamLogging.Lock()
+	defer upstreamLogging.Unlock()
+
+	if upstreamLogging.timer != nil {
+		upstreamLogging.timer.Stop()
+		upstreamLogging.timer = nil
+	}
+	upstreamLogging.enabled = enabled
+	upstreamLogging.until = time.Time{}
+	if enabled && duration > 0 {
+		upstreamLogging.until = time.Now().Add(duration)
+		var timer *time.Timer
+		timer = time.AfterFunc(duration, func() {
+			upstreamLogging.Lock()
+			defer upstreamLogging.Unlock()
+			if upstreamLogging.timer != timer { // Switched again meanwhile
+				return
+			}
+			upstreamLogging.enabled = false
+			upstreamLogging.until = time.Time{}
+			upstreamLogging.timer = nil
+			log.Print("Upstream request logging switched off")
+		})
+		upstreamLogging.timer = timer
+	}
+}
+
+// loggingUpstream returns the state of the debug mode
+func loggingUpstream() upstreamLoggingState {
+	upstreamLogging.Lock()
+	defer upstreamLogging.Unlock()
+
+	state := upstreamLoggingState{Enabled: upstreamLogging.enabled}
+	if !upstreamLogging.until.IsZero() {
+		until := upstreamLogging.until
+		state.Until = &until
+	}
+	return state
+}
+
+// countingBody counts the bytes read from a response body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// logUpstreamRequest logs an upstream request when the debug mode or debug logging is
+// on: its URL and headers with credentials redacted, and the status, size and duration
+// of the response
+func logUpstreamRequest(req *http.Request, resp *http.Response, size int64, elapsed time.Duration, err error) {
+	if !loggingUpstream().Enabled && !debugLogging() {
+		return
+	}
+
+	// The error repeats the URL without redaction
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	outcome := fmt.Sprintf("error: %v", err)
+	if resp != nil {
+		outcome = fmt.Sprintf("%d, %d bytes", resp.StatusCode, size)
+	}
+	log.Printf("Upstream %s %s -> %s in %v (headers: %s)", req.Method, redactURL(req.URL), outcome,
+		elapsed.Round(time.Millisecond), redactHeaders(req.Header))
+}
+
+// credentialName reports whether a header or query parameter holds credentials:
+// Ashley's Authorization and Client_Id, and the keys and tokens of other suppliers
+func credentialName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range []string{"auth", "client_id", "key", "token", "secret", "password", "signature"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns u with the credentials in its user info and query redacted
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	if u.User != nil {
+		redactedURL.User = url.User(redacted)
+	}
+	query := u.Query()
+	for name := range query {
+		if credentialName(name) {
+			query.Set(name, redacted)
+			redactedURL.RawQuery = query.Encode()
+		}
+	}
+	return redactedURL.String()
+}
+
+// redactHeaders formats headers as Name=value pairs in name order, with credentials
+// redacted
+func redactHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if credentialName(name) {
+			value = redacted
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// upstreamLoggingHandler shows whether upstream requests are logged
+func (s *server) upstreamLoggingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, loggingUpstream())
+}
+
+// setUpstreamLoggingHandler switches the logging of upstream requests on or off,
+// optionally for a duration, e.g. {"enabled": true, "for": "30m"}
+func (s *server) setUpstreamLoggingHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled *bool  `json:"enabled"`
+		For     string `json:"for"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.Enabled == nil {
+		http.Error(w, "enabled is required", http.StatusBadRequest)
+		return
+	}
+
+	var duration time.Duration
+	if body.For != "" {
+		var err error
+		duration, err = time.ParseDuration(body.For)
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration %q", body.For), http.StatusBadRequest)
+			return
+		}
+	}
+
+	SetUpstreamLogging(*body.Enabled, duration)
+	switch {
+	case !*body.Enabled:
+		log.Print("Upstream request logging switched off")
+	case duration > 0:
+		log.Printf("Upstream request logging switched on for %v", duration)
+	default:
+		log.Print("Upstream request logging switched on")
+	}
+	writeJSON(w, http.StatusOK, loggingUpstream())
+}
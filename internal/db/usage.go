@@ -0,0 +1,200 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/internal/metrics"
+)
+
+// Consumers are told apart by the fingerprint of their API key. Requests without one
+// (read routes while no keys are configured) and with an unknown one get these labels
+// instead, so bad keys can't grow the label sets.
+const (
+	consumerAnonymous = "anonymous"
+	consumerInvalid   = "invalid"
+)
+
+// defaultUsageTop is how many endpoints /admin/usage lists per key without ?top=
+const defaultUsageTop = 5
+
+// API usage metrics are labeled by key fingerprint and route, e.g. "GET /products"
+var (
+	apiRequestsTotal = metrics.NewCounter("ashley_api_requests_total",
+		"Requests served by API key fingerprint, route and status code", "key", "endpoint", "code")
+	apiResponseBytesTotal = metrics.NewCounter("ashley_api_response_bytes_total",
+		"Response bytes sent (compressed when negotiated) by API key fingerprint and route", "key", "endpoint")
+)
+
+// EndpointUsage is the traffic of a consumer on one route
+type EndpointUsage struct {
+	Endpoint string `json:"endpoint"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// KeyUsage is the traffic of a consumer, with its busiest routes
+type KeyUsage struct {
+	Key       string          `json:"key"` // Fingerprint, anonymous or invalid
+	Role      Role            `json:"role,omitempty"`
+	Requests  int64           `json:"requests"`
+	Bytes     int64           `json:"bytes"`
+	LastSeen  time.Time       `json:"lastSeen"`
+	Endpoints []EndpointUsage `json:"endpoints"` // Most requested first
+}
+
+// UsageReport is the traffic of every consumer since the server started
+type UsageReport struct {
+	Since time.Time  `json:"since"`
+	Keys  []KeyUsage `json:"keys"` // Most requests first
+}
+
+// usage accumulates the traffic of every consumer in memory
+var usage = struct {
+	sync.Mutex
+	since time.Time
+	keys  map[string]*KeyUsage
+	// Per key and route
+	endpoints map[string]map[string]*EndpointUsage
+}{
+	since:     time.Now(),
+	keys:      make(map[string]*KeyUsage),
+	endpoints: make(map[string]map[string]*EndpointUsage),
+}
+
+// recordUsage adds a served request to the metrics and the usage report
+func recordUsage(consumer string, role Role, endpoint string, code int, bytes int64) {
+	apiRequestsTotal.Inc(consumer, endpoint, strconv.Itoa(code))
+	apiResponseBytesTotal.Add(float64(bytes), consumer, endpoint)
+
+	usage.Lock()
+	defer usage.Unlock()
+
+	key, ok := usage.keys[consumer]
+	if !ok {
+		key = &KeyUsage{Key: consumer, Role: role}
+		usage.keys[consumer] = key
+		usage.endpoints[consumer] = make(map[string]*EndpointUsage)
+	}
+	key.Requests++
+	key.Bytes += bytes
+	key.LastSeen = time.Now()
+
+	route, ok := usage.endpoints[consumer][endpoint]
+	if !ok {
+		route = &EndpointUsage{Endpoint: endpoint}
+		usage.endpoints[consumer][endpoint] = route
+	}
+	route.Requests++
+	route.Bytes += bytes
+}
+
+// usageReport returns the traffic of every consumer with its top busiest routes
+func usageReport(top int) UsageReport {
+	usage.Lock()
+	defer usage.Unlock()
+
+	report := UsageReport{Since: usage.since, Keys: make([]KeyUsage, 0, len(usage.keys))}
+	for consumer, key := range usage.keys {
+		entry := *key
+		entry.Endpoints = make([]EndpointUsage, 0, len(usage.endpoints[consumer]))
+		for _, route := range usage.endpoints[consumer] {
+			entry.Endpoints = append(entry.Endpoints, *route)
+		}
+		sort.Slice(entry.Endpoints, func(i, j int) bool {
+			if entry.Endpoints[i].Requests != entry.Endpoints[j].Requests {
+				return entry.Endpoints[i].Requests > entry.Endpoints[j].Requests
+			}
+			return entry.Endpoints[i].Endpoint < entry.Endpoints[j].Endpoint
+		})
+		if len(entry.Endpoints) > top {
+			entry.Endpoints = entry.Endpoints[:top]
+		}
+		report.Keys = append(report.Keys, entry)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		if report.Keys[i].Requests != report.Keys[j].Requests {
+			return report.Keys[i].Requests > report.Keys[j].Requests
+		}
+		return report.Keys[i].Key < report.Keys[j].Key
+	})
+	return report
+}
+
+// usageResponseWriter counts the status and bytes of a response
+type usageResponseWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *usageResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *usageResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses (sync progress) working through the counter
+func (w *usageResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// identify returns the fingerprint and role of the request's API key, or consumerAnonymous
+// or consumerInvalid
+func (s *server) identify(r *http.Request) (string, Role) {
+	key := apiKeyFromRequest(r)
+	if key == "" || len(s.config.APIKeys) == 0 {
+		return consumerAnonymous, ""
+	}
+	apiKey, ok := s.lookupKey(key)
+	if !ok {
+		return consumerInvalid, ""
+	}
+	return keyFingerprint(key), apiKey.Role
+}
+
+// trackUsage wraps the handler of a route to record the requests of each consumer
+func (s *server) trackUsage(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consumer, role := s.identify(r)
+
+		counter := &usageResponseWriter{ResponseWriter: w}
+		next(counter, r)
+		if counter.code == 0 {
+			counter.code = http.StatusOK
+		}
+		recordUsage(consumer, role, endpoint, counter.code, counter.bytes)
+	}
+}
+
+// usageHandler serves the traffic of every API key since the server started, with
+// the ?top= (default 5) routes each requested most
+func (s *server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	top := defaultUsageTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid top: must be a positive integer, got %q", value), http.StatusBadRequest)
+			return
+		}
+		top = parsed
+	}
+
+	writeJSON(w, http.StatusOK, usageReport(top))
+}
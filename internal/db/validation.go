@@ -0,0 +1,208 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const quarantineBucketName = "quarantine"
+
+// Bound is the accepted [Min, Max] range of a numeric field. Values outside the
+// range are flagged, or rejected when Reject is set.
+type Bound struct {
+	Min    float64
+	Max    float64
+	Reject bool
+}
+
+// ValidationConfig maps bucket name and JSON field name of the stored record
+// to its accepted range, e.g. Bounds["products"]["unitHeightMm"]
+type ValidationConfig struct {
+	Bounds map[string]map[string]Bound
+}
+
+// ParseBounds parses comma separated bounds in the form bucket.field=min:max[:reject|flag],
+// e.g. "products.unitHeightMm=1:5000:reject,products.itemWeightKg=0.1:2000"
+func ParseBounds(s string) (ValidationConfig, error) {
+	config := ValidationConfig{Bounds: make(map[string]map[string]Bound)}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		field, rangeStr, found := strings.Cut(entry, "=")
+		if !found {
+			return config, fmt.Errorf("invalid bound %q: expected bucket.field=min:max", entry)
+		}
+
+		bucketName, fieldName, found := strings.Cut(strings.TrimSpace(field), ".")
+		if !found || bucketName == "" || fieldName == "" {
+			return config, fmt.Errorf("invalid bound %q: field must be qualified with its bucket (e.g. products.unitHeightMm)", entry)
+		}
+
+		parts := strings.Split(rangeStr, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return config, fmt.Errorf("invalid bound %q: expected min:max[:reject|flag]", entry)
+		}
+
+		var bound Bound
+		var err error
+		if bound.Min, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+			return config, fmt.Errorf("invalid minimum in bound %q: %v", entry, err)
+		}
+		if bound.Max, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return config, fmt.Errorf("invalid maximum in bound %q: %v", entry, err)
+		}
+		if bound.Min > bound.Max {
+			return config, fmt.Errorf("invalid bound %q: minimum is greater than maximum", entry)
+		}
+
+		if len(parts) == 3 {
+			switch strings.TrimSpace(parts[2]) {
+			case "reject":
+				bound.Reject = true
+			case "flag":
+			default:
+				return config, fmt.Errorf("invalid mode in bound %q: expected reject or flag", entry)
+			}
+		}
+
+		if config.Bounds[bucketName] == nil {
+			config.Bounds[bucketName] = make(map[string]Bound)
+		}
+		config.Bounds[bucketName][fieldName] = bound
+	}
+
+	return config, nil
+}
+
+// QuarantineRecord describes a record that failed validation
+type QuarantineRecord struct {
+	Bucket   string          `json:"bucket"`
+	Sku      string          `json:"sku"`
+	Issues   []string        `json:"issues"`
+	Rejected bool            `json:"rejected"` // true when the record was not stored
+	Record   json.RawMessage `json:"record"`
+	At       time.Time       `json:"at"`
+}
+
+// validateRecord checks the serialized record against the bounds of its bucket.
+// Returns the issues found and whether any of them rejects the record.
+func (v ValidationConfig) validateRecord(bucketName string, data []byte) ([]string, bool, error) {
+	bounds := v.Bounds[bucketName]
+	if len(bounds) == 0 {
+		return nil, false, nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false, err
+	}
+
+	var issues []string
+	rejected := false
+
+	names := make([]string, 0, len(bounds))
+	for name := range bounds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		bound := bounds[name]
+		value, ok := fields[name].(float64)
+		if !ok {
+			continue
+		}
+
+		if value < bound.Min || value > bound.Max {
+			issues = append(issues, fmt.Sprintf("%s=%v outside [%v, %v]", name, value, bound.Min, bound.Max))
+			rejected = rejected || bound.Reject
+		}
+	}
+
+	return issues, rejected, nil
+}
+
+// quarantine writes or clears the quarantine entry of a record within the caller's transaction
+func quarantine(tx *bolt.Tx, record QuarantineRecord) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(quarantineBucketName))
+	if err != nil {
+		return err
+	}
+
+	key := []byte(record.Bucket + "/" + record.Sku)
+	if len(record.Issues) == 0 {
+		return bucket.Delete(key)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshaling quarantine record %s: %v", record.Sku, err)
+	}
+	sealed, err := sealValue(quarantineBucketName, key, data)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, sealed)
+}
+
+// GetQuarantine returns every record currently in quarantine
+func GetQuarantine() ([]QuarantineRecord, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	records := []QuarantineRecord{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(quarantineBucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			v, err := openValue(quarantineBucketName, k, v)
+			if err != nil {
+				return err
+			}
+			var record QuarantineRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// quarantineHandler serves the records that failed validation
+func (s *server) quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := GetQuarantine()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching quarantine: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
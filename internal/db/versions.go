@@ -0,0 +1,627 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/calmestend/ashley-furniture-service/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	versionsBucketName     = "versions"      // version -> gzip compressed catalogSnapshot
+	versionIndexBucketName = "version_index" // version -> CatalogVersion
+)
+
+// CatalogVersion describes a snapshot of the catalog taken after a completed sync
+type CatalogVersion = api.CatalogVersion
+
+// catalogSnapshot holds the stored records of every snapshotted bucket, keyed by SKU
+type catalogSnapshot map[string]map[string]json.RawMessage
+
+func versionKey(version uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, version)
+	return key
+}
+
+// CreateVersion snapshots the buckets of the given fetchers along with the manual
+// replacements as a new catalog version, keeping only the newest keep versions
+func CreateVersion(fetchers []Syncer, keep int) (CatalogVersion, error) {
+	var version CatalogVersion
+
+	db, err := openDB()
+	if err != nil {
+		return version, err
+	}
+	defer db.Close()
+
+	bucketNames := []string{replacementsBucketName}
+	for _, fetcher := range fetchers {
+		bucketNames = append(bucketNames, fetcher.BucketName())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		snapshot := make(catalogSnapshot)
+		version.Records = make(map[string]int)
+		for _, bucketName := range bucketNames {
+			records := make(map[string]json.RawMessage)
+			if bucket := recordsOf(tx, bucketName); bucket != nil {
+				err := bucket.ForEach(func(k, v []byte) error {
+					v, err := openValue(bucketName, k, v)
+					if err != nil {
+						return err
+					}
+					records[string(k)] = append(json.RawMessage(nil), v...)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			snapshot[bucketName] = records
+			version.Records[bucketName] = len(records)
+		}
+
+		data, err := compressSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+
+		versions, err := tx.CreateBucketIfNotExists([]byte(versionsBucketName))
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists([]byte(versionIndexBucketName))
+		if err != nil {
+			return err
+		}
+
+		version.Version, err = index.NextSequence()
+		if err != nil {
+			return err
+		}
+		version.CreatedAt = time.Now()
+		version.Size = len(data)
+
+		meta, err := json.Marshal(version)
+		if err != nil {
+			return err
+		}
+		sealed, err := sealValue(versionsBucketName, versionKey(version.Version), data)
+		if err != nil {
+			return err
+		}
+		if err := versions.Put(versionKey(version.Version), sealed); err != nil {
+			return err
+		}
+		if err := index.Put(versionKey(version.Version), meta); err != nil {
+			return err
+		}
+
+		return pruneVersions(tx, keep)
+	})
+
+	if err != nil {
+		return version, fmt.Errorf("error creating catalog version: %v", err)
+	}
+
+	return version, nil
+}
+
+// pruneVersions removes all but the newest keep versions
+func pruneVersions(tx *bolt.Tx, keep int) error {
+	versions := tx.Bucket([]byte(versionsBucketName))
+	index := tx.Bucket([]byte(versionIndexBucketName))
+
+	var expired [][]byte
+	count := 0
+	c := index.Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		count++
+		if count > keep {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+	}
+
+	for _, key := range expired {
+		if err := versions.Delete(key); err != nil {
+			return err
+		}
+		if err := index.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compressSnapshot(snapshot catalogSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return nil, fmt.Errorf("error compressing snapshot: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing snapshot: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// GetVersions returns every retained catalog version, newest first
+func GetVersions() ([]CatalogVersion, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	versions := []CatalogVersion{}
+	err = db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(versionIndexBucketName))
+		if index == nil {
+			return nil
+		}
+
+		c := index.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var version CatalogVersion
+			if err := json.Unmarshal(v, &version); err != nil {
+				return err
+			}
+			versions = append(versions, version)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// versionAt returns the newest version created at or before t, which is the
+// catalog that was being served at that time
+func versionAt(t time.Time) (uint64, error) {
+	versions, err := GetVersions()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, version := range versions {
+		if !version.CreatedAt.After(t) {
+			return version.Version, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: no catalog version retained from before %s", ErrNotFound, t.Format(time.RFC3339))
+}
+
+// loadVersion returns the snapshot of a catalog version
+func loadVersion(version uint64) (catalogSnapshot, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var data []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket([]byte(versionsBucketName))
+		if versions == nil {
+			return fmt.Errorf("%w: catalog version %d", ErrNotFound, version)
+		}
+		stored := versions.Get(versionKey(version))
+		if stored == nil {
+			return fmt.Errorf("%w: catalog version %d", ErrNotFound, version)
+		}
+		opened, err := openValue(versionsBucketName, versionKey(version), stored)
+		if err != nil {
+			return err
+		}
+		data = append([]byte(nil), opened...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing catalog version %d: %v", version, err)
+	}
+	defer zr.Close()
+
+	var snapshot catalogSnapshot
+	if err := json.NewDecoder(zr).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("error decoding catalog version %d: %v", version, err)
+	}
+
+	return snapshot, nil
+}
+
+// snapshotEntities decodes the records of a bucket in a snapshot
+func snapshotEntities[T DatabaseEntity](snapshot catalogSnapshot, bucketName string) ([]T, error) {
+	skus := make([]string, 0, len(snapshot[bucketName]))
+	for sku := range snapshot[bucketName] {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	entities := make([]T, 0, len(skus))
+	for _, sku := range skus {
+		var entity T
+		if err := json.Unmarshal(snapshot[bucketName][sku], &entity); err != nil {
+			return nil, fmt.Errorf("error decoding %s %s: %v", bucketName, sku, err)
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities, nil
+}
+
+// buildVersionProductResponses builds the /products response as it was served at a
+// catalog version, optionally restricted to the product carrying upc or to the given SKUs
+func buildVersionProductResponses(snapshot catalogSnapshot, upc string, skus []string) ([]ProductResponseData, error) {
+	products, err := snapshotEntities[ProductRequestData](snapshot, "products")
+	if err != nil {
+		return nil, err
+	}
+	prices, err := snapshotEntities[PriceRequestData](snapshot, "prices")
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := snapshotEntities[ReplacementOverride](snapshot, replacementsBucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	if upc != "" {
+		var matched []ProductRequestData
+		for _, product := range products {
+			if product.Upc == upc || product.Gtin == upc {
+				matched = append(matched, product)
+			}
+		}
+		products = matched
+	}
+	if len(skus) > 0 {
+		bySKU := make(map[string]ProductRequestData, len(products))
+		for _, product := range products {
+			bySKU[product.Sku] = product
+		}
+		var matched []ProductRequestData
+		for _, sku := range skus {
+			if product, ok := bySKU[sku]; ok {
+				matched = append(matched, product)
+			}
+		}
+		products = matched
+	}
+
+	priceMap := make(map[string]PriceRequestData, len(prices))
+	for _, price := range prices {
+		priceMap[price.Sku] = price
+	}
+	replacements := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		replacements[override.Sku] = override.ReplacedBy
+	}
+
+	return mergeProductResponses(products, priceMap, replacements, nil), nil
+}
+
+// FieldChange is the old and new value of a field that differs between versions
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// RecordDiff lists the fields of a record that differ between versions
+type RecordDiff struct {
+	Sku    string                 `json:"sku"`
+	Fields map[string]FieldChange `json:"fields"`
+}
+
+// BucketDiff lists the records of a bucket added, removed or changed between versions
+type BucketDiff struct {
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []RecordDiff `json:"changed"`
+}
+
+// VersionDiff compares two catalog versions bucket by bucket
+type VersionDiff struct {
+	From    uint64                `json:"from"`
+	To      uint64                `json:"to"`
+	Buckets map[string]BucketDiff `json:"buckets"`
+}
+
+// DiffVersions compares the snapshots of two catalog versions
+func DiffVersions(from, to uint64) (VersionDiff, error) {
+	diff := VersionDiff{From: from, To: to, Buckets: make(map[string]BucketDiff)}
+
+	before, err := loadVersion(from)
+	if err != nil {
+		return diff, err
+	}
+	after, err := loadVersion(to)
+	if err != nil {
+		return diff, err
+	}
+
+	bucketNames := make(map[string]bool)
+	for name := range before {
+		bucketNames[name] = true
+	}
+	for name := range after {
+		bucketNames[name] = true
+	}
+
+	for name := range bucketNames {
+		bucketDiff, err := diffRecords(before[name], after[name])
+		if err != nil {
+			return diff, fmt.Errorf("error comparing %s: %v", name, err)
+		}
+		diff.Buckets[name] = bucketDiff
+	}
+
+	return diff, nil
+}
+
+// diffRecords compares two sets of stored records field by field
+func diffRecords(before, after map[string]json.RawMessage) (BucketDiff, error) {
+	diff := BucketDiff{Added: []string{}, Removed: []string{}, Changed: []RecordDiff{}}
+
+	for sku := range after {
+		if _, ok := before[sku]; !ok {
+			diff.Added = append(diff.Added, sku)
+		}
+	}
+
+	for sku, old := range before {
+		updated, ok := after[sku]
+		if !ok {
+			diff.Removed = append(diff.Removed, sku)
+			continue
+		}
+		if bytes.Equal(old, updated) {
+			continue
+		}
+
+		var oldFields, newFields map[string]any
+		if err := json.Unmarshal(old, &oldFields); err != nil {
+			return diff, err
+		}
+		if err := json.Unmarshal(updated, &newFields); err != nil {
+			return diff, err
+		}
+
+		changes := make(map[string]FieldChange)
+		for field, value := range newFields {
+			if !reflect.DeepEqual(oldFields[field], value) {
+				changes[field] = FieldChange{From: oldFields[field], To: value}
+			}
+		}
+		for field, value := range oldFields {
+			if _, ok := newFields[field]; !ok {
+				changes[field] = FieldChange{From: value}
+			}
+		}
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, RecordDiff{Sku: sku, Fields: changes})
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Sku < diff.Changed[j].Sku })
+
+	return diff, nil
+}
+
+// requestedVersion resolves ?version=<n> or ?asOf=<RFC 3339 timestamp>.
+// Returns 0 when neither is given, meaning the live catalog.
+func requestedVersion(r *http.Request) (uint64, error) {
+	query := r.URL.Query()
+
+	if value := query.Get("version"); value != "" {
+		version, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || version == 0 {
+			return 0, fmt.Errorf("version must be a positive integer, got %q", value)
+		}
+		return version, nil
+	}
+
+	if value := query.Get("asOf"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, fmt.Errorf("asOf must be an RFC 3339 timestamp, got %q", value)
+		}
+		return versionAt(t)
+	}
+
+	return 0, nil
+}
+
+// versionsHandler lists the retained catalog versions
+func (s *server) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	versions, err := GetVersions()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// versionDiffHandler compares two catalog versions
+func (s *server) versionDiffHandler(w http.ResponseWriter, r *http.Request) {
+	from, errFrom := strconv.ParseUint(r.PathValue("from"), 10, 64)
+	to, errTo := strconv.ParseUint(r.PathValue("to"), 10, 64)
+	if errFrom != nil || errTo != nil {
+		http.Error(w, "Versions must be positive integers", http.StatusBadRequest)
+		return
+	}
+
+	diff, err := DiffVersions(from, to)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error comparing versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeRedactedJSON(w, r, http.StatusOK, diff)
+}
+
+// RestoreResult summarizes the restore of the catalog to a version
+type RestoreResult struct {
+	Version  uint64         `json:"version"`           // The version restored
+	Run      string         `json:"run"`               // Journal run of the restore, which can itself be rolled back
+	Restored map[string]int `json:"restored"`          // Records put back or removed per bucket
+	Created  uint64         `json:"created,omitempty"` // The version snapshotting the restored catalog
+}
+
+// RestoreVersion rewrites the snapshotted buckets to their records at a catalog version,
+// in a single transaction. Changed and removed records are put back and records added
+// since are removed, through the change feed and journal like any other change.
+func RestoreVersion(version uint64) (RestoreResult, error) {
+	result := RestoreResult{Version: version, Restored: make(map[string]int)}
+
+	snapshot, err := loadVersion(version)
+	if err != nil {
+		return result, err
+	}
+
+	run, err := newRun(SourceRollback)
+	if err != nil {
+		return result, err
+	}
+	result.Run = run.ID
+
+	bucketNames := make([]string, 0, len(snapshot))
+	for bucketName := range snapshot {
+		bucketNames = append(bucketNames, bucketName)
+	}
+	sort.Strings(bucketNames)
+
+	db, err := openDB()
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range bucketNames {
+			records := snapshot[bucketName]
+			bucket, err := createRecords(tx, bucketName)
+			if err != nil {
+				return err
+			}
+
+			// Collect the current records before rewriting the bucket
+			current := make(map[string][]byte)
+			err = bucket.ForEach(func(k, v []byte) error {
+				v, err := openValue(bucketName, k, v)
+				if err != nil {
+					return err
+				}
+				current[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			count := 0
+			for sku := range current {
+				if _, ok := records[sku]; ok {
+					continue
+				}
+				if err := deleteRecord(tx, run, bucket, bucketName, sku); err != nil {
+					return fmt.Errorf("error removing %s %s: %v", bucketName, sku, err)
+				}
+				count++
+			}
+			for sku, record := range records {
+				if bytes.Equal(current[sku], record) {
+					continue
+				}
+				if err := restoreRecord(tx, run, bucketName, sku, current[sku], []byte(record)); err != nil {
+					return fmt.Errorf("error restoring %s %s: %v", bucketName, sku, err)
+				}
+				count++
+			}
+			result.Restored[bucketName] = count
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error restoring catalog version %d: %v", version, err)
+	}
+
+	invalidateCache()
+	refreshServingFile()
+	return result, nil
+}
+
+// restoreVersionHandler restores the catalog to ?version=, e.g. after a bad upstream
+// push, and snapshots the result as a new version
+func (s *server) restoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	if err != nil || version == 0 {
+		http.Error(w, "version must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	result, err := RestoreVersion(version)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring version: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Restored catalog version %d as journal run %s", version, result.Run)
+
+	// The restored catalog is what's served from now on
+	if keep := s.config.Upstream.KeepVersions; keep > 0 {
+		created, err := CreateVersion(s.config.Fetchers, keep)
+		if err != nil {
+			log.Printf("Error snapshotting restored catalog: %v", err)
+		} else {
+			result.Created = created.Version
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// snapshotAfterSync creates a catalog version unless versioning is disabled
+func snapshotAfterSync(fetchers []Syncer, keep int) {
+	if keep <= 0 {
+		return
+	}
+
+	version, err := CreateVersion(fetchers, keep)
+	if err != nil {
+		log.Printf("Error snapshotting catalog: %v", err)
+		return
+	}
+	log.Printf("Created catalog version %d (%d bytes)", version.Version, version.Size)
+}
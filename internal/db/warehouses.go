@@ -0,0 +1,122 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// homeWarehouses are the distribution centers we ship from, in priority order. When
+// set, only their stock counts as available; empty counts every warehouse.
+var homeWarehouses []string
+
+// SetHomeWarehouses sets the distribution centers counted as available stock, in the
+// order reservations draw from them
+func SetHomeWarehouses(warehouses []string) {
+	homeWarehouses = nil
+	for _, warehouse := range warehouses {
+		if warehouse = strings.TrimSpace(warehouse); warehouse != "" {
+			homeWarehouses = append(homeWarehouses, warehouse)
+		}
+	}
+}
+
+// warehousePriority returns the position of a warehouse in the home list and whether
+// it counts as available stock
+func warehousePriority(warehouse string) (int, bool) {
+	if len(homeWarehouses) == 0 {
+		return 0, true
+	}
+	for i, home := range homeWarehouses {
+		if strings.EqualFold(home, warehouse) {
+			return i, true
+		}
+	}
+	return len(homeWarehouses), false
+}
+
+// warehouseLevel is the stock of a SKU in one warehouse with the units reservations
+// hold there
+type warehouseLevel struct {
+	InventoryRequestData
+	home     bool
+	priority int
+	reserved int
+}
+
+// stockLevel is the synced inventory of a SKU after local reservations
+type stockLevel struct {
+	warehouses []warehouseLevel // Home DCs first in priority order, then the others by name
+
+	stock             int    // Units in the home DCs
+	totalStock        int    // Units in every DC
+	available         int    // Units in the home DCs left after reservations
+	nextAvailableDate string // Earliest next availability date among the home DCs
+}
+
+// newStockLevel applies the active reservations of a SKU to its synced inventory.
+// Units of reservations made before the inventory was synced aren't tied to a
+// warehouse and only reduce the aggregate.
+func newStockLevel(records []InventoryRequestData, reservations []Reservation) stockLevel {
+	allocated := make(map[string]int)
+	unallocated := 0
+	for _, r := range reservations {
+		if len(r.Allocations) == 0 {
+			unallocated += r.Quantity
+			continue
+		}
+		for _, a := range r.Allocations {
+			allocated[a.Warehouse] += a.Quantity
+		}
+	}
+
+	var level stockLevel
+	var earliest time.Time
+	for _, record := range records {
+		priority, home := warehousePriority(record.Warehouse)
+		w := warehouseLevel{InventoryRequestData: record, home: home, priority: priority, reserved: allocated[record.Warehouse]}
+		level.warehouses = append(level.warehouses, w)
+		level.totalStock += record.QuantityAvailable
+		if !home {
+			continue
+		}
+
+		level.stock += record.QuantityAvailable
+		level.available += available(record.QuantityAvailable, w.reserved)
+		if at, ok := parseNextAvailable(record.NextAvailableDate); ok && (earliest.IsZero() || at.Before(earliest)) {
+			earliest = at
+			level.nextAvailableDate = record.NextAvailableDate
+		}
+	}
+	level.available = available(level.available, unallocated)
+
+	sort.Slice(level.warehouses, func(i, j int) bool {
+		a, b := level.warehouses[i], level.warehouses[j]
+		if a.home != b.home {
+			return a.home
+		}
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.Warehouse < b.Warehouse
+	})
+
+	return level
+}
+
+// allocate spreads quantity over the home DCs in priority order, taking what is left
+// in each before moving to the next
+func (level stockLevel) allocate(quantity int) []Allocation {
+	var allocations []Allocation
+	for _, w := range level.warehouses {
+		if quantity == 0 || !w.home {
+			break
+		}
+		take := min(available(w.QuantityAvailable, w.reserved), quantity)
+		if take > 0 {
+			allocations = append(allocations, Allocation{Warehouse: w.Warehouse, Quantity: take})
+			quantity -= take
+		}
+	}
+	return allocations
+}
@@ -0,0 +1,135 @@
+// Package metrics keeps labeled counters and gauges in memory and serves them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types as reported in the # TYPE line
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// family is a metric name with its help text and one value per label combination
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by the rendered label set
+}
+
+// registry holds every family in registration order
+var registry = struct {
+	mu       sync.Mutex
+	families []*family
+}{}
+
+func register(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, existing := range registry.families {
+		if existing.name == name {
+			panic(fmt.Sprintf("metric %q already registered", name))
+		}
+	}
+	registry.families = append(registry.families, f)
+
+	return f
+}
+
+// labelKey renders label values as {a="x",b="y"}, escaped per the exposition format
+func (f *family) labelKey(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", label, values[i])
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func (f *family) update(values []string, apply func(current float64) float64) {
+	key := f.labelKey(values)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = apply(f.values[key])
+}
+
+// Counter is a monotonically increasing value per label combination
+type Counter struct{ family *family }
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{family: register(name, help, typeCounter, labels)}
+}
+
+// Add increases the counter of the given label values by delta
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.family.update(labelValues, func(current float64) float64 { return current + delta })
+}
+
+// Inc increases the counter of the given label values by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value per label combination that can go up and down
+type Gauge struct{ family *family }
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{family: register(name, help, typeGauge, labels)}
+}
+
+// Set sets the gauge of the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.update(labelValues, func(float64) float64 { return value })
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registry.mu.Lock()
+	families := append([]*family(nil), registry.families...)
+	registry.mu.Unlock()
+
+	for _, f := range families {
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, key, strconv.FormatFloat(f.values[key], 'g', -1, 64))
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,124 @@
+// Package pdf writes simple text documents as PDF: lines of monospaced text on US
+// Letter pages, enough for quotes and reports without a layout engine.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Page geometry in points
+const (
+	pageWidth  = 612
+	pageHeight = 792
+	margin     = 50
+)
+
+// Fonts available to lines
+const (
+	Regular = "F1" // Courier
+	Bold    = "F2" // Courier-Bold
+)
+
+// charWidth is the advance of a Courier glyph as a fraction of the font size
+const charWidth = 0.6
+
+// Document accumulates lines, starting a new page when one is full
+type Document struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+// New returns an empty document
+func New() *Document {
+	return &Document{}
+}
+
+// Columns returns how many characters of the given size fit on a line
+func Columns(size float64) int {
+	return int((pageWidth - 2*margin) / (size * charWidth))
+}
+
+// Line adds a line of text in the given font and size. Text longer than a line is cut.
+func (d *Document) Line(font string, size float64, text string) {
+	leading := size * 1.4
+	if len(d.pages) == 0 || d.y-leading < margin {
+		d.pages = append(d.pages, &bytes.Buffer{})
+		d.y = pageHeight - margin
+	}
+	d.y -= leading
+
+	if runes := []rune(text); len(runes) > Columns(size) {
+		text = string(runes[:Columns(size)])
+	}
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %g Tf %d %.2f Td (%s) Tj ET\n", font, size, margin, d.y, escape(text))
+}
+
+// Space adds vertical space of the given height
+func (d *Document) Space(height float64) {
+	d.y -= height
+}
+
+// escape encodes text as a PDF string literal in WinAnsi, replacing characters it
+// lacks with '?'
+func escape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			// Latin-1 letters such as á and ñ share their code in WinAnsi
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// WriteTo writes the document as PDF
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	if len(d.pages) == 0 {
+		d.pages = append(d.pages, &bytes.Buffer{})
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4 are the catalog, the page tree and the fonts; each page then takes
+	// two objects, the page and its content stream
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.WriteTo(w)
+}
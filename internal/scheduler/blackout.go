@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the day names of blackout windows, by time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a time of day, on some days of the week, when scheduled runs are held back
+type Window struct {
+	Days  [7]bool // By time.Weekday, the day the window starts on; none set means every day
+	Start int     // Minutes since midnight
+	End   int     // Minutes since midnight; before Start when the window spans midnight
+}
+
+// ParseBlackout parses semicolon separated windows, each an optional list of days
+// followed by a time range, e.g. "mon-fri 08:00-20:00;sat 09:00-14:00;22:00-02:00".
+// Days are listed with commas and ranges, e.g. mon,wed or fri-sun.
+func ParseBlackout(s string) ([]Window, error) {
+	var windows []Window
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		var window Window
+		switch len(fields) {
+		case 1:
+		case 2:
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid blackout window %q: %v", entry, err)
+			}
+			window.Days = days
+		default:
+			return nil, fmt.Errorf("invalid blackout window %q: expected [days] HH:MM-HH:MM", entry)
+		}
+
+		from, to, found := strings.Cut(fields[len(fields)-1], "-")
+		if !found {
+			return nil, fmt.Errorf("invalid blackout window %q: expected [days] HH:MM-HH:MM", entry)
+		}
+		var err error
+		if window.Start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %v", entry, err)
+		}
+		if window.End, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %v", entry, err)
+		}
+		if window.Start == window.End {
+			return nil, fmt.Errorf("invalid blackout window %q: it starts and ends at the same time", entry)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// parseDays parses a comma separated list of days and day ranges, e.g. mon-fri,sun
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	day := func(name string) (int, error) {
+		for i, weekday := range weekdays {
+			if strings.EqualFold(name, weekday) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown day %q (days are %s)", name, strings.Join(weekdays, ", "))
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := day(first)
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if isRange {
+			if to, err = day(last); err != nil {
+				return days, err
+			}
+		}
+		// Ranges wrap around the week, e.g. fri-mon
+		for i := from; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of day as HH:MM into minutes since midnight; 24:00 ends a day
+func parseClock(s string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hours, &minutes); err != nil || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", s)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// String formats the window as ParseBlackout reads it
+func (w Window) String() string {
+	clock := func(minutes int) string { return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60) }
+	var days []string
+	for i, set := range w.Days {
+		if set {
+			days = append(days, weekdays[i])
+		}
+	}
+	if len(days) == 0 {
+		return clock(w.Start) + "-" + clock(w.End)
+	}
+	return strings.Join(days, ",") + " " + clock(w.Start) + "-" + clock(w.End)
+}
+
+// on reports whether the window starts on day
+func (w Window) on(day time.Weekday) bool {
+	return w.Days == [7]bool{} || w.Days[day]
+}
+
+// until returns the end of the window when t falls within it
+func (w Window) until(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	minute := t.Hour()*60 + t.Minute()
+	at := func(day time.Time, minutes int) time.Time {
+		return day.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	if w.Start < w.End {
+		if w.on(t.Weekday()) && minute >= w.Start && minute < w.End {
+			return at(midnight, w.End), true
+		}
+		return time.Time{}, false
+	}
+
+	// Spanning midnight: the part after Start today, or before End of a window started yesterday
+	if w.on(t.Weekday()) && minute >= w.Start {
+		return at(midnight.AddDate(0, 0, 1), w.End), true
+	}
+	if w.on(midnight.AddDate(0, 0, -1).Weekday()) && minute < w.End {
+		return at(midnight, w.End), true
+	}
+	return time.Time{}, false
+}
+
+// blackedOut returns when the blackout holding t back ends, following windows that
+// meet, and false when t is outside every window
+func blackedOut(windows []Window, t time.Time) (time.Time, bool) {
+	end, held := t, false
+	// A window can only be entered once per day it starts on
+	for range 8 * len(windows) {
+		moved := false
+		for _, window := range windows {
+			if until, ok := window.until(end); ok {
+				end, held, moved = until, true, true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return end, held
+}
+
+// blackoutNote describes the windows for the scheduling log line, empty without any
+func blackoutNote(windows []Window) string {
+	if len(windows) == 0 {
+		return ""
+	}
+	names := make([]string, len(windows))
+	for i, window := range windows {
+		names[i] = window.String()
+	}
+	return ", not during " + strings.Join(names, "; ")
+}
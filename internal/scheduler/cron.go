@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+// cronScheduler runs a task at the times of a cron expression. Failures don't move
+// the next run: the expression already says when retrying is welcome. Nor do runs
+// skipped during a blackout window.
+type cronScheduler struct {
+	config Config
+	task   func() error
+	cron   gocron.Scheduler
+}
+
+func newCronScheduler(config Config, expression string, task func() error) (*cronScheduler, error) {
+	cron, err := gocron.NewScheduler(gocron.WithLocation(config.Location))
+	if err != nil {
+		return nil, fmt.Errorf("error creating scheduler: %v", err)
+	}
+
+	s := &cronScheduler{config: config, task: task, cron: cron}
+	name := config.Name
+
+	_, err = cron.NewJob(
+		gocron.CronJob(expression, false),
+		gocron.NewTask(s.run),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s schedule %q: %v", name, expression, err)
+	}
+
+	log.Printf("Scheduling %s at %q (%s)%s", name, expression, config.Location, blackoutNote(config.Blackout))
+
+	return s, nil
+}
+
+// Start starts running scheduled jobs
+func (s *cronScheduler) Start() {
+	s.cron.Start()
+}
+
+// Shutdown stops the scheduler, waiting for a running job to finish
+func (s *cronScheduler) Shutdown() error {
+	return s.cron.Shutdown()
+}
+
+func (s *cronScheduler) run() {
+	if until, held := s.config.heldBack(time.Now()); held {
+		log.Printf("Skipping scheduled %s during a blackout window until %s", s.config.Name, until.Format(time.RFC3339))
+		return
+	}
+	if err := s.task(); err != nil {
+		log.Printf("Scheduled %s finished with errors: %v", s.config.Name, err)
+	}
+}
@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+// intervalScheduler runs a task every Interval. After consecutive failures the interval
+// is doubled up to MaxInterval, and the normal cadence is restored after a success.
+// A run falling in a blackout window is postponed to the window's end, where the
+// cadence resumes.
+type intervalScheduler struct {
+	config   Config
+	task     func() error
+	cron     gocron.Scheduler
+	job      gocron.Job
+	mu       sync.Mutex
+	failures int
+}
+
+func newIntervalScheduler(config Config, task func() error) (*intervalScheduler, error) {
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("%s interval must be positive, got %v", config.Name, config.Interval)
+	}
+
+	cron, err := gocron.NewScheduler()
+	if err != nil {
+		return nil, fmt.Errorf("error creating scheduler: %v", err)
+	}
+
+	s := &intervalScheduler{config: config, task: task, cron: cron}
+
+	// The first run is pushed back by a random amount up to Jitter so environments
+	// sharing the same API credentials don't all hit the gateway at the same minute
+	firstRun := time.Now().Add(config.Interval)
+	if config.Jitter > 0 {
+		firstRun = firstRun.Add(rand.N(config.Jitter))
+	}
+	log.Printf("Scheduling %s every %v, first at %s%s", config.Name, config.Interval, firstRun.In(config.Location).Format(time.RFC3339), blackoutNote(config.Blackout))
+
+	s.job, err = cron.NewJob(
+		gocron.DurationJob(config.Interval),
+		gocron.NewTask(s.run),
+		gocron.WithStartAt(gocron.WithStartDateTime(firstRun)),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cron job: %v", err)
+	}
+
+	return s, nil
+}
+
+// Start starts running scheduled jobs
+func (s *intervalScheduler) Start() {
+	s.cron.Start()
+}
+
+// Shutdown stops the scheduler, waiting for a running job to finish
+func (s *intervalScheduler) Shutdown() error {
+	return s.cron.Shutdown()
+}
+
+// run executes the task and adjusts the interval based on its outcome
+func (s *intervalScheduler) run() {
+	if until, held := s.config.heldBack(time.Now()); held {
+		// Spread like the first run, so environments sharing a window don't all sync
+		// the minute it ends
+		if s.config.Jitter > 0 {
+			until = until.Add(rand.N(s.config.Jitter))
+		}
+		log.Printf("Postponing scheduled %s past a blackout window, to %s", s.config.Name, until.In(s.config.Location).Format(time.RFC3339))
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reschedule(s.interval(), until)
+		return
+	}
+
+	err := s.task()
+	if err != nil {
+		log.Printf("Scheduled %s finished with errors: %v", s.config.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.interval()
+	if err != nil {
+		s.failures++
+	} else {
+		s.failures = 0
+	}
+
+	next := s.interval()
+	if next == previous {
+		return
+	}
+
+	if err != nil {
+		log.Printf("%d consecutive failed %s runs, backing off to every %v", s.failures, s.config.Name, next)
+	} else {
+		log.Printf("Scheduled %s succeeded, restoring interval to every %v", s.config.Name, next)
+	}
+
+	s.reschedule(next, time.Now().Add(next))
+}
+
+// reschedule runs the task every interval from start on
+func (s *intervalScheduler) reschedule(interval time.Duration, start time.Time) {
+	job, err := s.cron.Update(
+		s.job.ID(),
+		gocron.DurationJob(interval),
+		gocron.NewTask(s.run),
+		gocron.WithStartAt(gocron.WithStartDateTime(start)),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	)
+	if err != nil {
+		log.Printf("Error updating %s interval: %v", s.config.Name, err)
+		return
+	}
+	s.job = job
+}
+
+// interval returns the current interval: Interval doubled once per consecutive
+// failure, capped at MaxInterval
+func (s *intervalScheduler) interval() time.Duration {
+	if s.config.MaxInterval <= s.config.Interval || s.failures == 0 {
+		return s.config.Interval
+	}
+
+	interval := s.config.Interval
+	for i := 0; i < s.failures && interval < s.config.MaxInterval; i++ {
+		interval *= 2
+	}
+
+	return min(interval, s.config.MaxInterval)
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"log"
+	"sync"
+)
+
+// manualScheduler never runs its task: runs are only triggered by hand
+type manualScheduler struct {
+	name string
+}
+
+func (s manualScheduler) Start() {
+	log.Printf("Scheduled %s disabled, it only runs when triggered", s.name)
+}
+
+func (s manualScheduler) Shutdown() error { return nil }
+
+// onceScheduler runs its task once at Start and hands the outcome to Done, e.g. to exit
+// the process when it runs as a Kubernetes CronJob
+type onceScheduler struct {
+	config Config
+	task   func() error
+	start  sync.Once
+	done   chan struct{}
+}
+
+func (s *onceScheduler) Start() {
+	s.start.Do(func() {
+		log.Printf("Running %s once", s.config.Name)
+		go func() {
+			defer close(s.done)
+			err := s.task()
+			if err != nil {
+				log.Printf("%s finished with errors: %v", s.config.Name, err)
+			}
+			if s.config.Done != nil {
+				s.config.Done(err)
+			}
+		}()
+	})
+}
+
+// Shutdown waits for the run when one was started
+func (s *onceScheduler) Shutdown() error {
+	started := true
+	s.start.Do(func() { started = false })
+	if started {
+		<-s.done
+	}
+	return nil
+}
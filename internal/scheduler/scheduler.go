@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedules besides cron expressions
+const (
+	ScheduleInterval = "interval" // Every Interval, backing off after failures
+	ScheduleManual   = "manual"   // Never automatically, only when triggered
+	ScheduleOnce     = "once"     // A single run at Start, then Done is called
+)
+
+// Config holds the scheduling settings of a periodic task
+type Config struct {
+	Name        string         // Task name used in logs (default "sync")
+	Schedule    string         // interval (default), manual, once or a cron expression, e.g. "0 3 * * *"
+	Interval    time.Duration  // Time between syncs while they succeed
+	Jitter      time.Duration  // Random delay (up to this value) added to the first run
+	MaxInterval time.Duration  // Ceiling for the interval after consecutive failures (0 disables backoff)
+	Done        func(error)    // Called with the outcome of the once schedule's run
+	Location    *time.Location // Time zone of cron expressions and blackout windows (default local)
+	Blackout    []Window       // Times when cron and interval runs are held back
+}
+
+// heldBack returns when the blackout window holding back a run at t ends, false when
+// t is outside every window
+func (c Config) heldBack(t time.Time) (time.Time, bool) {
+	location := c.Location
+	if location == nil {
+		location = time.Local
+	}
+	return blackedOut(c.Blackout, t.In(location))
+}
+
+// Postpone returns when a run due at t may happen: t itself, or the end of the blackout
+// window holding it back. Runs triggered outside the scheduler use it to respect the
+// same windows.
+func (c Config) Postpone(t time.Time) time.Time {
+	if until, held := c.heldBack(t); held {
+		return until
+	}
+	return t
+}
+
+// Scheduler decides when a task runs
+type Scheduler interface {
+	// Start starts running the task on schedule
+	Start()
+	// Shutdown stops the scheduler, waiting for a running task to finish
+	Shutdown() error
+}
+
+// New creates a scheduler running task according to config
+func New(config Config, task func() error) (Scheduler, error) {
+	if config.Name == "" {
+		config.Name = "sync"
+	}
+	if config.Location == nil {
+		config.Location = time.Local
+	}
+
+	switch schedule := strings.TrimSpace(config.Schedule); strings.ToLower(schedule) {
+	case "", ScheduleInterval:
+		return newIntervalScheduler(config, task)
+	case ScheduleManual:
+		return manualScheduler{name: config.Name}, nil
+	case ScheduleOnce:
+		return &onceScheduler{config: config, task: task, done: make(chan struct{})}, nil
+	default:
+		if len(strings.Fields(schedule)) != 5 {
+			return nil, fmt.Errorf("invalid %s schedule %q: expected interval, manual, once or a cron expression of 5 fields", config.Name, schedule)
+		}
+		return newCronScheduler(config, schedule, task)
+	}
+}
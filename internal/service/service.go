@@ -0,0 +1,41 @@
+// Package service integrates the daemon with the process manager supervising it:
+// systemd's sd_notify protocol on Linux and the service control manager on Windows.
+// Outside of either every call is a no-op besides stopping on SIGINT and SIGTERM.
+package service
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Context returns a context canceled when the service is asked to stop: by SIGINT or
+// SIGTERM, or a stop or shutdown request when running as the Windows service name
+func Context(name string) context.Context {
+	if ctx, ok := windowsServiceContext(name); ok {
+		return ctx
+	}
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx
+}
+
+// Ready reports the service finished starting. Under systemd it also starts the
+// watchdog pings when the unit sets WatchdogSec.
+func Ready() {
+	notify("READY=1")
+	startWatchdog()
+	reportWindowsRunning()
+}
+
+// Stopping reports the service is shutting down
+func Stopping() {
+	notify("STOPPING=1")
+	reportWindowsStopping()
+}
+
+// Stopped reports the service stopped, with err when it failed. It must be the last
+// call before the process exits.
+func Stopped(err error) {
+	reportWindowsStopped(err)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package service
+
+// systemd only runs on Linux
+func notify(state string) {}
+
+func startWatchdog() {}
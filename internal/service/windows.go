@@ -0,0 +1,126 @@
+//go:build windows
+
+package service
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// windowsStopTimeout is how long Stopped waits for the service control manager to
+// take the final status
+const windowsStopTimeout = 10 * time.Second
+
+// windowsService handles the requests of the service control manager
+type windowsService struct {
+	cancel  context.CancelFunc
+	running chan struct{} // Closed by Ready
+	stopped chan uint32   // Exit code sent by Stopped
+	done    chan struct{} // Closed once svc.Run returns
+
+	runningOnce sync.Once
+}
+
+// current is the running Windows service, nil when running from a console
+var current *windowsService
+
+// Chdir moves a Windows service, started in the system directory, to the directory of
+// its executable, where .env and ashley.db are
+func Chdir() error {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(filepath.Dir(executable))
+}
+
+func windowsServiceContext(name string) (context.Context, bool) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("Error detecting a Windows service: %v", err)
+		return nil, false
+	}
+	if !isService {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	current = &windowsService{
+		cancel:  cancel,
+		running: make(chan struct{}),
+		stopped: make(chan uint32, 1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(current.done)
+		if err := svc.Run(name, current); err != nil {
+			log.Printf("Error running Windows service %s: %v", name, err)
+			cancel()
+		}
+	}()
+	return ctx, true
+}
+
+// Execute reports the service states to the service control manager and cancels the
+// service's context on stop and shutdown requests
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	running := s.running
+	for {
+		select {
+		case <-running:
+			status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+			running = nil
+		case code := <-s.stopped:
+			return false, code
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				s.cancel()
+			}
+		}
+	}
+}
+
+func reportWindowsRunning() {
+	if current != nil {
+		current.runningOnce.Do(func() { close(current.running) })
+	}
+}
+
+// reportWindowsStopping cancels the context when the service stops on its own, so the
+// control manager isn't left waiting
+func reportWindowsStopping() {
+	if current != nil {
+		current.cancel()
+	}
+}
+
+func reportWindowsStopped(err error) {
+	if current == nil {
+		return
+	}
+	var code uint32
+	if err != nil {
+		code = 1
+	}
+	current.stopped <- code
+
+	select {
+	case <-current.done:
+	case <-time.After(windowsStopTimeout):
+	}
+}
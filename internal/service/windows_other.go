@@ -0,0 +1,16 @@
+//go:build !windows
+
+package service
+
+import "context"
+
+// Chdir is a no-op outside of Windows services
+func Chdir() error { return nil }
+
+func windowsServiceContext(name string) (context.Context, bool) { return nil, false }
+
+func reportWindowsRunning() {}
+
+func reportWindowsStopping() {}
+
+func reportWindowsStopped(err error) {}
@@ -0,0 +1,107 @@
+// Package api holds the types of the service's JSON responses, for Go services that
+// consume them. The service builds its responses from these same types, so they
+// can't drift from what is served.
+//
+// Responses use the Spanish field names of the struct tags. Two request options
+// change that shape:
+//
+//   - ?schema=en, or an API key with the en schema, serves the fields renamed by
+//     EnglishFields. Rename the keys back before decoding into these types, or
+//     request the default schema.
+//   - The nocost profile, assigned to API keys, removes CostFields from every
+//     response. Decoded, they are left at their zero value.
+//
+// ?fields= and custom profiles remove further fields the same way.
+//
+// The package only depends on the standard library.
+package api
+
+// EnglishFields are the English names the en schema serves the Spanish fields with,
+// at any depth of a response
+var EnglishFields = map[string]string{
+	// Products
+	"nombre":              "name",
+	"clave":               "sku",
+	"categoria":           "category",
+	"modelo":              "series",
+	"costo":               "cost",
+	"costo2":              "netCost",
+	"proveedor":           "supplier",
+	"cantidadSillas":      "chairsPerCarton",
+	"cantidadPorPaquete":  "itemsPerCase",
+	"descontinuado":       "status",
+	"alto":                "height",
+	"largo":               "width",
+	"ancho":               "depth",
+	"peso":                "weight",
+	"numeroModelo":        "modelNumber",
+	"costoKit":            "kitCost",
+	"reemplazo":           "replacement",
+	"empaque":             "packaging",
+	"calculados":          "computed",
+	"costoImportacion":    "landedCost",
+	"costoContrato":       "contractCost",
+	"promocion":           "promotion",
+	"fraccionArancelaria": "hsCode",
+	"categoriaFiscal":     "taxCategory",
+	"disponible":          "available",
+	"tiempoEntregaDias":   "leadTimeDays",
+	"disponibilidad":      "availability",
+	"operacion":           "operation",
+
+	// Similar products
+	"motivos":   "reasons",
+	"distancia": "distance",
+
+	// Product comparisons
+	"productos":   "products",
+	"diferencias": "differences",
+	"faltantes":   "missing",
+	"volumen":     "volume",
+
+	// Packaging
+	"cajasPorUnidad": "cartonsPerUnit",
+	"cajas":          "cartons",
+	"pesoTotal":      "totalWeight",
+	"numero":         "number",
+
+	// Landed cost
+	"tipoCambio":  "exchangeRate",
+	"flete":       "freight",
+	"valorAduana": "customsValue",
+	"arancel":     "duty",
+	"agente":      "brokerFees",
+	"iva":         "vat",
+
+	// Inventory
+	"existencia":      "stock",
+	"existenciaTotal": "totalStock",
+	"apartado":        "reserved",
+	"almacenes":       "warehouses",
+	"apartados":       "reservations",
+	"almacen":         "warehouse",
+	"proximaFecha":    "nextAvailableDate",
+
+	// Kit components
+	"componentes":      "components",
+	"cantidad":         "quantity",
+	"costo2Kit":        "kitNetCost",
+	"completo":         "complete",
+	"precio":           "price",
+	"precioFormateado": "formattedPrice",
+
+	// Price lists
+	"nivel":    "tier",
+	"generado": "generatedAt",
+	"precios":  "prices",
+	"moneda":   "currency",
+}
+
+// CostFields are the fields the nocost profile removes: the costs of product and kit
+// responses, computed fields (usually derived from costs) and the prices of stored
+// and upstream records
+var CostFields = []string{
+	"costo", "costo2", "costoKit", "costo2Kit", "calculados", "costoImportacion", "costoContrato",
+	"price", "basePrice", "sellPrice", "surcharge", "discount", "dfiDiscount",
+	"netPriceBeforeFreight", "freight", "expressFreight", "totalNetPrice", "containerPrice",
+}
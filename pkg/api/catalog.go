@@ -0,0 +1,67 @@
+package api
+
+import "time"
+
+// PriceListEntry is the price of a product for a tier
+type PriceListEntry struct {
+	Clave     string  `json:"clave"`
+	Nombre    string  `json:"nombre"`
+	Categoria string  `json:"categoria"`
+	Precio    float64 `json:"precio"`
+	Moneda    string  `json:"moneda"`
+}
+
+// PriceList is the catalog priced for a tier, as served by GET /price-list
+type PriceList struct {
+	Nivel      string           `json:"nivel"`
+	Generado   time.Time        `json:"generado"`
+	Precios    []PriceListEntry `json:"precios"`
+	StaleSince *time.Time       `json:"staleSince,omitempty"`
+}
+
+// PriceTrend is how the average price of a category or series moved over a window
+type PriceTrend struct {
+	Group         string  `json:"group"`
+	Skus          int     `json:"skus"`          // Priced SKUs of the group
+	Changed       int     `json:"changed"`       // SKUs whose price moved within the window
+	AverageStart  float64 `json:"averageStart"`  // Average price when the window started
+	AverageEnd    float64 `json:"averageEnd"`    // Average price now
+	Change        float64 `json:"change"`        // Percent change of the average
+	AverageChange float64 `json:"averageChange"` // Average of the per SKU percent changes
+}
+
+// PriceTrends are the trends of every category or series over a window, as served
+// by GET /analytics/price-trends
+type PriceTrends struct {
+	GroupBy string       `json:"groupBy"`
+	Field   string       `json:"field"`
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	Trends  []PriceTrend `json:"trends"`
+}
+
+// ChangeRecord is an entry of the change feed: a record of a bucket was written with a
+// different value or removed. Cursor is the position of the entry in the feed.
+type ChangeRecord struct {
+	Cursor  string    `json:"cursor"`
+	Bucket  string    `json:"bucket"`
+	Sku     string    `json:"sku"`
+	Deleted bool      `json:"deleted,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// ChangeFeed is a page of GET /changes. Cursor is the position to resume from.
+type ChangeFeed struct {
+	Changes []ChangeRecord `json:"changes"`
+	Cursor  string         `json:"cursor"`
+	More    bool           `json:"more"` // true when changes beyond this page exist
+}
+
+// CatalogVersion describes a snapshot of the catalog taken after a completed sync, as
+// listed by GET /versions
+type CatalogVersion struct {
+	Version   uint64         `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Records   map[string]int `json:"records"` // Records per bucket
+	Size      int            `json:"size"`    // Compressed size in bytes
+}
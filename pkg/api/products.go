@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Product is a product of GET /products: Ashley's product record merged with its
+// price, or an imported supplier product. Comments name the upstream fields.
+type Product struct {
+	Nombre             string   `json:"nombre"`              // ConsumerDescription
+	Clave              string   `json:"clave"`               // Sku
+	Categoria          string   `json:"categoria"`           // ItemSalesCategoryCodeKey
+	Modelo             string   `json:"modelo"`              // ItemSeries + SeriesId
+	Costo              float64  `json:"costo"`               // SellPrice
+	Costo2             float64  `json:"costo2"`              // TotalNetPrice
+	Proveedor          string   `json:"proveedor"`           // Supplier
+	CantidadSillas     int      `json:"cantidadSillas"`      // ChairQtyPerCarton
+	CantidadPorPaquete int      `json:"cantidadPorPaquete"`  // ItemsPerCase
+	Descontinuado      string   `json:"descontinuado"`       // Status
+	Alto               float64  `json:"alto"`                // UnitHeightMm
+	Largo              float64  `json:"largo"`               // UnitWidthMm
+	Ancho              float64  `json:"ancho"`               // UnitDepthMm
+	Peso               float64  `json:"peso"`                // ItemWeightKg
+	Upc                string   `json:"upc"`                 // Upc
+	Gtin               string   `json:"gtin"`                // Gtin
+	NumeroModelo       string   `json:"numeroModelo"`        // ModelNumber
+	CostoKit           *float64 `json:"costoKit,omitempty"`  // Sum of component SellPrice, kits only
+	Reemplazo          string   `json:"reemplazo,omitempty"` // Successor SKU (ReplacementSku or override)
+
+	Empaque *Packaging `json:"empaque,omitempty"` // Cartons a unit ships in, when Ashley sends them
+
+	Calculados map[string]float64 `json:"calculados,omitempty"` // Computed fields (COMPUTED_FIELDS)
+
+	CostoImportacion *LandedCost `json:"costoImportacion,omitempty"` // Landed cost in MXN (LANDED_*), priced products only
+	CostoContrato    *float64    `json:"costoContrato,omitempty"`    // BasePrice less the contract discount, products under contract only
+
+	Promocion string `json:"promocion,omitempty"` // Promotion whose prices costo and costo2 are, on ?date= or today (/admin/promotions)
+
+	FraccionArancelaria string `json:"fraccionArancelaria,omitempty"` // HS code for customs (CUSTOMS_HS_CODES, /admin/customs)
+	CategoriaFiscal     string `json:"categoriaFiscal,omitempty"`     // Tax category (CUSTOMS_TAX_CATEGORIES, /admin/customs)
+
+	Disponible        *int `json:"disponible,omitempty"`        // Synced stock minus active reservations
+	TiempoEntregaDias *int `json:"tiempoEntregaDias,omitempty"` // Estimated delivery days (LEAD_TIME_DAYS)
+
+	Disponibilidad string `json:"disponibilidad,omitempty"` // Status, stock and blacklist combined (AVAILABILITY_RULES)
+
+	Precio *float64 `json:"precio,omitempty"` // Selling cost times the channel markup, /channels/{name}/products only
+	Moneda string   `json:"moneda,omitempty"` // Currency of Precio
+
+	PrecioFormateado string `json:"precioFormateado,omitempty"` // Precio for display, e.g. $1,299.99, with the channel's symbol and format
+
+	StaleSince *time.Time `json:"staleSince,omitempty"` // Last successful sync, only set when stale
+
+	// Raw holds the records as received from upstream, by the bucket they were synced
+	// into (e.g. products and prices). Only served with ?include=raw.
+	Raw map[string]json.RawMessage `json:"raw,omitempty"`
+
+	// Descriptions holds Nombre in further languages. The service uses it to serve
+	// ?lang= and never encodes it, so it is always empty once decoded.
+	Descriptions map[string]string `json:"-"`
+}
+
+// Packaging describes the cartons one unit of a product ships in, for receiving and
+// delivery
+type Packaging struct {
+	CajasPorUnidad int      `json:"cajasPorUnidad"`      // CartonsPerUnit, or the cartons listed
+	Cajas          []Carton `json:"cajas,omitempty"`     // Cartons, when listed
+	PesoTotal      float64  `json:"pesoTotal,omitempty"` // Sum of the carton weights
+}
+
+// Carton is one of the cartons of a unit
+type Carton struct {
+	Numero int     `json:"numero"` // CartonNumber, e.g. 2 of 3
+	Alto   float64 `json:"alto"`   // HeightMm
+	Largo  float64 `json:"largo"`  // WidthMm
+	Ancho  float64 `json:"ancho"`  // DepthMm
+	Peso   float64 `json:"peso"`   // WeightKg
+}
+
+// SimilarProduct is a product suggested for another, as served by
+// GET /products/{sku}/similar, best first
+type SimilarProduct struct {
+	Product
+	Motivos   []string `json:"motivos"`   // "series" (same seriesId) and/or "category" (same category, alike in price and size)
+	Distancia float64  `json:"distancia"` // Price and size difference from the product, 0 when alike
+}
+
+// Comparison sets products side by side, as served by GET /products/compare
+type Comparison struct {
+	Productos   []ComparedProduct `json:"productos"`           // In the requested order
+	Diferencias []string          `json:"diferencias"`         // Fields whose value isn't the same for every product
+	Faltantes   []string          `json:"faltantes,omitempty"` // Requested SKUs that aren't stored
+}
+
+// ComparedProduct is a product of a comparison. Fields are those of Product.
+type ComparedProduct struct {
+	Clave         string     `json:"clave"`
+	Nombre        string     `json:"nombre"`
+	Categoria     string     `json:"categoria"`
+	Descontinuado string     `json:"descontinuado"`
+	Alto          float64    `json:"alto"`
+	Largo         float64    `json:"largo"`
+	Ancho         float64    `json:"ancho"`
+	Volumen       float64    `json:"volumen"` // Alto × Largo × Ancho in m³
+	Peso          float64    `json:"peso"`
+	Empaque       *Packaging `json:"empaque,omitempty"`
+
+	Costo     float64  `json:"costo"`
+	Costo2    float64  `json:"costo2"`
+	Precio    *float64 `json:"precio,omitempty"` // Price of the request's tier, priced products only
+	Moneda    string   `json:"moneda,omitempty"` // Currency of Precio
+	Promocion string   `json:"promocion,omitempty"`
+
+	Disponible        *int   `json:"disponible,omitempty"`
+	Disponibilidad    string `json:"disponibilidad,omitempty"`
+	TiempoEntregaDias *int   `json:"tiempoEntregaDias,omitempty"`
+}
+
+// LandedCost is the per unit cost of an imported product, in MXN
+type LandedCost struct {
+	TipoCambio  float64 `json:"tipoCambio"`
+	Flete       float64 `json:"flete"`       // Our freight, by unit volume
+	ValorAduana float64 `json:"valorAduana"` // (TotalNetPrice + freight) × exchange rate
+	Arancel     float64 `json:"arancel"`     // Import duty
+	Agente      float64 `json:"agente"`      // Customs broker fees
+	IVA         float64 `json:"iva"`
+	Total       float64 `json:"total"`
+}
+
+// KitComponent is a component of a kit
+type KitComponent struct {
+	Clave    string  `json:"clave"`    // Sku
+	Nombre   string  `json:"nombre"`   // ConsumerDescription, empty when the component is unknown
+	Cantidad int     `json:"cantidad"` // Quantity
+	Costo    float64 `json:"costo"`    // SellPrice
+	Costo2   float64 `json:"costo2"`   // TotalNetPrice
+	Precio   bool    `json:"precio"`   // Whether a price exists for the component
+}
+
+// Kit lists the components of a kit with their rolled up prices, as served by
+// GET /products/{sku}/components
+type Kit struct {
+	Clave       string         `json:"clave"`
+	Componentes []KitComponent `json:"componentes"`
+	CostoKit    float64        `json:"costoKit"`  // Sum of component SellPrice * Cantidad
+	Costo2Kit   float64        `json:"costo2Kit"` // Sum of component TotalNetPrice * Cantidad
+	Completo    bool           `json:"completo"`  // Whether every component has a price
+}
+
+// Replacement describes the successor of a SKU, as served by
+// GET /products/{sku}/replacement
+type Replacement struct {
+	Clave     string   `json:"clave"`
+	Reemplazo string   `json:"reemplazo,omitempty"` // Final successor after following the chain
+	Cadena    []string `json:"cadena"`              // Every hop from Clave to Reemplazo
+	Origen    string   `json:"origen,omitempty"`    // "override" or "ashley", for the first hop
+}